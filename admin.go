@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// adminAPI serves -admin-addr, which controls the live stream without a
+// restart: pausing and resuming it, changing its filters, and forcing a
+// reconnect, all resuming from the last handled event
+type adminAPI struct {
+	client    *jetstream.Client
+	connected atomic.Bool
+	// the endpoint last connected to
+	endpoint atomic.Pointer[string]
+	// time_us of the last event handled, 0 before the first
+	lastEventUs atomic.Int64
+}
+
+func newAdminAPI(client *jetstream.Client) *adminAPI {
+	return &adminAPI{client: client}
+}
+
+func (a *adminAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", a.serveStatus)
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		log.Info().Str("remote", r.RemoteAddr).Msg("pausing on admin request")
+		a.client.Pause()
+		a.serveStatus(w, r)
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		log.Info().Str("remote", r.RemoteAddr).Msg("resuming on admin request")
+		a.client.Resume()
+		a.serveStatus(w, r)
+	})
+	mux.HandleFunc("POST /reconnect", func(w http.ResponseWriter, r *http.Request) {
+		log.Info().Str("remote", r.RemoteAddr).Msg("reconnecting on admin request")
+		a.client.Reconnect()
+		a.serveStatus(w, r)
+	})
+	mux.HandleFunc("GET /filters", a.serveFilters)
+	mux.HandleFunc("PUT /filters", a.updateFilters)
+	if handleHistory != nil {
+		mux.HandleFunc("GET /handles/{did}", a.serveHandles)
+	}
+	if trends != nil {
+		mux.HandleFunc("GET /trends", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, trends.report(*trendsTopFlag))
+		})
+	}
+	return mux
+}
+
+// adminStatus is the body of GET /status
+type adminStatus struct {
+	Connected bool `json:"connected"`
+	Paused    bool `json:"paused"`
+	// Endpoint is the -url last connected to
+	Endpoint string `json:"endpoint,omitempty"`
+	// Cursor is the last handled event's time_us, or with -firehose its
+	// sequence number, and CommittedCursor what -cursor-file would save,
+	// which -nats-stream holds back until events are acknowledged
+	Cursor          int64    `json:"cursor"`
+	CommittedCursor int64    `json:"committed_cursor"`
+	LastEventTimeUs int64    `json:"last_event_time_us,omitempty"`
+	LagSeconds      *float64 `json:"lag_seconds,omitempty"`
+	CatchingUp      bool     `json:"catching_up"`
+}
+
+func (a *adminAPI) serveStatus(w http.ResponseWriter, r *http.Request) {
+	cursor := a.client.LastTimeUs()
+	status := adminStatus{
+		Connected:       a.connected.Load(),
+		Paused:          a.client.Paused(),
+		Cursor:          cursor,
+		CommittedCursor: committedCursor(cursor),
+		LastEventTimeUs: a.lastEventUs.Load(),
+		CatchingUp:      catchingUp(),
+	}
+	if endpoint := a.endpoint.Load(); endpoint != nil {
+		status.Endpoint = *endpoint
+	}
+	if status.LastEventTimeUs > 0 {
+		lag := time.Since(time.UnixMicro(status.LastEventTimeUs)).Seconds()
+		status.LagSeconds = &lag
+	}
+	writeJSON(w, status)
+}
+
+// adminFilters is the body of GET and PUT /filters. In a PUT, a missing
+// field leaves that filter as it is, and an empty list clears it.
+type adminFilters struct {
+	Collections *[]string `json:"collections"`
+	Dids        *[]string `json:"dids"`
+}
+
+func (a *adminAPI) serveFilters(w http.ResponseWriter, r *http.Request) {
+	collections, dids := a.client.Filters()
+	writeJSON(w, adminFilters{Collections: &collections, Dids: &dids})
+}
+
+func (a *adminAPI) updateFilters(w http.ResponseWriter, r *http.Request) {
+	var update adminFilters
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "invalid filters: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	collections, dids := a.client.Filters()
+	if update.Collections != nil {
+		collections = *update.Collections
+	}
+	if update.Dids != nil {
+		dids = *update.Dids
+	}
+	if err := a.client.SetFilters(collections, dids); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Info().
+		Str("remote", r.RemoteAddr).
+		Strs("collections", collections).
+		Int("dids", len(dids)).
+		Msg("filters changed on admin request")
+	a.serveFilters(w, r)
+}
+
+// serveHandles returns the handles a DID has used, from -handle-history,
+// oldest first
+func (a *adminAPI) serveHandles(w http.ResponseWriter, r *http.Request) {
+	changes, err := handleChanges(handleHistory.db, r.PathValue("did"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, changes)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
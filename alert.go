@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// alertQueueSize is how many alerts wait to be sent before new ones are
+// dropped
+const alertQueueSize = 1000
+
+// alerter posts to -alert-webhook when an event matches an -alert rule.
+// Alerts are queued rather than sent from the read loop, so a slow or
+// unreachable webhook only costs alerts, never the stream.
+type alerter struct {
+	rules    []alertRule
+	url      string
+	format   string
+	cooldown time.Duration
+	client   *http.Client
+	queue    chan alert
+	stopped  chan struct{}
+
+	// when each rule last fired and alerts held back since, only touched
+	// from the handling goroutine
+	lastFired  []time.Time
+	suppressed uint64
+}
+
+// alerts is nil unless -alert is set
+var alerts *alerter
+
+// alertRule is an -alert expression, named by its text
+type alertRule struct {
+	name string
+	expr filterExpr
+}
+
+// alertFormats are the webhook bodies -alert-format can send
+var alertFormats = map[string]bool{"json": true, "discord": true, "slack": true}
+
+func newAlerter(rules []string, url, format string, cooldown time.Duration) (*alerter, error) {
+	if !alertFormats[format] {
+		return nil, fmt.Errorf("unknown format %q, expected json, discord, or slack", format)
+	}
+	a := &alerter{
+		url:       url,
+		format:    format,
+		cooldown:  cooldown,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		queue:     make(chan alert, alertQueueSize),
+		stopped:   make(chan struct{}),
+		lastFired: make([]time.Time, len(rules)),
+	}
+	for _, s := range rules {
+		expr, err := parseFilter(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", s, err)
+		}
+		a.rules = append(a.rules, alertRule{name: s, expr: expr})
+	}
+	return a, nil
+}
+
+// alert is the generic JSON body of a webhook, with the fields that suit
+// the event
+type alert struct {
+	Rule       string `json:"rule"`
+	Summary    string `json:"summary"`
+	Kind       string `json:"kind"`
+	Did        string `json:"did"`
+	Handle     string `json:"handle,omitempty"`
+	TimeUs     int64  `json:"time_us"`
+	Collection string `json:"collection,omitempty"`
+	Operation  string `json:"operation,omitempty"`
+	URI        string `json:"uri,omitempty"`
+	Text       string `json:"text,omitempty"`
+	// URL links to posts on bsky.app
+	URL    string `json:"url,omitempty"`
+	Active *bool  `json:"active,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+// check queues an alert for the first rule msg matches, unless that rule
+// fired within the cooldown
+func (a *alerter) check(msg *jetstream.Message) {
+	e := &filterEvent{msg: msg}
+	for i, rule := range a.rules {
+		if !rule.expr.match(e) {
+			continue
+		}
+		now := time.Now()
+		if a.cooldown > 0 && now.Sub(a.lastFired[i]) < a.cooldown {
+			a.suppressed++
+			return
+		}
+		a.lastFired[i] = now
+
+		select {
+		case a.queue <- newAlert(rule.name, e):
+			alertsFired.Inc()
+		default:
+			drops.add("alert_queue_full")
+		}
+		return
+	}
+}
+
+func newAlert(rule string, e *filterEvent) alert {
+	msg := e.msg
+	al := alert{Rule: rule, Kind: msg.Kind, Did: msg.Did, TimeUs: msg.TimeUs}
+	who := msg.Did
+	if handles != nil {
+		if handle, ok := handles.lookup(msg.Did); ok {
+			al.Handle = handle
+			who = "@" + handle
+		}
+	}
+
+	switch {
+	case msg.Commit != nil:
+		c := msg.Commit
+		al.Collection, al.Operation = c.Collection, c.Operation
+		al.URI = atURI(msg.Did, c.Collection, c.Rkey)
+		al.Summary = fmt.Sprintf("%s %s %s", who, c.Operation, al.URI)
+		if post := e.postRecord(); post != nil {
+			al.Text = post.Text
+			al.URL = "https://bsky.app/profile/" + msg.Did + "/post/" + c.Rkey
+			al.Summary = fmt.Sprintf("%s posted: %s\n%s", who, post.Text, al.URL)
+		}
+	case msg.Account != nil:
+		active := msg.Account.Active
+		al.Active, al.Status = &active, msg.Account.Status
+		switch state := msg.Account.State(); state {
+		case "active":
+			al.Summary = who + " was activated"
+		case "takendown":
+			al.Summary = who + " was taken down"
+		case "inactive":
+			al.Summary = who + " was deactivated"
+		default:
+			al.Summary = who + " was " + state
+		}
+	case msg.Identity != nil:
+		al.Summary = who + " changed identity"
+		if msg.Identity.Handle != "" {
+			al.Summary += " to @" + msg.Identity.Handle
+		}
+	case msg.Label != nil:
+		l := msg.Label
+		al.URI = l.URI
+		al.Summary = fmt.Sprintf("%s labeled %s %s", l.Src, l.URI, l.Val)
+		if l.Neg {
+			al.Summary = fmt.Sprintf("%s removed %s from %s", l.Src, l.Val, l.URI)
+		}
+	default:
+		al.Summary = who + " sent a " + msg.Kind + " event"
+	}
+	return al
+}
+
+// body renders al in the webhook's format
+func (a *alerter) body(al alert) ([]byte, error) {
+	text := fmt.Sprintf("[%s] %s", al.Rule, al.Summary)
+	switch a.format {
+	case "discord":
+		// Discord rejects content over 2000 characters
+		if r := []rune(text); len(r) > 2000 {
+			text = string(r[:1999]) + "…"
+		}
+		return json.Marshal(map[string]string{"content": text})
+	case "slack":
+		return json.Marshal(map[string]string{"text": text})
+	}
+	return json.Marshal(al)
+}
+
+// run sends queued alerts until stop is called
+func (a *alerter) run() {
+	defer close(a.stopped)
+	for al := range a.queue {
+		if err := a.send(al); err != nil {
+			drops.add("alert_webhook")
+			log.Error().Err(err).Str("rule", al.Rule).Str("did", al.Did).Msg("failed to send alert")
+		}
+	}
+}
+
+// send posts al to the webhook, retrying once if it is rate limited
+func (a *alerter) send(al alert) error {
+	body, err := a.body(al)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests && attempt == 0:
+			time.Sleep(retryAfter(resp.Header.Get("Retry-After")))
+			continue
+		}
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
+
+// retryAfter parses a Retry-After header in seconds, which Discord may
+// give as a fraction, waiting a second if it is missing and at most a
+// minute
+func retryAfter(header string) time.Duration {
+	d, err := time.ParseDuration(strings.TrimSpace(header) + "s")
+	if err != nil || d <= 0 {
+		return time.Second
+	}
+	return min(d, time.Minute)
+}
+
+// stop sends the alerts still queued and waits for the sender to finish
+func (a *alerter) stop() {
+	close(a.queue)
+	<-a.stopped
+}
+
+func (a *alerter) logSummary() {
+	if a.suppressed == 0 {
+		return
+	}
+	log.Info().Uint64("suppressed", a.suppressed).Dur("cooldown", a.cooldown).Msg("alert_summary")
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// archiveColumn is a column of an archive table. Its type is one of text,
+// int, bool, or json, which each database maps to its own types.
+type archiveColumn struct {
+	name, typ string
+}
+
+// archiveTable is a table in the SQL archives, laid out the same way by
+// the SQLite and Postgres sinks. Tables with a key hold one row per
+// record, which updates replace; tables without one are append-only
+// event logs.
+type archiveTable struct {
+	name    string
+	columns []archiveColumn
+	key     []string
+	// indexes lists extra indexes beyond the key, one column list each
+	indexes [][]string
+}
+
+func (t *archiveTable) columnNames() []string {
+	names := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		names[i] = c.name
+	}
+	return names
+}
+
+// notNull reports whether column c is always set: the key, the repo, the
+// event time, and flags
+func (t *archiveTable) notNull(c archiveColumn) bool {
+	return c.name == "did" || c.name == "time_us" || c.typ == "bool" || slices.Contains(t.key, c.name)
+}
+
+// indexName names the index on columns after the table and its first column
+func (t *archiveTable) indexName(columns []string) string {
+	return t.name + "_" + columns[0]
+}
+
+// columns shared by every record table, before the record's own fields
+var recordColumns = []archiveColumn{{"did", "text"}, {"rkey", "text"}, {"time_us", "int"}, {"cid", "text"}}
+
+func withRecordColumns(columns ...archiveColumn) []archiveColumn {
+	return append(append([]archiveColumn{}, recordColumns...), columns...)
+}
+
+var (
+	postsTable = &archiveTable{
+		name: "posts",
+		columns: withRecordColumns(
+			archiveColumn{"text", "text"}, archiveColumn{"langs", "text"},
+			archiveColumn{"reply_root", "text"}, archiveColumn{"reply_parent", "text"},
+			archiveColumn{"embed_type", "text"}, archiveColumn{"created_at", "text"}),
+		key:     []string{"did", "rkey"},
+		indexes: [][]string{{"time_us"}},
+	}
+	likesTable = &archiveTable{
+		name: "likes",
+		columns: withRecordColumns(
+			archiveColumn{"subject_uri", "text"}, archiveColumn{"subject_cid", "text"}, archiveColumn{"created_at", "text"}),
+		key:     []string{"did", "rkey"},
+		indexes: [][]string{{"time_us"}, {"subject_uri"}},
+	}
+	repostsTable = &archiveTable{
+		name:    "reposts",
+		columns: likesTable.columns,
+		key:     []string{"did", "rkey"},
+		indexes: [][]string{{"time_us"}, {"subject_uri"}},
+	}
+	followsTable = &archiveTable{
+		name:    "follows",
+		columns: withRecordColumns(archiveColumn{"subject", "text"}, archiveColumn{"created_at", "text"}),
+		key:     []string{"did", "rkey"},
+		indexes: [][]string{{"time_us"}, {"subject"}},
+	}
+	blocksTable = &archiveTable{
+		name:    "blocks",
+		columns: followsTable.columns,
+		key:     []string{"did", "rkey"},
+		indexes: [][]string{{"time_us"}, {"subject"}},
+	}
+	recordsTable = &archiveTable{
+		name: "records",
+		columns: []archiveColumn{
+			{"did", "text"}, {"collection", "text"}, {"rkey", "text"}, {"time_us", "int"}, {"cid", "text"}, {"record", "json"}},
+		key:     []string{"did", "collection", "rkey"},
+		indexes: [][]string{{"collection", "time_us"}, {"time_us"}},
+	}
+	deletesTable = &archiveTable{
+		name:    "deletes",
+		columns: []archiveColumn{{"did", "text"}, {"collection", "text"}, {"rkey", "text"}, {"time_us", "int"}},
+		indexes: [][]string{{"did", "collection"}, {"time_us"}},
+	}
+	identitiesTable = &archiveTable{
+		name:    "identities",
+		columns: []archiveColumn{{"did", "text"}, {"handle", "text"}, {"seq", "int"}, {"time", "text"}, {"time_us", "int"}},
+		indexes: [][]string{{"did"}, {"time_us"}},
+	}
+	accountsTable = &archiveTable{
+		name:    "accounts",
+		columns: []archiveColumn{{"did", "text"}, {"active", "bool"}, {"seq", "int"}, {"time", "text"}, {"time_us", "int"}, {"status", "text"}},
+		indexes: [][]string{{"did"}, {"time_us"}},
+	}
+
+	archiveTables = []*archiveTable{
+		postsTable, likesTable, repostsTable, followsTable, blocksTable,
+		recordsTable, deletesTable, identitiesTable, accountsTable,
+	}
+)
+
+// archiveRow returns the table and column values msg is archived as, in
+// the table's column order. Records are keyed by repo and rkey, so an
+// update replaces the row it updates; deletes are logged rather than
+// applied, so the archive keeps deleted records. It returns a nil table
+// for messages with nothing to archive.
+func archiveRow(msg *jetstream.Message) (*archiveTable, []any, error) {
+	switch {
+	case msg.Identity != nil:
+		return identitiesTable, []any{msg.Did, msg.Identity.Handle, msg.Identity.Seq, msg.Identity.Time, msg.TimeUs}, nil
+	case msg.Account != nil:
+		return accountsTable, []any{msg.Did, msg.Account.Active, msg.Account.Seq, msg.Account.Time, msg.TimeUs, msg.Account.Status}, nil
+	case msg.Commit == nil:
+		return nil, nil, nil
+	}
+
+	c := msg.Commit
+	if c.Operation == "delete" {
+		return deletesTable, []any{msg.Did, c.Collection, c.Rkey, msg.TimeUs}, nil
+	}
+	switch c.Collection {
+	case "app.bsky.feed.post":
+		var record jetstream.Post
+		if err := json.Unmarshal(c.Record, &record); err != nil {
+			return nil, nil, err
+		}
+		var root, parent string
+		if record.Reply != nil {
+			if record.Reply.Root != nil {
+				root = record.Reply.Root.URI
+			}
+			if record.Reply.Parent != nil {
+				parent = record.Reply.Parent.URI
+			}
+		}
+		return postsTable, []any{msg.Did, c.Rkey, msg.TimeUs, c.Cid, record.Text, strings.Join(record.Langs, ","),
+			root, parent, summarizeEmbed(record.Embed).kind, record.CreatedAt}, nil
+
+	case "app.bsky.feed.like", "app.bsky.feed.repost":
+		// likes and reposts share a layout, as do follows and blocks
+		var record jetstream.Like
+		if err := json.Unmarshal(c.Record, &record); err != nil {
+			return nil, nil, err
+		}
+		var uri, cid string
+		if record.Subject != nil {
+			uri, cid = record.Subject.URI, record.Subject.Cid
+		}
+		table := likesTable
+		if c.Collection == "app.bsky.feed.repost" {
+			table = repostsTable
+		}
+		return table, []any{msg.Did, c.Rkey, msg.TimeUs, c.Cid, uri, cid, record.CreatedAt}, nil
+
+	case "app.bsky.graph.follow", "app.bsky.graph.block":
+		var record jetstream.Follow
+		if err := json.Unmarshal(c.Record, &record); err != nil {
+			return nil, nil, err
+		}
+		table := followsTable
+		if c.Collection == "app.bsky.graph.block" {
+			table = blocksTable
+		}
+		return table, []any{msg.Did, c.Rkey, msg.TimeUs, c.Cid, record.Subject, record.CreatedAt}, nil
+	}
+	return recordsTable, []any{msg.Did, c.Collection, c.Rkey, msg.TimeUs, c.Cid, string(c.Record)}, nil
+}
+
+// batchQueue queues events for a database sink and hands them to write in
+// batches, when size have built up or interval has passed since the last
+// write, or, with idle set, once no event has arrived for that long. Like
+// natsSink it doesn't block the read loop unless -sink-overflow
+// is block: when the queue is full, events are dropped and counted.
+type batchQueue struct {
+	name     string
+	queue    chan *jetstream.Message
+	size     int
+	interval time.Duration
+	// idle is how long the queue stays empty before a partial batch is
+	// written, 0 to wait for the interval
+	idle    time.Duration
+	write   func(batch []*jetstream.Message) error
+	breaker *circuitBreaker
+	failed  atomic.Uint64
+	stopped chan struct{}
+	// span is the trace span of the write in progress, only touched by
+	// run and by the failures write reports
+	span trace.Span
+}
+
+// partialWriteError is a failed write that lost only some of its batch, or
+// none, having written the rest or counted them as failed already
+type partialWriteError struct {
+	err  error
+	lost int
+}
+
+func (e *partialWriteError) Error() string { return e.err.Error() }
+func (e *partialWriteError) Unwrap() error { return e.err }
+
+func newBatchQueue(name string, queueSize, batchSize int, interval, idle time.Duration, write func([]*jetstream.Message) error) *batchQueue {
+	q := &batchQueue{
+		name:     name,
+		queue:    make(chan *jetstream.Message, queueSize),
+		size:     batchSize,
+		interval: interval,
+		idle:     idle,
+		write:    write,
+		breaker:  newCircuitBreaker(name, *sinkBreakerFailuresFlag, *sinkBreakerCooldownFlag),
+		stopped:  make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *batchQueue) publish(msg *jetstream.Message) {
+	if n := enqueue(q.queue, msg); n > 0 {
+		q.fail("queue_full", nil, n)
+	}
+}
+
+// fail counts n lost events, logging the first and then every 1000th.
+// reason is prefixed with the sink's name in the drop summary.
+func (q *batchQueue) fail(reason string, err error, n int) {
+	for range n {
+		drops.add(q.name + "_" + reason)
+	}
+	sinkDrop(q.name, reason, n)
+	if reason != "queue_full" && q.span != nil {
+		recordSinkError(q.span, reason, err, n)
+	}
+	total := q.failed.Add(uint64(n))
+	if before := total - uint64(n); before == 0 || before/1000 != total/1000 {
+		log.Warn().
+			Err(err).
+			Str("sink", q.name).
+			Str("reason", reason).
+			Uint64("failed", total).
+			Msg("archive write failed, dropping events")
+	}
+}
+
+func (q *batchQueue) run() {
+	defer close(q.stopped)
+
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	// stopped until the first event, and reset by every one after
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if q.idle > 0 {
+		idleTimer = time.NewTimer(q.idle)
+		idleTimer.Stop()
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	batch := make([]*jetstream.Message, 0, q.size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if !q.breaker.allow(time.Now()) {
+			q.breaker.drop(len(batch))
+			q.fail("circuit_open", nil, len(batch))
+			batch = batch[:0]
+			return
+		}
+		q.span = tracing.startSink(q.name, "write", len(batch))
+		err := q.write(batch)
+		q.breaker.done(err, time.Now())
+		if err != nil {
+			lost := len(batch)
+			var partial *partialWriteError
+			if errors.As(err, &partial) {
+				lost = partial.lost
+			}
+			if lost > 0 {
+				q.fail("write", err, lost)
+			}
+		}
+		q.span.End()
+		q.span = nil
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case msg, ok := <-q.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) >= catchUpBatchSize(q.size) {
+				flush()
+			}
+			if idleTimer != nil {
+				idleTimer.Reset(q.idle)
+			}
+		case <-ticker.C:
+			flush()
+		case <-idle:
+			flush()
+		}
+	}
+}
+
+// close writes what is queued and waits for it to finish
+func (q *batchQueue) close() {
+	close(q.queue)
+	<-q.stopped
+}
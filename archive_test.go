@@ -0,0 +1,66 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+func TestBatchQueue(t *testing.T) {
+	isolateBreakers(t)
+	tests := []struct {
+		name     string
+		size     int
+		interval time.Duration
+		idle     time.Duration
+		events   int
+		// want is the batch sizes written before close
+		want []int
+	}{
+		{"full batches", 2, time.Hour, 0, 5, []int{2, 2}},
+		{"partial batch waits for the interval", 10, time.Hour, 0, 3, nil},
+		{"partial batch written on idle", 10, time.Hour, 20 * time.Millisecond, 3, []int{3}},
+		{"partial batch written on the interval", 10, 20 * time.Millisecond, 0, 3, []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			written := make(chan int, 10)
+			q := newBatchQueue("test", 100, tt.size, tt.interval, tt.idle, func(batch []*jetstream.Message) error {
+				written <- len(batch)
+				return nil
+			})
+			for range tt.events {
+				q.publish(dedupCommit("r1", "create", "1", 1))
+			}
+
+			var got []int
+			timeout := time.After(200 * time.Millisecond)
+		wait:
+			for {
+				select {
+				case n := <-written:
+					got = append(got, n)
+				case <-timeout:
+					break wait
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("wrote batches of %v before closing, want %v", got, tt.want)
+			}
+
+			q.close()
+			total := 0
+			for _, n := range got {
+				total += n
+			}
+			for len(written) > 0 {
+				total += <-written
+			}
+			if total != tt.events {
+				t.Errorf("wrote %d events in all, want %d", total, tt.events)
+			}
+		})
+	}
+}
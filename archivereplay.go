@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// archiveCursor reads one archive table in time_us order, holding the
+// next event it has
+type archiveCursor struct {
+	table *archiveTable
+	rows  *sql.Rows
+	next  *jetstream.Message
+}
+
+// readArchive reads a -sqlite-file archive, merging its tables into one
+// stream in time_us order. The archive only keeps some fields of posts,
+// likes, reposts, follows, and blocks, so their records are rebuilt from
+// those, without facets, embeds, or reply CIDs; other collections come
+// back whole from records. Updates come back as creates, since only the
+// latest version of each record is kept, and commits have no rev. A
+// non-nil q skips rows outside its DIDs and time range.
+func readArchive(ctx context.Context, path string, q *eventQuery, each func(*jetstream.Message) bool) error {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var cursors []*archiveCursor
+	defer func() {
+		for _, c := range cursors {
+			c.rows.Close()
+		}
+	}()
+	for _, t := range archiveTables {
+		query, args, ok, err := archiveReadQuery(db, t, q)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", t.name, err)
+		}
+		if !ok {
+			continue
+		}
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", t.name, err)
+		}
+		c := &archiveCursor{table: t, rows: rows}
+		cursors = append(cursors, c)
+		if err := c.advance(); err != nil {
+			return err
+		}
+	}
+
+	for ctx.Err() == nil {
+		var earliest *archiveCursor
+		for _, c := range cursors {
+			if c.next != nil && (earliest == nil || c.next.TimeUs < earliest.next.TimeUs) {
+				earliest = c
+			}
+		}
+		if earliest == nil || !each(earliest.next) {
+			return nil
+		}
+		if err := earliest.advance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveReadQuery selects t's columns in time_us order, with NULL for
+// columns added since the archive was created, and q's DIDs and time range
+// if it is set. It reports false if the archive has no such table.
+func archiveReadQuery(db *sql.DB, t *archiveTable, q *eventQuery) (string, []any, bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", t.name)
+	if err != nil {
+		return "", nil, false, err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return "", nil, false, err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(existing) == 0 {
+		return "", nil, false, err
+	}
+
+	columns := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		columns[i] = c.name
+		if !existing[c.name] {
+			columns[i] = "NULL"
+		}
+	}
+	var where []string
+	var args []any
+	if q != nil {
+		if len(q.dids) > 0 {
+			where = append(where, "did IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(q.dids)), ", ")+")")
+			for _, did := range q.dids {
+				args = append(args, did)
+			}
+		}
+		if q.since > 0 {
+			where = append(where, "time_us >= ?")
+			args = append(args, q.since)
+		}
+		if q.until > 0 {
+			where = append(where, "time_us < ?")
+			args = append(args, q.until)
+		}
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), t.name)
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	return query + " ORDER BY time_us", args, true, nil
+}
+
+// advance reads the cursor's next row, skipping rows that can't be
+// rebuilt, and sets next to nil at the end of the table
+func (c *archiveCursor) advance() error {
+	for c.rows.Next() {
+		values := make([]any, len(c.table.columns))
+		pointers := make([]any, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := c.rows.Scan(pointers...); err != nil {
+			return err
+		}
+		row := archiveRowValues{}
+		for i, col := range c.table.columns {
+			row[col.name] = values[i]
+		}
+
+		msg, err := archiveMessage(c.table, row)
+		if err != nil {
+			log.Error().Err(err).Str("table", c.table.name).Msg("invalid archive row")
+			drops.add("replay_invalid_row")
+			continue
+		}
+		if msg.Raw, err = json.Marshal(msg); err != nil {
+			return err
+		}
+		c.next = msg
+		return nil
+	}
+	c.next = nil
+	return c.rows.Err()
+}
+
+// archiveRowValues is an archive row by column name
+type archiveRowValues map[string]any
+
+func (r archiveRowValues) str(column string) string {
+	switch v := r[column].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func (r archiveRowValues) int(column string) int64 {
+	v, _ := r[column].(int64)
+	return v
+}
+
+func (r archiveRowValues) bool(column string) bool {
+	switch v := r[column].(type) {
+	case int64:
+		return v != 0
+	case bool:
+		return v
+	}
+	return false
+}
+
+// archiveMessage rebuilds the event an archive row was written from, the
+// reverse of archiveRow
+func archiveMessage(t *archiveTable, row archiveRowValues) (*jetstream.Message, error) {
+	did, timeUs := row.str("did"), row.int("time_us")
+	switch t {
+	case identitiesTable:
+		return &jetstream.Message{Did: did, TimeUs: timeUs, Kind: "identity", Identity: &jetstream.IdentityEvent{
+			Did: did, Handle: row.str("handle"), Seq: row.int("seq"), Time: row.str("time"),
+		}}, nil
+	case accountsTable:
+		return &jetstream.Message{Did: did, TimeUs: timeUs, Kind: "account", Account: &jetstream.AccountEvent{
+			Active: row.bool("active"), Status: row.str("status"), Did: did, Seq: row.int("seq"), Time: row.str("time"),
+		}}, nil
+	case deletesTable:
+		return &jetstream.Message{Did: did, TimeUs: timeUs, Kind: "commit", Commit: &jetstream.CommitEvent{
+			Operation: "delete", Collection: row.str("collection"), Rkey: row.str("rkey"),
+		}}, nil
+	}
+
+	var collection string
+	var record any
+	switch t {
+	case postsTable:
+		collection = "app.bsky.feed.post"
+		post := jetstream.Post{Type: collection, Text: row.str("text"), CreatedAt: row.str("created_at")}
+		if langs := row.str("langs"); langs != "" {
+			post.Langs = strings.Split(langs, ",")
+		}
+		if root, parent := row.str("reply_root"), row.str("reply_parent"); root != "" || parent != "" {
+			post.Reply = &jetstream.Reply{Root: &jetstream.Subject{URI: root}, Parent: &jetstream.Subject{URI: parent}}
+		}
+		record = post
+	case likesTable, repostsTable:
+		collection = "app.bsky.feed.like"
+		if t == repostsTable {
+			collection = "app.bsky.feed.repost"
+		}
+		record = jetstream.Like{
+			Type:      collection,
+			Subject:   &jetstream.Subject{URI: row.str("subject_uri"), Cid: row.str("subject_cid")},
+			CreatedAt: row.str("created_at"),
+		}
+	case followsTable, blocksTable:
+		collection = "app.bsky.graph.follow"
+		if t == blocksTable {
+			collection = "app.bsky.graph.block"
+		}
+		record = jetstream.Follow{Type: collection, Subject: row.str("subject"), CreatedAt: row.str("created_at")}
+	case recordsTable:
+		collection = row.str("collection")
+		record = json.RawMessage(row.str("record"))
+		if !json.Valid(record.(json.RawMessage)) {
+			return nil, fmt.Errorf("invalid record json for %s", atURI(did, collection, row.str("rkey")))
+		}
+	default:
+		return nil, fmt.Errorf("unknown archive table %s", t.name)
+	}
+
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return &jetstream.Message{Did: did, TimeUs: timeUs, Kind: "commit", Commit: &jetstream.CommitEvent{
+		Operation: "create", Collection: collection, Rkey: row.str("rkey"), Record: raw, Cid: row.str("cid"),
+	}}, nil
+}
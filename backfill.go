@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// backfillDIDs are the repos the backfill command reads, from its
+// arguments and -backfill-dids-file
+var backfillDIDs []string
+
+// backfillCommand backfills the repos of its DID arguments, instead of
+// connecting
+func backfillCommand(args []string) {
+	backfillDIDs = parseArgs(flag.CommandLine, args)
+	if *backfillDIDsFileFlag != "" {
+		dids, err := readDIDsFile(*backfillDIDsFileFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read -backfill-dids-file")
+		}
+		backfillDIDs = append(backfillDIDs, dids...)
+	}
+	if len(backfillDIDs) == 0 {
+		log.Fatal().Msg("backfill needs DIDs, as arguments or in -backfill-dids-file")
+	}
+	for _, did := range backfillDIDs {
+		if !strings.HasPrefix(did, "did:") {
+			log.Fatal().Str("did", did).Msg("backfill takes DIDs, not handles or URLs")
+		}
+	}
+	runLogger()
+}
+
+// readDIDsFile reads one DID per line, skipping blank lines and # comments
+func readDIDsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var dids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			dids = append(dids, line)
+		}
+	}
+	return dids, scanner.Err()
+}
+
+// backfill downloads each repo in dids from its PDS with
+// com.atproto.sync.getRepo, on up to workers goroutines, and handles its
+// records as create commits marked backfill, the way replayFile handles a
+// capture. A repo's records are handled together, in key order, so repos
+// don't interleave. Repos that fail to download or decode are logged and
+// counted as backfill_failed drops, one per repo.
+func backfill(ctx context.Context, dids []string, workers int) {
+	log.Info().Int("repos", len(dids)).Int("workers", workers).Msg("backfilling")
+	client := &http.Client{Timeout: 10 * time.Minute}
+
+	var (
+		wg                    sync.WaitGroup
+		done, failed, handled atomic.Int64
+		queue                 = make(chan string)
+	)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for did := range queue {
+				start := time.Now()
+				n, err := backfillRepo(ctx, client, did)
+				if err != nil {
+					failed.Add(1)
+					drops.add("backfill_failed")
+					log.Error().Err(err).Str("did", did).Msg("failed to backfill repo")
+					continue
+				}
+				handled.Add(int64(n))
+				log.Info().
+					Str("did", did).
+					Int("events", n).
+					Dur("took", time.Since(start)).
+					Int64("repo", done.Add(1)+failed.Load()).
+					Int("of", len(dids)).
+					Msg("backfilled repo")
+			}
+		}()
+	}
+	for _, did := range dids {
+		select {
+		case queue <- did:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	event := log.Info().Int64("repos", done.Load()).Int64("failed", failed.Load()).Int64("events", handled.Load())
+	if ctx.Err() != nil {
+		event.Msg("backfill interrupted")
+	} else {
+		event.Msg("backfill finished")
+	}
+}
+
+// backfillRepo downloads and handles did's repo, returning how many of its
+// records were handled
+func backfillRepo(ctx context.Context, client *http.Client, did string) (int, error) {
+	doc, err := fetchDIDDocument(client, strings.TrimSuffix(*plcURLFlag, "/"), did)
+	if err != nil {
+		return 0, fmt.Errorf("resolving pds: %v", err)
+	}
+	pds, err := doc.pds(did)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pds+"/xrpc/com.atproto.sync.getRepo?did="+url.QueryEscape(did), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.car")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("getRepo returned %s", resp.Status)
+	}
+	car, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	handleMu.Lock()
+	defer handleMu.Unlock()
+	n := 0
+	var wrongRepo error
+	err = jetstream.ParseRepo(car, func(msg *jetstream.Message) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		if msg.Did != did {
+			wrongRepo = fmt.Errorf("repo is %s's, not %s's", msg.Did, did)
+			return false
+		}
+		if !matchesSubscription(msg) {
+			return true
+		}
+		if plugin != nil {
+			plugin.send(msg.Raw)
+		}
+		handleMessage(msg)
+		n++
+		return true
+	})
+	if wrongRepo != nil {
+		return n, wrongRepo
+	}
+	return n, err
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/rs/zerolog/log"
+)
+
+// blobPDSCacheSize bounds how many DIDs' PDS endpoints are remembered
+const blobPDSCacheSize = 100000
+
+// blobs is the -blob-dir or -blob-s3-bucket downloader, nil unless one is
+// set
+var blobs *blobFetcher
+
+// blobRef is a blob an event references, to be fetched from its owner's
+// PDS
+type blobRef struct {
+	did      string
+	cid      string
+	mimeType string
+	// size as the record declares it, 0 if it doesn't
+	size int64
+	// what the blob is to the record: image, video, avatar, or banner
+	kind string
+}
+
+// blobStore is where downloaded blobs are kept, named by their CID
+type blobStore interface {
+	has(ctx context.Context, cid string) (bool, error)
+	put(ctx context.Context, ref blobRef, data []byte) error
+}
+
+// blobFetcher downloads the images and videos posts embed, and the avatars
+// and banners profiles set, from each author's PDS with
+// com.atproto.sync.getBlob. Downloads happen on a few workers from a
+// queue, started no faster than the rate limit, so the stream never waits
+// on them; blobs already stored are skipped, and those declared or found
+// larger than maxSize aren't kept.
+type blobFetcher struct {
+	store   blobStore
+	client  *http.Client
+	plcURL  string
+	maxSize int64
+	queue   chan blobRef
+	tick    *time.Ticker
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped sync.WaitGroup
+
+	mu sync.Mutex
+	// pds maps DIDs to their PDS endpoint
+	pds map[string]string
+
+	saved, existing, tooLarge, failed atomic.Uint64
+}
+
+func newBlobFetcher(store blobStore, plcURL string, rate float64, maxSize int64, queueSize, workers int) *blobFetcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &blobFetcher{
+		store:   store,
+		client:  &http.Client{Timeout: time.Minute},
+		plcURL:  strings.TrimSuffix(plcURL, "/"),
+		maxSize: maxSize,
+		queue:   make(chan blobRef, queueSize),
+		tick:    time.NewTicker(time.Duration(float64(time.Second) / rate)),
+		ctx:     ctx,
+		cancel:  cancel,
+		pds:     map[string]string{},
+	}
+	for range workers {
+		f.stopped.Add(1)
+		go f.work()
+	}
+	return f
+}
+
+// see queues the blobs a created or updated record references
+func (f *blobFetcher) see(msg *jetstream.Message) {
+	c := msg.Commit
+	if c == nil || c.Operation == "delete" || len(c.Record) == 0 {
+		return
+	}
+	for _, ref := range recordBlobs(msg.Did, c.Collection, c.Record) {
+		select {
+		case f.queue <- ref:
+		default:
+			drops.add("blob_queue_full")
+		}
+	}
+}
+
+// recordBlobs returns the blobs of a post's image or video embed, or a
+// profile's avatar and banner
+func recordBlobs(did, collection string, raw []byte) []blobRef {
+	var refs []blobRef
+	add := func(b *jetstream.Blob, kind string) {
+		if b != nil && b.Link() != "" {
+			refs = append(refs, blobRef{did: did, cid: b.Link(), mimeType: b.MimeType, size: b.Size, kind: kind})
+		}
+	}
+	switch collection {
+	case "app.bsky.feed.post":
+		record, err := jetstream.DecodeRecord(raw)
+		post, ok := record.(*jetstream.Post)
+		if err != nil || !ok {
+			return nil
+		}
+		embed, err := jetstream.DecodeEmbed(post.Embed)
+		if err != nil || embed == nil {
+			return nil
+		}
+		if embed.Media != nil {
+			embed = embed.Media
+		}
+		for _, img := range embed.Images {
+			add(img.Image, "image")
+		}
+		add(embed.Video, "video")
+	case "app.bsky.actor.profile":
+		record, err := jetstream.DecodeRecord(raw)
+		profile, ok := record.(*jetstream.Profile)
+		if err != nil || !ok {
+			return nil
+		}
+		add(profile.Avatar, "avatar")
+		add(profile.Banner, "banner")
+	}
+	return refs
+}
+
+func (f *blobFetcher) work() {
+	defer f.stopped.Done()
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case ref := <-f.queue:
+			f.fetch(ref)
+		}
+	}
+}
+
+// fetch downloads and stores one blob, unless it is already stored
+func (f *blobFetcher) fetch(ref blobRef) {
+	logger := log.With().Str("did", ref.did).Str("cid", ref.cid).Str("kind", ref.kind).Logger()
+	if err := verifyBlobCID(ref.cid, nil); err != nil {
+		// a CID that isn't a raw blob's can't be checked, and shouldn't
+		// become a file name
+		f.failed.Add(1)
+		blobsFetched.WithLabelValues("error").Inc()
+		logger.Debug().Err(err).Msg("skipping blob")
+		return
+	}
+	if exists, err := f.store.has(f.ctx, ref.cid); err == nil && exists {
+		f.existing.Add(1)
+		blobsFetched.WithLabelValues("exists").Inc()
+		return
+	}
+	if ref.size > f.maxSize {
+		f.tooLarge.Add(1)
+		blobsFetched.WithLabelValues("too_large").Inc()
+		return
+	}
+
+	select {
+	case <-f.ctx.Done():
+		return
+	case <-f.tick.C:
+	}
+	data, err := f.download(ref)
+	if errors.Is(err, errBlobTooLarge) {
+		f.tooLarge.Add(1)
+		blobsFetched.WithLabelValues("too_large").Inc()
+		return
+	}
+	if err == nil {
+		err = verifyBlobCID(ref.cid, data)
+	}
+	if err == nil {
+		err = f.store.put(f.ctx, ref, data)
+	}
+	if err != nil {
+		f.failed.Add(1)
+		blobsFetched.WithLabelValues("error").Inc()
+		logger.Debug().Err(err).Msg("blob download failed")
+		return
+	}
+	f.saved.Add(1)
+	blobsFetched.WithLabelValues("saved").Inc()
+	blobBytes.Add(float64(len(data)))
+	logger.Debug().Int("bytes", len(data)).Msg("blob saved")
+}
+
+var errBlobTooLarge = errors.New("blob is larger than -blob-max-size")
+
+// download fetches a blob from its owner's PDS
+func (f *blobFetcher) download(ref blobRef) ([]byte, error) {
+	pds, err := f.pdsEndpoint(ref.did)
+	if err != nil {
+		return nil, err
+	}
+	u := pds + "/xrpc/com.atproto.sync.getBlob?" + url.Values{"did": {ref.did}, "cid": {ref.cid}}.Encode()
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// the account may have moved to another PDS
+		f.mu.Lock()
+		delete(f.pds, ref.did)
+		f.mu.Unlock()
+		return nil, fmt.Errorf("getBlob returned %s", resp.Status)
+	}
+	if resp.ContentLength > f.maxSize {
+		return nil, errBlobTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, f.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > f.maxSize {
+		return nil, errBlobTooLarge
+	}
+	return data, nil
+}
+
+// pdsEndpoint returns the PDS did's DID document names, cached
+func (f *blobFetcher) pdsEndpoint(did string) (string, error) {
+	f.mu.Lock()
+	pds, ok := f.pds[did]
+	f.mu.Unlock()
+	if ok {
+		return pds, nil
+	}
+
+	doc, err := fetchDIDDocument(f.client, f.plcURL, did)
+	if err != nil {
+		return "", err
+	}
+	if pds, err = doc.pds(did); err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.pds) >= blobPDSCacheSize {
+		// evict an arbitrary entry, which only costs a lookup
+		for d := range f.pds {
+			delete(f.pds, d)
+			break
+		}
+	}
+	f.pds[did] = pds
+	return pds, nil
+}
+
+// blobCIDEncoding is the multibase base32 alphabet CIDs are written in,
+// after their "b" prefix
+var blobCIDEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// verifyBlobCID checks that cid is a CIDv1 of a raw sha256 block, as blob
+// CIDs are, and with data set that data is what it hashes
+func verifyBlobCID(cid string, data []byte) error {
+	text, ok := strings.CutPrefix(cid, "b")
+	if !ok {
+		return fmt.Errorf("blob cid %q isn't base32", cid)
+	}
+	binary, err := blobCIDEncoding.DecodeString(text)
+	// version 1, codec raw (0x55), multihash sha2-256 (0x12) of 32 bytes
+	if err != nil || len(binary) != 36 || !bytes.Equal(binary[:4], []byte{0x01, 0x55, 0x12, 0x20}) {
+		return fmt.Errorf("blob cid %q isn't a raw sha256 cid", cid)
+	}
+	if data == nil {
+		return nil
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], binary[4:]) {
+		return errors.New("blob doesn't match its cid")
+	}
+	return nil
+}
+
+// stop abandons the queued downloads, waits for those in progress, and
+// logs a blob_summary
+func (f *blobFetcher) stop() {
+	f.cancel()
+	f.stopped.Wait()
+	f.tick.Stop()
+	log.Info().
+		Uint64("saved", f.saved.Load()).
+		Uint64("already_stored", f.existing.Load()).
+		Uint64("too_large", f.tooLarge.Load()).
+		Uint64("failed", f.failed.Load()).
+		Int("abandoned", len(f.queue)).
+		Msg("blob_summary")
+}
+
+// dirBlobStore keeps blobs as files named by CID in a directory
+type dirBlobStore struct {
+	dir string
+}
+
+func newDirBlobStore(dir string) (*dirBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &dirBlobStore{dir: dir}, nil
+}
+
+func (s *dirBlobStore) has(_ context.Context, cid string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.dir, cid))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// put writes the blob to a temporary file and renames it into place, so a
+// file named by a CID is always complete
+func (s *dirBlobStore) put(_ context.Context, ref blobRef, data []byte) error {
+	tmp, err := os.CreateTemp(s.dir, ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, ref.cid))
+}
+
+// s3BlobStore keeps blobs as objects named by CID, under a prefix, in an
+// S3 or S3-compatible bucket
+type s3BlobStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3BlobStore(endpoint, region, bucket, prefix string) (*s3BlobStore, error) {
+	client, err := newS3Client(endpoint, region)
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobStore{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+// awsCredentials are found from the usual AWS environment variables,
+// shared credentials file, or instance role
+func awsCredentials() *credentials.Credentials {
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{},
+	})
+}
+
+// newS3Client connects to endpoint, with awsCredentials
+func newS3Client(endpoint, region string) (*minio.Client, error) {
+	secure := true
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		// a scheme picks TLS, and is otherwise assumed
+		endpoint, secure = u.Host, u.Scheme != "http"
+	}
+	return minio.New(endpoint, &minio.Options{
+		Creds:  awsCredentials(),
+		Secure: secure,
+		Region: region,
+	})
+}
+
+func (s *s3BlobStore) has(ctx context.Context, cid string) (bool, error) {
+	_, err := s.client.StatObject(ctx, s.bucket, s.prefix+cid, minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *s3BlobStore) put(ctx context.Context, ref blobRef, data []byte) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.prefix+ref.cid, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:  ref.mimeType,
+		UserMetadata: map[string]string{"did": ref.did, "kind": ref.kind},
+	})
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// breakerState is where a circuitBreaker is: closed lets writes through,
+// open drops them, and half-open has let one through as a probe and drops
+// the rest until it reports back. They are in order of how bad they are,
+// as sink_breaker_state reports them.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// circuitBreaker stops a sink writing to a destination that keeps failing.
+// After failures writes in a row fail it opens, and for cooldown the
+// sink's writes are dropped without being tried, so a destination that is
+// down doesn't hold up the sink with timeouts and retries while its queue
+// overflows. Then one write is let through as a probe: if it succeeds the
+// breaker closes, and if not it opens for another cooldown.
+type circuitBreaker struct {
+	sink     string
+	failures int
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failed   int // writes in a row
+	openedAt time.Time
+	dropped  uint64
+}
+
+// breakers are every sink's circuit breakers, for /readyz
+var breakers struct {
+	mu  sync.Mutex
+	all []*circuitBreaker
+}
+
+// newCircuitBreaker returns sink's breaker, or nil if failures isn't
+// positive, which lets every write through
+func newCircuitBreaker(sink string, failures int, cooldown time.Duration) *circuitBreaker {
+	if failures <= 0 {
+		return nil
+	}
+	b := &circuitBreaker{sink: sink, failures: failures, cooldown: cooldown}
+	breakers.mu.Lock()
+	breakers.all = append(breakers.all, b)
+	breakers.mu.Unlock()
+	sinkBreakerState.WithLabelValues(sink).Set(0)
+	return b
+}
+
+// allow reports whether a write should be tried now. Once the cooldown is
+// over, the write it allows is the probe.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.set(breakerHalfOpen)
+		sinkBreakerProbes.WithLabelValues(b.sink).Inc()
+		return true
+	case breakerHalfOpen:
+		// the probe hasn't reported back yet
+		return false
+	}
+	return true
+}
+
+// done records how an allowed write went
+func (b *circuitBreaker) done(err error, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.state != breakerClosed {
+			log.Info().Str("sink", b.sink).Uint64("dropped", b.dropped).Msg("sink recovered, closing its circuit breaker")
+			b.set(breakerClosed)
+		}
+		b.failed, b.dropped = 0, 0
+		return
+	}
+	b.failed++
+	if b.state == breakerHalfOpen || b.failed >= b.failures {
+		if b.state == breakerClosed {
+			log.Warn().Err(err).Str("sink", b.sink).Int("failures", b.failed).Dur("cooldown", b.cooldown).Msg("sink keeps failing, opening its circuit breaker")
+			sinkBreakerOpens.WithLabelValues(b.sink).Inc()
+		}
+		b.set(breakerOpen)
+		b.openedAt = now
+	}
+}
+
+// drop counts n events dropped while the breaker was open
+func (b *circuitBreaker) drop(n int) {
+	b.mu.Lock()
+	b.dropped += uint64(n)
+	b.mu.Unlock()
+}
+
+// set moves the breaker to state. It must be called with mu held.
+func (b *circuitBreaker) set(state breakerState) {
+	b.state = state
+	sinkBreakerState.WithLabelValues(b.sink).Set(float64(state))
+}
+
+// breakerStates returns the state of each sink's breakers, the worst for
+// sinks with several, as in pipelines
+func breakerStates() map[string]breakerState {
+	breakers.mu.Lock()
+	defer breakers.mu.Unlock()
+	states := map[string]breakerState{}
+	for _, b := range breakers.all {
+		b.mu.Lock()
+		if state, ok := states[b.sink]; !ok || b.state > state {
+			states[b.sink] = b.state
+		}
+		b.mu.Unlock()
+	}
+	return states
+}
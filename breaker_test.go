@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// isolateBreakers keeps the breakers made by the test out of /readyz for
+// the rest
+func isolateBreakers(t *testing.T) {
+	breakers.mu.Lock()
+	saved := breakers.all
+	breakers.mu.Unlock()
+	t.Cleanup(func() {
+		breakers.mu.Lock()
+		breakers.all = saved
+		breakers.mu.Unlock()
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	isolateBreakers(t)
+	start := time.Unix(1_700_000_000, 0)
+	failed := errors.New("connection refused")
+	type write struct {
+		at    time.Duration
+		err   error
+		allow bool
+		state breakerState
+	}
+	tests := []struct {
+		name   string
+		writes []write
+	}{
+		{"stays closed under the limit", []write{
+			{0, failed, true, breakerClosed},
+			{0, failed, true, breakerClosed},
+			{0, nil, true, breakerClosed},
+			{0, failed, true, breakerClosed},
+			{0, failed, true, breakerClosed},
+		}},
+		{"opens after failures in a row", []write{
+			{0, failed, true, breakerClosed},
+			{0, failed, true, breakerClosed},
+			{0, failed, true, breakerOpen},
+			{time.Second, nil, false, breakerOpen},
+		}},
+		{"probe closes it", []write{
+			{0, failed, true, breakerClosed},
+			{0, failed, true, breakerClosed},
+			{0, failed, true, breakerOpen},
+			{time.Minute, nil, true, breakerClosed},
+			{time.Minute, failed, true, breakerClosed},
+		}},
+		{"failed probe opens it again", []write{
+			{0, failed, true, breakerClosed},
+			{0, failed, true, breakerClosed},
+			{0, failed, true, breakerOpen},
+			{time.Minute, failed, true, breakerOpen},
+			{time.Minute + time.Second, nil, false, breakerOpen},
+			{2 * time.Minute, nil, true, breakerClosed},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker("test", 3, time.Minute)
+			for i, w := range tt.writes {
+				now := start.Add(w.at)
+				if got := b.allow(now); got != w.allow {
+					t.Fatalf("write %d allowed = %v, want %v", i, got, w.allow)
+				}
+				if w.allow {
+					b.done(w.err, now)
+				}
+				if b.state != w.state {
+					t.Fatalf("after write %d the breaker is %s, want %s", i, b.state, w.state)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerHalfOpenAllowsOneProbe(t *testing.T) {
+	isolateBreakers(t)
+	start := time.Unix(1_700_000_000, 0)
+	b := newCircuitBreaker("test", 1, time.Minute)
+	b.done(errors.New("timeout"), start)
+	if !b.allow(start.Add(time.Minute)) {
+		t.Fatal("no probe after the cooldown")
+	}
+	if b.allow(start.Add(time.Minute)) {
+		t.Error("a second write was let through while the probe is out")
+	}
+}
+
+func TestNewCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker("test", 0, time.Minute)
+	if b != nil {
+		t.Fatal("got a breaker with -sink-breaker-failures 0")
+	}
+	for range 10 {
+		b.done(errors.New("timeout"), time.Now())
+	}
+	if !b.allow(time.Now()) {
+		t.Error("a nil breaker dropped a write")
+	}
+}
+
+func TestBatchQueueBreaker(t *testing.T) {
+	isolateBreakers(t)
+	defer func(failures int, cooldown time.Duration) {
+		*sinkBreakerFailuresFlag, *sinkBreakerCooldownFlag = failures, cooldown
+	}(*sinkBreakerFailuresFlag, *sinkBreakerCooldownFlag)
+	*sinkBreakerFailuresFlag, *sinkBreakerCooldownFlag = 2, time.Hour
+	before := drops.total()
+
+	var writes int
+	q := newBatchQueue("breaker_test", 100, 1, time.Hour, 0, func([]*jetstream.Message) error {
+		writes++
+		return errors.New("connection refused")
+	})
+	for range 5 {
+		q.publish(dedupCommit("r1", "create", "1", 1))
+	}
+	q.close()
+
+	if writes != 2 {
+		t.Errorf("tried %d writes, want the 2 before the breaker opened", writes)
+	}
+	if n := drops.total() - before; n != 5 {
+		t.Errorf("dropped %d events, want all 5", n)
+	}
+	if state := breakerStates()["breaker_test"]; state != breakerOpen {
+		t.Errorf("breaker is %s, want open", state)
+	}
+
+	health := newHealthCheck(time.Minute, 0)
+	status := health.status(true)
+	if s := status.Sinks["breaker_test"]; s.Healthy || s.Breaker != "open" {
+		t.Errorf("/readyz shows the sink as %+v, want it unhealthy with an open breaker", s)
+	}
+	if status.OK {
+		t.Error("/readyz is ok with an open breaker")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// broadcastPingInterval keeps idle downstream connections alive, and
+	// broadcastWriteTimeout drops clients that stop reading
+	broadcastPingInterval = 30 * time.Second
+	broadcastWriteTimeout = 10 * time.Second
+)
+
+// clientFilter is what a downstream client subscribed to, by collection
+// and DID, empty for all
+type clientFilter struct {
+	collections []string
+	dids        map[string]bool
+}
+
+func newClientFilter(collections, dids []string) clientFilter {
+	f := clientFilter{collections: collections, dids: map[string]bool{}}
+	for _, did := range dids {
+		f.dids[did] = true
+	}
+	return f
+}
+
+// wants reports whether msg passes the filter, which like jetstream's only
+// narrows commits by collection
+func (f clientFilter) wants(msg *jetstream.Message) bool {
+	if len(f.dids) > 0 && !f.dids[msg.Did] {
+		return false
+	}
+	if len(f.collections) == 0 || msg.Commit == nil {
+		return true
+	}
+	return matchesCollection(f.collections, msg.Commit.Collection)
+}
+
+// broadcastClient is a downstream connection to the broadcast server, with
+// the filters it subscribed with
+type broadcastClient struct {
+	clientFilter
+	conn   *websocket.Conn
+	remote string
+	queue  chan []byte
+	// closing is closed to disconnect the client, once
+	closing   chan struct{}
+	closeOnce sync.Once
+	reason    string
+}
+
+// disconnect closes the client's connection with reason, sent as a
+// policy violation so the client knows it was dropped
+func (c *broadcastClient) disconnect(reason string) {
+	c.closeOnce.Do(func() {
+		c.reason = reason
+		close(c.closing)
+	})
+}
+
+// broadcastServer rebroadcasts the event stream to downstream websocket
+// clients at /subscribe, speaking enough of jetstream's protocol that
+// jetstream clients can connect to it: events are the same JSON messages,
+// and wantedCollections and wantedDids narrow each client's stream. Events
+// reach it after -kind, -op, -filter, and -follows-of, like other sinks.
+// A client that falls queueSize events behind is disconnected rather than
+// slowing the stream down for everyone.
+type broadcastServer struct {
+	mu        sync.Mutex
+	clients   map[*broadcastClient]struct{}
+	queueSize int
+	upgrader  websocket.Upgrader
+	server    *http.Server
+	// connections counts the clients still being served, so close can
+	// wait for them to be told
+	connections sync.WaitGroup
+}
+
+func newBroadcastServer(addr string, queueSize int) *broadcastServer {
+	b := &broadcastServer{
+		clients:   map[*broadcastClient]struct{}{},
+		queueSize: queueSize,
+		upgrader: websocket.Upgrader{
+			// downstream consumers aren't browsers on other sites
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /subscribe", b.serveSubscribe)
+	b.server = &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.Info().Str("addr", addr).Msg("serving event broadcast")
+		if err := b.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("broadcast server error")
+		}
+	}()
+	return b
+}
+
+func (b *broadcastServer) serveSubscribe(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	client := &broadcastClient{
+		clientFilter: newClientFilter(query["wantedCollections"], query["wantedDids"]),
+		remote:       r.RemoteAddr,
+		queue:        make(chan []byte, b.queueSize),
+		closing:      make(chan struct{}),
+	}
+
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied
+		return
+	}
+	client.conn = conn
+	b.connections.Add(1)
+	defer b.connections.Done()
+
+	b.mu.Lock()
+	b.clients[client] = struct{}{}
+	broadcastClients.Set(float64(len(b.clients)))
+	b.mu.Unlock()
+	log.Info().
+		Str("remote", client.remote).
+		Strs("collections", client.collections).
+		Int("dids", len(client.dids)).
+		Bool("cursor_ignored", query.Has("cursor")).
+		Msg("broadcast client connected")
+
+	go b.read(client)
+	b.write(client)
+
+	b.mu.Lock()
+	delete(b.clients, client)
+	broadcastClients.Set(float64(len(b.clients)))
+	b.mu.Unlock()
+	log.Info().Str("remote", client.remote).Str("reason", client.reason).Msg("broadcast client disconnected")
+}
+
+// read discards what the client sends, handling control frames, until it
+// goes away
+func (b *broadcastServer) read(c *broadcastClient) {
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			c.disconnect("closed by client")
+			return
+		}
+	}
+}
+
+// write sends the client its queued events and pings until it disconnects
+func (b *broadcastServer) write(c *broadcastClient) {
+	defer c.conn.Close()
+
+	ping := time.NewTicker(broadcastPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case frame := <-c.queue:
+			c.conn.SetWriteDeadline(time.Now().Add(broadcastWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				c.disconnect("write failed")
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(broadcastWriteTimeout)); err != nil {
+				c.disconnect("ping failed")
+				return
+			}
+		case <-c.closing:
+			code := websocket.ClosePolicyViolation
+			if c.reason == "shutting down" || c.reason == "closed by client" {
+				code = websocket.CloseGoingAway
+			}
+			c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, c.reason), time.Now().Add(time.Second))
+			return
+		}
+	}
+}
+
+// publish queues msg for each client that wants it, disconnecting clients
+// too far behind to take it
+func (b *broadcastServer) publish(msg *jetstream.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		if !c.wants(msg) {
+			continue
+		}
+		select {
+		case c.queue <- msg.Raw:
+		default:
+			log.Warn().Str("remote", c.remote).Int("queue", b.queueSize).Msg("broadcast client too slow, disconnecting")
+			c.disconnect("consumer too slow")
+		}
+	}
+}
+
+// close disconnects every client and stops the server
+func (b *broadcastServer) close() {
+	b.mu.Lock()
+	for c := range b.clients {
+		c.disconnect("shutting down")
+	}
+	b.mu.Unlock()
+	b.server.Close()
+	b.connections.Wait()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// rawCapture writes every frame read from the websocket to a file, one per
+// line, before any parsing. Text frames are written as JSON and binary
+// frames as base64, so lines starting with '{' are always JSON.
+//
+// With a rotation interval the capture is split into wall-clock segments
+// named after the start of each segment, e.g. events-2024-01-02-15.ndjson
+// for hourly rotation of events.ndjson.
+type rawCapture struct {
+	mu         sync.Mutex
+	path       string
+	interval   time.Duration
+	file       *os.File
+	segmentEnd time.Time
+	buf        bytes.Buffer
+	// header is written at the start of every file or segment, if set
+	header []byte
+}
+
+// capture is the raw frame capture, nil unless -raw-capture-file is set
+var capture *rawCapture
+
+func openRawCapture(path string, interval time.Duration, header []byte) (*rawCapture, error) {
+	c := &rawCapture{path: path, interval: interval, header: header}
+	if err := c.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// open starts writing to the file (or segment) for now. It must be called
+// with mu held, or before the capture is shared.
+func (c *rawCapture) open(now time.Time) error {
+	path := c.path
+	if c.interval > 0 {
+		start := now.UTC().Truncate(c.interval)
+		c.segmentEnd = start.Add(c.interval)
+		path = segmentPath(c.path, start, c.interval)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if c.header != nil {
+		if _, err := f.Write(c.header); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	c.file = f
+	return nil
+}
+
+// segmentPath inserts the segment start time before the extension of
+// path, with only as much precision as the interval needs
+func segmentPath(path string, start time.Time, interval time.Duration) string {
+	layout := "2006-01-02-15-04"
+	switch {
+	case interval%(24*time.Hour) == 0:
+		layout = "2006-01-02"
+	case interval%time.Hour == 0:
+		layout = "2006-01-02-15"
+	}
+
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + start.Format(layout) + ext
+}
+
+// finalize flushes the current file to disk and closes it. It must be
+// called with mu held.
+func (c *rawCapture) finalize() error {
+	if err := c.file.Sync(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
+
+func (c *rawCapture) write(messageType int, frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.interval > 0 {
+		if now := time.Now(); !now.Before(c.segmentEnd) {
+			if err := c.finalize(); err != nil {
+				return err
+			}
+			if err := c.open(now); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.buf.Reset()
+	if messageType == websocket.TextMessage && json.Compact(&c.buf, frame) == nil {
+		// compacted so a frame never spans lines
+	} else {
+		c.buf.Reset()
+		c.buf.WriteString(base64.StdEncoding.EncodeToString(frame))
+	}
+	c.buf.WriteByte('\n')
+
+	_, err := c.file.Write(c.buf.Bytes())
+	return err
+}
+
+// reopen finishes the current file and opens its path again, for SIGHUP
+func (c *rawCapture) reopen() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.finalize(); err != nil {
+		return err
+	}
+	return c.open(time.Now())
+}
+
+func (c *rawCapture) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.finalize()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// catchUpMode switches the logger into catching up when it falls more than
+// enter behind the live stream, and back once it is within exit. While
+// catching up, handles and reply parents that aren't cached aren't
+// fetched, so events are logged without them, and batching sinks write
+// batches batchFactor times larger. Only the goroutine handling the main
+// stream calls observe.
+type catchUpMode struct {
+	enter, exit time.Duration
+	batchFactor int
+
+	active atomic.Bool
+	since  time.Time
+	// events handled since catching up began
+	events int64
+}
+
+// catchUp is nil unless -catch-up-lag is set
+var catchUp *catchUpMode
+
+func newCatchUpMode(enter, exit time.Duration, batchFactor int) *catchUpMode {
+	if exit <= 0 {
+		exit = enter / 2
+	}
+	return &catchUpMode{enter: enter, exit: exit, batchFactor: batchFactor}
+}
+
+// observe records the lag of the event about to be handled, switching
+// modes when it crosses a threshold
+func (c *catchUpMode) observe(lag time.Duration) {
+	if !c.active.Load() {
+		if lag <= c.enter {
+			return
+		}
+		c.since = time.Now()
+		c.events = 0
+		c.active.Store(true)
+		catchingUpGauge.Set(1)
+		log.Warn().
+			Dur("lag", lag).
+			Dur("threshold", c.enter).
+			Msg("falling behind, catching up without fetching handles or reply parents")
+		return
+	}
+	c.events++
+	if lag >= c.exit {
+		return
+	}
+	c.active.Store(false)
+	catchingUpGauge.Set(0)
+	log.Info().
+		Dur("lag", lag).
+		Dur("took", time.Since(c.since)).
+		Int64("events", c.events).
+		Msg("caught up, back to normal processing")
+}
+
+// catchingUp reports whether the logger is catching up, so enrichment that
+// costs requests should be skipped
+func catchingUp() bool {
+	return catchUp != nil && catchUp.active.Load()
+}
+
+// catchUpBatchSize is how many events a batching sink with the given batch
+// size writes at once, larger while catching up
+func catchUpBatchSize(size int) int {
+	if catchingUp() {
+		return size * catchUp.batchFactor
+	}
+	return size
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"github.com/google/cel-go/interpreter"
+)
+
+// celEnv declares what a -cel expression can refer to: the event's did,
+// time_us, and kind, and its commit, record, identity, account, or label,
+// which are null when the event has none. Fields are named as in
+// jetstream's JSON, so the record's are the lexicon's, like record.langs.
+var celEnv = func() *cel.Env {
+	env, err := cel.NewEnv(
+		cel.Variable("did", cel.StringType),
+		cel.Variable("time_us", cel.IntType),
+		cel.Variable("kind", cel.StringType),
+		cel.Variable("commit", cel.DynType),
+		cel.Variable("record", cel.DynType),
+		cel.Variable("identity", cel.DynType),
+		cel.Variable("account", cel.DynType),
+		cel.Variable("label", cel.DynType),
+		// record numbers are decoded from JSON as doubles, so let them
+		// compare with ints like record.count > 5
+		cel.CrossTypeNumericComparisons(true),
+		ext.Strings(),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}()
+
+// celExpr is a compiled -cel expression, matched like a -filter one.
+// An expression that fails on an event, such as by reading a field the
+// record doesn't have, doesn't match it.
+type celExpr struct {
+	program cel.Program
+}
+
+func parseCEL(s string) (celExpr, error) {
+	ast, issues := celEnv.Compile(s)
+	if issues.Err() != nil {
+		return celExpr{}, issues.Err()
+	}
+	if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+		return celExpr{}, fmt.Errorf("expression is %s, not bool", t)
+	}
+	program, err := celEnv.Program(ast)
+	if err != nil {
+		return celExpr{}, err
+	}
+	return celExpr{program: program}, nil
+}
+
+func (c celExpr) match(e *filterEvent) bool {
+	out, _, err := c.program.Eval(celActivation{e})
+	if err != nil {
+		return false
+	}
+	matched, ok := out.Value().(bool)
+	return ok && matched
+}
+
+// celActivation resolves celEnv's variables for an event, decoding its
+// record only if an expression reads it
+type celActivation struct {
+	e *filterEvent
+}
+
+func (a celActivation) ResolveName(name string) (any, bool) {
+	msg := a.e.msg
+	switch name {
+	case "did":
+		return msg.Did, true
+	case "time_us":
+		return msg.TimeUs, true
+	case "kind":
+		return msg.Kind, true
+	case "commit":
+		if c := msg.Commit; c != nil {
+			return map[string]any{
+				"rev":        c.Rev,
+				"operation":  c.Operation,
+				"collection": c.Collection,
+				"rkey":       c.Rkey,
+				"cid":        c.Cid,
+			}, true
+		}
+	case "record":
+		return a.e.genericRecord(), true
+	case "identity":
+		if i := msg.Identity; i != nil {
+			return map[string]any{"did": i.Did, "handle": i.Handle, "seq": i.Seq, "time": i.Time}, true
+		}
+	case "account":
+		if acct := msg.Account; acct != nil {
+			return map[string]any{
+				"active": acct.Active,
+				"status": acct.Status,
+				"did":    acct.Did,
+				"seq":    acct.Seq,
+				"time":   acct.Time,
+			}, true
+		}
+	case "label":
+		if l := msg.Label; l != nil {
+			return map[string]any{
+				"src": l.Src,
+				"uri": l.URI,
+				"cid": l.Cid,
+				"val": l.Val,
+				"neg": l.Neg,
+				"cts": l.Cts,
+				"exp": l.Exp,
+				"seq": l.Seq,
+			}, true
+		}
+	default:
+		return nil, false
+	}
+	return nil, true
+}
+
+func (a celActivation) Parent() interpreter.Activation { return nil }
+
+// genericRecord returns the commit's record decoded as plain JSON values,
+// or nil for events without one
+func (e *filterEvent) genericRecord() any {
+	if !e.recordDecoded {
+		e.recordDecoded = true
+		if c := e.msg.Commit; c != nil && len(c.Record) > 0 {
+			json.Unmarshal(c.Record, &e.record)
+		}
+	}
+	return e.record
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"github.com/rs/zerolog"
+)
+
+// ansiColors maps the color names accepted by -colors to escape codes
+var ansiColors = map[string]string{
+	"bold":    "1",
+	"dim":     "2",
+	"red":     "31",
+	"green":   "32",
+	"yellow":  "33",
+	"blue":    "34",
+	"magenta": "35",
+	"cyan":    "36",
+	"white":   "37",
+}
+
+// messageColors is the color of each event's message in console output,
+// keyed by event type. Types not listed are left uncolored.
+var messageColors = map[string]string{
+	"post":           "green",
+	"like":           "dim",
+	"repost":         "cyan",
+	"follow":         "blue",
+	"block":          "red",
+	"delete":         "yellow",
+	"profile":        "magenta",
+	"handle_update":  "bold",
+	"account_update": "bold",
+}
+
+func parseColors(value string) error {
+	pairs, err := parseKeyValues(value)
+	if err != nil {
+		return err
+	}
+	for typ, name := range pairs {
+		if name == "none" {
+			delete(messageColors, typ)
+			continue
+		}
+		if _, ok := ansiColors[name]; !ok {
+			return fmt.Errorf("unknown color %q for %s", name, typ)
+		}
+		messageColors[typ] = name
+	}
+	return nil
+}
+
+// newConsoleWriter builds the console output to out, with colors decided
+// by mode (auto, always or never). Auto only uses colors when out is a
+// terminal.
+func newConsoleWriter(out io.Writer, mode string) (zerolog.ConsoleWriter, error) {
+	w := zerolog.ConsoleWriter{
+		Out:        out,
+		TimeFormat: time.RFC3339,
+	}
+
+	switch mode {
+	case "auto":
+		f, ok := out.(*os.File)
+		w.NoColor = !ok || !isatty.IsTerminal(f.Fd())
+	case "always":
+	case "never":
+		w.NoColor = true
+	default:
+		return w, fmt.Errorf("unknown color mode %q", mode)
+	}
+
+	if !w.NoColor {
+		w.FormatMessage = func(i interface{}) string {
+			if i == nil {
+				return ""
+			}
+			msg := fmt.Sprint(i)
+			if name, ok := messageColors[msg]; ok {
+				return "\x1b[" + ansiColors[name] + "m" + msg + "\x1b[0m"
+			}
+			return msg
+		}
+	}
+	return w, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// command is a subcommand, the first argument, run with the arguments
+// after it
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string)
+}
+
+// commands are the subcommands. Without one, or with flags first, the
+// logger runs as run does, so command lines from before subcommands keep
+// working.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"run", "[flags]", "consume the live stream (the default)", runCommand},
+		{"replay", "[flags] FILE", "handle the events stored in FILE instead of connecting, as -replay-file does", replayCommand},
+		{"backfill", "[flags] DID...", "handle every record in the DIDs' repos, downloaded from their PDSes, instead of connecting", backfillCommand},
+		{"query", "[flags] FILE", "print the stored events matching the filters as JSON lines", queryCommand},
+		{"stats", "[flags] FILE", "report counts of the stored events matching the filters", statsCommand},
+		{"export", "[flags] -o OUT FILE", "convert the stored events matching the filters to another format", exportCommand},
+	}
+	flag.Usage = usage
+}
+
+// usage lists the commands, then the flags of run and replay, for -h
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: atproto-logger [command] [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(out, "\nFILE is a -raw-capture-file, -ndjson-file output, or -sqlite-file archive.\n")
+	fmt.Fprintf(out, "Run \"atproto-logger <command> -h\" for a command's flags. Flags of run and replay:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		runCommand(args)
+		return
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			c.run(args[1:])
+			return
+		}
+	}
+	if args[0] == "help" {
+		usage()
+		return
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	usage()
+	os.Exit(2)
+}
+
+// parseArgs parses args with fs, allowing flags after the positional
+// arguments, as in "replay FILE -collection app.bsky.feed.post", and
+// returns the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// runCommand consumes the live stream, or replays -replay-file
+func runCommand(args []string) {
+	if extra := parseArgs(flag.CommandLine, args); len(extra) > 0 {
+		log.Fatal().Strs("args", extra).Msg("unexpected arguments, run takes only flags")
+	}
+	runLogger()
+}
+
+// replayCommand replays its FILE argument, as -replay-file
+func replayCommand(args []string) {
+	files := parseArgs(flag.CommandLine, args)
+	switch {
+	case len(files) == 1:
+		flag.Set("replay-file", files[0])
+	case len(files) > 1:
+		log.Fatal().Strs("args", files).Msg("replay takes one file")
+	case *replayFileFlag == "":
+		log.Fatal().Msg("replay needs a file")
+	}
+	runLogger()
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rivo/uniseg"
+	"github.com/rs/zerolog"
+)
+
+// commitLogger logs a commit that has passed the filters in handleMessage
+type commitLogger func(logger zerolog.Logger, msg *jetstream.Message)
+
+// commitLoggers holds the dedicated handling for each collection, by NSID
+// or, for keys ending in *, by NSID prefix. -presets and
+// -collection-fields add to it at startup. Commits for any other
+// collection go to logOtherCommit.
+var commitLoggers = map[string]commitLogger{
+	"app.bsky.feed.post":         logPost,
+	"app.bsky.feed.like":         logLike,
+	"app.bsky.feed.repost":       logRepost,
+	"app.bsky.graph.follow":      logFollow,
+	"app.bsky.feed.threadgate":   logThreadgate,
+	"app.bsky.feed.postgate":     logPostgate,
+	"app.bsky.actor.profile":     logProfile,
+	"app.bsky.graph.block":       logBlock,
+	"app.bsky.feed.generator":    logFeedGenerator,
+	"app.bsky.graph.list":        logList,
+	"app.bsky.graph.listitem":    logListItem,
+	"app.bsky.graph.starterpack": logStarterpack,
+}
+
+// commitLoggerFor returns collection's handling in commitLoggers: its own,
+// or else that of the longest prefix matching it
+func commitLoggerFor(collection string) (commitLogger, bool) {
+	if fn, ok := commitLoggers[collection]; ok {
+		return fn, true
+	}
+	var (
+		best  string
+		found commitLogger
+	)
+	for pattern, fn := range commitLoggers {
+		prefix, ok := strings.CutSuffix(pattern, "*")
+		if ok && strings.HasPrefix(collection, prefix) && (found == nil || len(prefix) > len(best)) {
+			best, found = prefix, fn
+		}
+	}
+	return found, found != nil
+}
+
+// matchTerms are the lowercased -match substrings. Posts are only logged
+// if their text contains one of them, unless no terms are set.
+var matchTerms []string
+
+// matchesAny reports whether text contains any of the lowercased terms,
+// ignoring case. strings.ToLower maps the full Unicode range, so this works
+// for non-ASCII text too.
+func matchesAny(text string, terms []string) bool {
+	text = strings.ToLower(text)
+	for _, term := range terms {
+		if strings.Contains(text, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// postText returns the text of the post msg creates or updates, if it
+// does
+func postText(msg *jetstream.Message) (string, bool) {
+	c := msg.Commit
+	if c == nil || c.Collection != "app.bsky.feed.post" || c.Operation == "delete" {
+		return "", false
+	}
+	var record jetstream.Post
+	if err := json.Unmarshal(c.Record, &record); err != nil {
+		// logged as unparsed if it's logged at all
+		return "", false
+	}
+	return record.Text, true
+}
+
+// logPost logs an app.bsky.feed.post
+func logPost(logger zerolog.Logger, msg *jetstream.Message) {
+	var record jetstream.Post
+	if err := json.Unmarshal(msg.Commit.Record, &record); err != nil {
+		logUnparsed(logger, msg.Commit, err)
+		return
+	}
+	// graphemes rather than bytes or runes, so an emoji built from
+	// several code points counts once
+	if *minTextLengthFlag > 0 && uniseg.GraphemeClusterCount(record.Text) < *minTextLengthFlag {
+		return
+	}
+	if len(matchTerms) > 0 && !matchesAny(record.Text, matchTerms) {
+		return
+	}
+	event := logger.Info().
+		Str("type", "post").
+		Str("text", record.Text).
+		Str("rkey", msg.Commit.Rkey).
+		Bool("is_reply", record.Reply != nil)
+	if record.Reply != nil {
+		if record.Reply.Parent != nil {
+			event = event.Str("reply_parent", record.Reply.Parent.URI)
+			if replyContext != nil {
+				if text, ok := replyContext.lookup(record.Reply.Parent.URI); ok {
+					event = event.Str("reply_parent_text", text)
+				}
+			}
+		}
+		if record.Reply.Root != nil {
+			event = event.Str("reply_root", record.Reply.Root.URI)
+			// a direct reply's root is its parent, already covered
+			if replyContext != nil && (record.Reply.Parent == nil || record.Reply.Root.URI != record.Reply.Parent.URI) {
+				if text, ok := replyContext.lookup(record.Reply.Root.URI); ok {
+					event = event.Str("reply_root_text", text)
+				}
+			}
+		}
+	}
+	embed := summarizeEmbed(record.Embed)
+	if embed.kind != "" {
+		postEmbeds.WithLabelValues(metricsEmbedKind(embed.kind)).Inc()
+		event = event.Str("embed_type", embed.kind)
+		if embed.images > 0 {
+			event = event.Int("image_count", embed.images)
+		}
+		if len(embed.imageCIDs) > 0 {
+			event = event.Strs("image_cids", embed.imageCIDs)
+		}
+		if embed.hasAltText() {
+			event = event.Strs("image_alts", embed.imageAlts)
+		}
+		if embed.videoCID != "" {
+			event = event.Str("video_cid", embed.videoCID)
+		}
+		if embed.videoAlt != "" {
+			event = event.Str("video_alt", embed.videoAlt)
+		}
+		if embed.externalURL != "" {
+			event = event.Str("external_url", embed.externalURL)
+		}
+		if embed.externalTitle != "" {
+			event = event.Str("external_title", embed.externalTitle)
+		}
+		if embed.quoteURI != "" {
+			event = event.Str("quote_uri", embed.quoteURI)
+		}
+		if embed.quoteCid != "" {
+			event = event.Str("quote_cid", embed.quoteCid)
+		}
+	}
+	if len(record.Tags) > 0 {
+		event = event.Strs("post_tags", record.Tags)
+	}
+	if len(record.Langs) > 0 {
+		event = event.Strs("langs", record.Langs)
+	}
+	facets := summarizeFacets(record.Text, record.Facets)
+	if len(facets.mentions) > 0 {
+		event = event.Strs("mentions", facets.mentions)
+	}
+	if len(facets.links) > 0 {
+		event = event.Strs("links", facets.links)
+	}
+	if len(facets.hashtags) > 0 {
+		event = event.Strs("hashtags", facets.hashtags)
+	}
+	if facets.invalid > 0 {
+		event = event.Int("invalid_facets", facets.invalid)
+	}
+	if embed.externalURL != "" {
+		event = event.Bool("external_has_thumb", embed.externalHasThumb)
+	}
+	if extensions, via := postExtensions(msg.Commit.Record); len(extensions) > 0 {
+		event = event.Strs("extensions", extensions)
+		if via != "" {
+			event = event.Str("via", via)
+		}
+	}
+	if *cdnURLsFlag {
+		if cids := embed.imageCIDs; len(cids) > 0 {
+			urls := make([]string, len(cids))
+			for i, cid := range cids {
+				urls[i] = cdnImageURL(*cdnBaseFlag, msg.Did, cid)
+			}
+			event = event.Strs("image_url", urls)
+		}
+		if embed.videoCID != "" {
+			playlist, thumbnail := cdnVideoURLs(*cdnVideoBaseFlag, msg.Did, embed.videoCID)
+			event = event.Str("video_url", playlist).Str("video_thumbnail_url", thumbnail)
+		}
+	}
+	if embed.quoteDetached != nil {
+		event = event.Bool("quote_detached", *embed.quoteDetached)
+	}
+	event.Msg(eventName("post", msg.Commit.Operation))
+}
+
+// logLike logs an app.bsky.feed.like
+func logLike(logger zerolog.Logger, msg *jetstream.Message) {
+	var record jetstream.Like
+	if err := json.Unmarshal(msg.Commit.Record, &record); err != nil {
+		logUnparsed(logger, msg.Commit, err)
+		return
+	}
+	if record.Subject == nil || record.Subject.URI == "" {
+		warnMissingSubject(logger, msg.Commit)
+		return
+	}
+	logger.Info().
+		Str("type", "like").
+		Str("post_uri", record.Subject.URI).
+		Str("post_cid", record.Subject.Cid).
+		Msg(eventName("like", msg.Commit.Operation))
+}
+
+// logRepost logs an app.bsky.feed.repost
+func logRepost(logger zerolog.Logger, msg *jetstream.Message) {
+	var record jetstream.Repost
+	if err := json.Unmarshal(msg.Commit.Record, &record); err != nil {
+		logUnparsed(logger, msg.Commit, err)
+		return
+	}
+	if record.Subject == nil || record.Subject.URI == "" {
+		warnMissingSubject(logger, msg.Commit)
+		return
+	}
+	logger.Info().
+		Str("type", "repost").
+		Str("post_uri", record.Subject.URI).
+		Str("post_cid", record.Subject.Cid).
+		Msg(eventName("repost", msg.Commit.Operation))
+}
+
+// logFollow logs an app.bsky.graph.follow
+func logFollow(logger zerolog.Logger, msg *jetstream.Message) {
+	var record jetstream.Follow
+	if err := json.Unmarshal(msg.Commit.Record, &record); err != nil {
+		logUnparsed(logger, msg.Commit, err)
+		return
+	}
+	if record.Subject == "" {
+		warnMissingSubject(logger, msg.Commit)
+		return
+	}
+	logger.Info().
+		Str("type", "follow").
+		Str("subject", record.Subject).
+		Msg(eventName("follow", msg.Commit.Operation))
+}
+
+// logList logs an app.bsky.graph.list
+func logList(logger zerolog.Logger, msg *jetstream.Message) {
+	var record jetstream.List
+	if err := json.Unmarshal(msg.Commit.Record, &record); err != nil {
+		logUnparsed(logger, msg.Commit, err)
+		return
+	}
+	logger.Info().
+		Str("type", "list").
+		Str("rkey", msg.Commit.Rkey).
+		Str("name", record.Name).
+		Str("purpose", record.Purpose).
+		Str("description", record.Description).
+		Msg(eventName("list", msg.Commit.Operation))
+}
+
+// logListItem logs an app.bsky.graph.listitem
+func logListItem(logger zerolog.Logger, msg *jetstream.Message) {
+	var record jetstream.ListItem
+	if err := json.Unmarshal(msg.Commit.Record, &record); err != nil {
+		logUnparsed(logger, msg.Commit, err)
+		return
+	}
+	if record.Subject == "" {
+		warnMissingSubject(logger, msg.Commit)
+		return
+	}
+	logger.Info().
+		Str("type", "listitem").
+		Str("rkey", msg.Commit.Rkey).
+		Str("subject", record.Subject).
+		Str("list_uri", record.List).
+		Msg(eventName("listitem", msg.Commit.Operation))
+}
+
+// logStarterpack logs an app.bsky.graph.starterpack
+func logStarterpack(logger zerolog.Logger, msg *jetstream.Message) {
+	var record jetstream.Starterpack
+	if err := json.Unmarshal(msg.Commit.Record, &record); err != nil {
+		logUnparsed(logger, msg.Commit, err)
+		return
+	}
+	feeds := make([]string, len(record.Feeds))
+	for i, feed := range record.Feeds {
+		feeds[i] = feed.URI
+	}
+	logger.Info().
+		Str("type", "starterpack").
+		Str("rkey", msg.Commit.Rkey).
+		Str("name", record.Name).
+		Str("description", record.Description).
+		Str("list_uri", record.List).
+		Strs("feeds", feeds).
+		Msg(eventName("starterpack", msg.Commit.Operation))
+}
+
+// logThreadgate logs an app.bsky.feed.threadgate
+func logThreadgate(logger zerolog.Logger, msg *jetstream.Message) {
+	logger.Info().
+		Str("type", "threadgate").
+		Str("rkey", msg.Commit.Rkey).
+		Msg(eventName("threadgate", msg.Commit.Operation))
+}
+
+// logPostgate logs an app.bsky.feed.postgate
+func logPostgate(logger zerolog.Logger, msg *jetstream.Message) {
+	var record jetstream.Postgate
+	if err := json.Unmarshal(msg.Commit.Record, &record); err != nil {
+		logUnparsed(logger, msg.Commit, err)
+		return
+	}
+	logger.Info().
+		Str("type", "postgate").
+		Str("post_uri", record.Post).
+		Bool("quote_detached", len(record.DetachedEmbeddingUris) > 0).
+		Strs("detached_uris", record.DetachedEmbeddingUris).
+		Bool("quotes_disabled", record.QuotesDisabled()).
+		Msg(eventName("postgate", msg.Commit.Operation))
+}
+
+// logProfile logs an app.bsky.actor.profile
+func logProfile(logger zerolog.Logger, msg *jetstream.Message) {
+	event := logger.Info().
+		Str("type", "profile")
+	withRawJSON(event, msg.Commit.Collection, msg.Commit.Record).
+		Msg(eventName("profile", msg.Commit.Operation))
+}
+
+// logBlock logs an app.bsky.graph.block
+func logBlock(logger zerolog.Logger, msg *jetstream.Message) {
+	var record jetstream.Block
+	if err := json.Unmarshal(msg.Commit.Record, &record); err != nil {
+		logUnparsed(logger, msg.Commit, err)
+		return
+	}
+	if record.Subject == "" {
+		warnMissingSubject(logger, msg.Commit)
+		return
+	}
+	logger.Info().
+		Str("type", "block").
+		Str("subject", record.Subject).
+		Msg(eventName("block", msg.Commit.Operation))
+}
+
+// logFeedGenerator logs an app.bsky.feed.generator
+func logFeedGenerator(logger zerolog.Logger, msg *jetstream.Message) {
+	event := logger.Info().
+		Str("type", "feed_generator").
+		Str("rkey", msg.Commit.Rkey)
+	withRawJSON(event, msg.Commit.Collection, msg.Commit.Record).
+		Msg(eventName("feed_generator", msg.Commit.Operation))
+}
+
+// logOtherCommit logs commits for collections without a dedicated
+// handler
+func logOtherCommit(logger zerolog.Logger, msg *jetstream.Message) {
+	event := withCollection(logger.Info().Str("type", "other"), msg.Commit.Collection).
+		Str("rkey", msg.Commit.Rkey)
+	withRawJSON(event, msg.Commit.Collection, msg.Commit.Record).
+		Msg(eventName("other", msg.Commit.Operation))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog"
+)
+
+// logLines decodes the JSON lines written to buf
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("undecodable log line: %v", err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func commitMessage(collection, record string) *jetstream.Message {
+	return &jetstream.Message{Did: "did:plc:abc", Kind: "commit", Commit: &jetstream.CommitEvent{
+		Operation: "create", Collection: collection, Rkey: "3kabc", Record: json.RawMessage(record),
+	}}
+}
+
+func TestWarnMissingSubject(t *testing.T) {
+	var buf bytes.Buffer
+	warnMissingSubject(zerolog.New(&buf), commitMessage("app.bsky.feed.like", `{}`).Commit)
+	lines := logLines(t, &buf)
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1", len(lines))
+	}
+	want := map[string]any{"level": "warn", "collection": "app.bsky.feed.like", "rkey": "3kabc", "message": "record has no subject, skipping"}
+	for k, v := range want {
+		if lines[0][k] != v {
+			t.Errorf("%s = %v, want %v", k, lines[0][k], v)
+		}
+	}
+}
+
+func TestSubjectRecordsWithoutSubject(t *testing.T) {
+	tests := []struct {
+		name       string
+		log        func(zerolog.Logger, *jetstream.Message)
+		collection string
+		record     string
+	}{
+		{"like without subject", logLike, "app.bsky.feed.like", `{"$type": "app.bsky.feed.like", "createdAt": "2024-01-01T00:00:00Z"}`},
+		{"like with null subject", logLike, "app.bsky.feed.like", `{"$type": "app.bsky.feed.like", "subject": null}`},
+		{"like with empty uri", logLike, "app.bsky.feed.like", `{"$type": "app.bsky.feed.like", "subject": {"uri": "", "cid": "bafypost"}}`},
+		{"repost without subject", logRepost, "app.bsky.feed.repost", `{"$type": "app.bsky.feed.repost", "createdAt": "2024-01-01T00:00:00Z"}`},
+		{"repost with empty uri", logRepost, "app.bsky.feed.repost", `{"$type": "app.bsky.feed.repost", "subject": {"uri": "", "cid": "bafypost"}}`},
+		{"follow without subject", logFollow, "app.bsky.graph.follow", `{"$type": "app.bsky.graph.follow"}`},
+		{"follow with empty subject", logFollow, "app.bsky.graph.follow", `{"$type": "app.bsky.graph.follow", "subject": ""}`},
+		{"block without subject", logBlock, "app.bsky.graph.block", `{"$type": "app.bsky.graph.block"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.log(zerolog.New(&buf), commitMessage(tt.collection, tt.record))
+			lines := logLines(t, &buf)
+			if len(lines) != 1 {
+				t.Fatalf("got %d lines, want only the warning: %v", len(lines), lines)
+			}
+			if lines[0]["message"] != "record has no subject, skipping" || lines[0]["collection"] != tt.collection {
+				t.Errorf("got %v, want the missing subject warning", lines[0])
+			}
+		})
+	}
+}
+
+func TestSubjectRecordsWithSubject(t *testing.T) {
+	tests := []struct {
+		name       string
+		log        func(zerolog.Logger, *jetstream.Message)
+		collection string
+		record     string
+		field      string
+		want       string
+	}{
+		{"like", logLike, "app.bsky.feed.like", `{"subject": {"uri": "at://did:plc:x/app.bsky.feed.post/1", "cid": "bafypost"}}`, "post_uri", "at://did:plc:x/app.bsky.feed.post/1"},
+		{"repost", logRepost, "app.bsky.feed.repost", `{"subject": {"uri": "at://did:plc:x/app.bsky.feed.post/1", "cid": "bafypost"}}`, "post_uri", "at://did:plc:x/app.bsky.feed.post/1"},
+		{"follow", logFollow, "app.bsky.graph.follow", `{"subject": "did:plc:x"}`, "subject", "did:plc:x"},
+		{"block", logBlock, "app.bsky.graph.block", `{"subject": "did:plc:x"}`, "subject", "did:plc:x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.log(zerolog.New(&buf), commitMessage(tt.collection, tt.record))
+			lines := logLines(t, &buf)
+			if len(lines) != 1 || lines[0]["level"] != "info" {
+				t.Fatalf("got %v, want one info line", lines)
+			}
+			if lines[0][tt.field] != tt.want {
+				t.Errorf("%s = %v, want %s", tt.field, lines[0][tt.field], tt.want)
+			}
+		})
+	}
+}
+
+// multiOpMessages are the events the firehose makes of one commit writing
+// several records, which share its repo, rev, and time
+func multiOpMessages() []*jetstream.Message {
+	ops := []struct{ op, collection, rkey, record string }{
+		{"create", "app.bsky.feed.post", "3kpost", `{"$type": "app.bsky.feed.post", "text": "hello", "createdAt": "2024-09-09T19:46:02Z"}`},
+		{"create", "app.bsky.feed.threadgate", "3kpost", `{"$type": "app.bsky.feed.threadgate", "post": "at://did:plc:abc/app.bsky.feed.post/3kpost", "createdAt": "2024-09-09T19:46:02Z"}`},
+		{"update", "app.bsky.actor.profile", "self", `{"$type": "app.bsky.actor.profile", "displayName": "abc"}`},
+		{"delete", "app.bsky.graph.follow", "3kfollow", ``},
+		{"create", "app.bsky.feed.like", "3klike", `{"$type": "app.bsky.feed.like", "subject": {"uri": "at://did:plc:x/app.bsky.feed.post/1", "cid": "bafypost"}, "createdAt": "2024-09-09T19:46:02Z"}`},
+	}
+	var messages []*jetstream.Message
+	for _, o := range ops {
+		msg := &jetstream.Message{Did: "did:plc:abc", TimeUs: 1_725_911_162_329_308, Kind: "commit", Commit: &jetstream.CommitEvent{
+			Rev: "3kabcrev", Operation: o.op, Collection: o.collection, Rkey: o.rkey,
+		}}
+		if o.record != "" {
+			msg.Commit.Record = json.RawMessage(o.record)
+		}
+		msg.Raw, _ = json.Marshal(msg)
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func TestMultiOpCommitLogsEveryOp(t *testing.T) {
+	// the ops share a rev and time_us, which mustn't make -dedup-window
+	// take them for replays of each other
+	defer func(d *deduper) { dedup = d }(dedup)
+	dedup = newDeduper(time.Minute.Microseconds(), 1000, nil)
+
+	var buf bytes.Buffer
+	captureLog(t, &buf)
+	for _, msg := range multiOpMessages() {
+		handleMessage(msg)
+	}
+
+	want := []struct{ message, op, field, value string }{
+		{"post", "create", "rkey", "3kpost"},
+		{"threadgate", "create", "rkey", "3kpost"},
+		{"profile_update", "update", "type", "profile"},
+		{"delete", "delete", "uri", "at://did:plc:abc/app.bsky.graph.follow/3kfollow"},
+		{"like", "create", "post_uri", "at://did:plc:x/app.bsky.feed.post/1"},
+	}
+	lines := logLines(t, &buf)
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want one per op, %d: %v", len(lines), len(want), lines)
+	}
+	for i, w := range want {
+		l := lines[i]
+		if l["message"] != w.message || l["op"] != w.op || l[w.field] != w.value || l["did"] != "did:plc:abc" {
+			t.Errorf("line %d = %v, want %s %s with %s %s", i, l, w.message, w.op, w.field, w.value)
+		}
+	}
+}
+
+func TestReplyContextRemembersPostsThatAreNotLogged(t *testing.T) {
+	var buf bytes.Buffer
+	captureLog(t, &buf)
+	defer func(saved *replyContextCache) { replyContext = saved }(replyContext)
+	replyContext = newReplyContextCache("http://127.0.0.1:0", 10, 0)
+	// the parent's author is over -did-rate
+	defer func(saved *didThrottle) { throttle = saved }(throttle)
+	throttle = newDIDThrottle(1, 1, 10)
+	throttle.allow("did:plc:abc", time.Now())
+
+	handleMessage(commitMessage("app.bsky.feed.post", `{"text": "hi"}`))
+	parent := atURI("did:plc:abc", "app.bsky.feed.post", "3kabc")
+	reply := commitMessage("app.bsky.feed.post", `{"text": "hello there", "reply": {"parent": {"uri": "`+parent+`", "cid": "bafyparent"}, "root": {"uri": "`+parent+`", "cid": "bafyparent"}}}`)
+	reply.Did = "did:plc:xyz"
+	handleMessage(reply)
+
+	lines := logLines(t, &buf)
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want only the reply: %v", len(lines), lines)
+	}
+	if got := lines[0]["reply_parent_text"]; got != "hi" {
+		t.Errorf("reply_parent_text = %v, want the throttled parent's text", got)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envFlags are the environment variables that set flags, for running in
+// containers without a command line. Repeatable flags take a
+// comma-separated list.
+var envFlags = []struct{ env, flag string }{
+	{"JETSTREAM_URL", "url"},
+	{"JETSTREAM_COLLECTIONS", "collection"},
+	{"JETSTREAM_DIDS", "did"},
+	{"JETSTREAM_CURSOR", "cursor"},
+	{"JETSTREAM_COMPRESS", "compress"},
+}
+
+// applyConfig fills in flags not given on the command line, first from the
+// environment and then from the -config file, so the command line wins
+// over the environment, which wins over the file
+func applyConfig(path string) error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, e := range envFlags {
+		value := os.Getenv(e.env)
+		if value == "" || set[e.flag] {
+			continue
+		}
+		if err := setFlag(e.flag, value); err != nil {
+			return fmt.Errorf("%s: %v", e.env, err)
+		}
+		set[e.flag] = true
+	}
+
+	if path == "" {
+		return nil
+	}
+	return loadConfigFile(path, set)
+}
+
+// fixedFlags are the flags set on the command line or in the environment,
+// which the -config file can't change, and configValues are the values the
+// file set, by flag, which a reload compares against
+var (
+	fixedFlags   map[string]bool
+	configValues map[string][]string
+)
+
+// loadConfigFile sets flags from a file of "name = value" lines, with flag
+// names as on the command line but without the leading dash. Blank lines
+// and lines starting with # are ignored, values may be double-quoted, and
+// repeatable flags can be given on several lines. Flags in skip are left
+// alone.
+func loadConfigFile(path string, skip map[string]bool) error {
+	lines, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		if skip[l.name] {
+			continue
+		}
+		if err := flag.Set(l.name, l.value); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, l.n, err)
+		}
+	}
+	fixedFlags = skip
+	configValues = configFileValues(lines, skip)
+	return nil
+}
+
+// configLine is a name = value line of a config file, n being its line
+// number
+type configLine struct {
+	name, value string
+	n           int
+}
+
+// readConfigFile parses a config file, checking that each flag exists
+// without setting any
+func readConfigFile(path string) ([]configLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []configLine
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected name = value", path, n)
+		}
+		name = strings.TrimPrefix(strings.TrimSpace(name), "-")
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value: %v", path, n, err)
+			}
+		}
+		if name == "config" {
+			return nil, fmt.Errorf("%s:%d: config files can't include other config files", path, n)
+		}
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown flag %q", path, n, name)
+		}
+		lines = append(lines, configLine{name, value, n})
+	}
+	return lines, scanner.Err()
+}
+
+// configFileValues groups a config file's values by flag, in file order,
+// leaving out the flags in skip
+func configFileValues(lines []configLine, skip map[string]bool) map[string][]string {
+	values := map[string][]string{}
+	for _, l := range lines {
+		if !skip[l.name] {
+			values[l.name] = append(values[l.name], l.value)
+		}
+	}
+	return values
+}
+
+// setFlag sets a flag from an environment variable, splitting the value
+// on commas for repeatable flags
+func setFlag(name, value string) error {
+	if _, repeatable := flag.Lookup(name).Value.(*stringsFlag); !repeatable {
+		return flag.Set(name, value)
+	}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			if err := flag.Set(name, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file of lines
+func writeConfig(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "logger.conf")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useTestFlags swaps the command line for one with the few flags these
+// tests use, backed by the same variables, restoring both after the test,
+// so what one test sets doesn't count as set on the command line in the
+// next
+func useTestFlags(t *testing.T) {
+	savedLine := flag.CommandLine
+	savedURLs, savedCollections, savedDIDs := urlFlags, collectionFlags, didFlags
+	savedCursor, savedCompress, savedBackoff := *cursorFlag, *compressFlag, *maxBackoffFlag
+	t.Cleanup(func() {
+		flag.CommandLine = savedLine
+		urlFlags, collectionFlags, didFlags = savedURLs, savedCollections, savedDIDs
+		*cursorFlag, *compressFlag, *maxBackoffFlag = savedCursor, savedCompress, savedBackoff
+		fixedFlags, configValues = nil, nil
+	})
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	urlFlags, collectionFlags, didFlags = nil, nil, nil
+	fs.Var(&urlFlags, "url", "")
+	fs.Var(&collectionFlags, "collection", "")
+	fs.Var(&didFlags, "did", "")
+	fs.Int64Var(cursorFlag, "cursor", 0, "")
+	fs.BoolVar(compressFlag, "compress", false, "")
+	fs.DurationVar(maxBackoffFlag, "max-backoff", time.Minute, "")
+	fs.String("match", "", "")
+	fs.String("config", "", "")
+	flag.CommandLine = fs
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []configLine
+		err   string
+	}{
+		{
+			name:  "names and values",
+			lines: []string{"# a comment", "", "cursor = 1700000000000000", "-compress=true", `match = "hello world"`, "collection = app.bsky.feed.post", "collection = app.bsky.feed.like"},
+			want: []configLine{
+				{"cursor", "1700000000000000", 3},
+				{"compress", "true", 4},
+				{"match", "hello world", 5},
+				{"collection", "app.bsky.feed.post", 6},
+				{"collection", "app.bsky.feed.like", 7},
+			},
+		},
+		{name: "no value", lines: []string{"compress"}, err: ":1: expected name = value"},
+		{name: "unknown flag", lines: []string{"cursor = 1", "colection = app.bsky.feed.post"}, err: `:2: unknown flag "colection"`},
+		{name: "bad quotes", lines: []string{`match = "hello`}, err: ":1: invalid quoted value"},
+		{name: "nested config", lines: []string{"config = other.conf"}, err: ":1: config files can't include other config files"},
+	}
+	useTestFlags(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readConfigFile(writeConfig(t, tt.lines...))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("readConfigFile error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("readConfigFile = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigFileValues(t *testing.T) {
+	lines := []configLine{{"collection", "a", 1}, {"cursor", "5", 2}, {"collection", "b", 3}, {"compress", "true", 4}}
+	got := configFileValues(lines, map[string]bool{"compress": true})
+	if len(got) != 2 || !slices.Equal(got["collection"], []string{"a", "b"}) || !slices.Equal(got["cursor"], []string{"5"}) {
+		t.Fatalf("configFileValues = %v, want collection and cursor in file order, without compress", got)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	useTestFlags(t)
+	t.Setenv("JETSTREAM_CURSOR", "1700000000000000")
+	t.Setenv("JETSTREAM_COLLECTIONS", "app.bsky.feed.post, app.bsky.feed.like,")
+	path := writeConfig(t, "cursor = 1600000000000000", "collection = app.bsky.graph.follow", "max-backoff = 5s", "compress = true")
+
+	if err := applyConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	// the environment wins over the file
+	if *cursorFlag != 1700000000000000 {
+		t.Errorf("cursor = %d, want the environment's", *cursorFlag)
+	}
+	if !slices.Equal(collectionFlags, stringsFlag{"app.bsky.feed.post", "app.bsky.feed.like"}) {
+		t.Errorf("collections = %v, want the environment's, split on commas", collectionFlags)
+	}
+	if *maxBackoffFlag != 5*time.Second || !*compressFlag {
+		t.Errorf("max-backoff = %v and compress = %v, want the file's", *maxBackoffFlag, *compressFlag)
+	}
+	if !fixedFlags["cursor"] || !fixedFlags["collection"] || fixedFlags["max-backoff"] {
+		t.Errorf("fixed flags %v, want those from the environment", fixedFlags)
+	}
+	if !slices.Equal(configValues["max-backoff"], []string{"5s"}) || configValues["cursor"] != nil {
+		t.Errorf("config values %v, want only those the file set", configValues)
+	}
+}
+
+func TestApplyConfigReportsBadEnvironment(t *testing.T) {
+	useTestFlags(t)
+	t.Setenv("JETSTREAM_CURSOR", "yesterday")
+	err := applyConfig("")
+	if err == nil || !strings.HasPrefix(err.Error(), "JETSTREAM_CURSOR: ") {
+		t.Fatalf("applyConfig error = %v, want one naming JETSTREAM_CURSOR", err)
+	}
+}
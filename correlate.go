@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// correlator implements -collections-require-all. It remembers, per DID,
+// when each required collection was last seen, and only lets a DID's
+// events through while all of them have been seen within the window.
+//
+// Memory grows with the number of DIDs that produced any required
+// collection within the window: one map entry per DID plus one timestamp
+// per required collection it produced. Entries older than the window are
+// swept periodically.
+type correlator struct {
+	mu        sync.Mutex
+	required  []string
+	window    time.Duration
+	seen      map[string]map[string]time.Time
+	lastSweep time.Time
+}
+
+// correlation is the -collections-require-all filter, nil when disabled
+var correlation *correlator
+
+func newCorrelator(collections string, window time.Duration) *correlator {
+	c := &correlator{
+		window:    window,
+		seen:      make(map[string]map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+	for _, collection := range strings.Split(collections, ",") {
+		if collection = strings.TrimSpace(collection); collection != "" {
+			c.required = append(c.required, collection)
+		}
+	}
+	return c
+}
+
+// observe records a commit from did to collection and reports whether the
+// DID has now produced every required collection within the window
+func (c *correlator) observe(did, collection string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) > c.window {
+		c.sweep(now)
+	}
+
+	types := c.seen[did]
+	for _, r := range c.required {
+		if r == collection {
+			if types == nil {
+				types = make(map[string]time.Time, len(c.required))
+				c.seen[did] = types
+			}
+			types[collection] = now
+			break
+		}
+	}
+	if types == nil {
+		return false
+	}
+
+	cutoff := now.Add(-c.window)
+	for _, r := range c.required {
+		if t, ok := types[r]; !ok || t.Before(cutoff) {
+			return false
+		}
+	}
+	return true
+}
+
+// sweep forgets sightings older than the window. It must be called with mu
+// held.
+func (c *correlator) sweep(now time.Time) {
+	cutoff := now.Add(-c.window)
+	for did, types := range c.seen {
+		for collection, t := range types {
+			if t.Before(cutoff) {
+				delete(types, collection)
+			}
+		}
+		if len(types) == 0 {
+			delete(c.seen, did)
+		}
+	}
+	c.lastSweep = now
+}
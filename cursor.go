@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// cursorStore persists the time_us of the last handled event, so a
+// restarted logger resumes where the previous run stopped
+type cursorStore interface {
+	// load returns the saved cursor, or 0 if there is none
+	load() (int64, error)
+	save(cursor int64) error
+}
+
+// cursors is where the cursor is persisted, nil unless -cursor-file is set
+var cursors cursorStore
+
+// fileCursorStore keeps the cursor as a decimal time_us in a file
+type fileCursorStore struct {
+	path string
+}
+
+func (s *fileCursorStore) load() (int64, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// save writes the cursor to a temporary file and renames it into place, so
+// a crash mid-write leaves the previous cursor intact
+func (s *fileCursorStore) save(cursor int64) error {
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(cursor, 10)+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// committedCursor returns the cursor that is safe to save given last, the
+// last handled event: it is held back to the oldest event a committing
+// sink hasn't had acknowledged, which resuming from it replays
+func committedCursor(last int64) int64 {
+	for _, s := range sinks {
+		if c, ok := s.(committingSink); ok {
+			if oldest := c.oldestPending(); oldest > 0 && oldest < last {
+				last = oldest
+			}
+		}
+	}
+	return last
+}
+
+// saveCursors saves the cursor reported by current every interval until
+// ctx is cancelled, skipping saves when it hasn't moved
+func saveCursors(ctx context.Context, interval time.Duration, current func() int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var saved int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		cursor := current()
+		if cursor == 0 || cursor == saved {
+			continue
+		}
+		if err := cursors.save(cursor); err != nil {
+			log.Error().Err(err).Msg("failed to save cursor")
+			continue
+		}
+		saved = cursor
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// dedupEntry is an event identity in the order it was first seen
+type dedupEntry struct {
+	key    string
+	timeUs int64
+}
+
+// deduper drops events that were already handled, as happens when a
+// reconnect resumes from the cursor of the last handled event. It
+// remembers event identities for a window of stream time (time_us, not
+// wall-clock time) and at most max of them each, so memory stays bounded
+// on long runs. Labels from -labeler are tracked apart from the main stream,
+// since their times are when labels were created: while the main stream
+// replays from an old cursor, they would otherwise move the window past
+// everything being replayed.
+type deduper struct {
+	mu     sync.Mutex
+	window int64 // microseconds
+	max    int
+	// fields are the -dedup-key fields commits are identified by, nil
+	// for all of eventKey's
+	fields  []string
+	events  dedupSet
+	labels  dedupSet
+	dropped uint64
+}
+
+// dedupSet is the identities remembered for one stream
+type dedupSet struct {
+	seen   map[string]bool
+	order  []dedupEntry // oldest first
+	latest int64
+}
+
+// dedup is the duplicate filter, nil unless -dedup-window is set
+var dedup *deduper
+
+func newDeduper(windowUs int64, max int, fields []string) *deduper {
+	return &deduper{
+		window: windowUs,
+		max:    max,
+		fields: fields,
+		events: dedupSet{seen: make(map[string]bool)},
+		labels: dedupSet{seen: make(map[string]bool)},
+	}
+}
+
+// eventKey identifies an event independently of its time_us, which isn't
+// unique: several events can share one. Commits are identified by repo
+// rev and record, identity and account events by their sequence number,
+// and labels by their labeler, subject, value, and creation time.
+func eventKey(msg *jetstream.Message) string {
+	switch {
+	case msg.Commit != nil:
+		c := msg.Commit
+		return msg.Did + "|" + c.Rev + "|" + c.Operation + "|" + c.Collection + "|" + c.Rkey
+	case msg.Identity != nil:
+		return msg.Did + "|identity|" + strconv.FormatInt(msg.Identity.Seq, 10)
+	case msg.Account != nil:
+		return msg.Did + "|account|" + strconv.FormatInt(msg.Account.Seq, 10)
+	case msg.Label != nil:
+		l := msg.Label
+		return l.Src + "|label|" + l.URI + "|" + l.Val + "|" + l.Cts + "|" + strconv.FormatBool(l.Neg)
+	}
+	return msg.Did + "|" + msg.Kind + "|" + strconv.FormatInt(msg.TimeUs, 10)
+}
+
+// dedupKeyFields are the commit fields -dedup-key can pick
+var dedupKeyFields = map[string]func(msg *jetstream.Message) string{
+	"did":        func(msg *jetstream.Message) string { return msg.Did },
+	"rev":        func(msg *jetstream.Message) string { return msg.Commit.Rev },
+	"op":         func(msg *jetstream.Message) string { return msg.Commit.Operation },
+	"collection": func(msg *jetstream.Message) string { return msg.Commit.Collection },
+	"rkey":       func(msg *jetstream.Message) string { return msg.Commit.Rkey },
+	"cid":        func(msg *jetstream.Message) string { return msg.Commit.Cid },
+}
+
+// parseDedupKey parses -dedup-key, a comma-separated list of commit
+// fields. The full key, eventKey's, is returned as nil.
+func parseDedupKey(value string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if _, ok := dedupKeyFields[field]; !ok {
+			return nil, fmt.Errorf("unknown field %q, expected did, rev, op, collection, rkey, or cid", field)
+		}
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	if full := []string{"did", "rev", "op", "collection", "rkey"}; slices.Equal(fields, full) {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// key identifies msg for deduplication. Commits are identified by the
+// -dedup-key fields, and other events as eventKey identifies them.
+func (d *deduper) key(msg *jetstream.Message) string {
+	if d.fields == nil || msg.Commit == nil {
+		return eventKey(msg)
+	}
+	var b strings.Builder
+	for i, field := range d.fields {
+		if i > 0 {
+			b.WriteByte('|')
+		}
+		b.WriteString(dedupKeyFields[field](msg))
+	}
+	return b.String()
+}
+
+// duplicate records msg and reports whether it was seen before
+func (d *deduper) duplicate(msg *jetstream.Message) bool {
+	key := d.key(msg)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	set := &d.events
+	if msg.Label != nil {
+		set = &d.labels
+	}
+	if set.seen[key] {
+		d.dropped++
+		return true
+	}
+	set.seen[key] = true
+	set.order = append(set.order, dedupEntry{key: key, timeUs: msg.TimeUs})
+	if msg.TimeUs > set.latest {
+		set.latest = msg.TimeUs
+	}
+
+	// events tied with the cutoff are kept, so a replay that starts exactly
+	// at the window edge is still caught
+	cutoff := set.latest - d.window
+	n := 0
+	for n < len(set.order) && (len(set.order)-n > d.max || set.order[n].timeUs < cutoff) {
+		delete(set.seen, set.order[n].key)
+		set.order[n] = dedupEntry{}
+		n++
+	}
+	if n > 0 {
+		set.order = set.order[n:]
+	}
+	return false
+}
+
+// logSummary logs how many duplicates were dropped
+func (d *deduper) logSummary() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	log.Info().
+		Uint64("dropped", d.dropped).
+		Int("tracked", len(d.events.order)+len(d.labels.order)).
+		Msg("dedup_summary")
+}
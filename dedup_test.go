@@ -0,0 +1,125 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// dedupCommit is a commit of record rkey at rev, op, and timeUs
+func dedupCommit(rev, op, rkey string, timeUs int64) *jetstream.Message {
+	return &jetstream.Message{Did: "did:plc:abc", TimeUs: timeUs, Kind: "commit", Commit: &jetstream.CommitEvent{
+		Rev: rev, Operation: op, Collection: "app.bsky.feed.post", Rkey: rkey, Cid: "bafy" + rev,
+	}}
+}
+
+func TestDeduper(t *testing.T) {
+	identity := &jetstream.Message{Did: "did:plc:abc", TimeUs: 100, Kind: "identity", Identity: &jetstream.IdentityEvent{Did: "did:plc:abc", Seq: 7}}
+	tests := []struct {
+		name   string
+		key    string
+		window int64
+		max    int
+		events []*jetstream.Message
+		want   []bool
+	}{
+		{
+			name: "replayed commit", window: 1000, max: 100,
+			events: []*jetstream.Message{dedupCommit("r1", "create", "1", 100), dedupCommit("r1", "create", "1", 100)},
+			want:   []bool{false, true},
+		},
+		{
+			name: "commits sharing a time_us", window: 1000, max: 100,
+			events: []*jetstream.Message{dedupCommit("r1", "create", "1", 100), dedupCommit("r1", "create", "2", 100)},
+			want:   []bool{false, false},
+		},
+		{
+			name: "edits are not duplicates by default", window: 1000, max: 100,
+			events: []*jetstream.Message{dedupCommit("r1", "update", "1", 100), dedupCommit("r2", "update", "1", 200)},
+			want:   []bool{false, false},
+		},
+		{
+			name: "edits without the rev", key: "did,op,collection,rkey", window: 1000, max: 100,
+			events: []*jetstream.Message{dedupCommit("r1", "create", "1", 100), dedupCommit("r2", "update", "1", 200), dedupCommit("r3", "update", "1", 300), dedupCommit("r4", "delete", "1", 400)},
+			want:   []bool{false, false, true, false},
+		},
+		{
+			name: "key doesn't apply to identity events", key: "did", window: 1000, max: 100,
+			events: []*jetstream.Message{dedupCommit("r1", "create", "1", 100), identity, identity},
+			want:   []bool{false, false, true},
+		},
+		{
+			name: "outside the window", window: 1000, max: 100,
+			events: []*jetstream.Message{dedupCommit("r1", "create", "1", 100), dedupCommit("r2", "create", "2", 2000), dedupCommit("r1", "create", "1", 100)},
+			want:   []bool{false, false, false},
+		},
+		{
+			name: "tied with the cutoff", window: 1000, max: 100,
+			events: []*jetstream.Message{dedupCommit("r1", "create", "1", 1000), dedupCommit("r2", "create", "2", 2000), dedupCommit("r1", "create", "1", 1000)},
+			want:   []bool{false, false, true},
+		},
+		{
+			name: "over the max", window: 1000, max: 1,
+			events: []*jetstream.Message{dedupCommit("r1", "create", "1", 100), dedupCommit("r2", "create", "2", 101), dedupCommit("r1", "create", "1", 100)},
+			want:   []bool{false, false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := tt.key
+			if key == "" {
+				key = *dedupKeyFlag
+			}
+			fields, err := parseDedupKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := newDeduper(tt.window, tt.max, fields)
+			var got []bool
+			for _, msg := range tt.events {
+				got = append(got, d.duplicate(msg))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("duplicates = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeduperTracksLabelsApart(t *testing.T) {
+	d := newDeduper(1000, 100, nil)
+	label := &jetstream.Message{Did: "did:plc:abc", TimeUs: 100, Kind: "label", Label: &jetstream.LabelEvent{Src: "did:plc:labeler", URI: "at://did:plc:abc", Val: "spam"}}
+	d.duplicate(label)
+	// a main stream far ahead doesn't move the labels' window
+	d.duplicate(dedupCommit("r1", "create", "1", 1_000_000))
+	if !d.duplicate(label) {
+		t.Error("replayed label wasn't dropped")
+	}
+}
+
+func TestParseDedupKey(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"did,rev,op,collection,rkey", nil, false},
+		{"did, collection, rkey", []string{"did", "collection", "rkey"}, false},
+		{"did,did,rkey", []string{"did", "rkey"}, false},
+		{"cid", []string{"cid"}, false},
+		{"did,time", nil, true},
+		{"", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseDedupKey(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
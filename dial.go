@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// dialOptions are how stream connections are made, from -header,
+// -user-agent, -proxy, and the -tls-* flags
+type dialOptions struct {
+	header http.Header
+	tls    *tls.Config
+	proxy  func(*http.Request) (*url.URL, error)
+}
+
+// dialing is set from the flags at startup
+var dialing dialOptions
+
+func newDialOptions() (dialOptions, error) {
+	var o dialOptions
+	for _, h := range headerFlags {
+		name, value, ok := strings.Cut(h, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return o, fmt.Errorf("-header %q: expected Name: value", h)
+		}
+		if o.header == nil {
+			o.header = http.Header{}
+		}
+		o.header.Add(name, strings.TrimSpace(value))
+	}
+	if *userAgentFlag != "" {
+		if o.header == nil {
+			o.header = http.Header{}
+		}
+		o.header.Set("User-Agent", *userAgentFlag)
+	}
+
+	if *proxyFlag != "" {
+		u, err := url.Parse(*proxyFlag)
+		if err != nil {
+			return o, fmt.Errorf("-proxy: %v", err)
+		}
+		switch u.Scheme {
+		case "http", "socks5":
+		default:
+			return o, fmt.Errorf("-proxy %q: expected an http:// or socks5:// url", u.Redacted())
+		}
+		o.proxy = http.ProxyURL(u)
+	}
+
+	if *tlsCAFileFlag == "" && *tlsCertFileFlag == "" && *tlsKeyFileFlag == "" && *tlsServerNameFlag == "" && !*tlsSkipVerifyFlag {
+		return o, nil
+	}
+	o.tls = &tls.Config{ServerName: *tlsServerNameFlag, InsecureSkipVerify: *tlsSkipVerifyFlag}
+	if *tlsCAFileFlag != "" {
+		pem, err := os.ReadFile(*tlsCAFileFlag)
+		if err != nil {
+			return o, fmt.Errorf("-tls-ca-file: %v", err)
+		}
+		// trusted alongside the system's roots, not instead of them
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return o, fmt.Errorf("-tls-ca-file: no PEM certificates in %s", *tlsCAFileFlag)
+		}
+		o.tls.RootCAs = pool
+	}
+	if *tlsCertFileFlag != "" || *tlsKeyFileFlag != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCertFileFlag, *tlsKeyFileFlag)
+		if err != nil {
+			return o, fmt.Errorf("-tls-cert-file and -tls-key-file: %v", err)
+		}
+		o.tls.Certificates = []tls.Certificate{cert}
+	}
+	if *tlsSkipVerifyFlag {
+		log.Warn().Msg("INSECURE: not verifying tls certificates because -tls-skip-verify is set")
+	}
+	return o, nil
+}
+
+// apply sets client to connect with o. Headers are only sent with
+// withHeader, since they are meant for the main stream's deployment, and
+// labelers are run by others.
+func (o dialOptions) apply(client *jetstream.Client, withHeader bool) {
+	if withHeader {
+		client.Header = o.header
+	}
+	client.TLSConfig = o.tls
+	client.Proxy = o.proxy
+}
+
+// redactHeaders hides -header values in run metadata, since they often
+// carry credentials, keeping the names
+func redactHeaders(headers []string) string {
+	redacted := make([]string, len(headers))
+	for i, h := range headers {
+		name, _, _ := strings.Cut(h, ":")
+		redacted[i] = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)) + ": [redacted]"
+	}
+	return strings.Join(redacted, ",")
+}
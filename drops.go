@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// dropCounter counts events lost unintentionally during the run, by reason.
+// Events skipped on purpose (filters, sampling, throttling) aren't drops.
+type dropCounter struct {
+	mu      sync.Mutex
+	reasons map[string]uint64
+}
+
+var drops = &dropCounter{reasons: map[string]uint64{}}
+
+func (d *dropCounter) add(reason string) {
+	d.mu.Lock()
+	d.reasons[reason]++
+	d.mu.Unlock()
+}
+
+func (d *dropCounter) total() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var n uint64
+	for _, count := range d.reasons {
+		n += count
+	}
+	return n
+}
+
+// logSummary logs the drop breakdown at level
+func (d *dropCounter) logSummary(level zerolog.Level) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	reasons := zerolog.Dict()
+	var total uint64
+	for reason, count := range d.reasons {
+		reasons.Uint64(reason, count)
+		total += count
+	}
+	log.WithLevel(level).
+		Uint64("total", total).
+		Dict("reasons", reasons).
+		Msg("drop_summary")
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// a bulk request the cluster pushes back on, with 429 or 503, or that
+	// doesn't reach it, is tried this many times, backing off from
+	// elasticRetryDelay, before its posts are dropped
+	elasticAttempts   = 6
+	elasticRetryDelay = time.Second
+	elasticTimeout    = time.Minute
+)
+
+// elasticMapping is the index created on startup if it doesn't exist:
+// text analyzed for full-text search, and the rest as keywords and dates
+// for filtering and sorting
+const elasticMapping = `{
+  "mappings": {
+    "properties": {
+      "uri": {"type": "keyword"},
+      "cid": {"type": "keyword"},
+      "did": {"type": "keyword"},
+      "handle": {"type": "keyword"},
+      "text": {"type": "text"},
+      "langs": {"type": "keyword"},
+      "tags": {"type": "keyword"},
+      "reply_root": {"type": "keyword"},
+      "reply_parent": {"type": "keyword"},
+      "created_at": {"type": "date", "ignore_malformed": true},
+      "time": {"type": "date"},
+      "time_us": {"type": "long"}
+    }
+  }
+}`
+
+// elasticPost is the document a post is indexed as, with its AT URI as the
+// document ID
+type elasticPost struct {
+	URI         string   `json:"uri"`
+	Cid         string   `json:"cid,omitempty"`
+	Did         string   `json:"did"`
+	Handle      string   `json:"handle,omitempty"`
+	Text        string   `json:"text"`
+	Langs       []string `json:"langs,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	ReplyRoot   string   `json:"reply_root,omitempty"`
+	ReplyParent string   `json:"reply_parent,omitempty"`
+	CreatedAt   string   `json:"created_at,omitempty"`
+	Time        string   `json:"time"`
+	TimeUs      int64    `json:"time_us"`
+}
+
+// elasticSink indexes posts into Elasticsearch or OpenSearch with the bulk
+// API, for searching post text by keyword. Creates and updates index the
+// post, replacing any earlier version, and deletes remove it. Other
+// events aren't indexed.
+type elasticSink struct {
+	*batchQueue
+	url    string
+	index  string
+	apiKey string
+	client *http.Client
+}
+
+func newElasticSink(url, index, apiKey string, queueSize, batchSize int, interval, idle time.Duration) (*elasticSink, error) {
+	s := &elasticSink{
+		url:    strings.TrimSuffix(url, "/"),
+		index:  index,
+		apiKey: apiKey,
+		client: &http.Client{Timeout: elasticTimeout},
+	}
+	if err := s.createIndex(); err != nil {
+		return nil, err
+	}
+	s.batchQueue = newBatchQueue("elasticsearch", queueSize, batchSize, interval, idle, s.write)
+	return s, nil
+}
+
+// request sends a request to the cluster, returning its status and body
+func (s *elasticSink) request(method, path, contentType string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequest(method, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+s.apiKey)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// createIndex creates the index with elasticMapping, leaving an existing
+// one as it is
+func (s *elasticSink) createIndex() error {
+	status, body, err := s.request(http.MethodPut, "/"+s.index, "application/json", []byte(elasticMapping))
+	switch {
+	case err != nil:
+		return err
+	case status == http.StatusOK:
+		log.Info().Str("index", s.index).Msg("created elasticsearch index")
+		return nil
+	case status == http.StatusBadRequest && bytes.Contains(body, []byte("resource_already_exists_exception")):
+		return nil
+	}
+	return fmt.Errorf("creating index %s: %d %s", s.index, status, body)
+}
+
+// publish queues post commits
+func (s *elasticSink) publish(msg *jetstream.Message) {
+	if msg.Commit != nil && msg.Commit.Collection == "app.bsky.feed.post" {
+		s.batchQueue.publish(msg)
+	}
+}
+
+// elasticAction is the action line of a bulk request
+type elasticAction struct {
+	Index  *elasticTarget `json:"index,omitempty"`
+	Delete *elasticTarget `json:"delete,omitempty"`
+}
+
+type elasticTarget struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id"`
+}
+
+// elasticBulkResponse is the part of a bulk response that says which
+// actions failed
+type elasticBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// write indexes batch in one bulk request, retrying the actions the
+// cluster pushes back on. It fails, for the circuit breaker, when the
+// cluster refuses the request or the retries run out.
+func (s *elasticSink) write(batch []*jetstream.Message) error {
+	var actions [][]byte
+	for _, msg := range batch {
+		action, err := s.action(msg)
+		if err != nil {
+			s.fail("invalid_record", err, 1)
+			continue
+		}
+		actions = append(actions, action)
+	}
+
+	delay := elasticRetryDelay
+	for attempt := 1; len(actions) > 0; attempt++ {
+		retry, err := s.bulk(actions)
+		if len(retry) == 0 {
+			return err
+		}
+		if attempt == elasticAttempts {
+			return &partialWriteError{err: err, lost: len(retry)}
+		}
+		log.Warn().Err(err).Int("posts", len(retry)).Int("attempt", attempt).Dur("retry_in", delay).Msg("elasticsearch pushed back, retrying")
+		time.Sleep(delay)
+		delay *= 2
+		actions = retry
+	}
+	return nil
+}
+
+// action encodes the bulk action for msg, with the document for creates
+// and updates
+func (s *elasticSink) action(msg *jetstream.Message) ([]byte, error) {
+	c := msg.Commit
+	target := &elasticTarget{Index: s.index, ID: atURI(msg.Did, c.Collection, c.Rkey)}
+	if c.Operation == "delete" {
+		line, err := json.Marshal(elasticAction{Delete: target})
+		return append(line, '\n'), err
+	}
+
+	var record jetstream.Post
+	if err := json.Unmarshal(c.Record, &record); err != nil {
+		return nil, err
+	}
+	doc := elasticPost{
+		URI:       target.ID,
+		Cid:       c.Cid,
+		Did:       msg.Did,
+		Text:      record.Text,
+		Langs:     record.Langs,
+		Tags:      record.Tags,
+		CreatedAt: record.CreatedAt,
+		Time:      time.UnixMicro(msg.TimeUs).UTC().Format(time.RFC3339Nano),
+		TimeUs:    msg.TimeUs,
+	}
+	for _, tag := range summarizeFacets(record.Text, record.Facets).hashtags {
+		if !slices.Contains(doc.Tags, tag) {
+			doc.Tags = append(doc.Tags, tag)
+		}
+	}
+	if record.Reply != nil {
+		if record.Reply.Root != nil {
+			doc.ReplyRoot = record.Reply.Root.URI
+		}
+		if record.Reply.Parent != nil {
+			doc.ReplyParent = record.Reply.Parent.URI
+		}
+	}
+	if handles != nil {
+		doc.Handle, _ = handles.lookup(msg.Did)
+	}
+
+	line, err := json.Marshal(elasticAction{Index: target})
+	if err != nil {
+		return nil, err
+	}
+	docLine, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(append(line, '\n'), docLine...), '\n'), nil
+}
+
+// bulk sends actions in one request, returning those to retry: all of
+// them if the request failed or was pushed back, or else the ones that
+// were. A request refused for other reasons loses all its actions, and
+// single actions rejected are dropped and counted.
+func (s *elasticSink) bulk(actions [][]byte) ([][]byte, error) {
+	status, body, err := s.request(http.MethodPost, "/_bulk", "application/x-ndjson", bytes.Join(actions, nil))
+	if err != nil {
+		return actions, err
+	}
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		return actions, fmt.Errorf("status %d", status)
+	}
+	if status != http.StatusOK {
+		return nil, &partialWriteError{err: fmt.Errorf("status %d: %s", status, body), lost: len(actions)}
+	}
+
+	var resp elasticBulkResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return actions, err
+	}
+	if !resp.Errors {
+		return nil, nil
+	}
+	var retry [][]byte
+	for i, item := range resp.Items {
+		for _, result := range item {
+			switch {
+			case result.Status == http.StatusTooManyRequests && i < len(actions):
+				retry = append(retry, actions[i])
+			case result.Status == http.StatusNotFound && len(result.Error) == 0:
+				// deleting a post that was never indexed
+			case result.Status >= 300:
+				s.fail("rejected", fmt.Errorf("status %d: %s", result.Status, result.Error), 1)
+			}
+		}
+	}
+	if len(retry) > 0 {
+		return retry, fmt.Errorf("%d posts rejected with status 429", len(retry))
+	}
+	return nil, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// elasticResponse is how elasticServer answers a bulk request
+type elasticResponse struct {
+	status int
+	body   string
+}
+
+// elasticServer is a cluster with the index, answering each bulk request
+// with the next response, then indexing everything, and keeping the
+// actions it accepted
+type elasticServer struct {
+	responses []elasticResponse
+
+	mu      sync.Mutex
+	actions []string
+}
+
+func (e *elasticServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"type":"resource_already_exists_exception"}}`))
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.responses) > 0 {
+		response := e.responses[0]
+		e.responses = e.responses[1:]
+		w.WriteHeader(response.status)
+		w.Write([]byte(response.body))
+		return
+	}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, `{"index"`) || strings.HasPrefix(line, `{"delete"`) {
+			e.actions = append(e.actions, line)
+		}
+	}
+	w.Write([]byte(`{"errors":false,"items":[]}`))
+}
+
+func TestElasticSinkWrite(t *testing.T) {
+	isolateBreakers(t)
+	tests := []struct {
+		name      string
+		responses []elasticResponse
+		// lost is how many posts the write reports lost, 0 for none
+		lost    int
+		actions int
+	}{
+		{"indexed", nil, 0, 2},
+		{"pushed back posts retried", []elasticResponse{{http.StatusOK, `{"errors":true,"items":[{"index":{"status":429}},{"delete":{"status":200}}]}`}}, 0, 1},
+		{"deleted post that was never indexed", []elasticResponse{{http.StatusOK, `{"errors":true,"items":[{"index":{"status":201}},{"delete":{"status":404}}]}`}}, 0, 0},
+		{"request refused", []elasticResponse{{http.StatusUnauthorized, `{"error":"missing credentials"}`}}, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &elasticServer{responses: tt.responses}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+			s, err := newElasticSink(ts.URL, "posts", "", 10, 10, time.Hour, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.close()
+
+			err = s.write([]*jetstream.Message{parseFrame(t, postFrame), parseFrame(t, deleteFrame)})
+			var partial *partialWriteError
+			switch {
+			case tt.lost == 0 && err != nil:
+				t.Fatalf("write failed: %v", err)
+			case tt.lost > 0 && !errors.As(err, &partial):
+				t.Fatalf("write returned %v, want a partialWriteError for the circuit breaker", err)
+			case tt.lost > 0 && partial.lost != tt.lost:
+				t.Fatalf("write lost %d posts, want %d", partial.lost, tt.lost)
+			}
+			if len(server.actions) != tt.actions {
+				t.Fatalf("cluster accepted actions %v, want %d", server.actions, tt.actions)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// postFields are the fields defined by the app.bsky.feed.post lexicon
+var postFields = map[string]bool{
+	"$type": true, "text": true, "entities": true, "facets": true,
+	"reply": true, "embed": true, "langs": true, "labels": true,
+	"tags": true, "createdAt": true,
+}
+
+// postExtensions returns the top-level fields of a post record that aren't
+// part of the lexicon, which clients sometimes add, sorted by name. If one
+// of them is a string "via" field it is returned as the authoring client
+// hint.
+func postExtensions(raw json.RawMessage) (extensions []string, via string) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, ""
+	}
+	for name := range fields {
+		if !postFields[name] {
+			extensions = append(extensions, name)
+		}
+	}
+	if len(extensions) == 0 {
+		return nil, ""
+	}
+	sort.Strings(extensions)
+	if v, ok := fields["via"]; ok {
+		json.Unmarshal(v, &via)
+	}
+	return extensions, via
+}
+
+// embedKinds are the short labels logged as embed_type for each embed
+// $type
+var embedKinds = map[string]string{
+	"app.bsky.embed.images":          "images",
+	"app.bsky.embed.video":           "video",
+	"app.bsky.embed.external":        "external",
+	"app.bsky.embed.record":          "record",
+	"app.bsky.embed.recordWithMedia": "record_with_media",
+}
+
+// embedSummary is the concise form of a post embed that gets logged in
+// place of the full embed object
+type embedSummary struct {
+	kind string
+
+	images    int
+	imageCIDs []string
+	// imageAlts has an entry per image, empty where it has no alt text
+	imageAlts []string
+
+	videoCID string
+	videoAlt string
+
+	externalURL      string
+	externalTitle    string
+	externalHasThumb bool
+
+	quoteURI      string
+	quoteCid      string
+	quoteDetached *bool
+}
+
+// summarizeEmbed describes a post embed by its $type. Kinds without a short
+// label are reported by their full $type, and kind is empty when the post
+// has no embed. The media of a recordWithMedia embed is summarized
+// alongside its quote.
+func summarizeEmbed(raw any) embedSummary {
+	embed, err := jetstream.DecodeEmbed(raw)
+	if err != nil {
+		// a malformed embed still has a type worth reporting
+		m, _ := raw.(map[string]any)
+		t, _ := m["$type"].(string)
+		embed = &jetstream.Embed{Type: t}
+	}
+	if embed == nil || embed.Type == "" {
+		return embedSummary{}
+	}
+
+	s := embedSummary{kind: embed.Type}
+	if kind, ok := embedKinds[embed.Type]; ok {
+		s.kind = kind
+	}
+	if embed.Record != nil {
+		s.quoteURI, s.quoteCid, s.quoteDetached = embed.Record.URI, embed.Record.Cid, embed.Record.Detached
+	}
+	media := embed
+	if embed.Type == "app.bsky.embed.recordWithMedia" && embed.Media != nil {
+		media = embed.Media
+	}
+	switch media.Type {
+	case "app.bsky.embed.images":
+		s.images = len(media.Images)
+		for _, img := range media.Images {
+			if img.Image != nil && img.Image.Link() != "" {
+				s.imageCIDs = append(s.imageCIDs, img.Image.Link())
+			}
+			s.imageAlts = append(s.imageAlts, img.Alt)
+		}
+	case "app.bsky.embed.video":
+		if media.Video != nil {
+			s.videoCID = media.Video.Link()
+		}
+		s.videoAlt = media.Alt
+	case "app.bsky.embed.external":
+		if media.External != nil {
+			s.externalURL = media.External.URI
+			s.externalTitle = media.External.Title
+			s.externalHasThumb = media.External.Thumb != nil
+		}
+	}
+	return s
+}
+
+// hasAltText reports whether any image has alt text
+func (s embedSummary) hasAltText() bool {
+	for _, alt := range s.imageAlts {
+		if alt != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// cdnImageURL builds the public CDN URL for an image blob. This follows the
+// URL scheme the Bluesky CDN uses today and is best-effort: the CDN may not
+// serve every blob, and the scheme isn't part of the protocol.
+func cdnImageURL(base, did, cid string) string {
+	return strings.TrimSuffix(base, "/") + "/" + did + "/" + cid + "@jpeg"
+}
+
+// cdnVideoURLs builds the HLS playlist and thumbnail URLs the Bluesky video
+// CDN serves for a video blob. Like cdnImageURL it is best-effort, and
+// only covers videos the CDN has finished processing.
+func cdnVideoURLs(base, did, cid string) (playlist, thumbnail string) {
+	prefix := strings.TrimSuffix(base, "/") + "/" + url.QueryEscape(did) + "/" + cid
+	return prefix + "/playlist.m3u8", prefix + "/thumbnail.jpg"
+}
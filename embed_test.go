@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog"
+)
+
+func TestSummarizeEmbedMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		embed string
+		kind  string
+	}{
+		{"string", `"app.bsky.embed.images"`, ""},
+		{"array", `[{"$type": "app.bsky.embed.images"}]`, ""},
+		{"null", `null`, ""},
+		{"number", `42`, ""},
+		{"images with bad fields", `{"$type": "app.bsky.embed.images", "images": "nope"}`, "images"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw any
+			if err := json.Unmarshal([]byte(tt.embed), &raw); err != nil {
+				t.Fatal(err)
+			}
+			if got := summarizeEmbed(raw).kind; got != tt.kind {
+				t.Errorf("kind = %q, want %q", got, tt.kind)
+			}
+		})
+	}
+}
+
+func TestSummarizeEmbedImages(t *testing.T) {
+	var raw any
+	json.Unmarshal([]byte(`{"$type": "app.bsky.embed.images", "images": [
+		{"alt": "a cat", "image": {"$type": "blob", "ref": {"$link": "bafkreicat"}, "mimeType": "image/jpeg", "size": 10}},
+		{"alt": "", "image": {"$type": "blob", "ref": {"$link": "bafkreidog"}, "mimeType": "image/jpeg", "size": 10}}
+	]}`), &raw)
+	s := summarizeEmbed(raw)
+	if s.kind != "images" || s.images != 2 {
+		t.Fatalf("got kind %q with %d images, want images with 2", s.kind, s.images)
+	}
+	if len(s.imageCIDs) != 2 || s.imageCIDs[0] != "bafkreicat" || s.imageCIDs[1] != "bafkreidog" {
+		t.Errorf("imageCIDs = %v", s.imageCIDs)
+	}
+	if !s.hasAltText() {
+		t.Error("hasAltText = false, want true")
+	}
+}
+
+func TestCDNVideoURLs(t *testing.T) {
+	playlist, thumbnail := cdnVideoURLs("https://video.bsky.app/watch/", "did:plc:abc", "bafkreivideo")
+	if want := "https://video.bsky.app/watch/did%3Aplc%3Aabc/bafkreivideo/playlist.m3u8"; playlist != want {
+		t.Errorf("playlist = %q, want %q", playlist, want)
+	}
+	if want := "https://video.bsky.app/watch/did%3Aplc%3Aabc/bafkreivideo/thumbnail.jpg"; thumbnail != want {
+		t.Errorf("thumbnail = %q, want %q", thumbnail, want)
+	}
+}
+
+func TestLogPostVideoURLs(t *testing.T) {
+	defer func(enabled bool) { *cdnURLsFlag = enabled }(*cdnURLsFlag)
+	*cdnURLsFlag = true
+
+	// a video quoting another post, so the media sits under recordWithMedia
+	record := `{"$type": "app.bsky.feed.post", "text": "look", "createdAt": "2024-01-01T00:00:00Z", "embed": {
+		"$type": "app.bsky.embed.recordWithMedia",
+		"record": {"$type": "app.bsky.embed.record", "record": {"uri": "at://did:plc:other/app.bsky.feed.post/1", "cid": "bafyquoted"}},
+		"media": {"$type": "app.bsky.embed.video", "video": {"$type": "blob", "ref": {"$link": "bafkreivideo"}, "mimeType": "video/mp4", "size": 10}}
+	}}`
+	msg := &jetstream.Message{Did: "did:plc:abc", Kind: "commit", Commit: &jetstream.CommitEvent{
+		Operation: "create", Collection: "app.bsky.feed.post", Rkey: "1", Record: json.RawMessage(record),
+	}}
+	var buf bytes.Buffer
+	logPost(zerolog.New(&buf), msg)
+
+	var logged map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &logged); err != nil {
+		t.Fatalf("%v: %s", err, buf.Bytes())
+	}
+	if got, want := logged["video_url"], "https://video.bsky.app/watch/did%3Aplc%3Aabc/bafkreivideo/playlist.m3u8"; got != want {
+		t.Errorf("video_url = %v, want %s", got, want)
+	}
+	if got, want := logged["video_thumbnail_url"], "https://video.bsky.app/watch/did%3Aplc%3Aabc/bafkreivideo/thumbnail.jpg"; got != want {
+		t.Errorf("video_thumbnail_url = %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// how long one lookup attempt may take, including reading the response
+	enrichTimeout = 10 * time.Second
+	// a lookup the server rate limits is retried this many times, waiting
+	// as long as the server asks, but at most enrichMaxWait, or
+	// enrichRetryDelay if it doesn't say
+	enrichAttempts   = 3
+	enrichMaxWait    = time.Minute
+	enrichRetryDelay = time.Second
+)
+
+// enrichTransport is the http.RoundTripper the identity and AppView lookups
+// share: handle and signing key resolution, -reply-context, -follows-of,
+// and handles passed to -did. It holds the requests in flight under
+// -enrich-concurrency, reuses connections between them, and once a host
+// answers 429, or says its rate limit is used up, holds back every request
+// to it until the limit resets.
+type enrichTransport struct {
+	base  http.RoundTripper
+	slots chan struct{}
+	// requests waiting for a slot
+	waiting atomic.Int64
+
+	mu sync.Mutex
+	// hosts rate limited until the time they gave
+	blocked map[string]time.Time
+}
+
+// enrichment limits lookups made with enrichClient
+var enrichment = newEnrichTransport(16)
+
+// enrichClient is the HTTP client lookups are made with. Its timeout is
+// enrichTimeout per attempt, applied by enrichment.
+var enrichClient = &http.Client{Transport: enrichment}
+
+func newEnrichTransport(concurrency int) *enrichTransport {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	// lookups go to a handful of hosts, mostly plc.directory and the
+	// AppView, so keep enough idle connections to each for every slot
+	base.MaxIdleConnsPerHost = concurrency
+	return &enrichTransport{
+		base:    base,
+		slots:   make(chan struct{}, concurrency),
+		blocked: map[string]time.Time{},
+	}
+}
+
+// setConcurrency resizes the limit on requests in flight. It must be
+// called before any lookup is made.
+func (t *enrichTransport) setConcurrency(n int) {
+	t.slots = make(chan struct{}, n)
+	t.base.(*http.Transport).MaxIdleConnsPerHost = n
+}
+
+func (t *enrichTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if err := t.waitForHost(req.Context(), req.URL.Host); err != nil {
+			return nil, err
+		}
+		release, err := t.acquire(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), enrichTimeout)
+		resp, err := t.base.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			cancel()
+			release()
+			return nil, err
+		}
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() {
+			cancel()
+			release()
+		}}
+
+		until, limited := rateLimitedUntil(resp, time.Now())
+		if !until.IsZero() {
+			t.block(req.URL.Host, until)
+		}
+		if !limited || attempt == enrichAttempts || (req.Body != nil && req.Body != http.NoBody) {
+			return resp, nil
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		enrichRateLimited.Inc()
+		log.Debug().
+			Str("host", req.URL.Host).
+			Int("status", resp.StatusCode).
+			Int("attempt", attempt).
+			Time("until", until).
+			Msg("lookup rate limited, retrying")
+	}
+}
+
+// acquire waits for a slot, returning the func that gives it back
+func (t *enrichTransport) acquire(ctx context.Context) (func(), error) {
+	t.waiting.Add(1)
+	defer t.waiting.Add(-1)
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-t.slots }) }, nil
+}
+
+// waitForHost waits until host's rate limit has reset
+func (t *enrichTransport) waitForHost(ctx context.Context, host string) error {
+	t.mu.Lock()
+	until := t.blocked[host]
+	if !until.IsZero() && !time.Now().Before(until) {
+		delete(t.blocked, host)
+	}
+	t.mu.Unlock()
+	wait := time.Until(until)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// block holds back requests to host until until
+func (t *enrichTransport) block(host string, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until.After(t.blocked[host]) {
+		t.blocked[host] = until
+	}
+}
+
+// rateLimitedUntil reads when resp says its host's rate limit resets, from
+// Retry-After, or the RateLimit-Reset atproto services send once
+// RateLimit-Remaining runs out, capped at enrichMaxWait. It reports
+// whether resp itself was refused for the limit, a 429, or a 503 with
+// Retry-After. A zero time means the host isn't limited.
+func rateLimitedUntil(resp *http.Response, now time.Time) (time.Time, bool) {
+	retryAfter := resp.Header.Get("Retry-After")
+	limited := resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode == http.StatusServiceUnavailable && retryAfter != "")
+	var until time.Time
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		until = now.Add(time.Duration(seconds) * time.Second)
+	} else if at, err := http.ParseTime(retryAfter); err == nil {
+		until = at
+	} else if resp.Header.Get("RateLimit-Remaining") == "0" || limited {
+		if reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+			until = time.Unix(reset, 0)
+		}
+	}
+	if limited && !until.After(now) {
+		until = now.Add(enrichRetryDelay)
+	}
+	if until.After(now.Add(enrichMaxWait)) {
+		until = now.Add(enrichMaxWait)
+	}
+	if !until.After(now) {
+		return time.Time{}, limited
+	}
+	return until, limited
+}
+
+// releasingBody gives back a request's slot once its response is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedUntil(t *testing.T) {
+	now := time.Date(2024, 9, 9, 19, 46, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		status  int
+		headers map[string]string
+		until   time.Time
+		limited bool
+	}{
+		{"ok", http.StatusOK, nil, time.Time{}, false},
+		{"limit left", http.StatusOK, map[string]string{"RateLimit-Remaining": "12", "RateLimit-Reset": strconv.FormatInt(now.Add(time.Minute).Unix(), 10)}, time.Time{}, false},
+		{"limit used up", http.StatusOK, map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": strconv.FormatInt(now.Add(30*time.Second).Unix(), 10)}, now.Add(30 * time.Second), false},
+		{"refused with reset", http.StatusTooManyRequests, map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": strconv.FormatInt(now.Add(5*time.Second).Unix(), 10)}, now.Add(5 * time.Second), true},
+		{"retry after seconds", http.StatusTooManyRequests, map[string]string{"Retry-After": "7"}, now.Add(7 * time.Second), true},
+		{"retry after date", http.StatusServiceUnavailable, map[string]string{"Retry-After": now.Add(20 * time.Second).Format(http.TimeFormat)}, now.Add(20 * time.Second), true},
+		{"refused without a hint", http.StatusTooManyRequests, nil, now.Add(enrichRetryDelay), true},
+		{"capped", http.StatusTooManyRequests, map[string]string{"Retry-After": "86400"}, now.Add(enrichMaxWait), true},
+		{"unavailable", http.StatusServiceUnavailable, nil, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			for k, v := range tt.headers {
+				resp.Header.Set(k, v)
+			}
+			until, limited := rateLimitedUntil(resp, now)
+			if !until.Equal(tt.until) || limited != tt.limited {
+				t.Fatalf("rateLimitedUntil = %v, %v, want %v, %v", until, limited, tt.until, tt.limited)
+			}
+		})
+	}
+}
+
+func TestEnrichTransportHoldsConcurrency(t *testing.T) {
+	var inFlight, most atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	client := &http.Client{Transport: newEnrichTransport(2)}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(ts.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if n := most.Load(); n != 2 {
+		t.Fatalf("%d requests at once, want 2", n)
+	}
+}
+
+func TestEnrichTransportWaitsOutRateLimits(t *testing.T) {
+	var requests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	client := &http.Client{Transport: newEnrichTransport(2)}
+
+	start := time.Now()
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || requests.Load() != 2 {
+		t.Fatalf("got %s after %d requests, want the retry to succeed", resp.Status, requests.Load())
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Fatalf("retried after %v, before the server's Retry-After", waited)
+	}
+}
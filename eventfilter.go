@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	validKinds = map[string]bool{"commit": true, "identity": true, "account": true, "label": true}
+	validOps   = map[string]bool{"create": true, "update": true, "delete": true}
+)
+
+// eventFilter keeps only the event kinds given with -kind and the commit
+// operations given with -op. An empty set lets everything through, and ops
+// only apply to commits, so -op create alone still passes identity and
+// account events.
+type eventFilter struct {
+	kinds map[string]bool
+	ops   map[string]bool
+
+	// events skipped, only touched from the handling goroutine
+	skipped map[string]uint64
+}
+
+// eventFilters is nil unless -kind or -op is set
+var eventFilters *eventFilter
+
+func newEventFilter(kinds, ops []string) (*eventFilter, error) {
+	f := &eventFilter{kinds: map[string]bool{}, ops: map[string]bool{}, skipped: map[string]uint64{}}
+	for _, kind := range kinds {
+		if !validKinds[kind] {
+			return nil, fmt.Errorf("unknown kind %q, expected commit, identity, account, or label", kind)
+		}
+		f.kinds[kind] = true
+	}
+	for _, op := range ops {
+		if !validOps[op] {
+			return nil, fmt.Errorf("unknown op %q, expected create, update, or delete", op)
+		}
+		f.ops[op] = true
+	}
+	return f, nil
+}
+
+// allows reports whether msg passes the filter, counting it if not
+func (f *eventFilter) allows(msg *jetstream.Message) bool {
+	if len(f.kinds) > 0 && !f.kinds[msg.Kind] {
+		f.skipped[msg.Kind]++
+		return false
+	}
+	if len(f.ops) > 0 && msg.Commit != nil && !f.ops[msg.Commit.Operation] {
+		f.skipped[msg.Kind+"/"+msg.Commit.Operation]++
+		return false
+	}
+	return true
+}
+
+// logSummary logs how many events were skipped, by kind and by commit
+// operation
+func (f *eventFilter) logSummary() {
+	var total uint64
+	for _, n := range f.skipped {
+		total += n
+	}
+	if total == 0 {
+		return
+	}
+	event := log.Info().Uint64("skipped", total)
+	for key, n := range f.skipped {
+		event = event.Uint64(key, n)
+	}
+	event.Msg("event_filter_summary")
+}
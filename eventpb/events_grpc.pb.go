@@ -0,0 +1,133 @@
+// The event stream served by -grpc-addr, for consumers that would rather
+// speak gRPC than Jetstream's JSON over websockets. Events mirror
+// Jetstream's messages, with the record left as JSON since lexicons are
+// open-ended.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: events.proto
+
+package eventpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	EventStream_Subscribe_FullMethodName = "/atproto_logger.v1.EventStream/Subscribe"
+)
+
+// EventStreamClient is the client API for EventStream service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type EventStreamClient interface {
+	// Subscribe streams live events from when it is called, narrowed by the
+	// request's filters, until the client cancels or falls too far behind.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error)
+}
+
+type eventStreamClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewEventStreamClient(cc grpc.ClientConnInterface) EventStreamClient {
+	return &eventStreamClient{cc}
+}
+
+func (c *eventStreamClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &EventStream_ServiceDesc.Streams[0], EventStream_Subscribe_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SubscribeRequest, Event]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type EventStream_SubscribeClient = grpc.ServerStreamingClient[Event]
+
+// EventStreamServer is the server API for EventStream service.
+// All implementations must embed UnimplementedEventStreamServer
+// for forward compatibility.
+type EventStreamServer interface {
+	// Subscribe streams live events from when it is called, narrowed by the
+	// request's filters, until the client cancels or falls too far behind.
+	Subscribe(*SubscribeRequest, grpc.ServerStreamingServer[Event]) error
+	mustEmbedUnimplementedEventStreamServer()
+}
+
+// UnimplementedEventStreamServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedEventStreamServer struct{}
+
+func (UnimplementedEventStreamServer) Subscribe(*SubscribeRequest, grpc.ServerStreamingServer[Event]) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedEventStreamServer) mustEmbedUnimplementedEventStreamServer() {}
+func (UnimplementedEventStreamServer) testEmbeddedByValue()                     {}
+
+// UnsafeEventStreamServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to EventStreamServer will
+// result in compilation errors.
+type UnsafeEventStreamServer interface {
+	mustEmbedUnimplementedEventStreamServer()
+}
+
+func RegisterEventStreamServer(s grpc.ServiceRegistrar, srv EventStreamServer) {
+	// If the following call pancis, it indicates UnimplementedEventStreamServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&EventStream_ServiceDesc, srv)
+}
+
+func _EventStream_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EventStreamServer).Subscribe(m, &grpc.GenericServerStream[SubscribeRequest, Event]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type EventStream_SubscribeServer = grpc.ServerStreamingServer[Event]
+
+// EventStream_ServiceDesc is the grpc.ServiceDesc for EventStream service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var EventStream_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "atproto_logger.v1.EventStream",
+	HandlerType: (*EventStreamServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _EventStream_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "events.proto",
+}
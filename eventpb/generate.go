@@ -0,0 +1,5 @@
+// Package eventpb holds the protobuf schema and gRPC service of the event
+// stream -grpc-addr serves, and the Go code generated from them.
+package eventpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative events.proto
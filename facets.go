@@ -0,0 +1,46 @@
+package main
+
+import "github.com/dickeyy/atproto-logger/jetstream"
+
+// facetSummary is what a post's facets resolve to: the DIDs mentioned, the
+// link URIs, and the hashtags, in the order the record lists them
+type facetSummary struct {
+	mentions []string
+	links    []string
+	hashtags []string
+
+	// facets whose byte range doesn't fit the text, which are skipped
+	invalid int
+}
+
+// summarizeFacets resolves the facets of a post with the given text.
+// Facets are only trusted where their byte range lands on character
+// boundaries inside text; anything else was computed against different
+// text or in the wrong units, so its features may not belong to the span
+// they claim.
+func summarizeFacets(text string, facets []jetstream.Facet) facetSummary {
+	var s facetSummary
+	for i := range facets {
+		if _, ok := facets[i].Span(text); !ok {
+			s.invalid++
+			continue
+		}
+		for _, feature := range facets[i].Features {
+			switch feature.Type {
+			case "app.bsky.richtext.facet#mention":
+				if feature.Did != "" {
+					s.mentions = append(s.mentions, feature.Did)
+				}
+			case "app.bsky.richtext.facet#link":
+				if feature.URI != "" {
+					s.links = append(s.links, feature.URI)
+				}
+			case "app.bsky.richtext.facet#tag":
+				if feature.Tag != "" {
+					s.hashtags = append(s.hashtags, feature.Tag)
+				}
+			}
+		}
+	}
+	return s
+}
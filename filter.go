@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// filterExpr is a parsed -filter expression. Terms are field:value pairs,
+// combined with AND, OR, NOT, and parentheses; terms side by side are
+// ANDed, and AND binds tighter than OR:
+//
+//	lang:en (text:golang OR regex:"\bgo(lang)?\b") NOT did:@blocked.txt
+//
+// text, regex, lang, mention, tag, and link look at posts, so they never
+// match other events, active only matches account events, and valid only
+// matches records -validate-records has a lexicon for.
+type filterExpr interface {
+	match(e *filterEvent) bool
+}
+
+type (
+	filterAnd []filterExpr
+	filterOr  []filterExpr
+	filterNot struct{ expr filterExpr }
+	// filterTerm is one field:value test, built by newFilterTerm
+	filterTerm func(e *filterEvent) bool
+)
+
+func (f filterAnd) match(e *filterEvent) bool {
+	for _, expr := range f {
+		if !expr.match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f filterOr) match(e *filterEvent) bool {
+	for _, expr := range f {
+		if expr.match(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f filterNot) match(e *filterEvent) bool  { return !f.expr.match(e) }
+func (f filterTerm) match(e *filterEvent) bool { return f(e) }
+
+// filterEvent is the event a filter is matched against. The post record
+// is only decoded when a term needs it, and then only once.
+type filterEvent struct {
+	msg     *jetstream.Message
+	decoded bool
+	post    *jetstream.Post
+	// the post's facets, once summarized
+	facets *facetSummary
+	// any commit's record as plain JSON values, for -cel, once decoded
+	recordDecoded bool
+	record        any
+}
+
+func (e *filterEvent) postRecord() *jetstream.Post {
+	if !e.decoded {
+		e.decoded = true
+		c := e.msg.Commit
+		if c != nil && c.Collection == "app.bsky.feed.post" && len(c.Record) > 0 {
+			var record jetstream.Post
+			if json.Unmarshal(c.Record, &record) == nil {
+				e.post = &record
+			}
+		}
+	}
+	return e.post
+}
+
+// postFacets returns the post's facets, or nil for events other than posts
+func (e *filterEvent) postFacets() *facetSummary {
+	if e.facets == nil {
+		post := e.postRecord()
+		if post == nil {
+			return nil
+		}
+		facets := summarizeFacets(post.Text, post.Facets)
+		e.facets = &facets
+	}
+	return e.facets
+}
+
+// filterFields are the fields a term can test
+const filterFields = "text, regex, lang, mention, tag, link, did, collection, kind, op, active, status, or valid"
+
+func newFilterTerm(field, value string) (filterTerm, error) {
+	switch field {
+	case "text":
+		value = strings.ToLower(value)
+		return func(e *filterEvent) bool {
+			post := e.postRecord()
+			return post != nil && strings.Contains(strings.ToLower(post.Text), value)
+		}, nil
+	case "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(e *filterEvent) bool {
+			post := e.postRecord()
+			return post != nil && re.MatchString(post.Text)
+		}, nil
+	case "lang":
+		// lang:en matches en-US and en-GB too
+		return func(e *filterEvent) bool {
+			post := e.postRecord()
+			if post == nil {
+				return false
+			}
+			for _, lang := range post.Langs {
+				if strings.EqualFold(lang, value) || strings.HasPrefix(strings.ToLower(lang), strings.ToLower(value)+"-") {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "mention":
+		// a DID matches the post's mention facets, and a handle also
+		// matches "@handle" in its text, since facets only carry DIDs
+		if strings.HasPrefix(value, "did:") {
+			return func(e *filterEvent) bool {
+				facets := e.postFacets()
+				return facets != nil && slices.Contains(facets.mentions, value)
+			}, nil
+		}
+		handle := strings.ToLower(strings.TrimPrefix(value, "@"))
+		return func(e *filterEvent) bool {
+			post := e.postRecord()
+			if post == nil {
+				return false
+			}
+			if strings.Contains(strings.ToLower(post.Text), "@"+handle) {
+				return true
+			}
+			if handles == nil {
+				return false
+			}
+			for _, did := range e.postFacets().mentions {
+				if h, ok := handles.lookup(did); ok && strings.EqualFold(h, handle) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "tag":
+		// hashtag facets and the record's own tags, with or without the #
+		tag := strings.TrimPrefix(value, "#")
+		return func(e *filterEvent) bool {
+			facets := e.postFacets()
+			if facets == nil {
+				return false
+			}
+			for _, t := range slices.Concat(facets.hashtags, e.post.Tags) {
+				if strings.EqualFold(strings.TrimPrefix(t, "#"), tag) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "link":
+		value = strings.ToLower(value)
+		return func(e *filterEvent) bool {
+			facets := e.postFacets()
+			if facets == nil {
+				return false
+			}
+			for _, link := range facets.links {
+				if strings.Contains(strings.ToLower(link), value) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "did":
+		if path, ok := strings.CutPrefix(value, "@"); ok {
+			dids, err := readDidList(path)
+			if err != nil {
+				return nil, err
+			}
+			return func(e *filterEvent) bool { return dids[e.msg.Did] }, nil
+		}
+		return func(e *filterEvent) bool { return e.msg.Did == value }, nil
+	case "collection":
+		prefix, wildcard := strings.CutSuffix(value, "*")
+		return func(e *filterEvent) bool {
+			if e.msg.Commit == nil {
+				return false
+			}
+			if wildcard {
+				return strings.HasPrefix(e.msg.Commit.Collection, prefix)
+			}
+			return e.msg.Commit.Collection == value
+		}, nil
+	case "kind":
+		if !validKinds[value] {
+			return nil, fmt.Errorf("unknown kind %q, expected commit, identity, account, or label", value)
+		}
+		return func(e *filterEvent) bool { return e.msg.Kind == value }, nil
+	case "op":
+		if !validOps[value] {
+			return nil, fmt.Errorf("unknown op %q, expected create, update, or delete", value)
+		}
+		return func(e *filterEvent) bool { return e.msg.Commit != nil && e.msg.Commit.Operation == value }, nil
+	case "active":
+		active, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid active %q, expected true or false", value)
+		}
+		return func(e *filterEvent) bool { return e.msg.Account != nil && e.msg.Account.Active == active }, nil
+	case "status":
+		return func(e *filterEvent) bool { return e.msg.Account != nil && e.msg.Account.State() == value }, nil
+	case "valid":
+		valid, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid valid %q, expected true or false", value)
+		}
+		if validator == nil {
+			return nil, fmt.Errorf("valid needs -validate-records")
+		}
+		return func(e *filterEvent) bool {
+			if !validator.checks(e.msg) {
+				return false
+			}
+			return (validator.check(e.msg) == "") == valid
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown filter field %q, expected %s", field, filterFields)
+}
+
+// readDidList reads a file of DIDs, one per line, ignoring blank lines and
+// # comments
+func readDidList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dids := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			dids[line] = true
+		}
+	}
+	return dids, scanner.Err()
+}
+
+// parseFilter parses a -filter expression
+func parseFilter(s string) (filterExpr, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+// tokenizeFilter splits s into parentheses, operators, and terms. A term's
+// value can be double-quoted to include spaces or parentheses, with \"
+// for a quote inside it.
+func tokenizeFilter(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch r, size := utf8.DecodeRuneInString(s[i:]); {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '(' || r == ')':
+			tokens = append(tokens, string(r))
+			i++
+		default:
+			start := i
+			for i < len(s) {
+				r, size := utf8.DecodeRuneInString(s[i:])
+				if unicode.IsSpace(r) || r == '(' || r == ')' {
+					break
+				}
+				if r == '"' {
+					end, err := quotedEnd(s, i)
+					if err != nil {
+						return nil, err
+					}
+					i = end
+					continue
+				}
+				i += size
+			}
+			tokens = append(tokens, s[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+// quotedEnd returns the index just past the quoted string starting at i
+func quotedEnd(s string, i int) (int, error) {
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			if j+1 < len(s) && s[j+1] == '"' {
+				j++
+			}
+		case '"':
+			return j + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated quote in %q", s[i:])
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) operator(name string) bool {
+	if strings.EqualFold(p.peek(), name) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) or() (filterExpr, error) {
+	var terms filterOr
+	for {
+		expr, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, expr)
+		if !p.operator("OR") {
+			break
+		}
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func (p *filterParser) and() (filterExpr, error) {
+	var terms filterAnd
+	for {
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, expr)
+		if p.operator("AND") {
+			continue
+		}
+		if next := p.peek(); next == "" || next == ")" || strings.EqualFold(next, "OR") {
+			break
+		}
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func (p *filterParser) unary() (filterExpr, error) {
+	if p.operator("NOT") {
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{expr}, nil
+	}
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	case token == "(":
+		p.pos++
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.operator(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return expr, nil
+	case token == ")" || strings.EqualFold(token, "AND") || strings.EqualFold(token, "OR"):
+		return nil, fmt.Errorf("unexpected %q", token)
+	}
+	p.pos++
+
+	field, value, ok := strings.Cut(token, ":")
+	if !ok {
+		return nil, fmt.Errorf("expected field:value, got %q", token)
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		// only \" is an escape, so regexes can be quoted as they are
+		value = strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+	}
+	return newFilterTerm(strings.ToLower(field), value)
+}
+
+// eventExprFilter keeps only the events matching every -filter and -cel
+// expression
+type eventExprFilter struct {
+	exprs []filterExpr
+
+	// events matched and skipped, only touched from the handling goroutine
+	matched, skipped uint64
+}
+
+// exprFilters is nil unless -filter or -cel is set
+var exprFilters *eventExprFilter
+
+func newEventExprFilter(filters, celFilters []string) (*eventExprFilter, error) {
+	f := &eventExprFilter{}
+	for _, s := range filters {
+		expr, err := parseFilter(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", s, err)
+		}
+		f.exprs = append(f.exprs, expr)
+	}
+	for _, s := range celFilters {
+		expr, err := parseCEL(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", s, err)
+		}
+		f.exprs = append(f.exprs, expr)
+	}
+	return f, nil
+}
+
+// allows reports whether msg matches every expression, counting it either
+// way
+func (f *eventExprFilter) allows(msg *jetstream.Message) bool {
+	e := &filterEvent{msg: msg}
+	for _, expr := range f.exprs {
+		if !expr.match(e) {
+			f.skipped++
+			return false
+		}
+	}
+	f.matched++
+	return true
+}
+
+func (f *eventExprFilter) logSummary() {
+	if f.matched+f.skipped == 0 {
+		return
+	}
+	log.Info().Uint64("matched", f.matched).Uint64("skipped", f.skipped).Msg("filter_summary")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+func TestTokenizeFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{`lang:en (text:golang OR text:rust)`, []string{"lang:en", "(", "text:golang", "OR", "text:rust", ")"}},
+		{`text:"hello world" NOT did:@muted.txt`, []string{`text:"hello world"`, "NOT", "did:@muted.txt"}},
+		// à and ş end in the bytes 0xa0 and 0x85 that are spaces as runes
+		{`text:voilà`, []string{"text:voilà"}},
+		{`text:başka lang:tr`, []string{"text:başka", "lang:tr"}},
+		{"text:日本語 lang:ja", []string{"text:日本語", "lang:ja"}},
+	}
+	for _, tt := range tests {
+		got, err := tokenizeFilter(tt.filter)
+		if err != nil {
+			t.Errorf("tokenizeFilter(%q): %v", tt.filter, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("tokenizeFilter(%q) = %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestFilterNonASCIIText(t *testing.T) {
+	expr, err := parseFilter(`text:voilà`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for text, want := range map[string]bool{
+		"et voilà!":   true,
+		"VOILÀ":       true,
+		"voilÃ and x": false,
+		"voila":       false,
+	} {
+		record, _ := json.Marshal(map[string]any{"$type": "app.bsky.feed.post", "text": text, "createdAt": "2024-09-09T19:46:02.102Z"})
+		msg := &jetstream.Message{Did: "did:plc:a", Kind: "commit", Commit: &jetstream.CommitEvent{
+			Operation: "create", Collection: "app.bsky.feed.post", Rkey: "3l3qo2vutsw2b", Record: record,
+		}}
+		if got := expr.match(&filterEvent{msg: msg}); got != want {
+			t.Errorf("text:voilà matching %q = %v, want %v", text, got, want)
+		}
+	}
+}
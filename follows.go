@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// followNetwork is the -follows-of filter: the accounts an actor follows,
+// and the actor, fetched from the AppView and refreshed in the background.
+// Events from anyone else are skipped. When the network fits in
+// jetstream's DID filter it is also sent on subscribe, so the server does
+// the filtering.
+type followNetwork struct {
+	actor      string
+	appviewURL string
+	client     *http.Client
+	dids       atomic.Pointer[map[string]bool]
+
+	// events skipped, only touched from the handling goroutine
+	skipped uint64
+}
+
+// follows is the -follows-of filter, nil unless it is set
+var follows *followNetwork
+
+// newFollowNetwork fetches actor's follows, failing if they can't be
+// fetched, since starting unfiltered would log far more than asked for
+func newFollowNetwork(actor, appviewURL string) (*followNetwork, error) {
+	n := &followNetwork{
+		actor:      actor,
+		appviewURL: strings.TrimSuffix(appviewURL, "/"),
+		client:     enrichClient,
+	}
+	dids, err := n.fetch()
+	if err != nil {
+		return nil, err
+	}
+	n.dids.Store(&dids)
+	return n, nil
+}
+
+// fetch pages through app.bsky.graph.getFollows for the actor's follows,
+// adding the actor's own DID
+func (n *followNetwork) fetch() (map[string]bool, error) {
+	dids := map[string]bool{}
+	cursor := ""
+	for {
+		query := url.Values{"actor": {n.actor}, "limit": {"100"}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		resp, err := n.client.Get(n.appviewURL + "/xrpc/app.bsky.graph.getFollows?" + query.Encode())
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Subject struct {
+				Did string `json:"did"`
+			} `json:"subject"`
+			Follows []struct {
+				Did string `json:"did"`
+			} `json:"follows"`
+			Cursor string `json:"cursor"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("getFollows returned %s", resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if page.Subject.Did != "" {
+			dids[page.Subject.Did] = true
+		}
+		for _, f := range page.Follows {
+			dids[f.Did] = true
+		}
+		if page.Cursor == "" || page.Cursor == cursor || len(page.Follows) == 0 {
+			return dids, nil
+		}
+		cursor = page.Cursor
+	}
+}
+
+// wanted returns the network as a sorted list for jetstream's DID filter,
+// or nil if it is too large for one
+func (n *followNetwork) wanted() []string {
+	dids := *n.dids.Load()
+	if len(dids) > jetstream.MaxWantedDids {
+		return nil
+	}
+	return slices.Sorted(maps.Keys(dids))
+}
+
+// allows reports whether msg is from the network, counting it if not
+func (n *followNetwork) allows(msg *jetstream.Message) bool {
+	if (*n.dids.Load())[msg.Did] {
+		return true
+	}
+	n.skipped++
+	return false
+}
+
+// refresh refetches the network every interval. A change is applied to
+// client's DID filter too, which reconnects from the last handled event;
+// client is nil when replaying.
+func (n *followNetwork) refresh(interval time.Duration, client *jetstream.Client) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		dids, err := n.fetch()
+		if err != nil {
+			// keep the network as it was rather than logging everyone
+			log.Warn().Err(err).Str("actor", n.actor).Msg("failed to refresh follows")
+			continue
+		}
+		previous := *n.dids.Load()
+		if maps.Equal(dids, previous) {
+			continue
+		}
+		n.dids.Store(&dids)
+		log.Info().Str("actor", n.actor).Int("dids", len(dids)).Int("previous", len(previous)).Msg("follows changed")
+
+		if client != nil {
+			collections, _ := client.Filters()
+			if err := client.SetFilters(collections, n.wanted()); err != nil {
+				log.Error().Err(err).Msg("failed to update the DID filter")
+			}
+		}
+	}
+}
+
+func (n *followNetwork) logSummary() {
+	if n.skipped == 0 {
+		return
+	}
+	log.Info().Str("actor", n.actor).Uint64("skipped", n.skipped).Msg("follows_summary")
+}
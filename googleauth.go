@@ -0,0 +1,243 @@
+package main
+
+import (
+	"cmp"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	googleTokenURL     = "https://oauth2.googleapis.com/token"
+	googleTokenTimeout = 30 * time.Second
+	// a cached access token is replaced this long before it expires
+	googleTokenEarly = time.Minute
+)
+
+// googleCredentials are Google's application default credentials, found
+// as the Cloud client libraries find them: the key file named by
+// GOOGLE_APPLICATION_CREDENTIALS, then the one written by gcloud auth
+// application-default login, then the metadata server of the GCE, GKE, or
+// Cloud Run instance the logger runs on. Access tokens are cached until
+// shortly before they expire.
+type googleCredentials struct {
+	// source is where the credentials came from, for logs
+	source string
+	// request builds a request for a fresh access token
+	request func() (*http.Request, error)
+	client  *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// googleKeyFile is the part of a credentials file the service_account and
+// authorized_user kinds use
+type googleKeyFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// googleToken is an access token as the token endpoint and the metadata
+// server both return it
+type googleToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// findGoogleCredentials returns the application default credentials, for
+// tokens with scope
+func findGoogleCredentials(scope string) (*googleCredentials, error) {
+	c := &googleCredentials{client: &http.Client{Timeout: googleTokenTimeout}}
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		if _, err := os.Stat(gcloudCredentialsPath()); err == nil {
+			path = gcloudCredentialsPath()
+		}
+	}
+	if path == "" {
+		host := cmp.Or(os.Getenv("GCE_METADATA_HOST"), "metadata.google.internal")
+		tokenURL := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/token?scopes=" + url.QueryEscape(scope)
+		c.source = "metadata server"
+		c.request = func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodGet, tokenURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			return req, nil
+		}
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var key googleKeyFile
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c.source = path
+	tokenURL := cmp.Or(key.TokenURI, googleTokenURL)
+	switch key.Type {
+	case "service_account":
+		private, err := parseRSAKey(key.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		c.request = func() (*http.Request, error) {
+			assertion, err := googleJWT(private, key.ClientEmail, scope, tokenURL, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			return formRequest(tokenURL, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	case "authorized_user":
+		c.request = func() (*http.Request, error) {
+			return formRequest(tokenURL, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {key.ClientID},
+				"client_secret": {key.ClientSecret},
+				"refresh_token": {key.RefreshToken},
+			})
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported credentials type %q, expected service_account or authorized_user", path, key.Type)
+	}
+	return c, nil
+}
+
+// gcloudCredentialsPath is where gcloud auth application-default login
+// saves credentials
+func gcloudCredentialsPath() string {
+	dir := os.Getenv("CLOUDSDK_CONFIG")
+	if dir == "" && runtime.GOOS == "windows" {
+		dir = filepath.Join(os.Getenv("APPDATA"), "gcloud")
+	}
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config", "gcloud")
+	}
+	return filepath.Join(dir, "application_default_credentials.json")
+}
+
+func formRequest(target string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// parseRSAKey parses a service account's PEM private key
+func parseRSAKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key isn't RSA")
+	}
+	return private, nil
+}
+
+// googleJWT is the signed assertion a service account trades for an
+// access token, valid for an hour from now
+func googleJWT(key *rsa.PrivateKey, email, scope, audience string, now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iss":   email,
+		"scope": scope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// accessToken returns the cached access token, fetching another if it is
+// about to expire
+func (c *googleCredentials) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expiry) {
+		return c.token, nil
+	}
+	req, err := c.request()
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching access token from %s: %w", c.source, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching access token from %s: %d %s", c.source, resp.StatusCode, body)
+	}
+	var token googleToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("fetching access token from %s: no token in response", c.source)
+	}
+	c.token = token.AccessToken
+	c.expiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - googleTokenEarly)
+	return c.token, nil
+}
+
+// expire drops the cached access token, after it was refused
+func (c *googleCredentials) expire() {
+	c.mu.Lock()
+	c.token = ""
+	c.mu.Unlock()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/dickeyy/atproto-logger/eventpb"
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcSubscriber is a Subscribe call being served, with the filters it
+// asked for
+type grpcSubscriber struct {
+	clientFilter
+	remote string
+	queue  chan *eventpb.Event
+	// closing is closed to end the call, once, with err
+	closing   chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func (s *grpcSubscriber) disconnect(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.closing)
+	})
+}
+
+// grpcServer serves the event stream as the EventStream gRPC service in
+// eventpb, for consumers that would rather have typed messages than
+// jetstream's JSON. Like the broadcast server, each Subscribe call is
+// narrowed by the collections and DIDs it asks for, sees events after the
+// local filters, and is ended with RESOURCE_EXHAUSTED once it falls
+// queueSize events behind.
+type grpcServer struct {
+	eventpb.UnimplementedEventStreamServer
+	mu          sync.Mutex
+	subscribers map[*grpcSubscriber]struct{}
+	queueSize   int
+	server      *grpc.Server
+}
+
+func newGRPCServer(addr string, queueSize int) (*grpcServer, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	g := &grpcServer{
+		subscribers: map[*grpcSubscriber]struct{}{},
+		queueSize:   queueSize,
+		server:      grpc.NewServer(),
+	}
+	eventpb.RegisterEventStreamServer(g.server, g)
+	go func() {
+		log.Info().Str("addr", lis.Addr().String()).Msg("serving grpc event stream")
+		if err := g.server.Serve(lis); err != nil {
+			log.Fatal().Err(err).Msg("grpc server error")
+		}
+	}()
+	return g, nil
+}
+
+func (g *grpcServer) Subscribe(req *eventpb.SubscribeRequest, stream grpc.ServerStreamingServer[eventpb.Event]) error {
+	sub := &grpcSubscriber{
+		clientFilter: newClientFilter(req.WantedCollections, req.WantedDids),
+		queue:        make(chan *eventpb.Event, g.queueSize),
+		closing:      make(chan struct{}),
+	}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		sub.remote = p.Addr.String()
+	}
+
+	g.mu.Lock()
+	g.subscribers[sub] = struct{}{}
+	grpcClients.Set(float64(len(g.subscribers)))
+	g.mu.Unlock()
+	log.Info().
+		Str("remote", sub.remote).
+		Strs("collections", sub.collections).
+		Int("dids", len(sub.dids)).
+		Msg("grpc client subscribed")
+	defer func() {
+		g.mu.Lock()
+		delete(g.subscribers, sub)
+		grpcClients.Set(float64(len(g.subscribers)))
+		g.mu.Unlock()
+		log.Info().Str("remote", sub.remote).Err(sub.err).Msg("grpc client unsubscribed")
+	}()
+
+	for {
+		select {
+		case ev := <-sub.queue:
+			if err := stream.Send(ev); err != nil {
+				sub.disconnect(err)
+				return err
+			}
+		case <-stream.Context().Done():
+			sub.disconnect(stream.Context().Err())
+			return nil
+		case <-sub.closing:
+			return sub.err
+		}
+	}
+}
+
+// publish queues msg for each subscriber that wants it, converting it once,
+// and ends the calls of subscribers too far behind to take it
+func (g *grpcServer) publish(msg *jetstream.Message) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var ev *eventpb.Event
+	for sub := range g.subscribers {
+		if !sub.wants(msg) {
+			continue
+		}
+		if ev == nil {
+			ev = protoEvent(msg)
+		}
+		select {
+		case sub.queue <- ev:
+		default:
+			log.Warn().Str("remote", sub.remote).Int("queue", g.queueSize).Msg("grpc client too slow, disconnecting")
+			sub.disconnect(status.Error(codes.ResourceExhausted, "consumer too slow"))
+		}
+	}
+}
+
+// close ends every call and stops the server
+func (g *grpcServer) close() {
+	g.mu.Lock()
+	for sub := range g.subscribers {
+		sub.disconnect(status.Error(codes.Unavailable, "shutting down"))
+	}
+	g.mu.Unlock()
+	g.server.GracefulStop()
+}
+
+// protoEvent converts msg to its eventpb form
+func protoEvent(msg *jetstream.Message) *eventpb.Event {
+	ev := &eventpb.Event{Did: msg.Did, TimeUs: msg.TimeUs, Kind: msg.Kind}
+	switch {
+	case msg.Commit != nil:
+		c := msg.Commit
+		ev.Event = &eventpb.Event_Commit{Commit: &eventpb.Commit{
+			Rev:        c.Rev,
+			Operation:  c.Operation,
+			Collection: c.Collection,
+			Rkey:       c.Rkey,
+			Cid:        c.Cid,
+			RecordJson: string(c.Record),
+		}}
+	case msg.Identity != nil:
+		i := msg.Identity
+		ev.Event = &eventpb.Event_Identity{Identity: &eventpb.Identity{
+			Did:    i.Did,
+			Handle: i.Handle,
+			Seq:    i.Seq,
+			Time:   i.Time,
+		}}
+	case msg.Account != nil:
+		a := msg.Account
+		ev.Event = &eventpb.Event_Account{Account: &eventpb.Account{
+			Active: a.Active,
+			Status: a.Status,
+			Did:    a.Did,
+			Seq:    a.Seq,
+			Time:   a.Time,
+		}}
+	case msg.Label != nil:
+		l := msg.Label
+		ev.Event = &eventpb.Event_Label{Label: &eventpb.Label{
+			Src: l.Src,
+			Uri: l.URI,
+			Cid: l.Cid,
+			Val: l.Val,
+			Neg: l.Neg,
+			Cts: l.Cts,
+			Exp: l.Exp,
+			Seq: l.Seq,
+		}}
+	}
+	return ev
+}
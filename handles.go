@@ -0,0 +1,350 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// handleEntry is a cached DID to handle mapping. An empty handle records a
+// DID that doesn't declare one, so it isn't looked up again until expiry.
+type handleEntry struct {
+	did       string
+	handle    string
+	expiresAt time.Time
+}
+
+// handleResolver maps DIDs to handles for log output. Lookups never block:
+// a DID that isn't cached is queued for resolution in the background and
+// logged without a handle until it resolves. Handles are those the DID
+// document claims, which aren't verified against the handle's own DNS or
+// well-known record.
+type handleResolver struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+	pending map[string]bool
+
+	plcURL string
+	client *http.Client
+	queue  chan string
+}
+
+// handles is the DID to handle resolver, nil unless -resolve-handles is set
+var handles *handleResolver
+
+func newHandleResolver(plcURL string, max int, ttl time.Duration, workers int) *handleResolver {
+	r := &handleResolver{
+		ttl:     ttl,
+		max:     max,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		pending: make(map[string]bool),
+		plcURL:  strings.TrimSuffix(plcURL, "/"),
+		client:  enrichClient,
+		// a burst of new DIDs beyond this is dropped and retried the next
+		// time each DID is seen
+		queue: make(chan string, 1000),
+	}
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+// lookup returns the cached handle for did. On a miss or an expired entry
+// it queues did for resolution, unless catching up, and returns false.
+func (r *handleResolver) lookup(did string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if el, ok := r.entries[did]; ok {
+		e := el.Value.(*handleEntry)
+		if time.Now().Before(e.expiresAt) {
+			r.lru.MoveToFront(el)
+			return e.handle, e.handle != ""
+		}
+	}
+	if !r.pending[did] && !catchingUp() {
+		select {
+		case r.queue <- did:
+			r.pending[did] = true
+		default:
+		}
+	}
+	return "", false
+}
+
+// set caches handle for did, as resolved or as seen in an identity event
+func (r *handleResolver) set(did, handle string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expiresAt := time.Now().Add(r.ttl)
+	if el, ok := r.entries[did]; ok {
+		e := el.Value.(*handleEntry)
+		e.handle, e.expiresAt = handle, expiresAt
+		r.lru.MoveToFront(el)
+		return
+	}
+	r.entries[did] = r.lru.PushFront(&handleEntry{did: did, handle: handle, expiresAt: expiresAt})
+	if r.lru.Len() > r.max {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*handleEntry).did)
+	}
+}
+
+func (r *handleResolver) work() {
+	for did := range r.queue {
+		handle, err := r.resolve(did)
+		if err != nil {
+			// cached as having no handle, so a DID that fails to resolve
+			// is only retried once the entry expires
+			log.Debug().Err(err).Str("did", did).Msg("handle resolution failed")
+		}
+		r.set(did, handle)
+		r.mu.Lock()
+		delete(r.pending, did)
+		r.mu.Unlock()
+	}
+}
+
+// resolve fetches the DID document for did and returns the handle it
+// declares, or "" if it declares none
+func (r *handleResolver) resolve(did string) (string, error) {
+	doc, err := fetchDIDDocument(r.client, r.plcURL, did)
+	if err != nil {
+		return "", err
+	}
+	for _, aka := range doc.AlsoKnownAs {
+		if handle, ok := strings.CutPrefix(aka, "at://"); ok {
+			return handle, nil
+		}
+	}
+	return "", nil
+}
+
+// didDocument holds the parts of a DID document the logger uses
+type didDocument struct {
+	AlsoKnownAs        []string `json:"alsoKnownAs"`
+	VerificationMethod []struct {
+		ID                 string `json:"id"`
+		PublicKeyMultibase string `json:"publicKeyMultibase"`
+	} `json:"verificationMethod"`
+	Service []struct {
+		ID              string `json:"id"`
+		Type            string `json:"type"`
+		ServiceEndpoint string `json:"serviceEndpoint"`
+	} `json:"service"`
+}
+
+// pds returns the endpoint of the #atproto_pds service, where did's repo
+// is hosted
+func (doc *didDocument) pds(did string) (string, error) {
+	for _, s := range doc.Service {
+		if s.ID == "#atproto_pds" || s.ID == did+"#atproto_pds" {
+			return strings.TrimSuffix(s.ServiceEndpoint, "/"), nil
+		}
+	}
+	return "", errors.New("did document has no #atproto_pds service")
+}
+
+// fetchDIDDocument fetches the DID document for a did:plc DID from the PLC
+// directory at plcURL, or for a did:web DID from its host
+func fetchDIDDocument(client *http.Client, plcURL, did string) (*didDocument, error) {
+	var docURL string
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		docURL = plcURL + "/" + did
+	case strings.HasPrefix(did, "did:web:"):
+		// did:web:example.com lives at /.well-known, while extra
+		// colon-separated segments are a path on the host
+		parts := strings.Split(strings.TrimPrefix(did, "did:web:"), ":")
+		host, err := url.PathUnescape(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 1 {
+			docURL = "https://" + host + "/.well-known/did.json"
+		} else {
+			docURL = "https://" + host + "/" + strings.Join(parts[1:], "/") + "/did.json"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported did method")
+	}
+
+	resp, err := client.Get(docURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("did document request returned %s", resp.Status)
+	}
+
+	var doc didDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// handleCacheEntry is a cached handle as stored in -handle-cache-file
+type handleCacheEntry struct {
+	Did       string    `json:"did"`
+	Handle    string    `json:"handle"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// load fills the cache from a file written by save, skipping entries that
+// have expired since. A missing file is an empty cache.
+func (r *handleResolver) load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var entries []handleCacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	loaded := 0
+	// saved least recently used first, so the most recent end up in front
+	for _, e := range entries {
+		if e.Did == "" || !now.Before(e.ExpiresAt) || r.entries[e.Did] != nil {
+			continue
+		}
+		r.entries[e.Did] = r.lru.PushFront(&handleEntry{did: e.Did, handle: e.Handle, expiresAt: e.ExpiresAt})
+		loaded++
+		if r.lru.Len() > r.max {
+			oldest := r.lru.Back()
+			r.lru.Remove(oldest)
+			delete(r.entries, oldest.Value.(*handleEntry).did)
+			loaded--
+		}
+	}
+	return loaded, nil
+}
+
+// save writes the unexpired cache entries to path, replacing it
+// atomically so a crash mid-write keeps the previous cache
+func (r *handleResolver) save(path string) error {
+	r.mu.Lock()
+	now := time.Now()
+	entries := make([]handleCacheEntry, 0, r.lru.Len())
+	for el := r.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*handleEntry)
+		if now.Before(e.expiresAt) {
+			entries = append(entries, handleCacheEntry{Did: e.did, Handle: e.handle, ExpiresAt: e.expiresAt})
+		}
+	}
+	r.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// didFlagHandles caches the DIDs that handles given to -did resolved to,
+// so a -config reload doesn't resolve them again
+var didFlagHandles = struct {
+	sync.Mutex
+	dids map[string]string
+}{dids: map[string]string{}}
+
+// resolveDIDFlags returns the -did values as DIDs, resolving the handles
+// among them, with or without a leading @, through
+// com.atproto.identity.resolveHandle at appviewURL. Jetstream only filters
+// by DID, so a handle that doesn't resolve is an error rather than a
+// filter that matches nothing.
+func resolveDIDFlags(values []string, appviewURL string) ([]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	dids := make([]string, 0, len(values))
+	for _, v := range values {
+		if strings.HasPrefix(v, "did:") {
+			if !didPattern.MatchString(v) {
+				return nil, fmt.Errorf("%q isn't a valid DID", v)
+			}
+			dids = append(dids, v)
+			continue
+		}
+		handle := strings.ToLower(strings.TrimPrefix(v, "@"))
+		if !handlePattern.MatchString(handle) {
+			return nil, fmt.Errorf("%q is neither a DID nor a handle", v)
+		}
+
+		didFlagHandles.Lock()
+		did, ok := didFlagHandles.dids[handle]
+		didFlagHandles.Unlock()
+		if !ok {
+			var err error
+			if did, err = resolveHandle(enrichClient, appviewURL, handle); err != nil {
+				return nil, fmt.Errorf("resolving %s: %v", handle, err)
+			}
+			didFlagHandles.Lock()
+			didFlagHandles.dids[handle] = did
+			didFlagHandles.Unlock()
+			log.Info().Str("handle", handle).Str("did", did).Msg("resolved -did handle")
+		}
+		dids = append(dids, did)
+	}
+	return dids, nil
+}
+
+// resolveHandle looks up the DID of handle with
+// com.atproto.identity.resolveHandle at serviceURL
+func resolveHandle(client *http.Client, serviceURL, handle string) (string, error) {
+	query := url.Values{"handle": {handle}}
+	resp, err := client.Get(strings.TrimSuffix(serviceURL, "/") + "/xrpc/com.atproto.identity.resolveHandle?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// unknown handles are a 400 with an XRPC error naming why
+		var xrpcErr struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&xrpcErr) == nil && xrpcErr.Message != "" {
+			return "", fmt.Errorf("resolveHandle returned %s: %s", resp.Status, xrpcErr.Message)
+		}
+		return "", fmt.Errorf("resolveHandle returned %s", resp.Status)
+	}
+	var body struct {
+		Did string `json:"did"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if !didPattern.MatchString(body.Did) {
+		return "", fmt.Errorf("resolveHandle returned %q, which isn't a DID", body.Did)
+	}
+	return body.Did, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// mockResolveHandle serves com.atproto.identity.resolveHandle from dids,
+// counting the requests
+func mockResolveHandle(t *testing.T, dids map[string]string) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/xrpc/com.atproto.identity.resolveHandle" {
+			http.NotFound(w, r)
+			return
+		}
+		did, ok := dids[r.URL.Query().Get("handle")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"InvalidRequest","message":"Unable to resolve handle"}`))
+			return
+		}
+		w.Write([]byte(`{"did":"` + did + `"}`))
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &requests
+}
+
+func TestResolveDIDFlags(t *testing.T) {
+	ts, requests := mockResolveHandle(t, map[string]string{
+		"alice.test": "did:plc:alice",
+		"bob.test":   "did:web:bob.test",
+		"bad.test":   "alice",
+	})
+	tests := []struct {
+		name    string
+		values  []string
+		want    []string
+		wantErr string
+	}{
+		{"dids as given", []string{"did:plc:abc", "did:web:example.com"}, []string{"did:plc:abc", "did:web:example.com"}, ""},
+		{"handles resolved", []string{"alice.test", "@Bob.Test", "did:plc:abc"}, []string{"did:plc:alice", "did:web:bob.test", "did:plc:abc"}, ""},
+		{"unresolvable handle", []string{"alice.test", "nobody.test"}, nil, "resolving nobody.test: resolveHandle returned 400 Bad Request: Unable to resolve handle"},
+		{"resolved to something else", []string{"bad.test"}, nil, `resolving bad.test: resolveHandle returned "alice", which isn't a DID`},
+		{"not a handle", []string{"alice"}, nil, `"alice" is neither a DID nor a handle`},
+		{"not a did", []string{"did:plc:"}, nil, `"did:plc:" isn't a valid DID`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveDIDFlags(tt.values, ts.URL)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("dids = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// resolved handles are cached
+	before := requests.Load()
+	if _, err := resolveDIDFlags([]string{"alice.test", "bob.test"}, ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load() - before; n != 0 {
+		t.Errorf("%d requests for cached handles, want none", n)
+	}
+}
+
+func TestResolveDIDFlagsOnReload(t *testing.T) {
+	ts, _ := mockResolveHandle(t, map[string]string{"carol.test": "did:plc:carol"})
+	defer func(saved string) { *appviewURLFlag = saved }(*appviewURLFlag)
+	*appviewURLFlag = ts.URL
+	defer func(saved stringsFlag) { didFlags = saved }(didFlags)
+	defer func(saved []string) { wantedDids = saved }(wantedDids)
+
+	client := jetstream.NewClient(jetstream.DefaultURL)
+	didFlags = stringsFlag{"carol.test"}
+	if err := applyReloadedFlags(client, []string{"did"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, dids := client.Filters(); !slices.Equal(dids, []string{"did:plc:carol"}) {
+		t.Errorf("filtering to %v, want carol's DID", dids)
+	}
+
+	didFlags = stringsFlag{"dave.test"}
+	err := applyReloadedFlags(client, []string{"did"})
+	if err == nil || !strings.HasPrefix(err.Error(), "-did: resolving dave.test: ") {
+		t.Errorf("err = %v, want the unresolvable handle named", err)
+	}
+}
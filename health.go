@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// sinkFailure is the last time a sink lost events, and why
+type sinkFailure struct {
+	at     time.Time
+	reason string
+}
+
+// sinkFailures holds each sink's last failure, for /readyz
+var sinkFailures = struct {
+	mu   sync.Mutex
+	last map[string]sinkFailure
+}{last: map[string]sinkFailure{}}
+
+// sinkDrop counts n events a sink lost for reason, in
+// atproto_logger_sink_dropped_total and for /readyz
+func sinkDrop(sink, reason string, n int) {
+	sinkDropped.WithLabelValues(sink, reason).Add(float64(n))
+	sinkFailures.mu.Lock()
+	sinkFailures.last[sink] = sinkFailure{at: time.Now(), reason: reason}
+	sinkFailures.mu.Unlock()
+}
+
+// healthCheck answers /healthz and /readyz on -metrics-addr. The stream is
+// stalled once nothing has been handled for stallAfter, from the last
+// event or, before the first, from startup. /healthz fails only while it
+// is, for liveness probes to restart a stuck logger; /readyz also fails
+// while disconnected, while more than maxLag behind, or when a sink has
+// lost events within the last stallAfter.
+type healthCheck struct {
+	started    time.Time
+	stallAfter time.Duration
+	maxLag     time.Duration
+	connected  atomic.Bool
+	// when the last event was handled, in unix nanoseconds, and how far
+	// behind its time_us that was
+	lastHandled atomic.Int64
+	lastLag     atomic.Int64
+}
+
+// health is nil unless -metrics-addr is set
+var health *healthCheck
+
+func newHealthCheck(stallAfter, maxLag time.Duration) *healthCheck {
+	return &healthCheck{started: time.Now(), stallAfter: stallAfter, maxLag: maxLag}
+}
+
+// seen records that msg has been handled
+func (h *healthCheck) seen(msg *jetstream.Message) {
+	now := time.Now()
+	h.lastHandled.Store(now.UnixNano())
+	h.lastLag.Store(int64(now.Sub(time.UnixMicro(msg.TimeUs))))
+}
+
+// healthStatus is the body of /healthz and /readyz
+type healthStatus struct {
+	OK        bool `json:"ok"`
+	Connected bool `json:"connected"`
+	// SecondsSinceEvent is since the last event was handled, or since
+	// startup before the first
+	SecondsSinceEvent float64  `json:"seconds_since_event"`
+	LagSeconds        *float64 `json:"lag_seconds,omitempty"`
+	// Sinks are the sinks that have lost events, with when and why they
+	// last did, and the sinks with circuit breakers
+	Sinks    map[string]healthSink `json:"sinks,omitempty"`
+	Problems []string              `json:"problems,omitempty"`
+}
+
+type healthSink struct {
+	Healthy     bool       `json:"healthy"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	// Breaker is the state of the sink's circuit breaker, if it has one
+	Breaker string `json:"breaker,omitempty"`
+}
+
+// status checks the stream, with the readiness checks if ready is set
+func (h *healthCheck) status(ready bool) healthStatus {
+	now := time.Now()
+	last := h.started
+	status := healthStatus{Connected: h.connected.Load()}
+	if handled := h.lastHandled.Load(); handled > 0 {
+		last = time.Unix(0, handled)
+		lag := time.Duration(h.lastLag.Load()).Seconds()
+		status.LagSeconds = &lag
+	}
+	since := now.Sub(last)
+	status.SecondsSinceEvent = since.Seconds()
+	if since > h.stallAfter {
+		status.Problems = append(status.Problems, "stalled: no events for "+since.Truncate(time.Second).String())
+	}
+
+	sinkFailures.mu.Lock()
+	for sink, f := range sinkFailures.last {
+		if status.Sinks == nil {
+			status.Sinks = map[string]healthSink{}
+		}
+		healthy := now.Sub(f.at) > h.stallAfter
+		status.Sinks[sink] = healthSink{Healthy: healthy, LastFailure: &f.at, Reason: f.reason}
+		if ready && !healthy {
+			status.Problems = append(status.Problems, "sink "+sink+" is losing events: "+f.reason)
+		}
+	}
+	sinkFailures.mu.Unlock()
+	for sink, state := range breakerStates() {
+		if status.Sinks == nil {
+			status.Sinks = map[string]healthSink{}
+		}
+		s, ok := status.Sinks[sink]
+		if !ok {
+			s.Healthy = true
+		}
+		s.Breaker = state.String()
+		if state != breakerClosed {
+			s.Healthy = false
+			if ready {
+				status.Problems = append(status.Problems, "sink "+sink+" circuit breaker is "+s.Breaker)
+			}
+		}
+		status.Sinks[sink] = s
+	}
+
+	if ready {
+		if !status.Connected {
+			status.Problems = append(status.Problems, "disconnected")
+		}
+		if h.maxLag > 0 && status.LagSeconds != nil && *status.LagSeconds > h.maxLag.Seconds() {
+			status.Problems = append(status.Problems, "lagging more than "+h.maxLag.String()+" behind")
+		}
+	}
+	status.OK = len(status.Problems) == 0
+	return status
+}
+
+func (h *healthCheck) serve(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := h.status(ready)
+		if !status.OK {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, status)
+	}
+}
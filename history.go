@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// historyQueueSize is how many events are buffered for a history sink.
+// Account and identity events are rare next to commits, so this is plenty.
+const historyQueueSize = 10000
+
+// historyTable is a history kept by historySink: the table, the column
+// holding the value whose changes it records, and how events give that
+// value. value returns false for events the history doesn't keep.
+type historyTable struct {
+	name   string
+	column string
+	value  func(msg *jetstream.Message) (value string, seq int64, time string, ok bool)
+}
+
+var (
+	// accountHistoryTable records changes of account state, such as
+	// active to takendown and back
+	accountHistoryTable = &historyTable{
+		name:   "account_history",
+		column: "state",
+		value: func(msg *jetstream.Message) (string, int64, string, bool) {
+			if a := msg.Account; a != nil {
+				return a.State(), a.Seq, a.Time, true
+			}
+			return "", 0, "", false
+		},
+	}
+	// handleHistoryTable records the handles each DID has used. Identity
+	// events without a handle, which only mean the DID document changed,
+	// aren't kept.
+	handleHistoryTable = &historyTable{
+		name:   "handle_history",
+		column: "handle",
+		value: func(msg *jetstream.Message) (string, int64, string, bool) {
+			if i := msg.Identity; i != nil && i.Handle != "" {
+				return i.Handle, i.Seq, i.Time, true
+			}
+			return "", 0, "", false
+		},
+	}
+)
+
+// historySink keeps a history in a SQLite database, one row per change of
+// the table's value for a DID. Events that repeat the value a DID already
+// has, or that are older than its latest row, as after a replay, aren't
+// stored.
+type historySink struct {
+	*batchQueue
+	table *historyTable
+	db    *sql.DB
+}
+
+// historyEntry is a row of a history: a DID's new value, and the one it
+// replaced, empty for the first row
+type historyEntry struct {
+	value, previous string
+	seq             int64
+	time            string
+	timeUs          int64
+}
+
+// openHistory opens the database at path and creates the table's schema
+func openHistory(path string, table *historyTable) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	stmts := []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA busy_timeout = 5000",
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			did TEXT NOT NULL,
+			%s TEXT NOT NULL,
+			previous TEXT,
+			seq INTEGER NOT NULL,
+			time TEXT,
+			time_us INTEGER NOT NULL
+		)`, table.name, table.column),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_did ON %s (did, seq)", table.name, table.name),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s ON %s (%s, time_us)", table.name, table.column, table.name, table.column),
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func newHistorySink(path string, table *historyTable) (*historySink, error) {
+	db, err := openHistory(path, table)
+	if err != nil {
+		return nil, err
+	}
+	s := &historySink{table: table, db: db}
+	s.batchQueue = newBatchQueue(table.name, historyQueueSize, sqliteBatchSize, sqliteBatchInterval, 0, s.write)
+	return s, nil
+}
+
+// publish queues the events the history keeps
+func (s *historySink) publish(msg *jetstream.Message) {
+	if _, _, _, ok := s.table.value(msg); ok {
+		s.batchQueue.publish(msg)
+	}
+}
+
+// write stores the changes in batch in one transaction, comparing each
+// event with its DID's latest row
+func (s *historySink) write(batch []*jetstream.Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	latest := fmt.Sprintf("SELECT %s, seq FROM %s WHERE did = ? ORDER BY seq DESC LIMIT 1", s.table.column, s.table.name)
+	insert := fmt.Sprintf("INSERT INTO %s (did, %s, previous, seq, time, time_us) VALUES (?, ?, ?, ?, ?, ?)", s.table.name, s.table.column)
+	for _, msg := range batch {
+		value, seq, time, _ := s.table.value(msg)
+
+		var previous string
+		var previousSeq int64
+		err := tx.QueryRow(latest, msg.Did).Scan(&previous, &previousSeq)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			s.fail("insert", err, 1)
+			continue
+		case seq <= previousSeq || value == previous:
+			continue
+		}
+
+		_, err = tx.Exec(insert, msg.Did, value, sql.NullString{String: previous, Valid: previous != ""}, seq, time, msg.TimeUs)
+		if err != nil {
+			s.fail("insert", err, 1)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *historySink) close() {
+	s.batchQueue.close()
+	if err := s.db.Close(); err != nil {
+		log.Error().Err(err).Str("table", s.table.name).Msg("error closing history database")
+	}
+}
+
+// queryHistory returns did's rows of table in db, oldest first
+func queryHistory(db *sql.DB, table *historyTable, did string) ([]historyEntry, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT %s, COALESCE(previous, ''), seq, COALESCE(time, ''), time_us FROM %s WHERE did = ? ORDER BY seq",
+		table.column, table.name), did)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []historyEntry
+	for rows.Next() {
+		var e historyEntry
+		if err := rows.Scan(&e.value, &e.previous, &e.seq, &e.time, &e.timeUs); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// handleChange is a row of the handle history as GET /handles/{did} and
+// -handles-of report it
+type handleChange struct {
+	Handle   string `json:"handle"`
+	Previous string `json:"previous,omitempty"`
+	Seq      int64  `json:"seq"`
+	Time     string `json:"time,omitempty"`
+	TimeUs   int64  `json:"time_us"`
+}
+
+// handleChanges returns the handles did has used, oldest first
+func handleChanges(db *sql.DB, did string) ([]handleChange, error) {
+	entries, err := queryHistory(db, handleHistoryTable, did)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]handleChange, len(entries))
+	for i, e := range entries {
+		changes[i] = handleChange{Handle: e.value, Previous: e.previous, Seq: e.seq, Time: e.time, TimeUs: e.timeUs}
+	}
+	return changes, nil
+}
+
+// handleHistory is the -handle-history sink, nil unless it is set
+var handleHistory *historySink
+
+// printHandleHistory prints the handles did has used, from the database at
+// path, one JSON object per line, for -handles-of
+func printHandleHistory(path, did string) {
+	if path == "" {
+		log.Fatal().Msg("-handles-of needs -handle-history")
+	}
+	db, err := openHistory(path, handleHistoryTable)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open -handle-history")
+	}
+	defer db.Close()
+	changes, err := handleChanges(db, did)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to query -handle-history")
+	}
+	out := json.NewEncoder(os.Stdout)
+	for _, c := range changes {
+		out.Encode(c)
+	}
+}
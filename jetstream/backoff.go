@@ -0,0 +1,52 @@
+package jetstream
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	backoffBase = 1 * time.Second
+	backoffMax  = 60 * time.Second
+
+	// a connection that stays up this long resets the backoff
+	healthyConnection = 30 * time.Second
+)
+
+// backoff computes reconnect delays that double on every consecutive
+// failure up to a cap, with jitter so clients don't reconnect in lockstep
+type backoff struct {
+	base, max time.Duration
+	current   time.Duration
+	// retries counts delays handed out since the last reset
+	retries int
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{base: base, max: max}
+}
+
+// next returns the delay before the next attempt and doubles the delay
+// after it. The returned delay is picked at random from the upper half of
+// the current step, so it never drops below half of it.
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.base
+	}
+	d := b.current
+	b.current = min(b.current*2, b.max)
+	b.retries++
+	return d/2 + rand.N(d/2+1)
+}
+
+// slowDown skips ahead a step, for when the server has asked clients to
+// back off
+func (b *backoff) slowDown() {
+	b.current = min(max(b.current, b.base)*2, b.max)
+}
+
+// reset goes back to the base delay
+func (b *backoff) reset() {
+	b.current = 0
+	b.retries = 0
+}
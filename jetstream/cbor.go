@@ -0,0 +1,291 @@
+package jetstream
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// This file decodes the subset of CBOR the firehose uses, DAG-CBOR: maps
+// with string keys, arrays, strings, bytes, integers, floats, booleans,
+// null, and tag 42 for CID links. It is enough to read frames and records
+// without pulling in an IPLD library.
+
+// errTruncated is returned for input that ends partway through a value
+var errTruncated = errors.New("cbor: unexpected end of input")
+
+// maxCBORDepth bounds how deeply values can nest, so a malicious frame
+// can't exhaust the stack
+const maxCBORDepth = 64
+
+// cidLink is a link to another block by CID, tag 42 in DAG-CBOR. It holds
+// the binary CID, without the multibase prefix byte the tag carries.
+type cidLink []byte
+
+// base32Lower is the multibase base32 alphabet CIDs are written in
+var base32Lower = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// String returns the CID in its usual base32 text form, bafy...
+func (c cidLink) String() string {
+	return "b" + base32Lower.EncodeToString(c)
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// decodeCBOR decodes one value from the start of data, returning it and the
+// number of bytes it took
+func decodeCBOR(data []byte) (any, int, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.value(0)
+	return v, d.pos, err
+}
+
+// head reads a value's major type and argument
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, errTruncated
+	}
+	b := d.data[d.pos]
+	d.pos++
+	major, info := b>>5, b&0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		// indefinite lengths aren't allowed in DAG-CBOR
+		return 0, 0, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+	if len(d.data)-d.pos < size {
+		return 0, 0, errTruncated
+	}
+	var arg uint64
+	for _, c := range d.data[d.pos : d.pos+size] {
+		arg = arg<<8 | uint64(c)
+	}
+	d.pos += size
+	if major == 7 {
+		// floats keep their width in the argument's size
+		switch size {
+		case 2:
+			return major, uint64(math.Float64bits(float64(halfToFloat(uint16(arg))))), nil
+		case 4:
+			return major, uint64(math.Float64bits(float64(math.Float32frombits(uint32(arg))))), nil
+		case 8:
+			return major, arg, nil
+		}
+	}
+	return major, arg, nil
+}
+
+// bytes reads a byte or text string's contents
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errTruncated
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *cborDecoder) value(depth int) (any, error) {
+	if depth > maxCBORDepth {
+		return nil, errors.New("cbor: nested too deeply")
+	}
+	start := d.pos
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflows int64")
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflows int64")
+		}
+		return -1 - int64(arg), nil
+	case 2:
+		return d.bytes(arg)
+	case 3:
+		b, err := d.bytes(arg)
+		return string(b), err
+	case 4:
+		// every element takes at least a byte, which bounds the allocation
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errTruncated
+		}
+		list := make([]any, 0, arg)
+		for range arg {
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case 5:
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errTruncated
+		}
+		m := make(map[string]any, arg)
+		for range arg {
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("cbor: map key is %T, not a string", k)
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+		return m, nil
+	case 6:
+		if arg != 42 {
+			return nil, fmt.Errorf("cbor: unsupported tag %d", arg)
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := v.([]byte)
+		if !ok || len(b) == 0 || b[0] != 0 {
+			return nil, errors.New("cbor: invalid cid link")
+		}
+		return cidLink(b[1:]), nil
+	default:
+		info := d.data[start] & 0x1f
+		switch {
+		case info == 20:
+			return false, nil
+		case info == 21:
+			return true, nil
+		case info == 22 || info == 23:
+			return nil, nil
+		case info >= 25 && info <= 27:
+			return math.Float64frombits(arg), nil
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+}
+
+// halfToFloat converts an IEEE 754 half-precision float
+func halfToFloat(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+	switch exp {
+	case 0:
+		// subnormal, or zero
+		f := float32(frac) / 1024 / 16384
+		if sign != 0 {
+			return -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | frac<<13)
+	}
+	return math.Float32frombits(sign | (exp+112)<<23 | frac<<13)
+}
+
+// cborToJSON converts a decoded DAG-CBOR value to the atproto JSON form,
+// where CID links become {"$link": cid} and bytes {"$bytes": base64}
+func cborToJSON(v any) ([]byte, error) {
+	return json.Marshal(jsonValue(v))
+}
+
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case cidLink:
+		return map[string]string{"$link": v.String()}
+	case []byte:
+		return map[string]string{"$bytes": base64.RawStdEncoding.EncodeToString(v)}
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = jsonValue(e)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = jsonValue(e)
+		}
+		return out
+	}
+	return v
+}
+
+// readCAR reads the blocks of a CAR v1 file, as carried in a commit's
+// blocks field, keyed by binary CID
+func readCAR(data []byte) (map[string][]byte, error) {
+	headerLen, n := binary.Uvarint(data)
+	if n <= 0 || headerLen > uint64(len(data)-n) {
+		return nil, errors.New("car: invalid header length")
+	}
+	pos := n + int(headerLen)
+
+	blocks := map[string][]byte{}
+	for pos < len(data) {
+		sectionLen, n := binary.Uvarint(data[pos:])
+		if n <= 0 || sectionLen > uint64(len(data)-pos-n) {
+			return nil, errors.New("car: invalid block length")
+		}
+		section := data[pos+n : pos+n+int(sectionLen)]
+		pos += n + int(sectionLen)
+
+		cidLen, err := cidLength(section)
+		if err != nil {
+			return nil, err
+		}
+		blocks[string(section[:cidLen])] = section[cidLen:]
+	}
+	return blocks, nil
+}
+
+// cidLength returns the length of the binary CIDv1 at the start of b: a
+// version, a codec, and a multihash of a hash function, a digest length,
+// and the digest
+func cidLength(b []byte) (int, error) {
+	var fields [4]uint64
+	pos := 0
+	for i := range fields {
+		v, n := binary.Uvarint(b[pos:])
+		if n <= 0 {
+			return 0, errors.New("car: invalid cid")
+		}
+		fields[i] = v
+		pos += n
+	}
+	if fields[0] != 1 {
+		return 0, fmt.Errorf("car: unsupported cid version %d", fields[0])
+	}
+	if digestLen := fields[3]; digestLen <= uint64(len(b)-pos) {
+		return pos + int(digestLen), nil
+	}
+	return 0, errors.New("car: invalid cid")
+}
@@ -0,0 +1,99 @@
+package jetstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	cid := blockCID([]byte("block"))
+	value := map[string]any{
+		"text": "hello", "count": 3, "negative": -2, "ok": true, "none": nil,
+		"bytes": []byte{1, 2}, "list": []any{"a", 1}, "link": cid,
+	}
+	data := appendCBOR(nil, value)
+	got, n, err := decodeCBOR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Errorf("read %d of %d bytes", n, len(data))
+	}
+	m := got.(map[string]any)
+	if m["text"] != "hello" || m["count"] != int64(3) || m["negative"] != int64(-2) || m["ok"] != true || m["none"] != nil {
+		t.Errorf("decoded %v", m)
+	}
+	if link, ok := m["link"].(cidLink); !ok || !bytes.Equal(link, cid) {
+		t.Errorf("link = %v, want %s", m["link"], cid)
+	}
+	js, err := cborToJSON(m["link"])
+	if err != nil || string(js) != `{"$link":"`+cid.String()+`"}` {
+		t.Errorf("link as JSON = %s, %v", js, err)
+	}
+}
+
+func TestDecodeCBORInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"truncated string", []byte{0x65, 'h', 'i'}, "unexpected end"},
+		{"map with int key", []byte{0xa1, 0x01, 0x01}, "map key"},
+		{"unsupported tag", []byte{0xd8, 0x2b, 0x40}, "unsupported tag"},
+		{"cid link without its prefix", append([]byte{0xd8, 0x2a, 0x42}, 0x01, 0x71), "invalid cid link"},
+		{"nested too deeply", bytes.Repeat([]byte{0x81}, maxCBORDepth+2), "nested too deeply"},
+		{"huge array", []byte{0x9a, 0xff, 0xff, 0xff, 0xff}, "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := decodeCBOR(tt.data); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCAR(t *testing.T) {
+	one, two := appendCBOR(nil, "one"), appendCBOR(nil, "two")
+	blocks, err := readCAR(carFile(one, two))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || !bytes.Equal(blocks[string(blockCID(one))], one) || !bytes.Equal(blocks[string(blockCID(two))], two) {
+		t.Errorf("blocks = %v", blocks)
+	}
+
+	truncated := carFile(one)
+	if _, err := readCAR(truncated[:len(truncated)-1]); err == nil {
+		t.Error("a truncated CAR was read")
+	}
+	badCID := carFile(one)
+	// the version of the block's cid
+	badCID[len(badCID)-len(one)-len(blockCID(one))] = 2
+	if _, err := readCAR(badCID); err == nil || !strings.Contains(err.Error(), "cid version") {
+		t.Errorf("got %v, want the cid version rejected", err)
+	}
+	if _, err := readCAR(binary.AppendUvarint(nil, 1000)); err == nil {
+		t.Error("a header longer than the file was read")
+	}
+}
+
+func TestFirehoseBlocksGet(t *testing.T) {
+	block := appendCBOR(nil, map[string]any{"text": "hello"})
+	cid := blockCID(block)
+	blocks := firehoseBlocks{string(cid): block}
+	if got, err := blocks.get(cid); err != nil || !bytes.Equal(got, block) {
+		t.Errorf("got %x, %v", got, err)
+	}
+
+	blocks[string(cid)] = appendCBOR(nil, map[string]any{"text": "tampered"})
+	if _, err := blocks.get(cid); err == nil || !strings.Contains(err.Error(), "doesn't match its cid") {
+		t.Errorf("got %v, want the tampered block rejected", err)
+	}
+	if _, err := blocks.get(blockCID([]byte("other"))); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("got %v, want the missing block reported", err)
+	}
+}
@@ -0,0 +1,929 @@
+// Package jetstream subscribes to a Bluesky Jetstream instance, parses its
+// messages, and hands them to registered handlers, reconnecting with
+// backoff and resuming from the last handled event when the connection
+// drops. It can also read a relay's native firehose directly, decoding its
+// CBOR frames into the same messages.
+package jetstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultURL is a public Bluesky hosted Jetstream instance
+	DefaultURL = "wss://jetstream1.us-west.bsky.network/subscribe"
+
+	// jetstream rejects subscriptions asking for more collections or DIDs
+	// than this
+	MaxWantedCollections = 100
+	MaxWantedDids        = 10000
+
+	// how long the reader gets to finish in-flight messages on shutdown
+	shutdownDrain = 2 * time.Second
+
+	// maxLoggedFilterValues is how many filter values are logged in full
+	// before the subscription log falls back to just a count
+	maxLoggedFilterValues = 10
+)
+
+// ErrRetriesExhausted is returned by Run when MaxRetries reconnects in a
+// row have failed
+var ErrRetriesExhausted = errors.New("reconnect retries exhausted")
+
+// Handler is called for every message read from the stream, in order, from
+// a single goroutine, unless Client.PerDIDOrder is set
+type Handler func(msg *Message)
+
+// Client is a Jetstream subscription. Set its fields before calling Run;
+// they must not be changed while it is running. Filters can be changed with
+// SetFilters instead, and the stream paused with Pause.
+type Client struct {
+	// URL is the subscribe endpoint, ws://, wss://, or unix:// for a
+	// socket, where /subscribe is requested over the socket at the URL path
+	URL string
+
+	// FallbackURLs are further endpoints to fail over to when the current
+	// one can't be reached, drops FailoverDisconnects connections in a row
+	// before they're healthy, or lags by more than MaxLag. Every endpoint
+	// is tried once before the reconnect delay grows, healthiest first,
+	// and the cursor carries over, rewound by FailoverRewind, so a
+	// failover resumes close to where the last host left off.
+	FallbackURLs []string
+
+	// FailoverDisconnects is how many connections in a row may drop before
+	// staying up 30 seconds before Run fails over. Zero uses 3.
+	FailoverDisconnects int
+
+	// MaxLag fails over from an endpoint whose events stay more than this
+	// far behind the clock for a minute without catching up. Zero
+	// disables it. Since time_us is when jetstream received an event,
+	// this measures the instance's own lag behind its relay.
+	MaxLag time.Duration
+
+	// FailoverRewind moves the cursor back this far when connecting to a
+	// different endpoint than the one the last events came from, since
+	// each jetstream instance stamps events with its own time_us. Events
+	// in between arrive twice, and can be dropped by deduplicating on
+	// their content. It doesn't apply with Firehose or Labeler, whose
+	// cursors are sequence numbers.
+	FailoverRewind time.Duration
+
+	// PickFastest, with FallbackURLs, dials every endpoint before the
+	// first connection and starts with the one whose handshake is
+	// quickest rather than with URL. With ProbeInterval set they are
+	// measured again that often, and Run switches to one that has become
+	// clearly faster than the endpoint in use, as a failover.
+	PickFastest   bool
+	ProbeInterval time.Duration
+
+	// WantedCollections and WantedDids are the server-side filters sent on
+	// subscribe. An empty filter subscribes to everything.
+	WantedCollections []string
+	WantedDids        []string
+
+	// Cursor is the time_us to replay from on the first connection, 0 for
+	// the live tail. Later connections resume from the last handled event.
+	Cursor int64
+
+	// Firehose reads com.atproto.sync.subscribeRepos from a relay or PDS
+	// instead of Jetstream, such as DefaultFirehoseURL, decoding the CBOR
+	// frames into the same messages. WantedCollections and WantedDids are
+	// applied locally, since the firehose can't filter, and Cursor and
+	// LastTimeUs are the relay's sequence numbers rather than time_us.
+	// Compress doesn't apply.
+	Firehose bool
+
+	// Labeler reads com.atproto.label.subscribeLabels from a labeler
+	// instead, each label becoming a message of kind "label". As with
+	// Firehose, WantedDids applies locally, to the labeled account, and
+	// Cursor and LastTimeUs are the labeler's sequence numbers.
+	Labeler bool
+
+	// VerifyKeys, with Firehose, verifies each commit before it is
+	// handled: its signature against the repo's signing key, as VerifyKeys
+	// resolves it, and each operation against the MST proof in the
+	// commit's blocks. Only commits with events passing the filters are
+	// verified. Events of commits that fail are passed to OnUnverified,
+	// and dropped unless it returns true. VerifyKeys is called from the
+	// read goroutine, or the workers with Workers set, so it should cache
+	// keys.
+	VerifyKeys   KeyResolver
+	OnUnverified func(msg *Message, err error) bool
+
+	// Compress asks jetstream for zstd-compressed frames, which roughly
+	// halves bandwidth. They are decompressed before parsing.
+	Compress bool
+
+	// AllowInsecureFallback retries a wss:// endpoint over unencrypted
+	// ws:// if the TLS handshake fails. Development only.
+	AllowInsecureFallback bool
+
+	// Header is sent with each websocket handshake, such as a User-Agent
+	// or the Authorization a private deployment requires
+	Header http.Header
+
+	// TLSConfig configures wss:// connections, such as with custom root
+	// CAs or a client certificate. Nil uses the system defaults.
+	TLSConfig *tls.Config
+
+	// Proxy returns the http:// or socks5:// proxy to connect to an
+	// endpoint through, or nil to connect directly. Nil uses
+	// http.ProxyFromEnvironment, which reads HTTPS_PROXY, HTTP_PROXY, and
+	// NO_PROXY. It doesn't apply to unix:// endpoints.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// PingInterval is how often a websocket ping is sent, and PongTimeout
+	// how long the connection may go without receiving anything before it
+	// is treated as dead. A zero PingInterval disables the keepalive.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// IdleTimeout reconnects when no message has arrived for this long,
+	// even though pings are answered, for a server that stays connected
+	// but stops streaming. Zero disables it. With narrow filters the
+	// stream can be legitimately quiet, so it should be set well above
+	// the usual gap between events.
+	IdleTimeout time.Duration
+
+	// MaxBackoff caps the delay between reconnects, which doubles from a
+	// second on consecutive failures. Zero uses the default of a minute.
+	MaxBackoff time.Duration
+
+	// MaxRetries makes Run give up with ErrRetriesExhausted after this many
+	// reconnect delays in a row without a healthy connection in between,
+	// for supervisors that should restart or alert instead. Zero retries
+	// forever.
+	MaxRetries int
+
+	// Workers parses frames on this many goroutines instead of the read
+	// goroutine, for streams too busy for one core, such as the full
+	// firehose. Handlers still run one at a time in stream order unless
+	// PerDIDOrder is set, and the cursor only moves past a frame once it
+	// has been handled. OnParseError, OnUnverified, and VerifyKeys are
+	// called from the workers, so they must be safe for concurrent use.
+	// Zero parses on the read goroutine.
+	Workers int
+
+	// PerDIDOrder, with Workers set, runs handlers on the workers too:
+	// each repo's events are handled in order, but different repos' events
+	// concurrently, so handlers must be safe for concurrent use.
+	PerDIDOrder bool
+
+	// QueueMin and QueueMax, with Workers set and QueueMax positive, let
+	// the queue of frames read ahead of handling resize itself between
+	// them, instead of holding 64 frames per worker: it grows while reading
+	// outpaces handling and shrinks while the stream is quiet, logging each
+	// resize at debug level
+	QueueMin int
+	QueueMax int
+
+	// CollectionPriority, with Workers set, hands commits waiting to be
+	// handled to the handlers highest priority first, by their collection's
+	// exact NSID, so important ones aren't held up behind noise when
+	// handling falls behind. Collections it doesn't list, and events that
+	// aren't commits, have priority 0, and events of equal priority, such as
+	// all of one collection's, keep stream order. It only reorders what is
+	// queued, so it makes no difference until the queue fills. The cursor
+	// only moves past a frame once it and everything before it have been
+	// handled. It is ignored with PerDIDOrder, which it would break.
+	CollectionPriority map[string]int
+
+	// Logger receives connection lifecycle logs
+	Logger zerolog.Logger
+
+	// OnConnect is called after each successful connection with the
+	// cursor it resumed from, and whether it is a reconnect
+	OnConnect func(cursor int64, reconnect bool)
+	// OnDisconnect is called when a connection ends for any reason
+	OnDisconnect func()
+	// OnDial is called after every dial with the endpoint, how long its
+	// handshake took, and the error if it failed. Dials cut short by
+	// cancellation aren't reported.
+	OnDial func(endpoint string, handshake time.Duration, err error)
+	// OnFrame is called with every frame read, before it is parsed
+	OnFrame func(messageType int, frame []byte)
+	// OnParseError is called for frames that fail to parse, after the
+	// error has been logged
+	OnParseError func(err error)
+	// OnFailover is called when Run gives up on an endpoint for another,
+	// with why: "dial", "disconnects", "lag", or "latency" when
+	// PickFastest found a faster one
+	OnFailover func(from, to, reason string)
+	// OnProbe is called with each PickFastest probe's endpoint, how long
+	// its handshake took, and the error if it failed
+	OnProbe func(endpoint string, handshake time.Duration, err error)
+
+	handlers []Handler
+	commits  *CommitMux
+
+	// the pipeline of the current connection with Workers set
+	pipeline atomic.Pointer[pipeline]
+
+	// the filters in use, from WantedCollections and WantedDids or
+	// SetFilters
+	filters atomic.Pointer[filterSet]
+
+	// paused is set by Pause, and wake signals Run to act on it, on new
+	// filters, or on Reconnect
+	paused   atomic.Bool
+	wake     chan struct{}
+	wakeOnce sync.Once
+
+	// time_us of the last event handled, across connections. It is
+	// written as events are handled and read by Run to resume on
+	// reconnect.
+	lastTimeUs atomic.Int64
+	// time_us of the last message dispatched, for MaxLag
+	lastEventUs atomic.Int64
+	// the cursor Rewind asked the next connection to resume from, 0 for
+	// none
+	rewindTo atomic.Int64
+	// one more than the index of the endpoint last connected to, and of
+	// the one a probe found faster, 0 for none
+	inUse     atomic.Int64
+	preferred atomic.Int64
+}
+
+// NewClient returns a Client for the subscribe endpoint at url, with the
+// default keepalive and logging to the global zerolog logger
+func NewClient(url string) *Client {
+	return &Client{
+		URL:          url,
+		PingInterval: 30 * time.Second,
+		PongTimeout:  60 * time.Second,
+		Logger:       log.Logger,
+	}
+}
+
+// Handle registers fn to be called for every message. Handlers run in the
+// order they were registered.
+func (c *Client) Handle(fn Handler) {
+	c.handlers = append(c.handlers, fn)
+}
+
+// On registers fn for commits to collection. Commit handlers run after the
+// handlers registered with Handle.
+func (c *Client) On(collection string, fn CommitHandler) {
+	c.commitMux().On(collection, fn)
+}
+
+// OnOther registers fn for commits to collections with no handler
+// registered with On
+func (c *Client) OnOther(fn CommitHandler) {
+	c.commitMux().Fallback(fn)
+}
+
+// LastTimeUs returns the time_us of the last message handled, or the
+// starting Cursor if none has been yet. It is safe to call while Run is
+// running, for persisting the position to resume from.
+func (c *Client) LastTimeUs() int64 {
+	return c.lastTimeUs.Load()
+}
+
+func (c *Client) commitMux() *CommitMux {
+	if c.commits == nil {
+		c.commits = NewCommitMux()
+	}
+	return c.commits
+}
+
+// Run connects and reads until ctx is cancelled, reconnecting whenever the
+// connection drops. On cancellation the websocket is closed cleanly and
+// Run returns nil once the last message in flight has been handled. With
+// MaxRetries set, it returns an error wrapping ErrRetriesExhausted once
+// they run out.
+func (c *Client) Run(ctx context.Context) error {
+	// number of dials since the last successful connection
+	attempts := 0
+
+	// number of successful connections so far
+	connections := 0
+
+	// reconnect delays, kept across connections so repeated failures keep
+	// backing off
+	maxBackoff := c.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = backoffMax
+	}
+	retry := newBackoff(min(backoffBase, maxBackoff), maxBackoff)
+
+	// endpoints to try, the one in use, the last one that connected, and
+	// how many have failed in a row since then
+	endpoints := append([]string{c.URL}, c.FallbackURLs...)
+	current, lastGood, failures := 0, 0, 0
+	health := newEndpointHealth(len(endpoints))
+	failoverDisconnects := c.FailoverDisconnects
+	if failoverDisconnects <= 0 {
+		failoverDisconnects = defaultFailoverDisconnects
+	}
+
+	if c.PickFastest && len(endpoints) > 1 {
+		current = c.pickFastest(ctx, endpoints)
+		lastGood = current
+		if c.ProbeInterval > 0 {
+			go c.reprobe(ctx, endpoints)
+		}
+	}
+
+	// the cursor a failover rewind started from and the one it stored,
+	// so redialing a standby doesn't rewind again from an already rewound
+	// cursor
+	var rewoundFrom, rewoundTo int64
+	rewinding := false
+
+	c.lastTimeUs.Store(c.Cursor)
+
+	for {
+		if c.paused.Load() {
+			c.Logger.Info().Int64("cursor", c.lastTimeUs.Load()).Msg("paused")
+			for c.paused.Load() {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-c.wakeChan():
+				}
+			}
+			c.Logger.Info().Msg("resuming")
+		}
+		// anything that woke Run before this point is taken care of by the
+		// connection about to be made
+		select {
+		case <-c.wakeChan():
+		default:
+		}
+		if to := c.rewindTo.Swap(0); to > 0 {
+			// after the old connection's events have been handled, so
+			// none of them move the cursor past it again
+			c.lastTimeUs.Store(to)
+		}
+
+		if p := int(c.preferred.Swap(0)) - 1; p >= 0 && p != current {
+			from := current
+			current = p
+			c.failedOver(endpoints[from], endpoints[current], "latency")
+		}
+
+		endpoint := endpoints[current]
+		c.Logger.Info().Str("endpoint", endpoint).Msg("connecting to jetstream")
+
+		attempts++
+		cursor := c.lastTimeUs.Load()
+		if rewinding && cursor != rewoundTo {
+			// the position moved since, as when a rejected cursor is reset
+			rewinding = false
+		}
+		switch {
+		case current != lastGood && cursor > 0 && c.FailoverRewind > 0 && !c.Firehose && !c.Labeler:
+			// once per switch away from the last good endpoint, however
+			// many dials it takes, and stored so a retry doesn't skip what
+			// the rewind was for
+			if !rewinding {
+				rewinding, rewoundFrom = true, cursor
+			}
+			cursor = rewoundFrom - c.FailoverRewind.Microseconds()
+			rewoundTo = cursor
+			c.lastTimeUs.Store(cursor)
+		case current == lastGood && rewinding:
+			// back to the endpoint the cursor came from, which needs no
+			// rewind
+			cursor, rewinding = rewoundFrom, false
+			c.lastTimeUs.Store(cursor)
+		}
+		conn, handshake, err := c.connect(ctx, endpoint, cursor)
+		c.Logger.Debug().
+			Str("endpoint", endpoint).
+			Int("attempt", attempts).
+			Dur("handshake", handshake).
+			Bool("ok", err == nil).
+			Msg("dial attempt")
+		if err != nil && ctx.Err() != nil {
+			// cancelled while dialing
+			return nil
+		}
+		if c.OnDial != nil {
+			c.OnDial(endpoint, handshake, err)
+		}
+		if err != nil {
+			switch classifyRejection(err) {
+			case rejectedCursor:
+				c.resetCursor()
+			case rejectedOverload:
+				retry.slowDown()
+			}
+			failures++
+			health.fail(current)
+			health.tried[current] = true
+			if failures < len(endpoints) {
+				// still endpoints left this round, so move on without
+				// waiting
+				from := current
+				current = health.next(current)
+				c.Logger.Error().
+					Err(err).
+					Str("next_endpoint", endpoints[current]).
+					Msg("connection error, failing over")
+				c.failedOver(endpoints[from], endpoints[current], "dial")
+				continue
+			}
+			// every endpoint has failed, so back off and start the next
+			// round from the one that last worked
+			failures = 0
+			current = lastGood
+			health.newRound()
+			if c.retriesExhausted(retry) {
+				return fmt.Errorf("%w: %v", ErrRetriesExhausted, err)
+			}
+			wait := retry.next()
+			c.Logger.Error().Err(err).Dur("retry_in", wait).Msg("connection error, retrying")
+			if !c.sleep(ctx, wait) {
+				return nil
+			}
+			continue
+		}
+		connectedAt := time.Now()
+		lastGood, failures, rewinding = current, 0, false
+		c.inUse.Store(int64(current + 1))
+		health.newRound()
+
+		c.Logger.Info().
+			Str("endpoint", endpoint).
+			Int("dial_attempts", attempts).
+			Dur("handshake", handshake).
+			Msg("connected")
+		c.logSubscription(endpoint, cursor)
+		if c.OnConnect != nil {
+			c.OnConnect(cursor, connections > 0)
+		}
+		connections++
+		attempts = 0
+
+		done := make(chan struct{})
+		ka := startKeepalive(conn, c.PingInterval, c.PongTimeout, c.IdleTimeout, done, c.Logger)
+		// only read once done is closed
+		var readErr error
+		go func() {
+			defer close(done)
+			readErr = c.read(conn, ka)
+		}()
+
+		if lag, lagging := c.waitLagging(ctx, done, len(endpoints)); lagging {
+			health.fail(current)
+			from := current
+			current = health.next(current)
+			c.Logger.Warn().
+				Str("endpoint", endpoints[from]).
+				Dur("lag", lag).
+				Dur("max_lag", c.MaxLag).
+				Str("next_endpoint", endpoints[current]).
+				Msg("stream keeps lagging, failing over")
+			c.disconnect(conn, ka, done)
+			c.failedOver(endpoints[from], endpoints[current], "lag")
+			continue
+		}
+
+		select {
+		case <-done:
+			// after a keepalive or idle timeout the socket is still open,
+			// so it has to be torn down here
+			conn.Close()
+			if c.OnDisconnect != nil {
+				c.OnDisconnect()
+			}
+			rejected := classifyRejection(readErr)
+			healthy := time.Since(connectedAt) >= healthyConnection
+			if healthy && rejected != rejectedOverload {
+				retry.reset()
+			}
+			if healthy {
+				health.ok(current)
+			} else {
+				health.fail(current)
+			}
+			switch rejected {
+			case rejectedCursor:
+				c.resetCursor()
+			case rejectedOverload:
+				retry.slowDown()
+			}
+			if len(endpoints) > 1 && health.strikes[current] >= failoverDisconnects {
+				from := current
+				current = health.next(current)
+				c.Logger.Warn().
+					Str("endpoint", endpoints[from]).
+					Int("disconnects", health.strikes[from]).
+					Str("next_endpoint", endpoints[current]).
+					Msg("connections keep dropping, failing over")
+				c.failedOver(endpoints[from], endpoints[current], "disconnects")
+				continue
+			}
+			if c.retriesExhausted(retry) {
+				return fmt.Errorf("%w: connection closed: %v", ErrRetriesExhausted, readErr)
+			}
+			wait := retry.next()
+			c.Logger.Info().Dur("retry_in", wait).Msg("connection closed, reconnecting")
+			if !c.sleep(ctx, wait) {
+				return nil
+			}
+		case <-ctx.Done():
+			c.disconnect(conn, ka, done)
+			return nil
+		case <-c.wakeChan():
+			if !c.paused.Load() && c.preferred.Load() == 0 {
+				c.Logger.Info().Msg("reconnecting on request")
+			}
+			c.disconnect(conn, ka, done)
+		}
+	}
+}
+
+// waitLagging watches the connection's lag with MaxLag set and fallbacks to
+// use, until done is closed, ctx is cancelled, or Run is woken, which the
+// caller handles. It returns true and the lag if the connection lagged
+// too long, with the connection still open.
+func (c *Client) waitLagging(ctx context.Context, done chan struct{}, endpoints int) (time.Duration, bool) {
+	if c.MaxLag <= 0 || endpoints < 2 {
+		return 0, false
+	}
+	ticker := time.NewTicker(lagCheckInterval)
+	defer ticker.Stop()
+	// events from before this connection don't count
+	monitor := &lagMonitor{max: c.MaxLag, lastTimeUs: c.lastEventUs.Load()}
+	for {
+		select {
+		case <-done:
+			return 0, false
+		case <-ctx.Done():
+			return 0, false
+		case <-c.wakeChan():
+			// passed back for the caller's select to see
+			c.wakeUp()
+			return 0, false
+		case <-ticker.C:
+			if lag, lagging := monitor.check(c.lastEventUs.Load()); lagging {
+				return lag, true
+			}
+		}
+	}
+}
+
+// failedOver reports a failover to OnFailover
+func (c *Client) failedOver(from, to, reason string) {
+	if c.OnFailover != nil {
+		c.OnFailover(from, to, reason)
+	}
+}
+
+// disconnect closes conn cleanly once its reader, which closes done, has
+// finished the message it is on
+func (c *Client) disconnect(conn *websocket.Conn, ka *keepalive, done chan struct{}) {
+	// the deadline lets the reader finish the message it is on and see the
+	// server's close reply, without hanging on a dead peer
+	ka.drain(shutdownDrain)
+	err := conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("error closing connection")
+	}
+	<-done
+	conn.Close()
+	if c.OnDisconnect != nil {
+		c.OnDisconnect()
+	}
+}
+
+// retriesExhausted reports whether MaxRetries reconnect delays have been
+// used up since the last healthy connection
+func (c *Client) retriesExhausted(retry *backoff) bool {
+	if c.MaxRetries <= 0 || retry.retries < c.MaxRetries {
+		return false
+	}
+	c.Logger.Error().Int("retries", retry.retries).Msg("giving up after too many reconnect attempts")
+	return true
+}
+
+// read handles messages from conn until it fails, and returns the error
+// that ended it. With Workers set, frames already read are handled before
+// it returns.
+func (c *Client) read(conn *websocket.Conn, ka *keepalive) error {
+	if c.Workers <= 0 {
+		return c.readFrames(conn, ka, nil)
+	}
+	p := c.startPipeline()
+	err := c.readFrames(conn, ka, p)
+	if perr := p.close(); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// readFrames reads frames from conn until it fails, handling them itself
+// or submitting them to p
+func (c *Client) readFrames(conn *websocket.Conn, ka *keepalive, p *pipeline) error {
+	for {
+		messageType, message, err := conn.ReadMessage()
+		received := time.Now()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			c.Logger.Info().Msg("connection closed normally")
+			return err
+		}
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			c.Logger.Warn().
+				Int("code", closeErr.Code).
+				Str("reason", closeErr.Text).
+				Msg("connection closed by jetstream")
+			return err
+		}
+		if err != nil {
+			if ka.stalled.Load() {
+				c.Logger.Warn().
+					Dur("idle_timeout", c.IdleTimeout).
+					Msg("no messages from jetstream in time, assuming the stream has stalled")
+			} else if ka.timedOut(err) {
+				c.Logger.Warn().
+					Dur("pong_timeout", c.PongTimeout).
+					Msg("no data or pong from jetstream in time, assuming the connection is dead")
+			} else {
+				c.Logger.Error().Err(err).Msg("read error")
+			}
+			return err
+		}
+		ka.extend()
+		ka.received()
+
+		if c.OnFrame != nil {
+			c.OnFrame(messageType, message)
+		}
+
+		if p != nil {
+			if err := p.submit(messageType, message, received); err != nil {
+				return err
+			}
+			continue
+		}
+		r := c.parseFrame(messageType, message, received)
+		c.handleFrame(r)
+		if r.err != nil {
+			return r.err
+		}
+	}
+}
+
+// frameResult is what a frame parsed into: the messages to handle, the
+// cursor to resume from once they have been, or 0 to leave it, and an
+// error that ends the connection
+type frameResult struct {
+	messages []*Message
+	cursor   int64
+	err      error
+}
+
+// parseFrame parses a frame read at received, stamping its messages with
+// when it was read and parsed
+func (c *Client) parseFrame(messageType int, frame []byte, received time.Time) frameResult {
+	r := c.parse(messageType, frame)
+	parsed := time.Now()
+	for _, msg := range r.messages {
+		msg.ReceivedAt, msg.ParsedAt = received, parsed
+	}
+	return r
+}
+
+// parse parses a frame, logging frames that carry nothing to handle
+func (c *Client) parse(messageType int, frame []byte) frameResult {
+	if c.Firehose {
+		return c.parseFirehoseFrame(frame)
+	}
+	if c.Labeler {
+		return c.parseLabelFrame(frame)
+	}
+	msg, err := ParseMessage(messageType, frame)
+	if errors.Is(err, ErrSkipFrame) {
+		c.Logger.Trace().Err(err).Int("len", len(frame)).Msg("skipping frame")
+		return frameResult{}
+	}
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("parse error")
+		if c.OnParseError != nil {
+			c.OnParseError(err)
+		}
+		return frameResult{}
+	}
+	return frameResult{messages: []*Message{msg}, cursor: msg.TimeUs}
+}
+
+// handleFrame dispatches a parsed frame's messages and then advances the
+// cursor past it
+func (c *Client) handleFrame(r frameResult) {
+	for _, msg := range r.messages {
+		c.dispatch(msg)
+	}
+	if r.cursor > 0 {
+		c.lastTimeUs.Store(r.cursor)
+	}
+}
+
+// dispatch hands msg to the handlers
+func (c *Client) dispatch(msg *Message) {
+	c.lastEventUs.Store(msg.TimeUs)
+	for _, h := range c.handlers {
+		h(msg)
+	}
+	if c.commits != nil {
+		c.commits.Dispatch(msg)
+	}
+}
+
+// sleep waits for d before a reconnect, returning false early if ctx is
+// cancelled first, or true early if Run is woken
+func (c *Client) sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.wakeChan():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// subscribeURL builds the subscribe URL for endpoint with the current filters,
+// replaying from cursor (a time_us) when it is set
+func (c *Client) subscribeURL(endpoint string, cursor int64) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if c.Firehose || c.Labeler {
+		// the firehose has no filters or compression, just a cursor
+		if cursor > 0 {
+			q.Set("cursor", strconv.FormatInt(cursor, 10))
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+	// repeated parameters, not a comma-joined value, is what jetstream
+	// expects for multiple filters
+	filters := c.currentFilters()
+	for _, col := range filters.collections {
+		q.Add("wantedCollections", col)
+	}
+	for _, d := range filters.dids {
+		q.Add("wantedDids", d)
+	}
+	if cursor > 0 {
+		q.Set("cursor", strconv.FormatInt(cursor, 10))
+	}
+	if c.Compress {
+		q.Set("compress", "true")
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// unixDialer handles unix:// endpoints such as
+// unix:///run/jetstream.sock?wantedCollections=app.bsky.feed.post, where the
+// URL path is the socket to dial. It returns a dialer that connects to the
+// socket and the ws:// URL to request over it, path with the original
+// query.
+func unixDialer(target, path string) (*websocket.Dialer, string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Path == "" {
+		return nil, "", fmt.Errorf("unix url %q has no socket path", target)
+	}
+
+	socket := u.Path
+	dialer := *websocket.DefaultDialer
+	dialer.NetDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+
+	ws := url.URL{Scheme: "ws", Host: "localhost", Path: path, RawQuery: u.RawQuery}
+	return &dialer, ws.String(), nil
+}
+
+// dialer returns the websocket dialer for ws:// and wss:// endpoints,
+// with TLSConfig and Proxy if they are set
+func (c *Client) dialer() *websocket.Dialer {
+	if c.TLSConfig == nil && c.Proxy == nil {
+		return websocket.DefaultDialer
+	}
+	dialer := *websocket.DefaultDialer
+	if c.TLSConfig != nil {
+		dialer.TLSClientConfig = c.TLSConfig
+	}
+	if c.Proxy != nil {
+		dialer.Proxy = c.Proxy
+	}
+	return &dialer
+}
+
+// logSubscription logs the subscription parameters sent to the server
+func (c *Client) logSubscription(endpoint string, cursor int64) {
+	filters := c.currentFilters()
+	event := c.Logger.Info().Str("endpoint", endpoint)
+	if len(filters.collections) == 0 {
+		event = event.Str("collections", "all")
+	} else if len(filters.collections) > maxLoggedFilterValues {
+		event = event.Int("collections_count", len(filters.collections))
+	} else {
+		event = event.Strs("collections", filters.collections)
+	}
+	if len(filters.dids) == 0 {
+		event = event.Str("dids", "all")
+	} else if len(filters.dids) > maxLoggedFilterValues {
+		event = event.Int("dids_count", len(filters.dids))
+	} else {
+		event = event.Strs("dids", filters.dids)
+	}
+	if cursor > 0 {
+		event = event.Int64("cursor", cursor)
+	} else {
+		event = event.Str("cursor", "live")
+	}
+	event.Msg("subscription")
+}
+
+// connect dials endpoint, replaying from cursor if it is set, and reports
+// how long the websocket handshake took. Cancelling ctx aborts the dial.
+func (c *Client) connect(ctx context.Context, endpoint string, cursor int64) (*websocket.Conn, time.Duration, error) {
+	target, err := c.subscribeURL(endpoint, cursor)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid url: %v", err)
+	}
+
+	dialer := c.dialer()
+	if strings.HasPrefix(target, "unix://") {
+		path := "/subscribe"
+		if c.Firehose {
+			path = firehosePath
+		}
+		if c.Labeler {
+			path = LabelsPath
+		}
+		dialer, target, err = unixDialer(target, path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid url: %v", err)
+		}
+	}
+
+	start := time.Now()
+	conn, resp, err := dialer.DialContext(ctx, target, c.Header)
+	if err != nil && c.AllowInsecureFallback && strings.HasPrefix(target, "wss://") && isTLSError(err) {
+		insecure := "ws://" + strings.TrimPrefix(target, "wss://")
+		c.Logger.Warn().
+			Err(err).
+			Str("endpoint", insecure).
+			Msg("INSECURE: tls handshake failed, falling back to unencrypted ws because insecure fallback is enabled")
+		start = time.Now()
+		conn, resp, err = dialer.DialContext(ctx, insecure, c.Header)
+	}
+	handshake := time.Since(start)
+	if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+		err = newHandshakeError(resp)
+	}
+	if err != nil {
+		return nil, handshake, fmt.Errorf("dial error: %w", err)
+	}
+	return conn, handshake, nil
+}
+
+// isTLSError reports whether err came from the TLS handshake or certificate
+// verification, as opposed to the network or the websocket upgrade
+func isTLSError(err error) bool {
+	var (
+		recordErr    tls.RecordHeaderError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	return errors.As(err, &recordErr) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
@@ -0,0 +1,320 @@
+package jetstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+// standby is a jetstream endpoint that refuses its first few dials,
+// then accepts and reports the cursor it was asked for
+type standby struct {
+	refusals int
+
+	mu      sync.Mutex
+	dials   int
+	cursors chan int64
+}
+
+func (s *standby) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.dials++
+	refuse := s.dials <= s.refusals
+	s.mu.Unlock()
+	if refuse {
+		http.Error(w, "not yet", http.StatusInternalServerError)
+		return
+	}
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	cursor, _ := strconv.ParseInt(r.URL.Query().Get("cursor"), 10, 64)
+	s.cursors <- cursor
+	// held open until the client goes away
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func wsURL(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/subscribe"
+}
+
+func TestFailoverRewindsOncePerSwitch(t *testing.T) {
+	// the primary was the last to deliver events, and can't be reached
+	down := httptest.NewServer(http.NotFoundHandler())
+	primary := wsURL(down)
+	down.Close()
+
+	s := &standby{refusals: 3, cursors: make(chan int64, 1)}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	const cursor = int64(1_700_000_000_000_000)
+	c := NewClient(primary)
+	c.FallbackURLs = []string{wsURL(server)}
+	c.Cursor = cursor
+	c.FailoverRewind = 5 * time.Second
+	c.MaxBackoff = 10 * time.Millisecond
+	c.Logger = zerolog.Nop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case got := <-s.cursors:
+		want := cursor - c.FailoverRewind.Microseconds()
+		if got != want {
+			t.Errorf("standby was asked for cursor %d, want %d, rewound %s once", got, want, c.FailoverRewind)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the client never connected to the standby")
+	}
+}
+
+func TestOnDialReportsEveryDial(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	primary := wsURL(down)
+	down.Close()
+
+	s := &standby{refusals: 1, cursors: make(chan int64, 1)}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	type dial struct {
+		endpoint string
+		ok       bool
+	}
+	var mu sync.Mutex
+	var dials []dial
+	c := NewClient(primary)
+	c.FallbackURLs = []string{wsURL(server)}
+	c.MaxBackoff = 10 * time.Millisecond
+	c.Logger = zerolog.Nop()
+	c.OnDial = func(endpoint string, handshake time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dials = append(dials, dial{endpoint, err == nil})
+		if err == nil && handshake <= 0 {
+			t.Errorf("handshake with %s took %s", endpoint, handshake)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	select {
+	case <-s.cursors:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the client never connected to the standby")
+	}
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	// the primary can't be reached and the standby refuses once, then
+	// every endpoint is tried again
+	want := []dial{{primary, false}, {wsURL(server), false}, {primary, false}, {wsURL(server), true}}
+	if len(dials) != len(want) {
+		t.Fatalf("dials = %v, want %v", dials, want)
+	}
+	for i := range want {
+		if dials[i] != want[i] {
+			t.Errorf("dial %d = %v, want %v", i, dials[i], want[i])
+		}
+	}
+}
+
+// feeder is a jetstream endpoint that reports the cursor of each
+// connection and sends it the same events
+type feeder struct {
+	frames []string
+	// binary sends them as binary messages, as the firehose does
+	binary  bool
+	cursors chan int64
+}
+
+func (f *feeder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	cursor, _ := strconv.ParseInt(r.URL.Query().Get("cursor"), 10, 64)
+	f.cursors <- cursor
+	messageType := websocket.TextMessage
+	if f.binary {
+		messageType = websocket.BinaryMessage
+	}
+	for _, frame := range f.frames {
+		if err := conn.WriteMessage(messageType, []byte(frame)); err != nil {
+			return
+		}
+	}
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func TestRewindResumesFromCursor(t *testing.T) {
+	f := &feeder{cursors: make(chan int64, 2)}
+	for _, us := range []int64{1_700_000_010_000_000, 1_700_000_011_000_000, 1_700_000_012_000_000} {
+		f.frames = append(f.frames, `{"did":"did:plc:abc","time_us":`+strconv.FormatInt(us, 10)+`,"kind":"identity","identity":{"did":"did:plc:abc","seq":1,"time":"2023-11-14T22:13:30Z"}}`)
+	}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	const rewindTo = int64(1_700_000_000_000_000)
+	c := NewClient(wsURL(server))
+	c.MaxBackoff = 10 * time.Millisecond
+	c.Logger = zerolog.Nop()
+	var once sync.Once
+	c.Handle(func(msg *Message) {
+		// the events after this one are still handled before the
+		// connection closes, and mustn't move the cursor
+		once.Do(func() { c.Rewind(rewindTo) })
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for i, want := range []int64{0, rewindTo} {
+		select {
+		case got := <-f.cursors:
+			if got != want {
+				t.Errorf("connection %d resumed from %d, want %d", i+1, got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("connection %d was never made", i+1)
+		}
+	}
+}
+
+// slowEndpoint is a jetstream endpoint that takes delay to answer the
+// handshake, then holds the connection open until the client goes away
+type slowEndpoint struct {
+	delay atomic.Int64
+}
+
+func (s *slowEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(time.Duration(s.delay.Load()))
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func TestFastest(t *testing.T) {
+	tests := []struct {
+		name       string
+		handshakes []time.Duration
+		want       int
+	}{
+		{"quickest", []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond}, 1},
+		{"unreachable skipped", []time.Duration{-1, 30 * time.Millisecond, -1}, 1},
+		{"first on ties", []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}, 0},
+		{"none reachable", []time.Duration{-1, -1}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fastest(tt.handshakes); got != tt.want {
+				t.Errorf("fastest(%v) = %d, want %d", tt.handshakes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickFastest(t *testing.T) {
+	slow, fast := &slowEndpoint{}, &slowEndpoint{}
+	slow.delay.Store(int64(300 * time.Millisecond))
+	slowServer, fastServer := httptest.NewServer(slow), httptest.NewServer(fast)
+	defer slowServer.Close()
+	defer fastServer.Close()
+
+	dials := make(chan string, 10)
+	failovers := make(chan string, 10)
+	c := NewClient(wsURL(slowServer))
+	c.FallbackURLs = []string{wsURL(fastServer)}
+	c.PickFastest = true
+	c.ProbeInterval = 50 * time.Millisecond
+	c.MaxBackoff = 10 * time.Millisecond
+	c.Logger = zerolog.Nop()
+	c.OnDial = func(endpoint string, handshake time.Duration, err error) {
+		if err == nil {
+			dials <- endpoint
+		}
+	}
+	c.OnFailover = func(from, to, reason string) {
+		failovers <- reason + " " + to
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the second endpoint answers first, so it is the one connected to
+	select {
+	case got := <-dials:
+		if got != wsURL(fastServer) {
+			t.Fatalf("connected to %s first, want the fastest, %s", got, wsURL(fastServer))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("never connected")
+	}
+
+	// then they trade places, and a probe moves the connection over
+	slow.delay.Store(0)
+	fast.delay.Store(int64(300 * time.Millisecond))
+	select {
+	case got := <-failovers:
+		if want := "latency " + wsURL(slowServer); got != want {
+			t.Fatalf("failed over with %q, want %q", got, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("never switched to the endpoint that became faster")
+	}
+	select {
+	case got := <-dials:
+		if got != wsURL(slowServer) {
+			t.Fatalf("reconnected to %s, want %s", got, wsURL(slowServer))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("never reconnected after switching")
+	}
+}
@@ -0,0 +1,112 @@
+package jetstream
+
+import (
+	"fmt"
+	"slices"
+)
+
+// filterSet is the WantedCollections and WantedDids in use, replaced as a
+// whole by SetFilters
+type filterSet struct {
+	collections []string
+	dids        []string
+	// dids as a set, for filtering the firehose locally
+	didSet map[string]bool
+}
+
+func newFilterSet(collections, dids []string) *filterSet {
+	f := &filterSet{
+		collections: slices.Clone(collections),
+		dids:        slices.Clone(dids),
+		didSet:      make(map[string]bool, len(dids)),
+	}
+	for _, d := range dids {
+		f.didSet[d] = true
+	}
+	return f
+}
+
+// currentFilters returns the filters in use, WantedCollections and
+// WantedDids until SetFilters replaces them
+func (c *Client) currentFilters() *filterSet {
+	if f := c.filters.Load(); f != nil {
+		return f
+	}
+	c.filters.CompareAndSwap(nil, newFilterSet(c.WantedCollections, c.WantedDids))
+	return c.filters.Load()
+}
+
+// Filters returns the collection and DID filters in use
+func (c *Client) Filters() (collections, dids []string) {
+	f := c.currentFilters()
+	return slices.Clone(f.collections), slices.Clone(f.dids)
+}
+
+// SetFilters replaces the collection and DID filters, which are otherwise
+// fixed by WantedCollections and WantedDids. Jetstream only takes filters
+// on subscribe, so the client reconnects, resuming from the last handled
+// event so nothing is missed; the firehose is filtered locally and carries
+// on. It is safe to call while Run is running.
+func (c *Client) SetFilters(collections, dids []string) error {
+	if len(collections) > MaxWantedCollections {
+		return fmt.Errorf("%d collections is more than jetstream's limit of %d", len(collections), MaxWantedCollections)
+	}
+	if len(dids) > MaxWantedDids {
+		return fmt.Errorf("%d dids is more than jetstream's limit of %d", len(dids), MaxWantedDids)
+	}
+	c.filters.Store(newFilterSet(collections, dids))
+	if !c.Firehose && !c.Labeler {
+		c.Reconnect()
+	}
+	return nil
+}
+
+// Pause closes the connection once the messages in flight have been
+// handled, and stays disconnected until Resume, which reconnects from the
+// last handled event. It is safe to call while Run is running.
+func (c *Client) Pause() {
+	c.paused.Store(true)
+	c.wakeUp()
+}
+
+// Resume reconnects after Pause
+func (c *Client) Resume() {
+	c.paused.Store(false)
+	c.wakeUp()
+}
+
+// Paused reports whether the client is paused
+func (c *Client) Paused() bool {
+	return c.paused.Load()
+}
+
+// Reconnect closes the current connection, or cuts short the wait before
+// the next one, and connects again right away, resuming from the last
+// handled event. It is safe to call while Run is running.
+func (c *Client) Reconnect() {
+	c.wakeUp()
+}
+
+// Rewind reconnects like Reconnect, but resumes from cursor rather than
+// the last handled event, to replay events again. Events handled before
+// the connection closes don't move it. It is safe to call while Run is
+// running.
+func (c *Client) Rewind(cursor int64) {
+	c.rewindTo.Store(cursor)
+	c.wakeUp()
+}
+
+// wakeUp tells Run to act on a changed pause state or filters: a connected
+// client disconnects, and one waiting to reconnect stops waiting
+func (c *Client) wakeUp() {
+	select {
+	case c.wakeChan() <- struct{}{}:
+	default:
+		// already woken
+	}
+}
+
+func (c *Client) wakeChan() chan struct{} {
+	c.wakeOnce.Do(func() { c.wake = make(chan struct{}, 1) })
+	return c.wake
+}
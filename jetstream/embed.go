@@ -0,0 +1,120 @@
+package jetstream
+
+import "encoding/json"
+
+// Embed is a post's embed. Which fields are set depends on Type:
+//
+//   - app.bsky.embed.images: Images
+//   - app.bsky.embed.video: Video, with its Alt text
+//   - app.bsky.embed.external: External
+//   - app.bsky.embed.record: Record, the quoted record
+//   - app.bsky.embed.recordWithMedia: Record, and Media holding the images,
+//     video, or external embed alongside it
+//
+// Other types only have Type set.
+type Embed struct {
+	Type     string         `json:"$type"`
+	Images   []EmbedImage   `json:"images,omitempty"`
+	Video    *Blob          `json:"video,omitempty"`
+	Alt      string         `json:"alt,omitempty"`
+	External *EmbedExternal `json:"external,omitempty"`
+	Record   *EmbedRecord   `json:"-"`
+	Media    *Embed         `json:"media,omitempty"`
+}
+
+// EmbedImage is one image of an app.bsky.embed.images embed
+type EmbedImage struct {
+	Image *Blob  `json:"image"`
+	Alt   string `json:"alt"`
+}
+
+// EmbedExternal is the link card of an app.bsky.embed.external embed
+type EmbedExternal struct {
+	URI         string `json:"uri"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Thumb       *Blob  `json:"thumb,omitempty"`
+}
+
+// EmbedRecord references the record a post quotes. Detached isn't part of
+// the lexicon, which records detachment in the quoted author's postgate,
+// but is kept for the clients that set it.
+type EmbedRecord struct {
+	URI      string `json:"uri"`
+	Cid      string `json:"cid"`
+	Detached *bool  `json:"detached,omitempty"`
+}
+
+// UnmarshalJSON decodes an embed, whose record field is the quoted record's
+// reference in app.bsky.embed.record but wraps it in a record embed of its
+// own in app.bsky.embed.recordWithMedia
+func (e *Embed) UnmarshalJSON(data []byte) error {
+	type plain Embed
+	var embed struct {
+		plain
+		Record json.RawMessage `json:"record"`
+	}
+	if err := json.Unmarshal(data, &embed); err != nil {
+		return err
+	}
+	*e = Embed(embed.plain)
+	if len(embed.Record) == 0 {
+		return nil
+	}
+	var record struct {
+		EmbedRecord
+		Record *EmbedRecord `json:"record"`
+	}
+	if err := json.Unmarshal(embed.Record, &record); err != nil {
+		return err
+	}
+	switch {
+	case e.Type == "app.bsky.embed.recordWithMedia":
+		e.Record = record.Record
+	default:
+		e.Record = &record.EmbedRecord
+	}
+	return nil
+}
+
+// MarshalJSON encodes an embed the way UnmarshalJSON reads it
+func (e Embed) MarshalJSON() ([]byte, error) {
+	type plain Embed
+	embed := struct {
+		plain
+		Record any `json:"record,omitempty"`
+	}{plain: plain(e)}
+	if e.Record != nil {
+		embed.Record = e.Record
+		if e.Type == "app.bsky.embed.recordWithMedia" {
+			embed.Record = map[string]any{"$type": "app.bsky.embed.record", "record": e.Record}
+		}
+	}
+	return json.Marshal(embed)
+}
+
+// DecodeEmbed decodes a Post's Embed, which is left as generic JSON. It
+// returns nil for a post without an embed.
+func DecodeEmbed(embed any) (*Embed, error) {
+	if embed == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(embed)
+	if err != nil {
+		return nil, err
+	}
+	var e Embed
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Link returns the CID the blob points at, including for legacy blobs,
+// which carry it as cid rather than a ref
+func (b *Blob) Link() string {
+	if b.Ref.Link != "" {
+		return b.Ref.Link
+	}
+	return b.LegacyCid
+}
@@ -0,0 +1,290 @@
+package jetstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultFirehoseURL is the Bluesky relay's firehose, for Client.Firehose
+const DefaultFirehoseURL = "wss://bsky.network/xrpc/com.atproto.sync.subscribeRepos"
+
+// firehosePath is requested over unix:// sockets in firehose mode
+const firehosePath = "/xrpc/com.atproto.sync.subscribeRepos"
+
+// FirehoseError is an error frame from the firehose, such as FutureCursor
+// or ConsumerTooSlow, which the server sends before closing the connection
+type FirehoseError struct {
+	Name    string
+	Message string
+}
+
+func (e *FirehoseError) Error() string {
+	if e.Message == "" {
+		return "firehose error: " + e.Name
+	}
+	return fmt.Sprintf("firehose error: %s: %s", e.Name, e.Message)
+}
+
+// firehoseInfo is an #info frame, such as OutdatedCursor. It carries no
+// event, but unlike other skipped frames it is worth logging.
+type firehoseInfo struct {
+	name, message string
+}
+
+func (i *firehoseInfo) Error() string {
+	return fmt.Sprintf("firehose info: %s: %s", i.name, i.message)
+}
+
+func (i *firehoseInfo) Unwrap() error { return ErrSkipFrame }
+
+// ParseFirehoseFrame decodes a com.atproto.sync.subscribeRepos frame, a
+// DAG-CBOR header followed by a DAG-CBOR body, into the Jetstream-shaped
+// messages it carries, along with the frame's sequence number. A #commit
+// becomes one message per operation, with the record read from the
+// commit's blocks and converted to JSON; #identity and #account become one
+// message each. Operations whose record isn't in the blocks, as happens for
+// tooBig commits, are left out. Each message's Raw is its Jetstream JSON.
+//
+// Frames with no event, such as #sync and #info, return ErrSkipFrame with
+// their sequence number if they have one, and error frames return a
+// *FirehoseError.
+func ParseFirehoseFrame(frame []byte) ([]*Message, int64, error) {
+	messages, seq, _, err := decodeFirehoseFrame(frame)
+	return messages, seq, err
+}
+
+// firehoseCommit is a decoded #commit body and its blocks, kept for
+// verification
+type firehoseCommit struct {
+	body   map[string]any
+	blocks firehoseBlocks
+}
+
+// decodeFirehoseFrame is ParseFirehoseFrame, also returning the decoded
+// commit for #commit frames
+func decodeFirehoseFrame(frame []byte) ([]*Message, int64, *firehoseCommit, error) {
+	header, n, err := decodeCBOR(frame)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid frame header: %v", err)
+	}
+	h, _ := header.(map[string]any)
+	body, _, err := decodeCBOR(frame[n:])
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid frame body: %v", err)
+	}
+	b, ok := body.(map[string]any)
+	if !ok {
+		return nil, 0, nil, fmt.Errorf("frame body is %T, not a map", body)
+	}
+
+	op, _ := h["op"].(int64)
+	if op == -1 {
+		return nil, 0, nil, &FirehoseError{Name: cborString(b, "error"), Message: cborString(b, "message")}
+	}
+	seq, _ := b["seq"].(int64)
+	var (
+		messages []*Message
+		commit   *firehoseCommit
+	)
+	switch t := cborString(h, "t"); t {
+	case "#commit":
+		messages, commit, err = parseFirehoseCommit(b)
+	case "#identity":
+		messages = []*Message{{
+			Did:  cborString(b, "did"),
+			Kind: "identity",
+			Identity: &IdentityEvent{
+				Did:    cborString(b, "did"),
+				Handle: cborString(b, "handle"),
+				Seq:    seq,
+				Time:   cborString(b, "time"),
+			},
+		}}
+	case "#account":
+		active, _ := b["active"].(bool)
+		messages = []*Message{{
+			Did:  cborString(b, "did"),
+			Kind: "account",
+			Account: &AccountEvent{
+				Active: active,
+				Status: cborString(b, "status"),
+				Did:    cborString(b, "did"),
+				Seq:    seq,
+				Time:   cborString(b, "time"),
+			},
+		}}
+	case "#info":
+		return nil, 0, nil, &firehoseInfo{name: cborString(b, "name"), message: cborString(b, "message")}
+	default:
+		return nil, seq, nil, fmt.Errorf("%w: %s frame", ErrSkipFrame, t)
+	}
+	if err != nil {
+		return nil, seq, nil, err
+	}
+
+	timeUs := firehoseTime(cborString(b, "time"))
+	for _, msg := range messages {
+		msg.TimeUs = timeUs
+		if msg.Raw, err = json.Marshal(msg); err != nil {
+			return nil, seq, nil, err
+		}
+	}
+	return messages, seq, commit, nil
+}
+
+func parseFirehoseCommit(b map[string]any) ([]*Message, *firehoseCommit, error) {
+	var blocks firehoseBlocks
+	if car, ok := b["blocks"].([]byte); ok && len(car) > 0 {
+		raw, err := readCAR(car)
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks = firehoseBlocks(raw)
+	}
+
+	ops, _ := b["ops"].([]any)
+	messages := make([]*Message, 0, len(ops))
+	for _, o := range ops {
+		op, ok := o.(map[string]any)
+		if !ok {
+			continue
+		}
+		collection, rkey, _ := strings.Cut(cborString(op, "path"), "/")
+		commit := &CommitEvent{
+			Rev:        cborString(b, "rev"),
+			Operation:  cborString(op, "action"),
+			Collection: collection,
+			Rkey:       rkey,
+		}
+		if commit.Operation != "delete" {
+			cid, _ := op["cid"].(cidLink)
+			if _, ok := blocks[string(cid)]; !ok {
+				continue
+			}
+			// through get, so a record that doesn't hash to its CID, which
+			// is what the tree and signature vouch for, isn't passed on
+			block, err := blocks.get(cid)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid record %s/%s: %v", collection, rkey, err)
+			}
+			record, _, err := decodeCBOR(block)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid record %s/%s: %v", collection, rkey, err)
+			}
+			if commit.Record, err = cborToJSON(record); err != nil {
+				return nil, nil, err
+			}
+			commit.Cid = cid.String()
+		}
+		messages = append(messages, &Message{Did: cborString(b, "repo"), Kind: "commit", Commit: commit})
+	}
+	return messages, &firehoseCommit{body: b, blocks: blocks}, nil
+}
+
+func cborString(m map[string]any, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+// firehoseTime converts an event's time to time_us. The firehose has no
+// time_us of its own, so this stands in for it, falling back to now for a
+// missing or malformed time.
+func firehoseTime(s string) int64 {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Now().UnixMicro()
+	}
+	return t.UnixMicro()
+}
+
+// wanted applies the collection and DID filters to msg, which the firehose
+// can't filter server-side. Collection filters only apply to commits, and
+// a trailing * matches any collection with that prefix.
+func (c *Client) wanted(msg *Message) bool {
+	filters := c.currentFilters()
+	if len(filters.dids) > 0 && !filters.didSet[msg.Did] {
+		return false
+	}
+	if len(filters.collections) == 0 || msg.Commit == nil {
+		return true
+	}
+	for _, col := range filters.collections {
+		if prefix, ok := strings.CutSuffix(col, "*"); ok {
+			if strings.HasPrefix(msg.Commit.Collection, prefix) {
+				return true
+			}
+		} else if msg.Commit.Collection == col {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFirehoseFrame parses a firehose frame into the messages that pass
+// the filters and verification, with its sequence number as the cursor.
+// Error frames end the connection.
+func (c *Client) parseFirehoseFrame(frame []byte) frameResult {
+	messages, seq, commit, err := decodeFirehoseFrame(frame)
+	var (
+		info    *firehoseInfo
+		errorFr *FirehoseError
+	)
+	switch {
+	case errors.As(err, &info):
+		c.Logger.Warn().Str("name", info.name).Str("reason", info.message).Msg("firehose info")
+	case errors.As(err, &errorFr):
+		c.Logger.Error().Str("name", errorFr.Name).Str("reason", errorFr.Message).Msg("firehose error")
+		return frameResult{err: err}
+	case errors.Is(err, ErrSkipFrame):
+		c.Logger.Trace().Err(err).Int("len", len(frame)).Msg("skipping frame")
+	case err != nil:
+		c.Logger.Error().Err(err).Msg("parse error")
+		if c.OnParseError != nil {
+			c.OnParseError(err)
+		}
+	}
+
+	wanted := messages[:0]
+	for _, msg := range messages {
+		if c.wanted(msg) {
+			wanted = append(wanted, msg)
+		}
+	}
+	// only commits with wanted events are verified, since resolving keys
+	// is the expensive part
+	if c.VerifyKeys != nil && commit != nil && len(wanted) > 0 {
+		if err := c.verify(commit); err != nil {
+			kept := wanted[:0]
+			for _, msg := range wanted {
+				if c.OnUnverified != nil && c.OnUnverified(msg, err) {
+					kept = append(kept, msg)
+				}
+			}
+			wanted = kept
+		}
+	}
+	return frameResult{messages: wanted, cursor: seq}
+}
+
+// verify checks a commit against its repo's signing key, resolving the key
+// again if the signature doesn't match a cached one
+func (c *Client) verify(commit *firehoseCommit) error {
+	did := cborString(commit.body, "repo")
+	for _, fresh := range []bool{false, true} {
+		key, err := c.VerifyKeys(did, fresh)
+		if err != nil {
+			return fmt.Errorf("%w: resolving signing key: %v", ErrUnverified, err)
+		}
+		err = verifyFirehoseCommit(commit.body, commit.blocks, key)
+		if err == nil {
+			return nil
+		}
+		if fresh || !errors.Is(err, errBadSignature) {
+			return fmt.Errorf("%w: %v", ErrUnverified, err)
+		}
+	}
+	return nil
+}
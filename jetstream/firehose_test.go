@@ -0,0 +1,244 @@
+package jetstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// appendCBOR encodes v as DAG-CBOR, for the values decodeCBOR reads
+func appendCBOR(b []byte, v any) []byte {
+	head := func(major byte, n uint64) {
+		switch {
+		case n < 24:
+			b = append(b, major<<5|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, major<<5|24, byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, major<<5|25), uint16(n))
+		case n <= math.MaxUint32:
+			b = binary.BigEndian.AppendUint32(append(b, major<<5|26), uint32(n))
+		default:
+			b = binary.BigEndian.AppendUint64(append(b, major<<5|27), n)
+		}
+	}
+	switch v := v.(type) {
+	case nil:
+		b = append(b, 0xf6)
+	case bool:
+		if v {
+			b = append(b, 0xf5)
+		} else {
+			b = append(b, 0xf4)
+		}
+	case int:
+		if v < 0 {
+			head(1, uint64(-1-v))
+		} else {
+			head(0, uint64(v))
+		}
+	case string:
+		head(3, uint64(len(v)))
+		b = append(b, v...)
+	case []byte:
+		head(2, uint64(len(v)))
+		b = append(b, v...)
+	case cidLink:
+		head(6, 42)
+		head(2, uint64(len(v)+1))
+		b = append(append(b, 0), v...)
+	case []any:
+		head(4, uint64(len(v)))
+		for _, e := range v {
+			b = appendCBOR(b, e)
+		}
+	case map[string]any:
+		// DAG-CBOR orders keys by length, then bytewise
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		head(5, uint64(len(v)))
+		for _, k := range keys {
+			b = appendCBOR(appendCBOR(b, k), v[k])
+		}
+	default:
+		panic("appendCBOR: unsupported type")
+	}
+	return b
+}
+
+// blockCID is the CIDv1 of a DAG-CBOR block, with a sha2-256 multihash
+func blockCID(block []byte) cidLink {
+	sum := sha256.Sum256(block)
+	return cidLink(append([]byte{0x01, 0x71, 0x12, 0x20}, sum[:]...))
+}
+
+// commitFrame builds a #commit frame for repo with ops, each an action,
+// a path, and a record, nil for deletes. A record that is a string isn't
+// put in the blocks, as for tooBig commits.
+func commitFrame(seq int, repo, rev, when string, ops [][3]any) []byte {
+	var car []byte
+	appendSection := func(data []byte) {
+		car = binary.AppendUvarint(car, uint64(len(data)))
+		car = append(car, data...)
+	}
+	var roots []any
+	var opList []any
+	var blocks [][]byte
+	for _, o := range ops {
+		op := map[string]any{"action": o[0], "path": o[1], "cid": nil}
+		if record, ok := o[2].(map[string]any); ok {
+			block := appendCBOR(nil, record)
+			cid := blockCID(block)
+			op["cid"] = cid
+			roots = append(roots, cid)
+			blocks = append(blocks, append(slices.Clone([]byte(cid)), block...))
+		} else if o[2] != nil {
+			// a CID whose block was left out
+			op["cid"] = blockCID([]byte(o[2].(string)))
+		}
+		opList = append(opList, op)
+	}
+	appendSection(appendCBOR(nil, map[string]any{"version": 1, "roots": roots[:1]}))
+	for _, block := range blocks {
+		appendSection(block)
+	}
+
+	frame := appendCBOR(nil, map[string]any{"op": 1, "t": "#commit"})
+	return appendCBOR(frame, map[string]any{
+		"seq": seq, "repo": repo, "rev": rev, "time": when, "ops": opList,
+		"blocks": car, "tooBig": false, "rebase": false, "blobs": []any{},
+	})
+}
+
+// multiOpCommit is a commit writing several records at once, as an app
+// does when creating a post with a threadgate, or deleting a thread
+func multiOpCommit() []byte {
+	return commitFrame(42, "did:plc:abc", "3kabcrev", "2024-09-09T19:46:02.329308Z", [][3]any{
+		{"create", "app.bsky.feed.post/3kpost", map[string]any{"$type": "app.bsky.feed.post", "text": "hello", "createdAt": "2024-09-09T19:46:02Z"}},
+		{"create", "app.bsky.feed.threadgate/3kpost", map[string]any{"$type": "app.bsky.feed.threadgate", "post": "at://did:plc:abc/app.bsky.feed.post/3kpost", "createdAt": "2024-09-09T19:46:02Z"}},
+		{"update", "app.bsky.actor.profile/self", map[string]any{"$type": "app.bsky.actor.profile", "displayName": "abc"}},
+		{"delete", "app.bsky.graph.follow/3kfollow", nil},
+		{"create", "app.bsky.feed.like/3klike", map[string]any{"$type": "app.bsky.feed.like", "subject": map[string]any{"uri": "at://did:plc:x/app.bsky.feed.post/1", "cid": "bafypost"}, "createdAt": "2024-09-09T19:46:02Z"}},
+	})
+}
+
+// multiOpWant is the operation and path of each message multiOpCommit
+// becomes
+var multiOpWant = []string{
+	"create app.bsky.feed.post/3kpost",
+	"create app.bsky.feed.threadgate/3kpost",
+	"update app.bsky.actor.profile/self",
+	"delete app.bsky.graph.follow/3kfollow",
+	"create app.bsky.feed.like/3klike",
+}
+
+func opPath(msg *Message) string {
+	return msg.Commit.Operation + " " + msg.Commit.Collection + "/" + msg.Commit.Rkey
+}
+
+func TestParseFirehoseFrameMultiOpCommit(t *testing.T) {
+	messages, seq, err := ParseFirehoseFrame(multiOpCommit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 42 {
+		t.Errorf("seq = %d, want 42", seq)
+	}
+	if len(messages) != len(multiOpWant) {
+		t.Fatalf("got %d messages, want one per op, %d", len(messages), len(multiOpWant))
+	}
+	want := time.Date(2024, 9, 9, 19, 46, 2, 329308000, time.UTC).UnixMicro()
+	for i, msg := range messages {
+		if got := opPath(msg); got != multiOpWant[i] {
+			t.Errorf("message %d is %q, want %q", i, got, multiOpWant[i])
+		}
+		if msg.Did != "did:plc:abc" || msg.Commit.Rev != "3kabcrev" || msg.TimeUs != want {
+			t.Errorf("message %d has did %q, rev %q, time_us %d", i, msg.Did, msg.Commit.Rev, msg.TimeUs)
+		}
+		if (msg.Commit.Operation == "delete") != (msg.Commit.Record == nil) {
+			t.Errorf("message %d: %s with record %s", i, msg.Commit.Operation, msg.Commit.Record)
+		}
+	}
+
+	var like Like
+	if err := json.Unmarshal(messages[4].Commit.Record, &like); err != nil || like.Subject == nil || like.Subject.URI != "at://did:plc:x/app.bsky.feed.post/1" {
+		t.Errorf("like record = %s, %v", messages[4].Commit.Record, err)
+	}
+	var raw Message
+	if err := json.Unmarshal(messages[0].Raw, &raw); err != nil || raw.Commit == nil || raw.Commit.Rkey != "3kpost" {
+		t.Errorf("post Raw = %s, %v", messages[0].Raw, err)
+	}
+}
+
+func TestParseFirehoseFrameSkipsMissingBlocks(t *testing.T) {
+	frame := commitFrame(43, "did:plc:abc", "3kabcrev", "2024-09-09T19:46:02Z", [][3]any{
+		{"create", "app.bsky.feed.post/3kone", map[string]any{"text": "one"}},
+		{"create", "app.bsky.feed.post/3ktoobig", "not in the blocks"},
+		{"create", "app.bsky.feed.post/3ktwo", map[string]any{"text": "two"}},
+	})
+	messages, _, err := ParseFirehoseFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, msg := range messages {
+		got = append(got, msg.Commit.Rkey)
+	}
+	if !slices.Equal(got, []string{"3kone", "3ktwo"}) {
+		t.Errorf("rkeys = %v, want the ops with their records", got)
+	}
+}
+
+func TestFirehoseClientHandlesEveryOp(t *testing.T) {
+	f := &feeder{frames: []string{string(multiOpCommit())}, binary: true, cursors: make(chan int64, 1)}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	c := NewClient(wsURL(server))
+	c.Firehose = true
+	c.Logger = zerolog.Nop()
+	handled := make(chan *Message, len(multiOpWant))
+	c.Handle(func(msg *Message) { handled <- msg })
+	var posts []string
+	c.On("app.bsky.feed.post", func(commit *CommitEvent, _ *Message) { posts = append(posts, commit.Rkey) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	for i, want := range multiOpWant {
+		select {
+		case msg := <-handled:
+			if got := opPath(msg); got != want {
+				t.Errorf("message %d is %q, want %q", i, got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only %d of %d ops were handled", i, len(multiOpWant))
+		}
+	}
+	cancel()
+	<-done
+	if !slices.Equal(posts, []string{"3kpost"}) {
+		t.Errorf("post handler got %v", posts)
+	}
+	if got := c.LastTimeUs(); got != 42 {
+		t.Errorf("cursor = %d, want the frame's seq", got)
+	}
+}
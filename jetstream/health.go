@@ -0,0 +1,86 @@
+package jetstream
+
+import "time"
+
+const (
+	// how often a connection's lag is checked with MaxLag set, and how
+	// many checks in a row it must lag, without catching up, to fail over
+	lagCheckInterval = 10 * time.Second
+	lagChecks        = 6
+
+	// FailoverDisconnects defaults to this
+	defaultFailoverDisconnects = 3
+)
+
+// endpointHealth scores the endpoints Run fails over between. A failed
+// dial, a connection that drops before it is healthy, and a stream that
+// lags each count a strike against the endpoint, and a healthy connection
+// clears them. Failover picks the endpoint with the fewest strikes, so one
+// that keeps failing is tried last until it recovers.
+type endpointHealth struct {
+	strikes []int
+	// tried marks the endpoints whose dials failed in the current round
+	tried []bool
+}
+
+func newEndpointHealth(n int) *endpointHealth {
+	return &endpointHealth{strikes: make([]int, n), tried: make([]bool, n)}
+}
+
+func (h *endpointHealth) fail(i int) { h.strikes[i]++ }
+func (h *endpointHealth) ok(i int)   { h.strikes[i] = 0 }
+
+// next returns the endpoint to fail over to from current: the one with
+// the fewest strikes among those not yet tried this round, taking them in
+// order after current on ties. It returns current if every other endpoint
+// has been tried.
+func (h *endpointHealth) next(current int) int {
+	best := current
+	for step := 1; step < len(h.strikes); step++ {
+		i := (current + step) % len(h.strikes)
+		if h.tried[i] {
+			continue
+		}
+		if best == current || h.strikes[i] < h.strikes[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// newRound forgets which endpoints were tried, after a round of failed
+// dials or a successful connection
+func (h *endpointHealth) newRound() {
+	clear(h.tried)
+}
+
+// lagMonitor tracks whether a connection's events stay more than max
+// behind the clock. A connection replaying from an old cursor lags too,
+// but catches up, so a check only counts when the lag hasn't shrunk by
+// at least a tenth of the time since the last one.
+type lagMonitor struct {
+	max        time.Duration
+	lastTimeUs int64
+	previous   time.Duration
+	lagging    int
+}
+
+// check records the lag of the last event, at timeUs, and reports whether
+// the connection has now lagged for lagChecks checks in a row. Checks
+// without a new event since the last one don't count either way, since a
+// quiet stream isn't a lagging one.
+func (m *lagMonitor) check(timeUs int64) (time.Duration, bool) {
+	if timeUs == 0 || timeUs == m.lastTimeUs {
+		return 0, false
+	}
+	m.lastTimeUs = timeUs
+	lag := time.Since(time.UnixMicro(timeUs))
+	catchingUp := m.lagging > 0 && lag < m.previous-lagCheckInterval/10
+	m.previous = lag
+	if lag <= m.max || catchingUp {
+		m.lagging = 0
+		return lag, false
+	}
+	m.lagging++
+	return lag, m.lagging >= lagChecks
+}
@@ -0,0 +1,118 @@
+package jetstream
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+// keepalive pings the server on an interval and keeps a read deadline that
+// any frame, including a pong, pushes back. A connection that goes quiet
+// past the timeout then fails the blocked read instead of stalling forever,
+// and the usual reconnect path takes over.
+//
+// Separately, with an idle timeout, a watchdog fails the read when no
+// message has arrived for that long, even while pongs keep coming, which
+// catches a server that stays connected but stops streaming.
+type keepalive struct {
+	conn    *websocket.Conn
+	timeout time.Duration
+	idle    time.Duration
+	// unix nanoseconds of the last message read
+	lastMessage atomic.Int64
+	// set once shutdown has its own deadline, which pongs must not extend
+	draining atomic.Bool
+	// set once the watchdog has failed the read
+	stalled atomic.Bool
+}
+
+// startKeepalive arms the read deadline and starts pinging until done is
+// closed, and starts the idle watchdog. With a zero interval no deadline
+// is armed and nothing is pinged, and with a zero idle timeout there is no
+// watchdog.
+func startKeepalive(conn *websocket.Conn, interval, timeout, idle time.Duration, done <-chan struct{}, logger zerolog.Logger) *keepalive {
+	ka := &keepalive{conn: conn, idle: idle}
+	ka.received()
+	if idle > 0 {
+		go ka.watch(done)
+	}
+	if interval <= 0 {
+		return ka
+	}
+	ka.timeout = timeout
+
+	ka.extend()
+	conn.SetPongHandler(func(string) error {
+		ka.extend()
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// WriteControl is safe to call alongside the reader and
+				// the close frame written on shutdown
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval))
+				if err != nil && !ka.draining.Load() {
+					logger.Debug().Err(err).Msg("ping failed")
+				}
+			}
+		}
+	}()
+	return ka
+}
+
+// watch fails the read once no message has arrived for the idle timeout,
+// checking a few times per timeout until done is closed
+func (ka *keepalive) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(max(ka.idle/4, 100*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			last := time.Unix(0, ka.lastMessage.Load())
+			if time.Since(last) >= ka.idle && !ka.draining.Load() {
+				ka.stalled.Store(true)
+				ka.conn.SetReadDeadline(time.Now())
+				return
+			}
+		}
+	}
+}
+
+// received records that a message was read
+func (ka *keepalive) received() {
+	ka.lastMessage.Store(time.Now().UnixNano())
+}
+
+// extend pushes the read deadline back by the timeout
+func (ka *keepalive) extend() {
+	if ka.timeout <= 0 || ka.draining.Load() || ka.stalled.Load() {
+		return
+	}
+	ka.conn.SetReadDeadline(time.Now().Add(ka.timeout))
+}
+
+// drain replaces the keepalive deadline with a short one for shutdown
+func (ka *keepalive) drain(d time.Duration) {
+	ka.draining.Store(true)
+	ka.conn.SetReadDeadline(time.Now().Add(d))
+}
+
+// timedOut reports whether a read error came from the keepalive deadline
+// rather than shutdown or a network failure
+func (ka *keepalive) timedOut(err error) bool {
+	var netErr net.Error
+	return !ka.draining.Load() && ka.timeout > 0 && errors.As(err, &netErr) && netErr.Timeout()
+}
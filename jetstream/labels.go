@@ -0,0 +1,132 @@
+package jetstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// LabelsPath is where labelers serve com.atproto.label.subscribeLabels, and
+// is requested over unix:// sockets in labeler mode
+const LabelsPath = "/xrpc/com.atproto.label.subscribeLabels"
+
+// LabelEvent is a label a labeler applied to, or with Neg removed from, an
+// account or record. URI is the labeled account's DID or the record's AT
+// URI, with Cid pinning a record version if set.
+type LabelEvent struct {
+	Src string `json:"src"`
+	URI string `json:"uri"`
+	Cid string `json:"cid,omitempty"`
+	Val string `json:"val"`
+	Neg bool   `json:"neg,omitempty"`
+	Cts string `json:"cts"`
+	Exp string `json:"exp,omitempty"`
+	Seq int64  `json:"seq"`
+}
+
+// ParseLabelFrame decodes a com.atproto.label.subscribeLabels frame, which
+// is framed like the firehose, into one message of kind "label" per label
+// it carries, along with the frame's sequence number. Each message's Did
+// is the labeled account, taken from the label's URI, so labels line up
+// with that account's events, and its TimeUs is when the label was
+// created. Each message's Raw is its JSON.
+//
+// #info frames return an error wrapping ErrSkipFrame, and error frames a
+// *FirehoseError.
+func ParseLabelFrame(frame []byte) ([]*Message, int64, error) {
+	header, n, err := decodeCBOR(frame)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid frame header: %v", err)
+	}
+	h, _ := header.(map[string]any)
+	body, _, err := decodeCBOR(frame[n:])
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid frame body: %v", err)
+	}
+	b, ok := body.(map[string]any)
+	if !ok {
+		return nil, 0, fmt.Errorf("frame body is %T, not a map", body)
+	}
+
+	if op, _ := h["op"].(int64); op == -1 {
+		return nil, 0, &FirehoseError{Name: cborString(b, "error"), Message: cborString(b, "message")}
+	}
+	seq, _ := b["seq"].(int64)
+	switch t := cborString(h, "t"); t {
+	case "#labels":
+	case "#info":
+		return nil, 0, &firehoseInfo{name: cborString(b, "name"), message: cborString(b, "message")}
+	default:
+		return nil, seq, fmt.Errorf("%w: %s frame", ErrSkipFrame, t)
+	}
+
+	labels, _ := b["labels"].([]any)
+	messages := make([]*Message, 0, len(labels))
+	for _, l := range labels {
+		l, ok := l.(map[string]any)
+		if !ok {
+			continue
+		}
+		neg, _ := l["neg"].(bool)
+		label := &LabelEvent{
+			Src: cborString(l, "src"),
+			URI: cborString(l, "uri"),
+			Cid: cborString(l, "cid"),
+			Val: cborString(l, "val"),
+			Neg: neg,
+			Cts: cborString(l, "cts"),
+			Exp: cborString(l, "exp"),
+			Seq: seq,
+		}
+		msg := &Message{Did: labelSubject(label.URI), TimeUs: firehoseTime(label.Cts), Kind: "label", Label: label}
+		if msg.Raw, err = json.Marshal(msg); err != nil {
+			return nil, seq, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, seq, nil
+}
+
+// labelSubject returns the DID of the account a label URI refers to, itself
+// or the repo of an at:// record
+func labelSubject(uri string) string {
+	if rest, ok := strings.CutPrefix(uri, "at://"); ok {
+		did, _, _ := strings.Cut(rest, "/")
+		return did
+	}
+	return uri
+}
+
+// parseLabelFrame parses a labeler frame into the messages that pass the
+// DID filter, with its sequence number as the cursor. Error frames end the
+// connection.
+func (c *Client) parseLabelFrame(frame []byte) frameResult {
+	messages, seq, err := ParseLabelFrame(frame)
+	var (
+		info    *firehoseInfo
+		errorFr *FirehoseError
+	)
+	switch {
+	case errors.As(err, &info):
+		c.Logger.Warn().Str("name", info.name).Str("reason", info.message).Msg("labeler info")
+	case errors.As(err, &errorFr):
+		c.Logger.Error().Str("name", errorFr.Name).Str("reason", errorFr.Message).Msg("labeler error")
+		return frameResult{err: err}
+	case errors.Is(err, ErrSkipFrame):
+		c.Logger.Trace().Err(err).Int("len", len(frame)).Msg("skipping frame")
+	case err != nil:
+		c.Logger.Error().Err(err).Msg("parse error")
+		if c.OnParseError != nil {
+			c.OnParseError(err)
+		}
+	}
+
+	wanted := messages[:0]
+	for _, msg := range messages {
+		if c.wanted(msg) {
+			wanted = append(wanted, msg)
+		}
+	}
+	return frameResult{messages: wanted, cursor: seq}
+}
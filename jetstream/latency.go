@@ -0,0 +1,123 @@
+package jetstream
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a probe dial may take before the endpoint counts as
+	// unreachable
+	probeTimeout = 5 * time.Second
+
+	// an endpoint a later probe finds has to beat the one in use by this
+	// fraction of its handshake before Run switches, so near ties and
+	// jitter don't bounce the connection between them
+	probeMargin = 0.2
+)
+
+// probe dials every endpoint at once and returns how long each one's
+// handshake took, or -1 for those that couldn't be reached. The probe
+// connections are closed straight away.
+func (c *Client) probe(ctx context.Context, endpoints []string) []time.Duration {
+	handshakes := make([]time.Duration, len(endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dialCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+			defer cancel()
+			conn, handshake, err := c.connect(dialCtx, endpoint, 0)
+			handshakes[i] = handshake
+			if err != nil {
+				handshakes[i] = -1
+			} else {
+				conn.Close()
+			}
+			if ctx.Err() != nil {
+				// cancelled, not unreachable
+				return
+			}
+			if err != nil {
+				c.Logger.Debug().Err(err).Str("endpoint", endpoint).Msg("endpoint didn't answer the latency probe")
+			} else {
+				c.Logger.Debug().Str("endpoint", endpoint).Dur("handshake", handshake).Msg("probed endpoint")
+			}
+			if c.OnProbe != nil {
+				c.OnProbe(endpoint, handshake, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return handshakes
+}
+
+// fastest returns the endpoint with the quickest handshake, or -1 if none
+// could be reached
+func fastest(handshakes []time.Duration) int {
+	best := -1
+	for i, h := range handshakes {
+		if h >= 0 && (best < 0 || h < handshakes[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// pickFastest probes the endpoints and returns the fastest to start with,
+// or 0, the first, if none answered
+func (c *Client) pickFastest(ctx context.Context, endpoints []string) int {
+	handshakes := c.probe(ctx, endpoints)
+	best := fastest(handshakes)
+	if best < 0 {
+		if ctx.Err() == nil {
+			c.Logger.Warn().Msg("no endpoint answered the latency probe, connecting in order")
+		}
+		return 0
+	}
+	c.Logger.Info().
+		Str("endpoint", endpoints[best]).
+		Dur("handshake", handshakes[best]).
+		Int("endpoints", len(endpoints)).
+		Msg("picked the fastest endpoint")
+	return best
+}
+
+// reprobe measures the endpoints every ProbeInterval until ctx is
+// cancelled, and has Run switch to one that has become clearly faster
+// than the one it last connected to
+func (c *Client) reprobe(ctx context.Context, endpoints []string) {
+	ticker := time.NewTicker(c.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := int(c.inUse.Load()) - 1
+		if current < 0 {
+			continue
+		}
+		handshakes := c.probe(ctx, endpoints)
+		best := fastest(handshakes)
+		if best < 0 || best == current || handshakes[current] < 0 {
+			// an endpoint in use that doesn't answer probes is left to
+			// the failover checks
+			continue
+		}
+		if float64(handshakes[best]) > float64(handshakes[current])*(1-probeMargin) {
+			continue
+		}
+		c.Logger.Info().
+			Str("endpoint", endpoints[current]).
+			Dur("handshake", handshakes[current]).
+			Str("next_endpoint", endpoints[best]).
+			Dur("next_handshake", handshakes[best]).
+			Msg("found a faster endpoint, switching")
+		c.preferred.Store(int64(best + 1))
+		c.wakeUp()
+	}
+}
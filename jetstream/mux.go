@@ -0,0 +1,40 @@
+package jetstream
+
+// CommitHandler is called for a commit event, with the message it came in
+type CommitHandler func(commit *CommitEvent, msg *Message)
+
+// CommitMux dispatches commit events to handlers registered by collection
+type CommitMux struct {
+	handlers map[string]CommitHandler
+	fallback CommitHandler
+}
+
+// NewCommitMux returns an empty CommitMux
+func NewCommitMux() *CommitMux {
+	return &CommitMux{handlers: map[string]CommitHandler{}}
+}
+
+// On registers fn for commits to collection, replacing any handler already
+// registered for it
+func (m *CommitMux) On(collection string, fn CommitHandler) {
+	m.handlers[collection] = fn
+}
+
+// Fallback registers fn for commits to collections with no handler of
+// their own
+func (m *CommitMux) Fallback(fn CommitHandler) {
+	m.fallback = fn
+}
+
+// Dispatch calls the handler for msg's commit. Messages that aren't
+// commits are ignored.
+func (m *CommitMux) Dispatch(msg *Message) {
+	if msg.Commit == nil {
+		return
+	}
+	if fn, ok := m.handlers[msg.Commit.Collection]; ok {
+		fn(msg.Commit, msg)
+	} else if m.fallback != nil {
+		m.fallback(msg.Commit, msg)
+	}
+}
@@ -0,0 +1,41 @@
+package jetstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrSkipFrame is returned by ParseMessage for frames that carry no event,
+// such as empty or non-JSON frames. These aren't worth an error log.
+var ErrSkipFrame = errors.New("frame carries no event")
+
+// ParseMessage decodes a websocket frame into a Message. Binary frames are
+// zstd-compressed JSON, as sent to subscriptions made with compress=true;
+// text frames are plain JSON.
+func ParseMessage(messageType int, message []byte) (*Message, error) {
+	if messageType == websocket.BinaryMessage {
+		decoded, err := decompress(message)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress message: %v", err)
+		}
+		message = decoded
+	}
+	message = bytes.TrimSpace(message)
+	if len(message) == 0 {
+		return nil, fmt.Errorf("%w: empty frame", ErrSkipFrame)
+	}
+	if message[0] != '{' {
+		return nil, fmt.Errorf("%w: not a json object", ErrSkipFrame)
+	}
+
+	var msg Message
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message: %v", err)
+	}
+	msg.Raw = message
+	return &msg, nil
+}
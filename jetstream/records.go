@@ -0,0 +1,156 @@
+package jetstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Post is an app.bsky.feed.post record. Embed is left as decoded JSON,
+// since it can be any of several embed types, each with its own fields;
+// DecodeEmbed turns it into an Embed.
+type Post struct {
+	Type      string   `json:"$type"`
+	Text      string   `json:"text"`
+	Facets    []Facet  `json:"facets,omitempty"`
+	Reply     *Reply   `json:"reply,omitempty"`
+	Embed     any      `json:"embed,omitempty"`
+	Langs     []string `json:"langs,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+// Like is an app.bsky.feed.like record. Subject is nil in malformed
+// records, so check it before use.
+type Like struct {
+	Type      string   `json:"$type"`
+	Subject   *Subject `json:"subject"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+// Repost is an app.bsky.feed.repost record. As with Like, Subject can be
+// nil.
+type Repost struct {
+	Type      string   `json:"$type"`
+	Subject   *Subject `json:"subject"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+// Follow is an app.bsky.graph.follow record of the account with DID
+// Subject
+type Follow struct {
+	Type      string `json:"$type"`
+	Subject   string `json:"subject"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// Block is an app.bsky.graph.block record of the account with DID Subject
+type Block struct {
+	Type      string `json:"$type"`
+	Subject   string `json:"subject"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// Profile is an app.bsky.actor.profile record, of which an account has
+// one, with rkey self
+type Profile struct {
+	Type                 string   `json:"$type"`
+	DisplayName          string   `json:"displayName,omitempty"`
+	Description          string   `json:"description,omitempty"`
+	Avatar               *Blob    `json:"avatar,omitempty"`
+	Banner               *Blob    `json:"banner,omitempty"`
+	PinnedPost           *Subject `json:"pinnedPost,omitempty"`
+	JoinedViaStarterPack *Subject `json:"joinedViaStarterPack,omitempty"`
+	CreatedAt            string   `json:"createdAt,omitempty"`
+}
+
+// Generator is an app.bsky.feed.generator record, declaring a custom feed
+// served by the service with DID Did
+type Generator struct {
+	Type                string `json:"$type"`
+	Did                 string `json:"did"`
+	DisplayName         string `json:"displayName"`
+	Description         string `json:"description,omitempty"`
+	Avatar              *Blob  `json:"avatar,omitempty"`
+	AcceptsInteractions bool   `json:"acceptsInteractions,omitempty"`
+	ContentMode         string `json:"contentMode,omitempty"`
+	CreatedAt           string `json:"createdAt"`
+}
+
+// Threadgate is an app.bsky.feed.threadgate record, limiting who can reply
+// to the thread rooted at Post. Each Allow rule has a $type such as
+// app.bsky.feed.threadgate#mentionRule, and List is set for #listRule. An
+// empty, non-nil Allow means nobody can reply.
+type Threadgate struct {
+	Type  string `json:"$type"`
+	Post  string `json:"post"`
+	Allow []struct {
+		Type string `json:"$type"`
+		List string `json:"list,omitempty"`
+	} `json:"allow"`
+	HiddenReplies []string `json:"hiddenReplies,omitempty"`
+	CreatedAt     string   `json:"createdAt"`
+}
+
+// Blob is a reference to an uploaded file, such as an image. Use Link for
+// its CID, which legacy blobs carry as LegacyCid instead of Ref.
+type Blob struct {
+	Type string `json:"$type"`
+	Ref  struct {
+		Link string `json:"$link"`
+	} `json:"ref"`
+	LegacyCid string `json:"cid,omitempty"`
+	MimeType  string `json:"mimeType"`
+	Size      int64  `json:"size"`
+}
+
+// ErrUnknownRecordType is returned by DecodeRecord for a $type it has no
+// struct for
+var ErrUnknownRecordType = errors.New("unknown record type")
+
+// recordTypes constructs the struct for each $type DecodeRecord knows
+var recordTypes = map[string]func() any{
+	"app.bsky.feed.post":         func() any { return new(Post) },
+	"app.bsky.feed.like":         func() any { return new(Like) },
+	"app.bsky.feed.repost":       func() any { return new(Repost) },
+	"app.bsky.feed.generator":    func() any { return new(Generator) },
+	"app.bsky.feed.threadgate":   func() any { return new(Threadgate) },
+	"app.bsky.feed.postgate":     func() any { return new(Postgate) },
+	"app.bsky.actor.profile":     func() any { return new(Profile) },
+	"app.bsky.graph.follow":      func() any { return new(Follow) },
+	"app.bsky.graph.block":       func() any { return new(Block) },
+	"app.bsky.graph.list":        func() any { return new(List) },
+	"app.bsky.graph.listitem":    func() any { return new(ListItem) },
+	"app.bsky.graph.starterpack": func() any { return new(Starterpack) },
+}
+
+// RegisterRecordType makes DecodeRecord decode records whose $type is nsid
+// into what newRecord returns, a pointer to a struct, such as one for a
+// third-party lexicon. It replaces any type already registered for nsid.
+// It isn't safe to call while records are being decoded, so register types
+// first, as from an init function.
+func RegisterRecordType(nsid string, newRecord func() any) {
+	recordTypes[nsid] = newRecord
+}
+
+// DecodeRecord decodes a record into the struct for its $type, returned as
+// a pointer such as *Post or *Follow, so callers can switch on the type.
+// Records of other types, unless registered with RegisterRecordType,
+// return an error wrapping ErrUnknownRecordType.
+func DecodeRecord(raw json.RawMessage) (any, error) {
+	var head struct {
+		Type string `json:"$type"`
+	}
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return nil, err
+	}
+	newRecord, ok := recordTypes[head.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownRecordType, head.Type)
+	}
+	record := newRecord()
+	if err := json.Unmarshal(raw, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
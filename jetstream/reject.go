@@ -0,0 +1,113 @@
+package jetstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// rejection is why jetstream turned a connection away, when it says
+type rejection int
+
+const (
+	rejectedOther rejection = iota
+	// the cursor is older than the server's history, so retrying it can
+	// never succeed
+	rejectedCursor
+	// the server is rate limiting or overloaded and wants clients to come
+	// back later
+	rejectedOverload
+)
+
+// handshakeError is a websocket upgrade refused with an HTTP error, which
+// is how jetstream rejects a subscription it won't serve at all
+type handshakeError struct {
+	status int
+	body   string
+}
+
+func newHandshakeError(resp *http.Response) *handshakeError {
+	// error bodies are a short message, so anything past this is noise
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	resp.Body.Close()
+	return &handshakeError{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+}
+
+func (e *handshakeError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("websocket: bad handshake: %d %s", e.status, http.StatusText(e.status))
+	}
+	return fmt.Sprintf("websocket: bad handshake: %d %s: %s", e.status, http.StatusText(e.status), e.body)
+}
+
+// classifyRejection picks out the rejections worth reacting to from a dial
+// or read error: a refused upgrade's status and body, a close frame's code
+// and reason, or a firehose error frame's name. Jetstream doesn't document these, so the reasons are
+// matched loosely.
+func classifyRejection(err error) rejection {
+	var (
+		hsErr    *handshakeError
+		closeErr *websocket.CloseError
+		fhErr    *FirehoseError
+	)
+	switch {
+	case errors.As(err, &fhErr):
+		switch fhErr.Name {
+		case "FutureCursor":
+			return rejectedCursor
+		case "ConsumerTooSlow":
+			return rejectedOverload
+		}
+	case errors.As(err, &hsErr):
+		switch {
+		case hsErr.status == http.StatusBadRequest && mentionsOldCursor(hsErr.body):
+			return rejectedCursor
+		case hsErr.status == http.StatusTooManyRequests || hsErr.status == http.StatusServiceUnavailable:
+			return rejectedOverload
+		}
+	case errors.As(err, &closeErr):
+		switch {
+		case mentionsOldCursor(closeErr.Text):
+			return rejectedCursor
+		case closeErr.Code == websocket.CloseTryAgainLater:
+			return rejectedOverload
+		case closeErr.Code == websocket.ClosePolicyViolation && strings.Contains(strings.ToLower(closeErr.Text), "rate"):
+			return rejectedOverload
+		}
+	}
+	return rejectedOther
+}
+
+// mentionsOldCursor reports whether an error message is about a cursor
+// outside the server's history, as in the "CursorTooOld" error name and
+// "cursor too old" message
+func mentionsOldCursor(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "cursortooold") || strings.Contains(msg, "cursor too old")
+}
+
+// resetCursor drops a cursor the server rejected, so the next connection
+// starts from the live tail instead of retrying it forever
+func (c *Client) resetCursor() {
+	cursor := c.lastTimeUs.Load()
+	if cursor == 0 {
+		return
+	}
+	if c.Firehose || c.Labeler {
+		// relays replay from their oldest event for a cursor that is too
+		// old, so only one past their latest event is rejected
+		c.Logger.Warn().
+			Int64("cursor", cursor).
+			Msg("the relay rejected the cursor as ahead of its stream, resuming from the live tail")
+		c.lastTimeUs.Store(0)
+		return
+	}
+	c.Logger.Warn().
+		Int64("cursor", cursor).
+		Msg("jetstream rejected the cursor as too old, resuming from the live tail, events since the cursor are missed")
+	c.lastTimeUs.Store(0)
+}
@@ -0,0 +1,142 @@
+package jetstream
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ParseRepo decodes a repo CAR file, as com.atproto.sync.getRepo returns
+// it, passing each record to each as a create commit message until it
+// returns false. Records come in the repo's key order, collection then
+// rkey, with the rev of the repo's latest commit, and marked Backfill. The
+// repo has no time for each record, so TimeUs is the record's createdAt,
+// or now for records without one. Blocks are checked against their CIDs,
+// but the commit's signature isn't verified.
+func ParseRepo(car []byte, each func(*Message) bool) error {
+	root, err := carRoot(car)
+	if err != nil {
+		return err
+	}
+	raw, err := readCAR(car)
+	if err != nil {
+		return err
+	}
+	blocks := firehoseBlocks(raw)
+
+	block, err := blocks.get(root)
+	if err != nil {
+		return err
+	}
+	value, _, err := decodeCBOR(block)
+	if err != nil {
+		return fmt.Errorf("invalid commit block: %v", err)
+	}
+	commit, _ := value.(map[string]any)
+	data, ok := commit["data"].(cidLink)
+	if !ok {
+		return errors.New("commit has no data root")
+	}
+	did, rev := cborString(commit, "did"), cborString(commit, "rev")
+
+	_, err = mstWalk(blocks, data, 0, func(key string, cid cidLink) (bool, error) {
+		collection, rkey, _ := strings.Cut(key, "/")
+		block, err := blocks.get(cid)
+		if err != nil {
+			return false, err
+		}
+		record, _, err := decodeCBOR(block)
+		if err != nil {
+			return false, fmt.Errorf("invalid record %s: %v", key, err)
+		}
+		msg := &Message{Did: did, Kind: "commit", Backfill: true, Commit: &CommitEvent{
+			Rev:        rev,
+			Operation:  "create",
+			Collection: collection,
+			Rkey:       rkey,
+			Cid:        cid.String(),
+		}}
+		if msg.Commit.Record, err = cborToJSON(record); err != nil {
+			return false, err
+		}
+		createdAt, _ := record.(map[string]any)
+		msg.TimeUs = firehoseTime(cborString(createdAt, "createdAt"))
+		if msg.Raw, err = json.Marshal(msg); err != nil {
+			return false, err
+		}
+		return each(msg), nil
+	})
+	return err
+}
+
+// carRoot returns the first root CID in a CAR v1 file's header, which for
+// a repo is its commit
+func carRoot(data []byte) (cidLink, error) {
+	headerLen, n := binary.Uvarint(data)
+	if n <= 0 || headerLen > uint64(len(data)-n) {
+		return nil, errors.New("car: invalid header length")
+	}
+	value, _, err := decodeCBOR(data[n : n+int(headerLen)])
+	if err != nil {
+		return nil, fmt.Errorf("car: invalid header: %v", err)
+	}
+	header, _ := value.(map[string]any)
+	roots, _ := header["roots"].([]any)
+	if len(roots) == 0 {
+		return nil, errors.New("car: no roots")
+	}
+	root, ok := roots[0].(cidLink)
+	if !ok {
+		return nil, errors.New("car: root isn't a cid")
+	}
+	return root, nil
+}
+
+// mstWalk calls each for every key in the MST rooted at node, in order:
+// the subtree left of the first entry, then each entry followed by the
+// subtree right of it. It reports whether the walk should continue.
+func mstWalk(blocks firehoseBlocks, node cidLink, depth int, each func(key string, cid cidLink) (bool, error)) (bool, error) {
+	if depth > maxMSTDepth {
+		return false, errors.New("tree is too deep")
+	}
+	block, err := blocks.get(node)
+	if err != nil {
+		return false, err
+	}
+	value, _, err := decodeCBOR(block)
+	if err != nil {
+		return false, fmt.Errorf("invalid tree node: %v", err)
+	}
+	n, _ := value.(map[string]any)
+	if left, ok := n["l"].(cidLink); ok {
+		if more, err := mstWalk(blocks, left, depth+1, each); !more || err != nil {
+			return false, err
+		}
+	}
+
+	entries, _ := n["e"].([]any)
+	var previous []byte
+	for _, e := range entries {
+		entry, _ := e.(map[string]any)
+		prefix, _ := entry["p"].(int64)
+		suffix, _ := entry["k"].([]byte)
+		if prefix < 0 || int(prefix) > len(previous) {
+			return false, errors.New("invalid tree entry")
+		}
+		full := append(previous[:prefix:prefix], suffix...)
+		previous = full
+
+		v, _ := entry["v"].(cidLink)
+		if more, err := each(string(full), v); !more || err != nil {
+			return false, err
+		}
+		if right, ok := entry["t"].(cidLink); ok {
+			if more, err := mstWalk(blocks, right, depth+1, each); !more || err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
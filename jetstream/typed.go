@@ -0,0 +1,65 @@
+package jetstream
+
+import "encoding/json"
+
+// RecordHandler is called for a commit with its record decoded. record is
+// nil for deletes, which carry no record.
+type RecordHandler[T any] func(record *T, commit *CommitEvent, msg *Message)
+
+// OnPost registers fn for app.bsky.feed.post commits
+func (c *Client) OnPost(fn RecordHandler[Post]) {
+	onRecord(c, "app.bsky.feed.post", fn)
+}
+
+// OnLike registers fn for app.bsky.feed.like commits
+func (c *Client) OnLike(fn RecordHandler[Like]) {
+	onRecord(c, "app.bsky.feed.like", fn)
+}
+
+// OnRepost registers fn for app.bsky.feed.repost commits
+func (c *Client) OnRepost(fn RecordHandler[Repost]) {
+	onRecord(c, "app.bsky.feed.repost", fn)
+}
+
+// OnFollow registers fn for app.bsky.graph.follow commits
+func (c *Client) OnFollow(fn RecordHandler[Follow]) {
+	onRecord(c, "app.bsky.graph.follow", fn)
+}
+
+// OnBlock registers fn for app.bsky.graph.block commits
+func (c *Client) OnBlock(fn RecordHandler[Block]) {
+	onRecord(c, "app.bsky.graph.block", fn)
+}
+
+// OnRecord registers fn for commits to collection, decoding each record
+// into a T first, for record types with no method of their own, such as a
+// third-party lexicon's. Records that don't decode are handled as with
+// OnPost.
+func OnRecord[T any](c *Client, collection string, fn RecordHandler[T]) {
+	onRecord(c, collection, fn)
+}
+
+// onRecord registers fn for commits to collection, decoding each record
+// into a T first. Records that don't decode are logged and reported to
+// OnParseError instead of reaching fn.
+func onRecord[T any](c *Client, collection string, fn RecordHandler[T]) {
+	c.On(collection, func(commit *CommitEvent, msg *Message) {
+		if commit.Operation == "delete" || len(commit.Record) == 0 {
+			fn(nil, commit, msg)
+			return
+		}
+		record := new(T)
+		if err := json.Unmarshal(commit.Record, record); err != nil {
+			c.Logger.Error().
+				Err(err).
+				Str("collection", collection).
+				Str("rkey", commit.Rkey).
+				Msg("record parse error")
+			if c.OnParseError != nil {
+				c.OnParseError(err)
+			}
+			return
+		}
+		fn(record, commit, msg)
+	})
+}
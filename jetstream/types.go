@@ -0,0 +1,206 @@
+package jetstream
+
+import (
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+)
+
+// Message represents the top-level message structure
+type Message struct {
+	Did      string         `json:"did"`
+	TimeUs   int64          `json:"time_us"`
+	Kind     string         `json:"kind"`
+	Commit   *CommitEvent   `json:"commit,omitempty"`
+	Identity *IdentityEvent `json:"identity,omitempty"`
+	Account  *AccountEvent  `json:"account,omitempty"`
+	Label    *LabelEvent    `json:"label,omitempty"`
+
+	// Backfill marks messages read from a whole repo by ParseRepo rather
+	// than from a stream
+	Backfill bool `json:"backfill,omitempty"`
+
+	// Raw is the JSON the message was parsed from
+	Raw []byte `json:"-"`
+
+	// ReceivedAt is when the Client read the frame the message came from,
+	// and ParsedAt when it finished decoding it. Both are zero for
+	// messages the Client didn't read.
+	ReceivedAt time.Time `json:"-"`
+	ParsedAt   time.Time `json:"-"`
+}
+
+// CommitEvent represents a single operation from a repository commit.
+// Jetstream splits multi-operation repo commits into one event per
+// operation, all sharing the commit's rev, so each event carries exactly one
+// record.
+type CommitEvent struct {
+	Rev        string          `json:"rev"`
+	Operation  string          `json:"operation"`
+	Collection string          `json:"collection"`
+	Rkey       string          `json:"rkey"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	Cid        string          `json:"cid,omitempty"`
+}
+
+// IdentityEvent represents an identity update
+type IdentityEvent struct {
+	Did    string `json:"did"`
+	Handle string `json:"handle"`
+	Seq    int64  `json:"seq"`
+	Time   string `json:"time"`
+}
+
+// AccountEvent represents an account status change. Status says why an
+// inactive account is inactive: takendown, suspended, deleted,
+// deactivated, desynchronized, or throttled. It is usually empty for
+// active accounts.
+type AccountEvent struct {
+	Active bool   `json:"active"`
+	Status string `json:"status,omitempty"`
+	Did    string `json:"did"`
+	Seq    int64  `json:"seq"`
+	Time   string `json:"time"`
+}
+
+// State returns "active" for an active account and its Status otherwise,
+// or "inactive" if the event gives no status
+func (a *AccountEvent) State() string {
+	switch {
+	case a.Active:
+		return "active"
+	case a.Status != "":
+		return a.Status
+	}
+	return "inactive"
+}
+
+// Record covers the fields used by the app.bsky.feed.* and app.bsky.graph.*
+// record types.
+//
+// Deprecated: Use the struct for the record's type, such as Post or Like,
+// or DecodeRecord.
+type Record struct {
+	Type      string      `json:"$type"`
+	Text      string      `json:"text,omitempty"`
+	Subject   *Subject    `json:"subject,omitempty"`
+	CreatedAt string      `json:"createdAt,omitempty"`
+	Embed     interface{} `json:"embed,omitempty"`
+	Tags      []string    `json:"tags,omitempty"`
+	Reply     *Reply      `json:"reply,omitempty"`
+	Langs     []string    `json:"langs,omitempty"`
+	Facets    []Facet     `json:"facets,omitempty"`
+}
+
+// Facet annotates a span of a post's text as a mention, link, or hashtag.
+// The span is a range of UTF-8 bytes, not runes or characters.
+type Facet struct {
+	Index struct {
+		ByteStart int `json:"byteStart"`
+		ByteEnd   int `json:"byteEnd"`
+	} `json:"index"`
+	Features []FacetFeature `json:"features"`
+}
+
+// FacetFeature is one annotation of a facet. Which field is set depends on
+// the type: Did for app.bsky.richtext.facet#mention, URI for #link, and Tag
+// for #tag.
+type FacetFeature struct {
+	Type string `json:"$type"`
+	Did  string `json:"did,omitempty"`
+	URI  string `json:"uri,omitempty"`
+	Tag  string `json:"tag,omitempty"`
+}
+
+// Span returns the part of text the facet covers. It reports false if the
+// byte range falls outside text or cuts through a multi-byte character,
+// as it does when a client computes offsets in runes or UTF-16 units.
+func (f *Facet) Span(text string) (string, bool) {
+	start, end := f.Index.ByteStart, f.Index.ByteEnd
+	if start < 0 || end > len(text) || start >= end {
+		return "", false
+	}
+	span := text[start:end]
+	if !utf8.RuneStart(span[0]) || (end < len(text) && !utf8.RuneStart(text[end])) {
+		return "", false
+	}
+	return span, true
+}
+
+// GraphRecord covers app.bsky.graph.follow and app.bsky.graph.block, whose
+// subject is the DID of the account followed or blocked rather than a
+// record reference.
+//
+// Deprecated: Use Follow or Block.
+type GraphRecord struct {
+	Type      string `json:"$type"`
+	Subject   string `json:"subject"`
+	CreatedAt string `json:"createdAt,omitempty"`
+}
+
+// List is an app.bsky.graph.list record. Purpose is a token such as
+// app.bsky.graph.defs#modlist or #curatelist.
+type List struct {
+	Type        string `json:"$type"`
+	Name        string `json:"name"`
+	Purpose     string `json:"purpose"`
+	Description string `json:"description,omitempty"`
+	CreatedAt   string `json:"createdAt,omitempty"`
+}
+
+// ListItem is an app.bsky.graph.listitem record, adding the account with
+// DID Subject to the list at the URI List
+type ListItem struct {
+	Type      string `json:"$type"`
+	Subject   string `json:"subject"`
+	List      string `json:"list"`
+	CreatedAt string `json:"createdAt,omitempty"`
+}
+
+// Starterpack is an app.bsky.graph.starterpack record, which bundles a
+// list of accounts and some feeds to follow
+type Starterpack struct {
+	Type        string `json:"$type"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	List        string `json:"list"`
+	Feeds       []struct {
+		URI string `json:"uri"`
+	} `json:"feeds,omitempty"`
+	CreatedAt string `json:"createdAt,omitempty"`
+}
+
+// Reply is the reply reference of a post: the thread's root post and the
+// post being replied to directly
+type Reply struct {
+	Root   *Subject `json:"root"`
+	Parent *Subject `json:"parent"`
+}
+
+// Postgate is an app.bsky.feed.postgate record, which controls how a post
+// can be quoted. Quote posts the author has detached from their post are
+// listed in DetachedEmbeddingUris.
+type Postgate struct {
+	Type                  string   `json:"$type"`
+	Post                  string   `json:"post"`
+	DetachedEmbeddingUris []string `json:"detachedEmbeddingUris,omitempty"`
+	EmbeddingRules        []struct {
+		Type string `json:"$type"`
+	} `json:"embeddingRules,omitempty"`
+}
+
+// QuotesDisabled reports whether the postgate stops anyone quoting the post
+func (p *Postgate) QuotesDisabled() bool {
+	for _, rule := range p.EmbeddingRules {
+		if rule.Type == "app.bsky.feed.postgate#disableRule" {
+			return true
+		}
+	}
+	return false
+}
+
+// Subject is a strong reference to a record
+type Subject struct {
+	URI string `json:"uri"`
+	Cid string `json:"cid"`
+}
@@ -0,0 +1,295 @@
+package jetstream
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secpecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// ErrUnverified is wrapped by the errors passed to OnUnverified, for
+// firehose commits that fail verification
+var ErrUnverified = errors.New("commit failed verification")
+
+// errBadSignature is a well-formed signature made with another key, which
+// may mean the repo has rotated its key since it was resolved
+var errBadSignature = errors.New("bad signature")
+
+// KeyResolver returns the signing key of the repo did, as published in its
+// DID document. fresh asks it to skip any cache, which happens when a
+// commit doesn't verify against a cached key that may have been rotated.
+type KeyResolver func(did string, fresh bool) (*SigningKey, error)
+
+// SigningKey is a repo's atproto signing key, a secp256k1 or P-256 public
+// key
+type SigningKey struct {
+	k256 *secp256k1.PublicKey
+	p256 *ecdsa.PublicKey
+}
+
+// multicodec prefixes of compressed public keys in did:key and
+// publicKeyMultibase values
+var (
+	secp256k1Prefix = []byte{0xe7, 0x01}
+	p256Prefix      = []byte{0x80, 0x24}
+)
+
+// ParseSigningKey parses a key in the multibase form DID documents list it
+// in, publicKeyMultibase, or as a did:key
+func ParseSigningKey(s string) (*SigningKey, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimPrefix(s, "did:key:"), "z")
+	if !ok {
+		return nil, errors.New("signing key isn't base58btc multibase")
+	}
+	data, err := decodeBase58(encoded)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(data, secp256k1Prefix):
+		key, err := secp256k1.ParsePubKey(data[len(secp256k1Prefix):])
+		if err != nil {
+			return nil, err
+		}
+		return &SigningKey{k256: key}, nil
+	case bytes.HasPrefix(data, p256Prefix):
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), data[len(p256Prefix):])
+		if x == nil {
+			return nil, errors.New("invalid p256 key")
+		}
+		return &SigningKey{p256: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+	}
+	return nil, errors.New("signing key is neither secp256k1 nor p256")
+}
+
+// Verify checks sig, a 64-byte r and s as atproto signs with, over data.
+// Like the reference implementation, it rejects high-S signatures.
+func (k *SigningKey) Verify(data, sig []byte) error {
+	if len(sig) != 64 {
+		return fmt.Errorf("signature is %d bytes, not 64", len(sig))
+	}
+	hash := sha256.Sum256(data)
+	if k.k256 != nil {
+		var r, s secp256k1.ModNScalar
+		if r.SetByteSlice(sig[:32]) || s.SetByteSlice(sig[32:]) || r.IsZero() || s.IsZero() {
+			return errors.New("invalid signature")
+		}
+		if s.IsOverHalfOrder() {
+			return errors.New("signature isn't low-S")
+		}
+		if !secpecdsa.NewSignature(&r, &s).Verify(hash[:], k.k256) {
+			return errBadSignature
+		}
+		return nil
+	}
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if s.Cmp(new(big.Int).Rsh(k.p256.Curve.Params().N, 1)) > 0 {
+		return errors.New("signature isn't low-S")
+	}
+	if !ecdsa.Verify(k.p256, hash[:], r, s) {
+		return errBadSignature
+	}
+	return nil
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func decodeBase58(s string) ([]byte, error) {
+	n := new(big.Int)
+	for _, c := range []byte(s) {
+		i := strings.IndexByte(base58Alphabet, c)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", c)
+		}
+		n.Mul(n, big.NewInt(58)).Add(n, big.NewInt(int64(i)))
+	}
+	decoded := n.Bytes()
+	// each leading 1 is a leading zero byte
+	zeros := len(s) - len(strings.TrimLeft(s, "1"))
+	return append(make([]byte, zeros), decoded...), nil
+}
+
+// firehoseBlocks are a commit's blocks, checked against their CIDs as they
+// are used
+type firehoseBlocks map[string][]byte
+
+// get returns the block for cid, verifying that it hashes to it
+func (b firehoseBlocks) get(cid cidLink) ([]byte, error) {
+	block, ok := b[string(cid)]
+	if !ok {
+		return nil, fmt.Errorf("block %s missing from the commit", cid)
+	}
+	// a CIDv1 prefix is the version, codec, sha2-256, and a 32 byte length
+	n, err := cidLength(cid)
+	if err != nil || n != len(cid) || len(cid) < 34 || cid[len(cid)-34] != 0x12 || cid[len(cid)-33] != 0x20 {
+		return nil, fmt.Errorf("block %s isn't a sha2-256 cid", cid)
+	}
+	if sum := sha256.Sum256(block); !bytes.Equal(sum[:], cid[len(cid)-32:]) {
+		return nil, fmt.Errorf("block %s doesn't match its cid", cid)
+	}
+	return block, nil
+}
+
+// verifyFirehoseCommit checks a #commit body: that the commit block is
+// signed by key and belongs to the repo, and that the MST (Merkle search
+// tree) it points to, as far as the included blocks prove it, holds each
+// created or updated record's CID and no longer holds deleted ones
+func verifyFirehoseCommit(b map[string]any, blocks firehoseBlocks, key *SigningKey) error {
+	commitCid, _ := b["commit"].(cidLink)
+	block, err := blocks.get(commitCid)
+	if err != nil {
+		return err
+	}
+	unsigned, sig, err := splitSignature(block)
+	if err != nil {
+		return err
+	}
+	if err := key.Verify(unsigned, sig); err != nil {
+		return fmt.Errorf("commit signature: %w", err)
+	}
+
+	value, _, err := decodeCBOR(block)
+	if err != nil {
+		return fmt.Errorf("invalid commit block: %v", err)
+	}
+	commit, _ := value.(map[string]any)
+	switch {
+	case cborString(commit, "did") != cborString(b, "repo"):
+		return fmt.Errorf("commit is for %s, not the repo %s", cborString(commit, "did"), cborString(b, "repo"))
+	case cborString(commit, "rev") != cborString(b, "rev"):
+		return fmt.Errorf("commit rev %s doesn't match the event's %s", cborString(commit, "rev"), cborString(b, "rev"))
+	}
+	root, ok := commit["data"].(cidLink)
+	if !ok {
+		return errors.New("commit has no data root")
+	}
+
+	ops, _ := b["ops"].([]any)
+	for _, o := range ops {
+		op, _ := o.(map[string]any)
+		path := cborString(op, "path")
+		found, err := mstLookup(blocks, root, path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		want, _ := op["cid"].(cidLink)
+		switch {
+		case cborString(op, "action") != "delete" && want == nil:
+			return fmt.Errorf("%s: %s has no record cid", path, cborString(op, "action"))
+		case cborString(op, "action") == "delete" && found != nil:
+			return fmt.Errorf("%s: deleted record is still in the tree", path)
+		case cborString(op, "action") != "delete" && !bytes.Equal(found, want):
+			return fmt.Errorf("%s: tree doesn't hold the record's cid", path)
+		}
+	}
+	return nil
+}
+
+// splitSignature returns a signed commit block re-encoded without its sig
+// field, which is what was signed, and the signature. DAG-CBOR has a
+// single encoding for each value, so dropping the field's bytes and
+// decrementing the map length reproduces it exactly.
+func splitSignature(block []byte) ([]byte, []byte, error) {
+	d := &cborDecoder{data: block}
+	major, count, err := d.head()
+	if err != nil || major != 5 {
+		return nil, nil, errors.New("commit block isn't a map")
+	}
+	if count == 0 {
+		return nil, nil, errors.New("commit isn't signed")
+	}
+	unsigned := appendHead(nil, 5, count-1)
+	var sig []byte
+	for range count {
+		start := d.pos
+		key, err := d.value(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := d.value(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key == "sig" {
+			sig, _ = value.([]byte)
+			continue
+		}
+		unsigned = append(unsigned, block[start:d.pos]...)
+	}
+	if sig == nil {
+		return nil, nil, errors.New("commit isn't signed")
+	}
+	return unsigned, sig, nil
+}
+
+// appendHead appends a CBOR head in its shortest form, as DAG-CBOR requires
+func appendHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major<<5|byte(n))
+	case n <= 0xff:
+		return append(b, major<<5|24, byte(n))
+	case n <= 0xffff:
+		return append(b, major<<5|25, byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		return append(b, major<<5|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, major<<5|27, byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32), byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// maxMSTDepth bounds the walk down the tree, far beyond any real repo
+const maxMSTDepth = 128
+
+// mstLookup finds key in the MST rooted at root, returning the CID it maps
+// to, or nil if the tree proves it absent. Each node holds sorted entries,
+// keys prefix-compressed against the entry before, with a subtree left of
+// the first entry and right of each; a key that falls in a subtree whose
+// node isn't among the blocks can't be proven either way.
+func mstLookup(blocks firehoseBlocks, root cidLink, key string) (cidLink, error) {
+	node := root
+	for range maxMSTDepth {
+		block, err := blocks.get(node)
+		if err != nil {
+			return nil, err
+		}
+		value, _, err := decodeCBOR(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tree node: %v", err)
+		}
+		n, _ := value.(map[string]any)
+		entries, _ := n["e"].([]any)
+
+		subtree, _ := n["l"].(cidLink)
+		var previous []byte
+		for _, e := range entries {
+			entry, _ := e.(map[string]any)
+			prefix, _ := entry["p"].(int64)
+			suffix, _ := entry["k"].([]byte)
+			if prefix < 0 || int(prefix) > len(previous) {
+				return nil, errors.New("invalid tree entry")
+			}
+			full := append(previous[:prefix:prefix], suffix...)
+			previous = full
+
+			if c := strings.Compare(key, string(full)); c == 0 {
+				v, _ := entry["v"].(cidLink)
+				return v, nil
+			} else if c < 0 {
+				break
+			}
+			subtree, _ = entry["t"].(cidLink)
+		}
+		if subtree == nil {
+			return nil, nil
+		}
+		node = subtree
+	}
+	return nil, errors.New("tree is too deep")
+}
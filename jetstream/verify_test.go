@@ -0,0 +1,201 @@
+package jetstream
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secpecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// carFile builds a CAR v1 of blocks, the first of them its root
+func carFile(blocks ...[]byte) []byte {
+	car := appendCBOR(nil, map[string]any{"version": 1, "roots": []any{blockCID(blocks[0])}})
+	car = append(binary.AppendUvarint(nil, uint64(len(car))), car...)
+	for _, block := range blocks {
+		cid := blockCID(block)
+		car = binary.AppendUvarint(car, uint64(len(cid)+len(block)))
+		car = append(append(car, cid...), block...)
+	}
+	return car
+}
+
+// signedCommit is a commit to build into a #commit frame: the records in
+// its tree, by path, and the ops it reports, whose cid is the path of
+// the record it points to
+type signedCommit struct {
+	key     *secp256k1.PrivateKey
+	records map[string]map[string]any
+	ops     []any
+}
+
+func (c *signedCommit) frame(t *testing.T) (map[string]any, firehoseBlocks) {
+	t.Helper()
+	// a single node tree, its entries sorted and prefix-compressed
+	var paths []string
+	var recordBlocks [][]byte
+	cids := map[string]cidLink{}
+	for path := range c.records {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var entries []any
+	previous := ""
+	for _, path := range paths {
+		block := appendCBOR(nil, c.records[path])
+		recordBlocks = append(recordBlocks, block)
+		cids[path] = blockCID(block)
+		p := 0
+		for p < len(previous) && p < len(path) && previous[p] == path[p] {
+			p++
+		}
+		entries = append(entries, map[string]any{"p": p, "k": []byte(path[p:]), "v": cids[path], "t": nil})
+		previous = path
+	}
+	node := appendCBOR(nil, map[string]any{"l": nil, "e": entries})
+
+	unsigned := map[string]any{"did": "did:plc:abc", "rev": "3kabcrev", "version": 3, "data": blockCID(node), "prev": nil}
+	hash := sha256.Sum256(appendCBOR(nil, unsigned))
+	// the compact form is a recovery byte, then r and s
+	unsigned["sig"] = secpecdsa.SignCompact(c.key, hash[:], true)[1:]
+	commit := appendCBOR(nil, unsigned)
+
+	for _, o := range c.ops {
+		op := o.(map[string]any)
+		if cid, ok := op["cid"].(string); ok {
+			op["cid"] = cids[cid]
+		}
+	}
+	car := carFile(append([][]byte{commit, node}, recordBlocks...)...)
+	frame := appendCBOR(nil, map[string]any{"op": 1, "t": "#commit"})
+	frame = appendCBOR(frame, map[string]any{
+		"seq": 1, "repo": "did:plc:abc", "rev": "3kabcrev", "time": "2024-09-09T19:46:02Z",
+		"commit": blockCID(commit), "ops": c.ops, "blocks": car,
+	})
+	_, _, fc, err := decodeFirehoseFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fc.body, fc.blocks
+}
+
+func newTestKey(t *testing.T) *secp256k1.PrivateKey {
+	t.Helper()
+	key, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifyFirehoseCommit(t *testing.T) {
+	key := newTestKey(t)
+	post := map[string]any{"$type": "app.bsky.feed.post", "text": "hello"}
+	tests := []struct {
+		name    string
+		commit  signedCommit
+		signer  *secp256k1.PrivateKey
+		wantErr string
+	}{
+		{
+			name: "create",
+			commit: signedCommit{key: key, records: map[string]map[string]any{"app.bsky.feed.post/3kpost": post},
+				ops: []any{map[string]any{"action": "create", "path": "app.bsky.feed.post/3kpost", "cid": "app.bsky.feed.post/3kpost"}}},
+		},
+		{
+			name: "delete",
+			commit: signedCommit{key: key, records: map[string]map[string]any{"app.bsky.feed.post/3kpost": post},
+				ops: []any{map[string]any{"action": "delete", "path": "app.bsky.feed.post/3kgone", "cid": nil}}},
+		},
+		{
+			name: "bad signature",
+			commit: signedCommit{key: newTestKey(t), records: map[string]map[string]any{"app.bsky.feed.post/3kpost": post},
+				ops: []any{map[string]any{"action": "create", "path": "app.bsky.feed.post/3kpost", "cid": "app.bsky.feed.post/3kpost"}}},
+			wantErr: "commit signature: bad signature",
+		},
+		{
+			name: "create without a cid",
+			commit: signedCommit{key: key, records: map[string]map[string]any{"app.bsky.feed.post/3kpost": post},
+				ops: []any{map[string]any{"action": "create", "path": "app.bsky.feed.post/3kmissing", "cid": nil}}},
+			wantErr: "create has no record cid",
+		},
+		{
+			name: "update without a cid",
+			commit: signedCommit{key: key, records: map[string]map[string]any{"app.bsky.feed.post/3kpost": post},
+				ops: []any{map[string]any{"action": "update", "path": "app.bsky.feed.post/3kpost", "cid": nil}}},
+			wantErr: "update has no record cid",
+		},
+		{
+			name: "deleted record still in the tree",
+			commit: signedCommit{key: key, records: map[string]map[string]any{"app.bsky.feed.post/3kpost": post},
+				ops: []any{map[string]any{"action": "delete", "path": "app.bsky.feed.post/3kpost", "cid": nil}}},
+			wantErr: "deleted record is still in the tree",
+		},
+		{
+			name: "cid not in the tree",
+			commit: signedCommit{key: key, records: map[string]map[string]any{"app.bsky.feed.post/3kpost": post},
+				ops: []any{map[string]any{"action": "create", "path": "app.bsky.feed.post/3kother", "cid": "app.bsky.feed.post/3kpost"}}},
+			wantErr: "tree doesn't hold the record's cid",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, blocks := tt.commit.frame(t)
+			err := verifyFirehoseCommit(body, blocks, &SigningKey{k256: key.PubKey()})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("got %v, want it verified", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyFirehoseCommitTamperedBlock(t *testing.T) {
+	key := newTestKey(t)
+	commit := signedCommit{key: key, records: map[string]map[string]any{"app.bsky.feed.post/3kpost": {"text": "hello"}},
+		ops: []any{map[string]any{"action": "create", "path": "app.bsky.feed.post/3kpost", "cid": "app.bsky.feed.post/3kpost"}}}
+	body, blocks := commit.frame(t)
+	// a tree node swapped for another under the same cid
+	root := body["commit"].(cidLink)
+	block, _ := blocks.get(root)
+	value, _, _ := decodeCBOR(block)
+	data := value.(map[string]any)["data"].(cidLink)
+	blocks[string(data)] = appendCBOR(nil, map[string]any{"l": nil, "e": []any{}})
+
+	err := verifyFirehoseCommit(body, blocks, &SigningKey{k256: key.PubKey()})
+	if err == nil || !strings.Contains(err.Error(), "doesn't match its cid") {
+		t.Errorf("got %v, want the tampered node rejected", err)
+	}
+}
+
+func TestParseFirehoseFrameTamperedRecord(t *testing.T) {
+	record := appendCBOR(nil, map[string]any{"text": "hello"})
+	forged := appendCBOR(nil, map[string]any{"text": "forged"})
+	cid := blockCID(record)
+
+	// the forged record stored under the real record's cid
+	car := appendCBOR(nil, map[string]any{"version": 1, "roots": []any{cid}})
+	car = append(binary.AppendUvarint(nil, uint64(len(car))), car...)
+	car = binary.AppendUvarint(car, uint64(len(cid)+len(forged)))
+	car = append(append(car, cid...), forged...)
+
+	frame := appendCBOR(nil, map[string]any{"op": 1, "t": "#commit"})
+	frame = appendCBOR(frame, map[string]any{
+		"seq": 1, "repo": "did:plc:abc", "rev": "3kabcrev", "time": "2024-09-09T19:46:02Z",
+		"ops":    []any{map[string]any{"action": "create", "path": "app.bsky.feed.post/3kpost", "cid": cid}},
+		"blocks": car,
+	})
+	messages, _, err := ParseFirehoseFrame(frame)
+	if err == nil || !strings.Contains(err.Error(), "doesn't match its cid") {
+		t.Errorf("got %d messages and %v, want the forged record rejected", len(messages), err)
+	}
+	if errors.Is(err, ErrSkipFrame) {
+		t.Error("a forged record was skipped as if the frame carried no event")
+	}
+}
@@ -0,0 +1,422 @@
+package jetstream
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	// framesPerWorker is how many frames each worker can have queued,
+	// which bounds how far reading runs ahead of handling, unless QueueMax
+	// is set
+	framesPerWorker = 64
+
+	// how often the queue is resized between QueueMin and QueueMax
+	resizeInterval = time.Second
+)
+
+// pipeline parses a connection's frames on Client.Workers goroutines. A
+// slot for each frame's result is queued in stream order as it is read,
+// so the dispatcher can wait on the slots one by one and hand off the
+// results in order however the parsing interleaves.
+type pipeline struct {
+	c       *Client
+	jobs    chan frameJob
+	ordered chan chan frameResult
+	parsers sync.WaitGroup
+
+	// closed by the dispatcher once a frame ends the connection, with
+	// failed as the error
+	stopped chan struct{}
+	failed  error
+	done    chan struct{}
+
+	// the frames submitted but not yet handed off, kept under limit, with
+	// what resize judges the load by since it last ran
+	mu      sync.Mutex
+	room    *sync.Cond
+	halted  bool
+	queued  int
+	limit   int
+	waited  bool
+	peak    int
+	handled int
+
+	// with PerDIDOrder, handler queues by DID hash, or with
+	// CollectionPriority, the messages waiting to be handled, and the
+	// frames still being handled
+	handlers []chan didJob
+	ready    *readyQueue
+	handling sync.WaitGroup
+	inflight inflight
+}
+
+type frameJob struct {
+	messageType int
+	frame       []byte
+	received    time.Time
+	result      chan frameResult
+}
+
+type didJob struct {
+	msg   *Message
+	frame *inflightFrame
+}
+
+func (c *Client) startPipeline() *pipeline {
+	limit := c.Workers * framesPerWorker
+	if c.QueueMax > 0 {
+		limit = min(max(limit, c.QueueMin), c.QueueMax)
+	}
+	queue := max(limit, c.QueueMax)
+	p := &pipeline{
+		c:        c,
+		jobs:     make(chan frameJob, queue),
+		ordered:  make(chan chan frameResult, queue),
+		stopped:  make(chan struct{}),
+		done:     make(chan struct{}),
+		limit:    limit,
+		inflight: inflight{c: c},
+	}
+	p.room = sync.NewCond(&p.mu)
+	for range c.Workers {
+		p.parsers.Add(1)
+		go p.parse()
+	}
+	switch {
+	case c.PerDIDOrder:
+		for range c.Workers {
+			ch := make(chan didJob, framesPerWorker)
+			p.handlers = append(p.handlers, ch)
+			p.handling.Add(1)
+			go p.handle(ch)
+		}
+	case len(c.CollectionPriority) > 0:
+		p.ready = &readyQueue{}
+		p.ready.cond = sync.NewCond(&p.ready.mu)
+		p.handling.Add(1)
+		go p.handleReady()
+	}
+	go p.dispatch()
+	if c.QueueMax > 0 {
+		go p.resizer()
+	}
+	c.pipeline.Store(p)
+	return p
+}
+
+// submit queues a frame, blocking while the queue is full. It returns an
+// error once a frame has ended the connection.
+func (p *pipeline) submit(messageType int, frame []byte, received time.Time) error {
+	p.mu.Lock()
+	for p.queued >= p.limit && !p.halted {
+		p.waited = true
+		p.room.Wait()
+	}
+	if p.halted {
+		p.mu.Unlock()
+		return p.failed
+	}
+	p.queued++
+	p.peak = max(p.peak, p.queued)
+	p.mu.Unlock()
+
+	result := make(chan frameResult, 1)
+	select {
+	case p.ordered <- result:
+	case <-p.stopped:
+		return p.failed
+	}
+	p.jobs <- frameJob{messageType: messageType, frame: frame, received: received, result: result}
+	return nil
+}
+
+func (p *pipeline) parse() {
+	defer p.parsers.Done()
+	for job := range p.jobs {
+		job.result <- p.c.parseFrame(job.messageType, job.frame, job.received)
+	}
+}
+
+func (p *pipeline) dispatch() {
+	defer close(p.done)
+	for result := range p.ordered {
+		r := <-result
+		switch {
+		case p.failed != nil:
+			// nothing after the frame that ended the connection counts
+		case r.err != nil:
+			p.failed = r.err
+			close(p.stopped)
+			p.mu.Lock()
+			p.halted = true
+			p.room.Broadcast()
+			p.mu.Unlock()
+		case p.ready != nil && len(r.messages) > 0:
+			frame := p.inflight.add(r.cursor, len(r.messages))
+			for _, msg := range r.messages {
+				p.ready.push(didJob{msg: msg, frame: frame}, p.c.priority(msg))
+			}
+			// released once its last message has been handled
+			continue
+		case p.ready != nil:
+			p.inflight.add(r.cursor, 0)
+		case p.handlers == nil:
+			p.c.handleFrame(r)
+		default:
+			frame := p.inflight.add(r.cursor, len(r.messages))
+			for _, msg := range r.messages {
+				h := fnv.New32a()
+				h.Write([]byte(msg.Did))
+				p.handlers[h.Sum32()%uint32(len(p.handlers))] <- didJob{msg: msg, frame: frame}
+			}
+		}
+		p.release()
+	}
+}
+
+// release makes room for another frame once one has been handed off
+func (p *pipeline) release() {
+	p.mu.Lock()
+	p.queued--
+	p.handled++
+	p.room.Signal()
+	p.mu.Unlock()
+}
+
+// resizer resizes the queue every resizeInterval until the dispatcher is
+// done
+func (p *pipeline) resizer() {
+	ticker := time.NewTicker(resizeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.resize(resizeInterval)
+		}
+	}
+}
+
+// resize doubles the queue, up to QueueMax, if reading had to wait for
+// room in it over the last interval while handling kept moving, so bursts
+// are absorbed rather than held up; a stalled handler gains nothing from
+// more frames piling up. It halves the queue, down to QueueMin, if it
+// never got over a quarter full, so an idle stream holds little memory.
+func (p *pipeline) resize(interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	limit, reason := p.limit, ""
+	switch {
+	case p.waited && p.handled > 0 && p.limit < p.c.QueueMax:
+		limit, reason = min(2*p.limit, p.c.QueueMax), "saturated"
+	case p.peak < p.limit/4 && p.limit > p.c.QueueMin:
+		limit, reason = max(p.limit/2, p.c.QueueMin, 1), "idle"
+	}
+	if limit != p.limit {
+		p.c.Logger.Debug().
+			Int("from", p.limit).
+			Int("to", limit).
+			Str("reason", reason).
+			Int("peak", p.peak).
+			Float64("frames_per_second", float64(p.handled)/interval.Seconds()).
+			Msg("resized the frame queue")
+		p.limit = limit
+		p.room.Broadcast()
+	}
+	p.waited, p.peak, p.handled = false, p.queued, 0
+}
+
+func (p *pipeline) handle(jobs chan didJob) {
+	defer p.handling.Done()
+	for job := range jobs {
+		p.c.dispatch(job.msg)
+		p.inflight.finish(job.frame)
+	}
+}
+
+// handleReady handles the waiting messages one at a time, highest
+// priority first, making room in the queue as each frame is done with
+func (p *pipeline) handleReady() {
+	defer p.handling.Done()
+	for {
+		job, ok := p.ready.pop()
+		if !ok {
+			return
+		}
+		p.c.dispatch(job.msg)
+		if p.inflight.finish(job.frame) {
+			p.release()
+		}
+	}
+}
+
+// priority is msg's CollectionPriority, 0 for events that aren't commits
+// or collections it doesn't list
+func (c *Client) priority(msg *Message) int {
+	if msg.Commit == nil {
+		return 0
+	}
+	return c.CollectionPriority[msg.Commit.Collection]
+}
+
+// close handles the frames still queued and returns the error of a frame
+// that ended the connection, if one did. Nothing can be submitted after.
+func (p *pipeline) close() error {
+	close(p.ordered)
+	close(p.jobs)
+	<-p.done
+	p.parsers.Wait()
+	for _, ch := range p.handlers {
+		close(ch)
+	}
+	if p.ready != nil {
+		p.ready.close()
+	}
+	p.handling.Wait()
+	p.c.pipeline.Store(nil)
+	return p.failed
+}
+
+// inflight tracks frames whose messages are being handled concurrently
+// with PerDIDOrder, advancing the cursor only past frames with every
+// message handled, so resuming never skips an unhandled one
+type inflight struct {
+	c      *Client
+	mu     sync.Mutex
+	frames []*inflightFrame // in stream order
+}
+
+type inflightFrame struct {
+	cursor    int64
+	remaining int
+}
+
+func (f *inflight) add(cursor int64, messages int) *inflightFrame {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	frame := &inflightFrame{cursor: cursor, remaining: messages}
+	f.frames = append(f.frames, frame)
+	f.advance()
+	return frame
+}
+
+// finish marks one of frame's messages handled, reporting whether it was
+// the last
+func (f *inflight) finish(frame *inflightFrame) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	frame.remaining--
+	f.advance()
+	return frame.remaining == 0
+}
+
+func (f *inflight) advance() {
+	for len(f.frames) > 0 && f.frames[0].remaining == 0 {
+		if cursor := f.frames[0].cursor; cursor > 0 {
+			f.c.lastTimeUs.Store(cursor)
+		}
+		f.frames = f.frames[1:]
+	}
+}
+
+// readyQueue holds messages waiting to be handled with CollectionPriority,
+// handing out the highest priority first, and messages of equal priority
+// in the order they were read. It needs no bound of its own, as the
+// frames in it still count against the pipeline's limit.
+type readyQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	jobs   readyJobs
+	next   uint64
+	closed bool
+}
+
+type readyJob struct {
+	didJob
+	priority int
+	seq      uint64
+}
+
+// push queues job with priority
+func (q *readyQueue) push(job didJob, priority int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	heap.Push(&q.jobs, readyJob{didJob: job, priority: priority, seq: q.next})
+	q.next++
+	q.cond.Signal()
+}
+
+// pop waits for a message to handle, returning false once the queue is
+// closed and empty
+func (q *readyQueue) pop() (didJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.jobs) == 0 {
+		return didJob{}, false
+	}
+	return heap.Pop(&q.jobs).(readyJob).didJob, true
+}
+
+// close has pop return false once the messages still queued are handed out
+func (q *readyQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// readyJobs is a heap.Interface of jobs by priority, then read order
+type readyJobs []readyJob
+
+func (j readyJobs) Len() int { return len(j) }
+func (j readyJobs) Less(a, b int) bool {
+	if j[a].priority != j[b].priority {
+		return j[a].priority > j[b].priority
+	}
+	return j[a].seq < j[b].seq
+}
+func (j readyJobs) Swap(a, b int) { j[a], j[b] = j[b], j[a] }
+func (j *readyJobs) Push(x any)   { *j = append(*j, x.(readyJob)) }
+func (j *readyJobs) Pop() any {
+	old := *j
+	job := old[len(old)-1]
+	*j = old[:len(old)-1]
+	return job
+}
+
+// QueueDepth returns how many frames have been read but not yet handled,
+// with Workers set, as a measure of how far handling is falling behind.
+// It is safe to call while Run is running.
+func (c *Client) QueueDepth() int {
+	p := c.pipeline.Load()
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	n := p.queued
+	p.mu.Unlock()
+	for _, ch := range p.handlers {
+		n += len(ch)
+	}
+	return n
+}
+
+// QueueLimit returns how many frames can be read ahead of handling, with
+// Workers set, which changes with the load between QueueMin and QueueMax.
+// It is safe to call while Run is running.
+func (c *Client) QueueLimit() int {
+	p := c.pipeline.Load()
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.limit
+}
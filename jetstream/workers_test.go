@@ -0,0 +1,170 @@
+package jetstream
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+// identityFrame is an identity event at us
+func identityFrame(us int64) []byte {
+	return []byte(`{"did":"did:plc:abc","time_us":` + strconv.FormatInt(us, 10) + `,"kind":"identity","identity":{"did":"did:plc:abc","seq":1,"time":"2023-11-14T22:13:30Z"}}`)
+}
+
+// jetstreamCommit is a create in collection at us
+func jetstreamCommit(us int64, collection string) []byte {
+	return []byte(`{"did":"did:plc:abc","time_us":` + strconv.FormatInt(us, 10) + `,"kind":"commit","commit":{"rev":"3l3qo2vutsw2b","operation":"create","collection":"` + collection + `","rkey":"3l3qo2vuowo2b","record":{"$type":"` + collection + `","createdAt":"2024-09-09T19:46:02.102Z"},"cid":"bafyreidc6sydkkbchcyg62v77wbhzvb2mvytlmsychqgwf2xojjtirmzj4"}}`)
+}
+
+func TestPipelineResize(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		waited  bool
+		peak    int
+		handled int
+		want    int
+	}{
+		{"saturated grows", 64, true, 64, 100, 128},
+		{"grows up to max", 300, true, 300, 100, 512},
+		{"stalled handler doesn't grow", 64, true, 64, 0, 64},
+		{"busy stays", 64, false, 40, 100, 64},
+		{"idle shrinks", 64, false, 3, 10, 32},
+		{"shrinks down to min", 20, false, 0, 0, 16},
+		{"at min stays", 16, false, 0, 0, 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &pipeline{
+				c:       &Client{QueueMin: 16, QueueMax: 512, Logger: zerolog.Nop()},
+				limit:   tt.limit,
+				waited:  tt.waited,
+				peak:    tt.peak,
+				handled: tt.handled,
+			}
+			p.room = sync.NewCond(&p.mu)
+			p.resize(time.Second)
+			if p.limit != tt.want {
+				t.Fatalf("resized to %d, want %d", p.limit, tt.want)
+			}
+			if p.waited || p.handled != 0 {
+				t.Fatal("resize didn't start measuring the load afresh")
+			}
+		})
+	}
+}
+
+func TestPipelineHoldsQueueLimit(t *testing.T) {
+	c := NewClient(DefaultURL)
+	c.Logger = zerolog.Nop()
+	c.Workers = 1
+	c.QueueMin, c.QueueMax = 2, 2
+	release := make(chan struct{})
+	var handled []int64
+	c.Handle(func(msg *Message) {
+		<-release
+		handled = append(handled, msg.TimeUs)
+	})
+	p := c.startPipeline()
+	if got := c.QueueLimit(); got != 2 {
+		t.Fatalf("queue limit %d, want 2", got)
+	}
+
+	submitted := make(chan int64, 3)
+	go func() {
+		for us := int64(1); us <= 3; us++ {
+			if err := p.submit(websocket.TextMessage, identityFrame(us), time.Now()); err != nil {
+				t.Error(err)
+			}
+			submitted <- us
+		}
+	}()
+	<-submitted
+	<-submitted
+	select {
+	case <-submitted:
+		t.Fatal("a third frame was queued past the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if depth := c.QueueDepth(); depth != 2 {
+		t.Fatalf("queue depth %d, want 2", depth)
+	}
+
+	close(release)
+	<-submitted
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 3 || handled[0] != 1 || handled[2] != 3 {
+		t.Fatalf("handled %v, want all three in order", handled)
+	}
+}
+
+func TestPipelinePrioritisesCollections(t *testing.T) {
+	c := NewClient(DefaultURL)
+	c.Logger = zerolog.Nop()
+	c.Workers = 2
+	c.CollectionPriority = map[string]int{"app.bsky.feed.post": 10, "app.bsky.feed.like": -1}
+	started, release := make(chan struct{}), make(chan struct{})
+	var handled, cursors []int64
+	c.Handle(func(msg *Message) {
+		if msg.TimeUs == 1 {
+			close(started)
+			<-release
+		}
+		handled = append(handled, msg.TimeUs)
+		cursors = append(cursors, c.lastTimeUs.Load())
+	})
+	p := c.startPipeline()
+
+	frames := [][]byte{
+		identityFrame(1),
+		jetstreamCommit(2, "app.bsky.feed.like"),
+		jetstreamCommit(3, "app.bsky.feed.post"),
+		jetstreamCommit(4, "app.bsky.feed.like"),
+		jetstreamCommit(5, "app.bsky.feed.post"),
+		identityFrame(6),
+	}
+	for i, frame := range frames {
+		if err := p.submit(websocket.TextMessage, frame, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			<-started
+		}
+	}
+	// the handler holds the first while the rest wait their turn
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.ready.mu.Lock()
+		waiting := len(p.ready.jobs)
+		p.ready.mu.Unlock()
+		if waiting == len(frames)-1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events waiting, want %d", waiting, len(frames)-1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int64{1, 3, 5, 6, 2, 4}; !slices.Equal(handled, want) {
+		t.Fatalf("handled %v, want %v", handled, want)
+	}
+	// the cursor waits for the likes, but catches up once they are handled
+	if want := []int64{0, 1, 1, 1, 1, 3}; !slices.Equal(cursors, want) {
+		t.Fatalf("cursor while handling %v, want %v", cursors, want)
+	}
+	if cursor := c.lastTimeUs.Load(); cursor != 6 {
+		t.Fatalf("cursor %d once everything was handled, want 6", cursor)
+	}
+}
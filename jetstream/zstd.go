@@ -0,0 +1,30 @@
+package jetstream
+
+import (
+	_ "embed"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdDictionary is the custom dictionary jetstream compresses frames with
+// when subscribed with compress=true, copied from the jetstream repository
+// (pkg/models/zstd_dictionary)
+//
+//go:embed zstd_dictionary
+var zstdDictionary []byte
+
+// zstdDecoder is shared by every connection. DecodeAll is safe for
+// concurrent use.
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderDicts(zstdDictionary))
+})
+
+// decompress decodes a compressed jetstream frame
+func decompress(frame []byte) ([]byte, error) {
+	dec, err := zstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+	return dec.DecodeAll(frame, nil)
+}
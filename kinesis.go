@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// records a shard throttles, and requests that fail or are throttled
+	// as a whole, are retried this many times, backing off from
+	// kinesisRetryDelay, before they are dropped
+	kinesisAttempts   = 8
+	kinesisRetryDelay = 100 * time.Millisecond
+	kinesisTimeout    = time.Minute
+	// a PutRecords request holds at most this many records, and this many
+	// bytes of data and partition keys, and a record at most
+	// kinesisMaxRecordBytes, Kinesis's own limits
+	kinesisMaxRecords     = 500
+	kinesisMaxBytes       = 5 << 20
+	kinesisMaxRecordBytes = 1 << 20
+	kinesisMaxKeyLength   = 256
+)
+
+// kinesisRecord is a record of a PutRecords request. Data is sent base64
+// encoded, as encoding/json does with []byte.
+type kinesisRecord struct {
+	Data         []byte `json:"Data"`
+	PartitionKey string `json:"PartitionKey"`
+}
+
+// kinesisResult is the part of a PutRecords response that says which
+// records failed, in the order they were sent
+type kinesisResult struct {
+	FailedRecordCount int `json:"FailedRecordCount"`
+	Records           []struct {
+		ErrorCode    string `json:"ErrorCode"`
+		ErrorMessage string `json:"ErrorMessage"`
+	} `json:"Records"`
+}
+
+// kinesisError is the body of a request Kinesis refused
+type kinesisError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+// kinesisSink puts every event as JSON into an AWS Kinesis data stream,
+// batched with PutRecords, with the DID as the partition key so each
+// account's events land on one shard in order. Records a shard throttles
+// are retried with backoff, and counted in kinesis_throttled_records_total
+// and kinesis_retries_total.
+type kinesisSink struct {
+	*batchQueue
+	stream   string
+	region   string
+	endpoint string
+	creds    *credentials.Credentials
+	client   *http.Client
+}
+
+// newKinesisSink puts records into stream, checking it exists and the
+// credentials can be used first. endpoint defaults to region's.
+func newKinesisSink(stream, region, endpoint string, queueSize, batchSize int, interval, idle time.Duration) (*kinesisSink, error) {
+	if endpoint == "" {
+		endpoint = "https://kinesis." + region + ".amazonaws.com"
+	}
+	s := &kinesisSink{
+		stream:   stream,
+		region:   region,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds:    awsCredentials(),
+		client:   &http.Client{Timeout: kinesisTimeout},
+	}
+	status, body, err := s.request("DescribeStreamSummary", map[string]string{"StreamName": stream})
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, kinesisFailure(status, body)
+	}
+	s.batchQueue = newBatchQueue("kinesis", queueSize, batchSize, interval, idle, s.write)
+	return s, nil
+}
+
+// request calls the Kinesis API action with input, signed with the
+// current credentials, returning its status and body
+func (s *kinesisSink) request(action string, input any) (int, []byte, error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return 0, nil, err
+	}
+	creds, err := s.creds.Get()
+	if err != nil {
+		return 0, nil, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return 0, nil, errors.New("no AWS credentials found")
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "Kinesis_20131202."+action)
+	signAWSv4(req, body, creds, s.region, "kinesis", time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// kinesisFailure describes a refused request by its error type
+func kinesisFailure(status int, body []byte) error {
+	var e kinesisError
+	if json.Unmarshal(body, &e) == nil && e.Type != "" {
+		return fmt.Errorf("status %d: %s: %s", status, kinesisErrorType(e.Type), e.Message)
+	}
+	return fmt.Errorf("status %d: %s", status, bytes.TrimSpace(body))
+}
+
+// kinesisErrorType strips the namespace some error types come with, as in
+// com.amazonaws.kinesis#ProvisionedThroughputExceededException
+func kinesisErrorType(t string) string {
+	return t[strings.LastIndexByte(t, '#')+1:]
+}
+
+// kinesisThrottling are the errors that mean a request or record went over
+// a limit and is worth retrying once Kinesis catches up
+var kinesisThrottling = []string{"ProvisionedThroughputExceededException", "LimitExceededException", "ThrottlingException", "KMSThrottlingException"}
+
+// write puts batch in as few requests as Kinesis's limits allow, in order.
+// Once a request fails the rest aren't tried.
+func (s *kinesisSink) write(batch []*jetstream.Message) error {
+	var requests [][]kinesisRecord
+	var request []kinesisRecord
+	size := 0
+	for _, msg := range batch {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			s.fail("invalid_record", err, 1)
+			continue
+		}
+		key := msg.Did
+		if len(key) > kinesisMaxKeyLength {
+			key = key[:kinesisMaxKeyLength]
+		}
+		n := len(data) + len(key)
+		if n > kinesisMaxRecordBytes {
+			s.fail("too_large", fmt.Errorf("%d byte event", len(data)), 1)
+			continue
+		}
+		if len(request) == kinesisMaxRecords || size+n > kinesisMaxBytes {
+			requests = append(requests, request)
+			request, size = nil, 0
+		}
+		request = append(request, kinesisRecord{Data: data, PartitionKey: key})
+		size += n
+	}
+	if len(request) > 0 {
+		requests = append(requests, request)
+	}
+
+	for i, request := range requests {
+		if err := s.put(request); err != nil {
+			lost := 0
+			for _, r := range requests[i+1:] {
+				lost += len(r)
+			}
+			var partial *partialWriteError
+			if errors.As(err, &partial) {
+				lost += partial.lost
+			}
+			return &partialWriteError{err: err, lost: lost}
+		}
+	}
+	return nil
+}
+
+// put sends records in one PutRecords request, retrying the ones that
+// were throttled or failed inside Kinesis until they go through or the
+// attempts run out. Single records rejected for other reasons are dropped
+// and counted. An error is a partialWriteError for the records that were
+// never put.
+func (s *kinesisSink) put(records []kinesisRecord) error {
+	delay := kinesisRetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := s.putRecords(records)
+		if len(retry) == 0 {
+			return err
+		}
+		if attempt == kinesisAttempts {
+			return &partialWriteError{err: err, lost: len(retry)}
+		}
+		kinesisRetries.Inc()
+		log.Debug().Err(err).Int("records", len(retry)).Int("attempt", attempt).Dur("retry_in", delay).Msg("kinesis pushed back, retrying")
+		time.Sleep(delay)
+		delay *= 2
+		records = retry
+	}
+}
+
+// putRecords sends one PutRecords request, returning the records to
+// retry with why: all of them if the request didn't reach Kinesis, was
+// throttled, or failed inside it, or else those that were. A request
+// refused for other reasons loses all its records.
+func (s *kinesisSink) putRecords(records []kinesisRecord) ([]kinesisRecord, error) {
+	status, body, err := s.request("PutRecords", map[string]any{"StreamName": s.stream, "Records": records})
+	if err != nil {
+		return records, err
+	}
+	if status != http.StatusOK {
+		err := kinesisFailure(status, body)
+		var e kinesisError
+		json.Unmarshal(body, &e)
+		switch {
+		case slices.Contains(kinesisThrottling, kinesisErrorType(e.Type)):
+			kinesisThrottled.Add(float64(len(records)))
+			return records, err
+		case status >= 500:
+			return records, err
+		}
+		return nil, &partialWriteError{err: err, lost: len(records)}
+	}
+
+	var result kinesisResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return records, err
+	}
+	if result.FailedRecordCount == 0 {
+		return nil, nil
+	}
+	var retry []kinesisRecord
+	var last error
+	for i, r := range result.Records {
+		if r.ErrorCode == "" || i >= len(records) {
+			continue
+		}
+		err := fmt.Errorf("%s: %s", r.ErrorCode, r.ErrorMessage)
+		switch r.ErrorCode {
+		case "ProvisionedThroughputExceededException":
+			kinesisThrottled.Inc()
+			retry = append(retry, records[i])
+			last = err
+		case "InternalFailure":
+			retry = append(retry, records[i])
+			last = err
+		default:
+			s.fail("rejected", err, 1)
+		}
+	}
+	if len(retry) > 0 {
+		return retry, fmt.Errorf("%d records failed, the last with %w", len(retry), last)
+	}
+	return nil, nil
+}
+
+// signAWSv4 signs req, whose body is body, with AWS Signature Version 4
+// for service in region, as of now. Every header set on req is signed,
+// along with its host.
+func signAWSv4(req *http.Request, body []byte, creds credentials.Value, region, service string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payload := sha256.Sum256(body)
+	request := strings.Join([]string{req.Method, path, req.URL.RawQuery, canonical.String(), signed, hex.EncodeToString(payload[:])}, "\n")
+	hashed := sha256.Sum256([]byte(request))
+
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
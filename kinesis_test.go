@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/signer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSignAWSv4MatchesMinio(t *testing.T) {
+	body := []byte(`{"StreamName":"events"}`)
+	payload := sha256.Sum256(body)
+	creds := credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "session"}
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, "https://s3.us-east-1.amazonaws.com/bucket/key", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		// minio signs whatever this says the payload hashes to
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+		return req
+	}
+
+	want := signer.SignV4(*newRequest(), creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken, "us-east-1")
+	at, err := time.Parse("20060102T150405Z", want.Header.Get("X-Amz-Date"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := newRequest()
+	signAWSv4(got, body, creds, "us-east-1", "s3", at)
+	if got.Header.Get("Authorization") != want.Header.Get("Authorization") {
+		t.Fatalf("Authorization\n%s\nwant\n%s", got.Header.Get("Authorization"), want.Header.Get("Authorization"))
+	}
+}
+
+// counterValue reads counter, through a registry of its own
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(counter)
+	families, err := reg.Gather()
+	if err != nil || len(families) != 1 {
+		t.Fatalf("gathering %v: %v", counter.Desc(), err)
+	}
+	return families[0].GetMetric()[0].GetCounter().GetValue()
+}
+
+// kinesisResponse is how kinesisServer answers a PutRecords request: with
+// status and body, or with 200 and these error codes for its records, ""
+// for those put
+type kinesisResponse struct {
+	status int
+	body   string
+	codes  []string
+}
+
+// kinesisServer is a Kinesis endpoint with one stream, answering each
+// PutRecords request with the next response, then putting every record,
+// and keeping the partition keys of the records it put
+type kinesisServer struct {
+	t         *testing.T
+	responses []kinesisResponse
+
+	mu  sync.Mutex
+	put []string
+}
+
+func (k *kinesisServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(r.Header.Get("Authorization"), "/us-west-2/kinesis/aws4_request") {
+		k.t.Errorf("request signed with %q", r.Header.Get("Authorization"))
+	}
+	var input struct {
+		StreamName string
+		Records    []kinesisRecord
+	}
+	json.NewDecoder(r.Body).Decode(&input)
+	if input.StreamName != "events" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Stream not found"}`))
+		return
+	}
+	switch r.Header.Get("X-Amz-Target") {
+	case "Kinesis_20131202.DescribeStreamSummary":
+		w.Write([]byte(`{"StreamDescriptionSummary":{"StreamName":"events","StreamStatus":"ACTIVE"}}`))
+		return
+	case "Kinesis_20131202.PutRecords":
+	default:
+		k.t.Errorf("unexpected target %q", r.Header.Get("X-Amz-Target"))
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var response kinesisResponse
+	if len(k.responses) > 0 {
+		response = k.responses[0]
+		k.responses = k.responses[1:]
+	}
+	if response.status != 0 {
+		w.WriteHeader(response.status)
+		w.Write([]byte(response.body))
+		return
+	}
+	var result kinesisResult
+	result.Records = make([]struct {
+		ErrorCode    string `json:"ErrorCode"`
+		ErrorMessage string `json:"ErrorMessage"`
+	}, len(input.Records))
+	for i, record := range input.Records {
+		if i < len(response.codes) && response.codes[i] != "" {
+			result.FailedRecordCount++
+			result.Records[i].ErrorCode = response.codes[i]
+			result.Records[i].ErrorMessage = "failed"
+			continue
+		}
+		k.put = append(k.put, record.PartitionKey)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func TestKinesisSinkWrite(t *testing.T) {
+	isolateBreakers(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	throttled := kinesisResponse{status: http.StatusBadRequest, body: `{"__type":"com.amazonaws.kinesis#ProvisionedThroughputExceededException","message":"Rate exceeded for stream"}`}
+	tests := []struct {
+		name      string
+		responses []kinesisResponse
+		// put is the partition keys put, in order
+		put []string
+		// lost is how many events the write reports lost, 0 for none
+		lost      int
+		throttled float64
+		retries   float64
+	}{
+		{"put", nil, []string{"did:plc:alice", "did:plc:bob", "did:plc:alice"}, 0, 0, 0},
+		{"throttled records retried", []kinesisResponse{
+			{codes: []string{"", "ProvisionedThroughputExceededException", "InternalFailure"}},
+		}, []string{"did:plc:alice", "did:plc:bob", "did:plc:alice"}, 0, 1, 1},
+		{"throttled request retried", []kinesisResponse{throttled, throttled}, []string{"did:plc:alice", "did:plc:bob", "did:plc:alice"}, 0, 6, 2},
+		{"record rejected", []kinesisResponse{
+			{codes: []string{"KMSAccessDeniedException"}},
+		}, []string{"did:plc:bob", "did:plc:alice"}, 0, 0, 0},
+		{"request rejected", []kinesisResponse{
+			{status: http.StatusBadRequest, body: `{"__type":"AccessDeniedException","message":"denied"}`},
+		}, nil, 3, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &kinesisServer{t: t, responses: tt.responses}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+			s, err := newKinesisSink("events", "us-west-2", ts.URL, 10, 10, time.Hour, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.close()
+			throttledBefore, retriesBefore := counterValue(t, kinesisThrottled), counterValue(t, kinesisRetries)
+
+			err = s.write([]*jetstream.Message{parseFrame(t, postFrame), parseFrame(t, likeFrame), parseFrame(t, identityFrame)})
+			var partial *partialWriteError
+			switch {
+			case tt.lost == 0 && err != nil:
+				t.Fatalf("write failed: %v", err)
+			case tt.lost > 0 && !errors.As(err, &partial):
+				t.Fatalf("write returned %v, want a partialWriteError", err)
+			case tt.lost > 0 && partial.lost != tt.lost:
+				t.Fatalf("write lost %d events, want %d", partial.lost, tt.lost)
+			}
+			if !slices.Equal(server.put, tt.put) {
+				t.Errorf("put records with keys %v, want %v", server.put, tt.put)
+			}
+			if got := counterValue(t, kinesisThrottled) - throttledBefore; got != tt.throttled {
+				t.Errorf("counted %v throttled records, want %v", got, tt.throttled)
+			}
+			if got := counterValue(t, kinesisRetries) - retriesBefore; got != tt.retries {
+				t.Errorf("counted %v retries, want %v", got, tt.retries)
+			}
+		})
+	}
+}
+
+func TestNewKinesisSinkChecksStream(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	ts := httptest.NewServer(&kinesisServer{t: t})
+	defer ts.Close()
+	_, err := newKinesisSink("missing", "us-west-2", ts.URL, 10, 10, time.Hour, 0)
+	if err == nil || !strings.Contains(err.Error(), "ResourceNotFoundException") {
+		t.Fatalf("opening a missing stream returned %v", err)
+	}
+}
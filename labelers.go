@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// handleMu serializes handleMessage between the main stream and the
+// -labeler streams, since the handler's state assumes a single caller
+var handleMu sync.Mutex
+
+// labelerURL turns a -labeler value, a labeler's host or service URL, into
+// its subscribeLabels websocket URL
+func labelerURL(raw string) (string, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "wss://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	case "ws", "wss", "unix":
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Scheme != "unix" && (u.Path == "" || u.Path == "/") {
+		u.Path = jetstream.LabelsPath
+	}
+	return u.String(), nil
+}
+
+// runLabelers subscribes to each -labeler until ctx is done, feeding their
+// labels through handleMessage alongside the main stream. Labelers are
+// followed from the live tail: their sequence numbers aren't saved to
+// -cursor-file, and a labeler that gives up reconnecting only ends its own
+// stream.
+func runLabelers(ctx context.Context, urls []string) {
+	var wg sync.WaitGroup
+	for _, u := range urls {
+		client := jetstream.NewClient(u)
+		client.Labeler = true
+		// -follows-of is applied by handleMessage, and refreshes without
+		// reaching these clients
+		if follows == nil {
+			client.WantedDids = wantedDids
+		}
+		client.AllowInsecureFallback = *insecureFallbackFlag
+		dialing.apply(client, false)
+		client.PingInterval = *pingIntervalFlag
+		client.PongTimeout = *pongTimeoutFlag
+		client.MaxBackoff = *maxBackoffFlag
+		client.MaxRetries = *maxRetriesFlag
+		// no -idle-timeout, since a labeler can go a long time between labels
+		client.OnFrame = func(_ int, frame []byte) {
+			bytesReceived.Add(float64(len(frame)))
+		}
+		client.OnParseError = func(error) {
+			parseErrors.Inc()
+			drops.add("parse_error")
+		}
+		client.Handle(func(msg *jetstream.Message) {
+			if plugin != nil {
+				plugin.send(msg.Raw)
+			}
+			handleMu.Lock()
+			defer handleMu.Unlock()
+			handleMessage(msg)
+		})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.Run(ctx); err != nil {
+				log.Error().Err(err).Str("labeler", u).Msg("labeler stream ended")
+			}
+		}()
+	}
+	wg.Wait()
+}
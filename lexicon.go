@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// lexiconDoc is the part of a lexicon file needed to find record types
+type lexiconDoc struct {
+	Lexicon int    `json:"lexicon"`
+	ID      string `json:"id"`
+	Defs    map[string]struct {
+		Type string `json:"type"`
+	} `json:"defs"`
+}
+
+// collectionsFromLexiconDir walks dir for lexicon JSON files and returns the
+// NSIDs of those whose main definition is a record, which are the
+// collections that can appear in commits
+func collectionsFromLexiconDir(dir string) ([]string, error) {
+	var collections []string
+	err := walkLexiconDir(dir, func(_ string, _ []byte, doc lexiconDoc) error {
+		if doc.Defs["main"].Type == "record" {
+			collections = append(collections, doc.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(collections)
+	return collections, nil
+}
+
+// walkLexiconDir calls fn with each lexicon JSON file in dir, skipping JSON
+// files that aren't lexicons
+func walkLexiconDir(dir string, fn func(path string, data []byte, doc lexiconDoc) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".json") {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var doc lexiconDoc
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if doc.Lexicon == 0 || doc.ID == "" {
+			// not a lexicon file
+			return nil
+		}
+		return fn(path, data, doc)
+	})
+}
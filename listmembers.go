@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// listItem is the record body of app.bsky.graph.listitem
+type listItem struct {
+	Subject string `json:"subject"`
+	List    string `json:"list"`
+}
+
+// listMemberTracker reconstructs list membership from the listitem events
+// seen during the run. It only knows about changes observed since startup,
+// so the membership it reports is partial: members added before the logger
+// started are missing, and removals of those members can't be applied.
+type listMemberTracker struct {
+	mu         sync.Mutex
+	maxLists   int
+	maxMembers int
+	started    time.Time
+	lists      map[string]map[string]string // list uri -> subject did -> item uri
+	items      map[string]listItem          // item uri -> membership
+	// memberships not tracked because a cap was reached
+	droppedLists   uint64
+	droppedMembers uint64
+}
+
+// listMembers is the list membership tracker, nil unless
+// -list-members-file is set
+var listMembers *listMemberTracker
+
+func newListMemberTracker(maxLists, maxMembers int) *listMemberTracker {
+	return &listMemberTracker{
+		maxLists:   maxLists,
+		maxMembers: maxMembers,
+		started:    time.Now(),
+		lists:      make(map[string]map[string]string),
+		items:      make(map[string]listItem),
+	}
+}
+
+// observe applies a listitem commit to the tracked membership
+func (t *listMemberTracker) observe(commit *jetstream.CommitEvent, did string) {
+	uri := atURI(did, commit.Collection, commit.Rkey)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch commit.Operation {
+	case "create":
+		var item listItem
+		if err := json.Unmarshal(commit.Record, &item); err != nil || item.List == "" || item.Subject == "" {
+			return
+		}
+		members, ok := t.lists[item.List]
+		if !ok {
+			if len(t.lists) >= t.maxLists {
+				t.droppedLists++
+				return
+			}
+			members = make(map[string]string)
+			t.lists[item.List] = members
+		}
+		if len(members) >= t.maxMembers {
+			t.droppedMembers++
+			return
+		}
+		members[item.Subject] = uri
+		t.items[uri] = item
+
+	case "delete":
+		item, ok := t.items[uri]
+		if !ok {
+			return
+		}
+		delete(t.items, uri)
+		if members := t.lists[item.List]; members != nil && members[item.Subject] == uri {
+			delete(members, item.Subject)
+			if len(members) == 0 {
+				delete(t.lists, item.List)
+			}
+		}
+	}
+}
+
+// listMembersSnapshot is the exported form of the tracked membership
+type listMembersSnapshot struct {
+	ObservedSince  time.Time           `json:"observed_since"`
+	GeneratedAt    time.Time           `json:"generated_at"`
+	Partial        bool                `json:"partial"`
+	DroppedLists   uint64              `json:"dropped_lists"`
+	DroppedMembers uint64              `json:"dropped_members"`
+	Lists          map[string][]string `json:"lists"`
+}
+
+// export writes the current membership to path as JSON. The file is
+// replaced atomically so readers never see a partial write.
+func (t *listMemberTracker) export(path string) error {
+	t.mu.Lock()
+	snapshot := listMembersSnapshot{
+		ObservedSince:  t.started,
+		GeneratedAt:    time.Now(),
+		Partial:        true,
+		DroppedLists:   t.droppedLists,
+		DroppedMembers: t.droppedMembers,
+		Lists:          make(map[string][]string, len(t.lists)),
+	}
+	for list, members := range t.lists {
+		dids := make([]string, 0, len(members))
+		for did := range members {
+			dids = append(dids, did)
+		}
+		sort.Strings(dids)
+		snapshot.Lists[list] = dids
+	}
+	t.mu.Unlock()
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".list-members-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// exportListMembersOnSignal writes the membership snapshot to path each
+// time the process receives SIGUSR1
+func exportListMembersOnSignal(path string) {
+	if exportSignal == nil {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, exportSignal)
+	for range sigs {
+		if err := listMembers.export(path); err != nil {
+			log.Error().Err(err).Msg("failed to export list members")
+			continue
+		}
+		log.Info().Str("path", path).Msg("exported list members")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// fieldSelector picks the fields of each log line, from -log-fields or
+// -log-omit-fields. The level, time, message, and error are always kept,
+// so lines stay readable and failures explained.
+type fieldSelector struct {
+	keep map[string]bool
+	omit map[string]bool
+}
+
+// parseFieldSelector parses the comma-separated -log-fields and
+// -log-omit-fields, returning nil when neither is set
+func parseFieldSelector(keep, omit string) (*fieldSelector, error) {
+	if keep == "" && omit == "" {
+		return nil, nil
+	}
+	if keep != "" && omit != "" {
+		return nil, errors.New("-log-fields and -log-omit-fields can't be combined")
+	}
+	s := &fieldSelector{}
+	if keep != "" {
+		s.keep = fieldSet(keep)
+	} else {
+		s.omit = fieldSet(omit)
+	}
+	return s, nil
+}
+
+func fieldSet(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			set[name] = true
+		}
+	}
+	return set
+}
+
+// logs reports whether a line's key should be kept
+func (s *fieldSelector) logs(key string) bool {
+	switch key {
+	case zerolog.LevelFieldName, zerolog.TimestampFieldName, zerolog.MessageFieldName, zerolog.ErrorFieldName:
+		return true
+	}
+	if s.keep != nil {
+		return s.keep[key]
+	}
+	return !s.omit[key]
+}
+
+// logField is a key of a log line with its JSON value
+type logField struct {
+	key   string
+	value json.RawMessage
+}
+
+// parseLogLine splits one of zerolog's JSON lines into its fields, in the
+// order they were written
+func parseLogLine(line []byte) ([]logField, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("not a json object")
+	}
+	var fields []logField
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := t.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, logField{key, value})
+	}
+	return fields, nil
+}
+
+// lineWriter rewrites zerolog's JSON lines on their way to out, dropping
+// the fields its selector doesn't log and, with logfmt, writing them as
+// key=value pairs instead of JSON. A console writer as out formats what's
+// left as usual.
+type lineWriter struct {
+	out    io.Writer
+	fields *fieldSelector
+	logfmt bool
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	fields, err := parseLogLine(p)
+	if err != nil {
+		// not a line zerolog wrote, so there's nothing to rewrite
+		return w.out.Write(p)
+	}
+	if w.fields != nil {
+		kept := fields[:0]
+		for _, f := range fields {
+			if w.fields.logs(f.key) {
+				kept = append(kept, f)
+			}
+		}
+		fields = kept
+	}
+
+	var buf bytes.Buffer
+	if w.logfmt {
+		writeLogfmt(&buf, fields)
+	} else {
+		buf.WriteByte('{')
+		for i, f := range fields {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(f.key)
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(f.value)
+		}
+		buf.WriteString("}\n")
+	}
+	if _, err := w.out.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeLogfmt writes fields as a logfmt line, the time, level, and message
+// first, as logfmt readers expect, and the rest in order. Objects and
+// arrays are written as quoted JSON.
+func writeLogfmt(buf *bytes.Buffer, fields []logField) {
+	first := []string{zerolog.TimestampFieldName, zerolog.LevelFieldName, zerolog.MessageFieldName}
+	n := 0
+	write := func(f logField) {
+		if n > 0 {
+			buf.WriteByte(' ')
+		}
+		n++
+		buf.WriteString(logfmtKey(f.key))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(f.value))
+	}
+	for _, key := range first {
+		for _, f := range fields {
+			if f.key == key {
+				write(f)
+			}
+		}
+	}
+	for _, f := range fields {
+		if f.key != first[0] && f.key != first[1] && f.key != first[2] {
+			write(f)
+		}
+	}
+	buf.WriteByte('\n')
+}
+
+// logfmtKey replaces the characters logfmt keys can't contain
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// logfmtValue formats a JSON value for logfmt, quoting strings only when
+// they need it
+func logfmtValue(value json.RawMessage) string {
+	switch {
+	case len(value) == 0:
+		return ""
+	case value[0] == '{' || value[0] == '[':
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, value); err != nil {
+			return strconv.Quote(string(value))
+		}
+		return strconv.Quote(compact.String())
+	case value[0] != '"':
+		// numbers, booleans, and null
+		return string(value)
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return strconv.Quote(string(value))
+	}
+	if s == "" || strings.ContainsFunc(s, func(r rune) bool { return r <= ' ' || r == '=' || r == '"' || r == '\\' || r == 0x7f }) {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaScript runs a -lua-script's process function on each event, which
+// can change the event, drop it, or emit derived events besides it.
+// Events are passed to the script as tables shaped like jetstream's JSON,
+// and what it returns is decoded back into events, so the script can add
+// fields to records but not to the message itself. It is only called from
+// the handling goroutine.
+type luaScript struct {
+	state   *lua.LState
+	process *lua.LFunction
+	// emitted collects the events emit is called with during one call
+	emitted []*lua.LTable
+	failed  atomic.Uint64
+}
+
+// script is nil unless -lua-script is set
+var script *luaScript
+
+// luaArray marks tables decoded from JSON arrays, so they encode back to
+// arrays even when empty
+const luaArray = "json_array"
+
+func newLuaScript(path string) (*luaScript, error) {
+	s := &luaScript{state: lua.NewState()}
+	s.state.SetGlobal("emit", s.state.NewFunction(func(L *lua.LState) int {
+		s.emitted = append(s.emitted, L.CheckTable(1))
+		return 0
+	}))
+	s.state.NewTypeMetatable(luaArray)
+	if err := s.state.DoFile(path); err != nil {
+		s.state.Close()
+		return nil, err
+	}
+	process, ok := s.state.GetGlobal("process").(*lua.LFunction)
+	if !ok {
+		s.state.Close()
+		return nil, fmt.Errorf("%s doesn't define a process function", path)
+	}
+	s.process = process
+	return s, nil
+}
+
+// run returns the events msg becomes: none if the script drops it, and
+// then any it emits. Events the script fails on are dropped and counted.
+func (s *luaScript) run(msg *jetstream.Message) []*jetstream.Message {
+	var event any
+	if err := json.Unmarshal(msg.Raw, &event); err != nil {
+		s.fail("script_error", err)
+		return nil
+	}
+	s.emitted = s.emitted[:0]
+	err := s.state.CallByParam(lua.P{Fn: s.process, NRet: 1, Protect: true}, toLua(s.state, event))
+	if err != nil {
+		s.fail("script_error", err)
+		return nil
+	}
+	ret := s.state.Get(-1)
+	s.state.Pop(1)
+
+	var out []*jetstream.Message
+	switch ret := ret.(type) {
+	case lua.LBool:
+		if ret {
+			out = append(out, msg)
+		}
+	case *lua.LTable:
+		if m := s.message(ret); m != nil {
+			out = append(out, m)
+		}
+	case *lua.LNilType:
+	default:
+		s.fail("script_invalid_event", fmt.Errorf("process returned a %s", ret.Type()))
+	}
+	for _, t := range s.emitted {
+		if m := s.message(t); m != nil {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// message decodes an event table the script returned or emitted
+func (s *luaScript) message(t *lua.LTable) *jetstream.Message {
+	raw, err := json.Marshal(fromLua(t, s.state.GetTypeMetatable(luaArray)))
+	if err != nil {
+		s.fail("script_invalid_event", err)
+		return nil
+	}
+	var msg jetstream.Message
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		s.fail("script_invalid_event", err)
+		return nil
+	}
+	if msg.Did == "" || msg.Kind == "" {
+		s.fail("script_invalid_event", fmt.Errorf("event without a did or kind: %s", raw))
+		return nil
+	}
+	msg.Raw = raw
+	return &msg
+}
+
+// fail counts an event lost to the script, logging the first and then
+// every 1000th
+func (s *luaScript) fail(reason string, err error) {
+	drops.add(reason)
+	if n := s.failed.Add(1); n == 1 || n%1000 == 0 {
+		log.Warn().Err(err).Str("reason", reason).Uint64("failed", n).Msg("lua script failed, dropping event")
+	}
+}
+
+// toLua converts a decoded JSON value to a Lua value
+func toLua(L *lua.LState, v any) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []any:
+		t := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			t.Append(toLua(L, item))
+		}
+		L.SetMetatable(t, L.GetTypeMetatable(luaArray))
+		return t
+	case map[string]any:
+		t := L.CreateTable(0, len(v))
+		for key, item := range v {
+			t.RawSetString(key, toLua(L, item))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// fromLua converts a Lua value to one that encodes as JSON: tables with
+// keys 1 to n, or with the array metatable toLua gave them, become arrays,
+// and other tables objects
+func fromLua(v lua.LValue, array lua.LValue) any {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		f := float64(v)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return json.Number(strconv.FormatInt(int64(f), 10))
+		}
+		return f
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if n := v.Len(); n > 0 && n == luaTableSize(v) || v.Metatable == array {
+			items := make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				items = append(items, fromLua(v.RawGetInt(i), array))
+			}
+			return items
+		}
+		obj := map[string]any{}
+		v.ForEach(func(key, item lua.LValue) {
+			obj[key.String()] = fromLua(item, array)
+		})
+		return obj
+	}
+	return nil
+}
+
+// luaTableSize counts every key of t
+func luaTableSize(t *lua.LTable) int {
+	n := 0
+	t.ForEach(func(lua.LValue, lua.LValue) { n++ })
+	return n
+}
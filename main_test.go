@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestGapRewindCursor(t *testing.T) {
+	defer func(d time.Duration) { *gapRewindFlag = d }(*gapRewindFlag)
+	*gapRewindFlag = time.Minute
+
+	const first = int64(1_700_000_600_000_000)
+	tests := []struct {
+		name       string
+		lastTimeUs int64
+		want       int64
+	}{
+		{"gap within the limit", first - (10 * time.Second).Microseconds(), first - (10 * time.Second).Microseconds()},
+		{"gap past the limit", first - (10 * time.Minute).Microseconds(), first - time.Minute.Microseconds()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !checkGap(tt.lastTimeUs, first) {
+				t.Fatal("checkGap didn't report the gap")
+			}
+			if got := gapRewindCursor(tt.lastTimeUs, first); got != tt.want {
+				t.Errorf("cursor = %d, want %d", got, tt.want)
+			}
+		})
+	}
+	if checkGap(first-time.Second.Microseconds(), first) {
+		t.Error("checkGap reported a gap under -gap-threshold")
+	}
+}
+
+// captureLog points the global logger, which handleMessage logs through,
+// at buf for the rest of the test
+func captureLog(t *testing.T, buf *bytes.Buffer) {
+	saved := log.Logger
+	t.Cleanup(func() { log.Logger = saved })
+	configureLogFields(zerolog.MessageFieldName, zerolog.LevelFieldName, zerolog.TimestampFieldName)
+	log.Logger = zerolog.New(buf).With().Timestamp().Logger()
+}
+
+func TestEventTimeMatchesTimeUs(t *testing.T) {
+	var buf bytes.Buffer
+	captureLog(t, &buf)
+
+	msg := commitMessage("app.bsky.feed.like", `{"subject": {"uri": "at://did:plc:x/app.bsky.feed.post/1", "cid": "bafypost"}}`)
+	msg.TimeUs = 1_725_911_162_329_308
+	handleMessage(msg)
+
+	lines := logLines(t, &buf)
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1: %v", len(lines), lines)
+	}
+	logged, err := time.Parse(time.RFC3339Nano, lines[0]["event_time"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logged.UnixMicro() != msg.TimeUs {
+		t.Errorf("event_time %s is %d, want time_us %d", lines[0]["event_time"], logged.UnixMicro(), msg.TimeUs)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, lines[0]["time"].(string)); err != nil {
+		t.Errorf("time isn't RFC3339: %v", err)
+	}
+
+	// the console writer renders both as given, rather than reinterpreting
+	// them as Unix seconds
+	var console bytes.Buffer
+	w, err := newConsoleWriter(&console, "never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Logger = zerolog.New(w).With().Timestamp().Logger()
+	before := time.Now().Truncate(time.Second)
+	handleMessage(msg)
+	out := console.String()
+	if !strings.Contains(out, "event_time=2024-09-09T19:46:02.329308Z") {
+		t.Errorf("console output lacks the event time: %s", out)
+	}
+	rendered, err := time.Parse(time.RFC3339, strings.Fields(out)[0])
+	if err != nil || rendered.Before(before) || rendered.After(time.Now()) {
+		t.Errorf("console timestamp %q isn't the logging time: %v", strings.Fields(out)[0], err)
+	}
+}
+
+func TestDeletesOnly(t *testing.T) {
+	defer func(saved bool) { *deletesOnlyFlag = saved }(*deletesOnlyFlag)
+	*deletesOnlyFlag = true
+
+	account := &jetstream.Message{Did: "did:plc:alice", Kind: "account", Account: &jetstream.AccountEvent{Did: "did:plc:alice", Status: "takendown", Seq: 8}}
+	label := &jetstream.Message{Did: "did:plc:alice", Kind: "label", Label: &jetstream.LabelEvent{Src: "did:plc:labeler", URI: "at://did:plc:alice", Val: "spam", Seq: 9}}
+	tests := []struct {
+		name    string
+		msg     *jetstream.Message
+		message string
+	}{
+		{"delete", parseFrame(t, deleteFrame), "delete"},
+		{"create", parseFrame(t, postFrame), ""},
+		{"identity", parseFrame(t, identityFrame), ""},
+		{"account", account, ""},
+		{"label", label, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			captureLog(t, &buf)
+			handleMessage(tt.msg)
+
+			lines := logLines(t, &buf)
+			if tt.message == "" {
+				if len(lines) != 0 {
+					t.Errorf("logged %v, want nothing", lines)
+				}
+				return
+			}
+			if len(lines) != 1 || lines[0]["message"] != tt.message {
+				t.Errorf("logged %v, want one %s line", lines, tt.message)
+			}
+		})
+	}
+}
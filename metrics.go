@@ -0,0 +1,254 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metricsRegistry holds the collectors until registerMetrics knows the
+// -metrics-namespace to prefix their names with, and registers later ones
+// straight away
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []prometheus.Collector
+	target     prometheus.Registerer
+}
+
+func (r *metricsRegistry) Register(c prometheus.Collector) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.target != nil {
+		return r.target.Register(c)
+	}
+	r.collectors = append(r.collectors, c)
+	return nil
+}
+
+func (r *metricsRegistry) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *metricsRegistry) Unregister(c prometheus.Collector) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.target != nil {
+		return r.target.Unregister(c)
+	}
+	n := len(r.collectors)
+	r.collectors = slices.DeleteFunc(r.collectors, func(other prometheus.Collector) bool { return other == c })
+	return len(r.collectors) < n
+}
+
+var (
+	metrics        = &metricsRegistry{}
+	metricsFactory = promauto.With(metrics)
+)
+
+// metricsNamespacePattern is what a metric name prefix may hold
+var metricsNamespacePattern = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)?$`)
+
+// registerMetrics registers every collector with the default registry,
+// named with namespace in front
+func registerMetrics(namespace string) {
+	metrics.registerWith(prometheus.WrapRegistererWithPrefix(namespace, prometheus.DefaultRegisterer))
+}
+
+// registerWith registers the collectors held so far with target, and
+// later ones as they come
+func (r *metricsRegistry) registerWith(target prometheus.Registerer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.target = target
+	r.target.MustRegister(r.collectors...)
+	r.collectors = nil
+}
+
+// Prometheus metrics, served on -metrics-addr, named under
+// -metrics-namespace. They are always updated so the hot path doesn't
+// need to check whether the server is enabled.
+var (
+	messagesReceived = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "messages_received_total",
+		Help: "Jetstream messages received, by kind and collection. Collections without dedicated handling are counted as \"other\" to bound cardinality.",
+	}, []string{"kind", "collection"})
+
+	parseErrors = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "parse_errors_total",
+		Help: "Jetstream frames that could not be unmarshalled.",
+	})
+
+	reconnects = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "reconnects_total",
+		Help: "Successful connections to jetstream after the first.",
+	})
+
+	gapRewinds = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "gap_rewinds_total",
+		Help: "Reconnects rewound by -gap-rewind to replay a gap after a reconnect.",
+	})
+
+	failovers = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "failovers_total",
+		Help: "Switches to another -url endpoint, by reason: dial, disconnects, lag, or latency.",
+	}, []string{"reason"})
+
+	probeSeconds = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "endpoint_probe_seconds",
+		Help: "How long the last -pick-fastest-url probe's handshake took, by -url endpoint, or -1 if it couldn't be reached.",
+	}, []string{"endpoint"})
+
+	connected = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "connected",
+		Help: "1 while connected to jetstream, 0 otherwise.",
+	})
+
+	dialAttempts = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "dial_attempts_total",
+		Help: "Websocket dials to jetstream, by -url endpoint and result: ok or error.",
+	}, []string{"endpoint", "result"})
+
+	handshakeSeconds = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "handshake_duration_seconds",
+		Help:    "How long successful websocket handshakes with jetstream took, by -url endpoint.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+	}, []string{"endpoint"})
+
+	endpointConnected = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "endpoint_connected",
+		Help: "1 for the -url endpoint the logger is connected to, 0 for the others.",
+	}, []string{"endpoint"})
+
+	lagSeconds = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "lag_seconds",
+		Help: "How far behind the live stream the last handled event was, from its time_us to when it was handled.",
+	})
+
+	catchingUpGauge = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "catching_up",
+		Help: "1 while -catch-up-lag has switched the logger into catching up, 0 otherwise.",
+	})
+
+	bytesReceived = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "bytes_received_total",
+		Help: "Bytes of websocket frames read from jetstream, as received and before decompression.",
+	})
+
+	sinkDropped = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "sink_dropped_total",
+		Help: "Events a sink lost, by sink and reason: queue_full when its queue overflowed, or the write that failed.",
+	}, []string{"sink", "reason"})
+
+	sinkBreakerState = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sink_breaker_state",
+		Help: "State of each sink's circuit breaker: 0 closed, 1 half-open while a probe is written, 2 open.",
+	}, []string{"sink"})
+
+	sinkBreakerOpens = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "sink_breaker_opens_total",
+		Help: "Times a sink's circuit breaker opened after its writes kept failing.",
+	}, []string{"sink"})
+
+	sinkBreakerProbes = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "sink_breaker_probes_total",
+		Help: "Writes let through an open circuit breaker to probe whether its sink has recovered.",
+	}, []string{"sink"})
+
+	kinesisThrottled = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "kinesis_throttled_records_total",
+		Help: "Records -kinesis-stream throttled for exceeding a shard's throughput, each time it did.",
+	})
+
+	kinesisRetries = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "kinesis_retries_total",
+		Help: "PutRecords requests retried for -kinesis-stream after throttling or a failure.",
+	})
+
+	invalidRecords = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "invalid_records_total",
+		Help: "Created and updated records that failed -validate-records, by collection.",
+	}, []string{"collection"})
+
+	postEmbeds = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "post_embeds_total",
+		Help: "Posts logged with an embed, by embed_type. Types other than images, video, external, record, and record_with_media are counted as \"other\".",
+	}, []string{"type"})
+
+	blobsFetched = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "blobs_total",
+		Help: "Blobs handled by -blob-dir or -blob-s3-bucket, by result: saved, exists when already stored, too_large, or error.",
+	}, []string{"result"})
+
+	blobBytes = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "blob_bytes_total",
+		Help: "Bytes of blobs downloaded and stored.",
+	})
+
+	alertsFired = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "alerts_fired_total",
+		Help: "Events that matched an -alert rule and were queued for -alert-webhook.",
+	})
+
+	broadcastClients = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "broadcast_clients",
+		Help: "Downstream clients connected to -broadcast-addr.",
+	})
+
+	grpcClients = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "grpc_clients",
+		Help: "Subscribe calls being served on -grpc-addr.",
+	})
+
+	enrichRateLimited = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "enrich_rate_limited_total",
+		Help: "Lookups retried because the server rate limited them.",
+	})
+)
+
+// registerEnrichQueueDepth exports how many lookups are waiting in queue,
+// as reported by depth
+func registerEnrichQueueDepth(queue string, depth func() int) {
+	metricsFactory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "enrich_queue_depth",
+		Help:        "Lookups waiting, by queue: handles and reply_context for those queued to be resolved or fetched, requests for those waiting for an -enrich-concurrency slot.",
+		ConstLabels: prometheus.Labels{"queue": queue},
+	}, func() float64 { return float64(depth()) })
+}
+
+// registerQueueDepth exports the number of frames -workers have yet to
+// handle, as reported by depth, and how many they may, as limit does
+func registerQueueDepth(depth, limit func() int) {
+	metricsFactory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "queue_depth",
+		Help: "Frames read from jetstream but not yet handled, with -workers.",
+	}, func() float64 { return float64(depth()) })
+	metricsFactory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "queue_limit",
+		Help: "Frames that can be read ahead of handling, with -workers, which -queue-max lets change with the load.",
+	}, func() float64 { return float64(limit()) })
+}
+
+// metricsCollection is the collection label for a commit
+func metricsCollection(collection string) string {
+	if isKnownCollection(collection) {
+		return collection
+	}
+	return "other"
+}
+
+// metricsEmbedKind is the type label for a post embed's embed_type
+func metricsEmbedKind(kind string) string {
+	for _, known := range embedKinds {
+		if kind == known {
+			return kind
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+func TestMetricsNamespace(t *testing.T) {
+	tests := []struct {
+		namespace string
+		want      []string
+	}{
+		{"atproto_logger_", []string{"atproto_logger_early_total", "atproto_logger_late"}},
+		{"jetstream_", []string{"jetstream_early_total", "jetstream_late"}},
+		{"", []string{"early_total", "late"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			r := &metricsRegistry{}
+			factory := promauto.With(r)
+			factory.NewCounter(prometheus.CounterOpts{Name: "early_total", Help: "Registered before the namespace is known."}).Inc()
+
+			reg := prometheus.NewRegistry()
+			r.registerWith(prometheus.WrapRegistererWithPrefix(tt.namespace, reg))
+			factory.NewGaugeFunc(prometheus.GaugeOpts{Name: "late", Help: "Registered after."}, func() float64 { return 1 })
+
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range families {
+				got = append(got, f.GetName())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("metrics = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsNamespacePattern(t *testing.T) {
+	for namespace, want := range map[string]bool{
+		"atproto_logger_": true,
+		"app:jetstream_":  true,
+		"":                true,
+		"1logger_":        false,
+		"atproto-logger_": false,
+	} {
+		if got := metricsNamespacePattern.MatchString(namespace); got != want {
+			t.Errorf("-metrics-namespace %q valid = %v, want %v", namespace, got, want)
+		}
+	}
+}
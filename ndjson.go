@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// ndjsonSink writes every event as a line of JSON, to stdout or a file.
+// File output can rotate by size, by time, or both, keeping rotated files
+// alongside with a timestamp in their name. Lines are queued for a writer
+// goroutine, so a slow disk only stalls the read loop under -sink-overflow
+// block.
+type ndjsonSink struct {
+	out     io.Writer
+	closer  io.Closer
+	queue   chan []byte
+	failed  atomic.Uint64
+	stopped chan struct{}
+	// stopRotate ends the time-based rotation, nil without it
+	stopRotate chan struct{}
+	// written is set once anything is written since the last rotation,
+	// so quiet intervals don't leave empty files behind
+	written atomic.Bool
+}
+
+// rotatingFile is a file output that can be rotated on demand, as
+// lumberjack's and segmentWriter's are
+type rotatingFile interface {
+	io.WriteCloser
+	Rotate() error
+}
+
+// newNDJSONSink opens the sink at path, "-" being stdout, queueing up to
+// queueSize lines. maxSize is in megabytes; with it and interval both zero
+// the file grows without rotating. With compression set the file is
+// written as compressed segments, which always get their own files.
+func newNDJSONSink(path string, queueSize, maxSize, maxBackups int, interval time.Duration, compression string, level int) (*ndjsonSink, error) {
+	s := &ndjsonSink{queue: make(chan []byte, queueSize), stopped: make(chan struct{})}
+	if path == "-" {
+		if compression != "" {
+			return nil, errors.New("compression needs a file, not stdout")
+		}
+		s.out = os.Stdout
+		go s.run()
+		return s, nil
+	}
+	if compression != "" {
+		file, err := newSegmentWriter(path, compression, level, maxSize, maxBackups, 0)
+		if err != nil {
+			return nil, err
+		}
+		s.start(file, interval)
+		return s, nil
+	}
+	if maxSize == 0 && interval == 0 {
+		f, err := openAppendFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s.out, s.closer = f, f
+		go s.run()
+		return s, nil
+	}
+
+	file := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+	if maxSize == 0 {
+		// lumberjack has no unlimited size, so make it large enough
+		// that only the interval rotates
+		file.MaxSize = 1 << 20
+	}
+	s.start(file, interval)
+	return s, nil
+}
+
+// start writes to file, rotating it every interval if positive
+func (s *ndjsonSink) start(file rotatingFile, interval time.Duration) {
+	s.out, s.closer = file, file
+	if interval > 0 {
+		s.stopRotate = make(chan struct{})
+		go s.rotate(file, interval)
+	}
+	go s.run()
+}
+
+func (s *ndjsonSink) rotate(file rotatingFile, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !s.written.Swap(false) {
+				continue
+			}
+			if err := file.Rotate(); err != nil {
+				log.Error().Err(err).Msg("failed to rotate ndjson file")
+			}
+		case <-s.stopRotate:
+			return
+		}
+	}
+}
+
+func (s *ndjsonSink) publish(msg *jetstream.Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		s.fail("marshal", err)
+		return
+	}
+	for range enqueue(s.queue, append(data, '\n')) {
+		s.fail("queue_full", nil)
+	}
+}
+
+// fail counts a lost event, logging the first and then every 1000th
+func (s *ndjsonSink) fail(reason string, err error) {
+	drops.add("ndjson_" + reason)
+	sinkDrop("ndjson", reason, 1)
+	if n := s.failed.Add(1); n == 1 || n%1000 == 0 {
+		log.Warn().Err(err).Str("reason", reason).Uint64("failed", n).Msg("ndjson write failed, dropping events")
+	}
+}
+
+func (s *ndjsonSink) run() {
+	defer close(s.stopped)
+	for line := range s.queue {
+		if _, err := s.out.Write(line); err != nil {
+			s.fail("write", err)
+			continue
+		}
+		s.written.Store(true)
+	}
+}
+
+// reopen opens the file at its path again, for SIGHUP
+func (s *ndjsonSink) reopen() error {
+	switch f := s.closer.(type) {
+	case *appendFile:
+		return f.reopen()
+	case *segmentWriter:
+		return f.Rotate()
+	case *lumberjack.Logger:
+		// opened again on the next write
+		return f.Close()
+	}
+	return nil
+}
+
+// close writes what is queued, then closes the file
+func (s *ndjsonSink) close() {
+	close(s.queue)
+	<-s.stopped
+	if s.stopRotate != nil {
+		close(s.stopRotate)
+	}
+	if s.closer != nil {
+		if err := s.closer.Close(); err != nil {
+			log.Error().Err(err).Msg("error closing ndjson file")
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// ndjsonDIDs returns the DID of each line of data
+func ndjsonDIDs(t *testing.T, data string) []string {
+	t.Helper()
+	var dids []string
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		var msg jetstream.Message
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		dids = append(dids, msg.Did)
+	}
+	return dids
+}
+
+func TestNDJSONSink(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxSize     int
+		interval    time.Duration
+		compression string
+	}{
+		{"plain file", 0, 0, ""},
+		{"with a size limit", 1, 0, ""},
+		{"with an interval", 0, time.Hour, ""},
+		{"compressed", 0, 0, "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "events.ndjson")
+			s, err := newNDJSONSink(path, 10, tt.maxSize, 0, tt.interval, tt.compression, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			segments, _ := s.closer.(*segmentWriter)
+			for _, frame := range []string{postFrame, likeFrame, identityFrame} {
+				s.publish(parseFrame(t, frame))
+			}
+			s.close()
+
+			var got []string
+			if segments != nil {
+				for _, line := range segmentLines(t, segments) {
+					got = append(got, ndjsonDIDs(t, line)...)
+				}
+			} else {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = ndjsonDIDs(t, string(data))
+			}
+			if want := "did:plc:alice did:plc:bob did:plc:alice"; strings.Join(got, " ") != want {
+				t.Fatalf("wrote events from %v, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestNDJSONSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	for range 2 {
+		s, err := newNDJSONSink(path, 10, 0, 0, 0, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.publish(parseFrame(t, postFrame))
+		s.close()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ndjsonDIDs(t, string(data)); len(got) != 2 {
+		t.Fatalf("file holds %v after two runs, want both", got)
+	}
+}
+
+func TestNDJSONSinkRotatesOnlyAfterWrites(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.ndjson")
+	s, err := newNDJSONSink(path, 10, 0, 0, 20*time.Millisecond, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.publish(parseFrame(t, postFrame))
+	// several intervals pass, only the first with anything written
+	time.Sleep(100 * time.Millisecond)
+	s.publish(parseFrame(t, likeFrame))
+	s.close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "events*.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("files %v, want the rotated one and the current one", files)
+	}
+}
+
+func TestNDJSONSinkRefusesCompressedStdout(t *testing.T) {
+	if _, err := newNDJSONSink("-", 10, 0, 0, 0, "zstd", 0); err == nil {
+		t.Fatal("compressed stdout was accepted")
+	}
+}
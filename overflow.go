@@ -0,0 +1,62 @@
+package main
+
+import "fmt"
+
+// overflowPolicy is what a sink does with an event when its queue is full,
+// set by -sink-overflow
+type overflowPolicy string
+
+const (
+	// overflowBlock waits for room, slowing the read loop down to the
+	// sink's pace, at the risk of Jetstream disconnecting a slow reader
+	overflowBlock overflowPolicy = "block"
+	// overflowDropNewest drops the event that doesn't fit
+	overflowDropNewest overflowPolicy = "drop-newest"
+	// overflowDropOldest drops the oldest queued event to make room, so
+	// the sink stays as close to live as it can
+	overflowDropOldest overflowPolicy = "drop-oldest"
+)
+
+func parseOverflowPolicy(s string) (overflowPolicy, error) {
+	switch p := overflowPolicy(s); p {
+	case overflowBlock, overflowDropNewest, overflowDropOldest:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q, expected block, drop-newest, or drop-oldest", s)
+}
+
+// sinkOverflow is the policy for every sink queue
+var sinkOverflow = overflowDropNewest
+
+// enqueue adds v to queue under sinkOverflow, returning how many events
+// were dropped: v itself or, with drop-oldest, those it displaced. The
+// caller counts the drops.
+func enqueue[T any](queue chan T, v T) int {
+	switch sinkOverflow {
+	case overflowBlock:
+		queue <- v
+		return 0
+	case overflowDropOldest:
+		dropped := 0
+		for {
+			select {
+			case queue <- v:
+				return dropped
+			default:
+			}
+			// the consumer may have made room in the meantime, in which
+			// case there is nothing to evict and the send is retried
+			select {
+			case <-queue:
+				dropped++
+			default:
+			}
+		}
+	}
+	select {
+	case queue <- v:
+		return 0
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/parquet-go/parquet-go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// parquet files are written a row group at a time, holding the rows
+	// of a partition in memory until then
+	parquetRowGroupSize     = 10000
+	parquetBatchSize        = 1000
+	parquetBatchInterval    = time.Second
+	parquetPartitionPattern = "date=2006-01-02/hour=15"
+)
+
+// parquetRow is a row of the Parquet files, one layout for every event so
+// partitions can be read together. Columns that don't apply to an event
+// are null.
+type parquetRow struct {
+	Did        string `parquet:"did,dict"`
+	TimeUs     int64  `parquet:"time_us,delta"`
+	Time       int64  `parquet:"time,timestamp(microsecond),delta"`
+	Kind       string `parquet:"kind,dict"`
+	Operation  string `parquet:"operation,optional,dict"`
+	Collection string `parquet:"collection,optional,dict"`
+	Rkey       string `parquet:"rkey,optional"`
+	Rev        string `parquet:"rev,optional"`
+	Cid        string `parquet:"cid,optional"`
+	Record     string `parquet:"record,optional,json"`
+	Handle     string `parquet:"handle,optional"`
+	Active     *bool  `parquet:"active,optional"`
+	Status     string `parquet:"status,optional,dict"`
+	Seq        int64  `parquet:"seq,optional"`
+	LabelSrc   string `parquet:"label_src,optional,dict"`
+	LabelURI   string `parquet:"label_uri,optional"`
+	LabelVal   string `parquet:"label_val,optional,dict"`
+	LabelNeg   bool   `parquet:"label_neg,optional"`
+}
+
+func newParquetRow(msg *jetstream.Message) parquetRow {
+	row := parquetRow{Did: msg.Did, TimeUs: msg.TimeUs, Time: msg.TimeUs, Kind: msg.Kind}
+	switch {
+	case msg.Commit != nil:
+		c := msg.Commit
+		row.Operation, row.Collection, row.Rkey, row.Rev, row.Cid = c.Operation, c.Collection, c.Rkey, c.Rev, c.Cid
+		row.Record = string(c.Record)
+	case msg.Identity != nil:
+		row.Handle, row.Seq = msg.Identity.Handle, msg.Identity.Seq
+	case msg.Account != nil:
+		active := msg.Account.Active
+		row.Active, row.Status, row.Seq = &active, msg.Account.Status, msg.Account.Seq
+	case msg.Label != nil:
+		l := msg.Label
+		row.LabelSrc, row.LabelURI, row.LabelVal, row.LabelNeg, row.Seq = l.Src, l.URI, l.Val, l.Neg, l.Seq
+	}
+	return row
+}
+
+// parquetPartition is a file being written for one hour and collection.
+// It is written under a temporary name and renamed once complete, so
+// readers of the directory only see finished files.
+type parquetPartition struct {
+	hour   time.Time
+	path   string
+	file   *os.File
+	writer *parquet.GenericWriter[parquetRow]
+	rows   int
+}
+
+// parquetSink writes events into Parquet files under dir, partitioned by
+// the hour of their time_us and by collection, in Hive-style directories
+// like date=2024-09-09/hour=19/collection=app.bsky.feed.post. Events other
+// than commits are partitioned by kind instead, as collection=identity and
+// so on. Each partition's file is completed once an event from a later
+// hour arrives, and on shutdown; a late event for an hour already
+// completed starts another file in its partition.
+type parquetSink struct {
+	*batchQueue
+	dir        string
+	partitions map[string]*parquetPartition
+	newest     time.Time
+	files      int
+}
+
+func newParquetSink(dir string, queueSize int) (*parquetSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &parquetSink{dir: dir, partitions: map[string]*parquetPartition{}}
+	s.batchQueue = newBatchQueue("parquet", queueSize, parquetBatchSize, parquetBatchInterval, 0, s.write)
+	return s, nil
+}
+
+// write adds batch to the partitions' files, completing those of earlier
+// hours when the stream moves into a new one
+func (s *parquetSink) write(batch []*jetstream.Message) error {
+	var failed error
+	for _, msg := range batch {
+		hour := time.UnixMicro(msg.TimeUs).UTC().Truncate(time.Hour)
+		if hour.After(s.newest) {
+			s.newest = hour
+			for key, p := range s.partitions {
+				if p.hour.Before(hour) {
+					s.complete(key, p)
+				}
+			}
+		}
+
+		collection := msg.Kind
+		if msg.Commit != nil {
+			collection = msg.Commit.Collection
+		}
+		key := filepath.Join(hour.Format(parquetPartitionPattern), "collection="+collection)
+		p, err := s.partition(key, hour)
+		if err != nil {
+			s.fail("open", err, 1)
+			failed = err
+			continue
+		}
+		if _, err := p.writer.Write([]parquetRow{newParquetRow(msg)}); err != nil {
+			s.fail("write", err, 1)
+			failed = err
+			continue
+		}
+		p.rows++
+		if p.rows%parquetRowGroupSize == 0 {
+			if err := p.writer.Flush(); err != nil {
+				s.fail("write", err, parquetRowGroupSize)
+				failed = err
+			}
+		}
+	}
+	if failed != nil {
+		// the events are counted already, but the circuit breaker needs
+		// to know
+		return &partialWriteError{err: failed}
+	}
+	return nil
+}
+
+// partition returns the open file of the partition key, starting one if
+// there is none
+func (s *parquetSink) partition(key string, hour time.Time) (*parquetPartition, error) {
+	if p := s.partitions[key]; p != nil {
+		return p, nil
+	}
+	dir := filepath.Join(s.dir, key)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s.files++
+	path := filepath.Join(dir, fmt.Sprintf("part-%d-%d.parquet", time.Now().UnixNano(), s.files))
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	p := &parquetPartition{
+		hour:   hour,
+		path:   path,
+		file:   f,
+		writer: parquet.NewGenericWriter[parquetRow](f, parquet.Compression(&parquet.Zstd)),
+	}
+	s.partitions[key] = p
+	return p, nil
+}
+
+// complete writes the footer of a partition's file and moves it into place
+func (s *parquetSink) complete(key string, p *parquetPartition) {
+	delete(s.partitions, key)
+	err := p.writer.Close()
+	if err == nil {
+		err = p.file.Sync()
+	}
+	if closeErr := p.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(p.path+".tmp", p.path)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("file", p.path).Int("rows", p.rows).Msg("failed to complete parquet file")
+		s.fail("complete", err, p.rows)
+		os.Remove(p.path + ".tmp")
+		return
+	}
+	log.Debug().Str("file", p.path).Int("rows", p.rows).Msg("parquet file completed")
+}
+
+// close writes what is queued and completes every open file
+func (s *parquetSink) close() {
+	s.batchQueue.close()
+	for key, p := range s.partitions {
+		s.complete(key, p)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+func TestParquetSinkWriteReportsFailures(t *testing.T) {
+	isolateBreakers(t)
+	dir := t.TempDir()
+	s, err := newParquetSink(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	// a file where the like's partition directory should go
+	if err := os.MkdirAll(filepath.Join(dir, "date=2024-09-09", "hour=19"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "date=2024-09-09", "hour=19", "collection=app.bsky.feed.like"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.write([]*jetstream.Message{parseFrame(t, postFrame)}); err != nil {
+		t.Fatalf("writing a post failed: %v", err)
+	}
+	err = s.write([]*jetstream.Message{parseFrame(t, postFrame), parseFrame(t, likeFrame)})
+	var partial *partialWriteError
+	if !errors.As(err, &partial) || partial.lost != 0 {
+		t.Fatalf("write with a failed event returned %v, want a partialWriteError that lost nothing more", err)
+	}
+	if n := s.failed.Load(); n != 1 {
+		t.Fatalf("%d events counted as failed, want 1", n)
+	}
+}
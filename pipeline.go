@@ -0,0 +1,290 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// pipelines are the -pipeline profiles, each handed every event the main
+// connection delivers
+var pipelines []*pipeline
+
+// pipelineSettings are the flags a -pipeline file can set. Everything
+// else, the connection, enrichment, and logging, is shared by the whole
+// process and stays in -config or on the command line.
+var pipelineSettings = map[string]bool{
+	"collection": true, "did": true, "kind": true, "op": true, "filter": true, "cel": true,
+	"alert": true, "alert-webhook": true, "alert-format": true, "alert-cooldown": true,
+	"ndjson-file": true, "ndjson-queue": true, "ndjson-max-size": true, "ndjson-max-backups": true,
+	"ndjson-rotate-interval": true, "ndjson-compression": true, "ndjson-compression-level": true,
+	"sqlite-file": true, "sqlite-queue": true,
+	"parquet-dir": true, "parquet-queue": true,
+	"postgres-url": true, "postgres-queue": true, "postgres-batch-size": true, "postgres-flush-interval": true,
+	"flush-on-idle": true,
+}
+
+// pipeline is a named profile from -pipeline: its own filters, alert
+// rules, and sinks, fed from the shared connection. It only touches
+// events from the handling goroutine, so needs no locking.
+type pipeline struct {
+	name        string
+	collections []string
+	dids        map[string]bool
+	events      *eventFilter
+	exprs       *eventExprFilter
+	alerts      *alerter
+	sinks       []eventSink
+
+	seen, passed uint64
+}
+
+// pipelineFile is a -pipeline file's values, by flag
+type pipelineFile struct {
+	path   string
+	values map[string][]string
+	err    error
+}
+
+// str returns the flag's last value in the file, or its default
+func (f *pipelineFile) str(name string) string {
+	if v := f.values[name]; len(v) > 0 {
+		return v[len(v)-1]
+	}
+	return flag.Lookup(name).DefValue
+}
+
+// list returns every value of a repeatable flag in the file
+func (f *pipelineFile) list(name string) []string {
+	return f.values[name]
+}
+
+func (f *pipelineFile) integer(name string) int {
+	n, err := strconv.Atoi(f.str(name))
+	if err != nil && f.err == nil {
+		f.err = fmt.Errorf("%s: invalid %s: %v", f.path, name, err)
+	}
+	return n
+}
+
+func (f *pipelineFile) duration(name string) time.Duration {
+	d, err := time.ParseDuration(f.str(name))
+	if err != nil && f.err == nil {
+		f.err = fmt.Errorf("%s: invalid %s: %v", f.path, name, err)
+	}
+	return d
+}
+
+// newPipelines builds the pipelines -pipeline describes, each NAME=FILE
+// with FILE in the -config format
+func newPipelines(specs []string) ([]*pipeline, error) {
+	var built []*pipeline
+	closeAll := func() {
+		for _, p := range built {
+			p.close()
+		}
+	}
+	for _, spec := range specs {
+		name, path, ok := strings.Cut(spec, "=")
+		if !ok || name == "" || path == "" {
+			closeAll()
+			return nil, fmt.Errorf("%q: expected NAME=FILE, e.g. archive=archive.conf", spec)
+		}
+		if slices.ContainsFunc(built, func(p *pipeline) bool { return p.name == name }) {
+			closeAll()
+			return nil, fmt.Errorf("pipeline %q is defined twice", name)
+		}
+		p, err := newPipeline(name, path)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("pipeline %q: %v", name, err)
+		}
+		built = append(built, p)
+	}
+	return built, nil
+}
+
+func newPipeline(name, path string) (*pipeline, error) {
+	lines, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range lines {
+		if !pipelineSettings[l.name] {
+			return nil, fmt.Errorf("%s:%d: %s can't be set per pipeline", path, l.n, l.name)
+		}
+	}
+	f := &pipelineFile{path: path, values: configFileValues(lines, nil)}
+
+	p := &pipeline{name: name, collections: f.list("collection")}
+	if dids := f.list("did"); len(dids) > 0 {
+		p.dids = map[string]bool{}
+		for _, did := range dids {
+			p.dids[did] = true
+		}
+	}
+	if kinds, ops := f.list("kind"), f.list("op"); len(kinds) > 0 || len(ops) > 0 {
+		if p.events, err = newEventFilter(kinds, ops); err != nil {
+			return nil, err
+		}
+	}
+	if filters, cels := f.list("filter"), f.list("cel"); len(filters) > 0 || len(cels) > 0 {
+		if p.exprs, err = newEventExprFilter(filters, cels); err != nil {
+			return nil, err
+		}
+	}
+
+	ndjsonQueue, ndjsonMaxSize, ndjsonMaxBackups := f.integer("ndjson-queue"), f.integer("ndjson-max-size"), f.integer("ndjson-max-backups")
+	ndjsonInterval, ndjsonLevel := f.duration("ndjson-rotate-interval"), f.integer("ndjson-compression-level")
+	sqliteQueue, parquetQueue := f.integer("sqlite-queue"), f.integer("parquet-queue")
+	postgresQueue, postgresBatch, postgresInterval := f.integer("postgres-queue"), f.integer("postgres-batch-size"), f.duration("postgres-flush-interval")
+	flushOnIdle := f.duration("flush-on-idle")
+	alertCooldown := f.duration("alert-cooldown")
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	// the outputs are opened last, so a bad setting leaves nothing to close
+	if rules := f.list("alert"); len(rules) > 0 {
+		if f.str("alert-webhook") == "" {
+			return nil, fmt.Errorf("%s: alert needs alert-webhook to send to", path)
+		}
+		if p.alerts, err = newAlerter(rules, f.str("alert-webhook"), f.str("alert-format"), alertCooldown); err != nil {
+			return nil, fmt.Errorf("invalid alert: %v", err)
+		}
+		go p.alerts.run()
+	} else if f.str("alert-webhook") != "" {
+		return nil, fmt.Errorf("%s: alert-webhook needs at least one alert rule", path)
+	}
+	if dest := f.str("ndjson-file"); dest != "" {
+		if dest == "-" {
+			p.close()
+			return nil, fmt.Errorf("%s: a pipeline's ndjson-file can't be stdout, which the main output writes to", path)
+		}
+		s, err := newNDJSONSink(dest, ndjsonQueue, ndjsonMaxSize, ndjsonMaxBackups, ndjsonInterval, f.str("ndjson-compression"), ndjsonLevel)
+		if err != nil {
+			p.close()
+			return nil, fmt.Errorf("failed to open ndjson-file: %v", err)
+		}
+		p.sinks = append(p.sinks, s)
+	}
+	if dest := f.str("sqlite-file"); dest != "" {
+		s, err := newSQLiteSink(dest, sqliteQueue)
+		if err != nil {
+			p.close()
+			return nil, fmt.Errorf("failed to open sqlite-file: %v", err)
+		}
+		p.sinks = append(p.sinks, s)
+	}
+	if dest := f.str("parquet-dir"); dest != "" {
+		s, err := newParquetSink(dest, parquetQueue)
+		if err != nil {
+			p.close()
+			return nil, fmt.Errorf("failed to open parquet-dir: %v", err)
+		}
+		p.sinks = append(p.sinks, s)
+	}
+	if dest := f.str("postgres-url"); dest != "" {
+		if postgresBatch <= 0 || postgresInterval <= 0 || flushOnIdle < 0 {
+			p.close()
+			return nil, fmt.Errorf("%s: invalid postgres-batch-size, postgres-flush-interval, or flush-on-idle, the first two must be positive and flush-on-idle can't be negative", path)
+		}
+		s, err := newPostgresSink(dest, postgresQueue, postgresBatch, postgresInterval, flushOnIdle)
+		if err != nil {
+			p.close()
+			return nil, fmt.Errorf("failed to open postgres-url: %v", err)
+		}
+		p.sinks = append(p.sinks, s)
+	}
+	if p.alerts == nil && len(p.sinks) == 0 {
+		return nil, fmt.Errorf("%s: a pipeline needs an alert or a sink such as ndjson-file, sqlite-file, parquet-dir, or postgres-url", path)
+	}
+	return p, nil
+}
+
+// handle runs msg through the pipeline's filters, then its alert rules
+// and sinks. As with the server-side filters, -collection only narrows
+// commits.
+func (p *pipeline) handle(msg *jetstream.Message) {
+	p.seen++
+	if len(p.dids) > 0 && !p.dids[msg.Did] {
+		return
+	}
+	if len(p.collections) > 0 && msg.Commit != nil && !matchesCollection(p.collections, msg.Commit.Collection) {
+		return
+	}
+	if p.events != nil && !p.events.allows(msg) {
+		return
+	}
+	if p.exprs != nil && !p.exprs.allows(msg) {
+		return
+	}
+	p.passed++
+	if p.alerts != nil {
+		p.alerts.check(msg)
+	}
+	for _, s := range p.sinks {
+		s.publish(msg)
+	}
+}
+
+// close flushes the pipeline's sinks and sends its queued alerts
+func (p *pipeline) close() {
+	if p.alerts != nil {
+		p.alerts.stop()
+	}
+	for _, s := range p.sinks {
+		s.close()
+	}
+}
+
+func (p *pipeline) logSummary() {
+	log.Info().
+		Str("pipeline", p.name).
+		Uint64("seen", p.seen).
+		Uint64("passed", p.passed).
+		Msg("pipeline_summary")
+	if p.alerts != nil {
+		p.alerts.logSummary()
+	}
+}
+
+// warnUnsubscribed warns about pipelines wanting collections or DIDs the
+// main connection's server-side filters leave out, since they only see
+// what it subscribes to
+func warnUnsubscribed(pipelines []*pipeline) {
+	for _, p := range pipelines {
+		if len(wantedCollections) > 0 {
+			if len(p.collections) == 0 {
+				log.Warn().Str("pipeline", p.name).Strs("collections", wantedCollections).Msg("pipeline has no collection filter, but only sees the collections the main connection subscribes to")
+			}
+			for _, c := range p.collections {
+				if !subscribedCollection(c) {
+					log.Warn().Str("pipeline", p.name).Str("collection", c).Msg("pipeline collection isn't subscribed to, add it to -collection")
+				}
+			}
+		}
+		if len(wantedDids) > 0 {
+			for did := range p.dids {
+				if !slices.Contains(wantedDids, did) {
+					log.Warn().Str("pipeline", p.name).Str("did", did).Msg("pipeline DID isn't subscribed to, add it to -did")
+				}
+			}
+			if len(p.dids) == 0 {
+				log.Warn().Str("pipeline", p.name).Msg("pipeline has no did filter, but only sees the DIDs the main connection subscribes to")
+			}
+		}
+	}
+}
+
+// subscribedCollection reports whether the main connection's collection
+// filter covers every collection c matches
+func subscribedCollection(c string) bool {
+	return matchesCollection(wantedCollections, strings.TrimSuffix(c, "*"))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// subprocessHandler feeds every event to an external command as NDJSON on
+// its stdin, restarting the command if it exits. Events are queued so a
+// slow handler never blocks the read loop; when the queue is full, events
+// are dropped and counted.
+type subprocessHandler struct {
+	args    []string
+	queue   chan []byte
+	dropped atomic.Uint64
+	stopped chan struct{}
+}
+
+// plugin is the external handler, nil unless -handler-cmd is set
+var plugin *subprocessHandler
+
+func newSubprocessHandler(command string, queueSize int) *subprocessHandler {
+	return &subprocessHandler{
+		args:    strings.Fields(command),
+		queue:   make(chan []byte, queueSize),
+		stopped: make(chan struct{}),
+	}
+}
+
+// send queues a raw event for the handler without blocking
+func (h *subprocessHandler) send(message []byte) {
+	if bytes.IndexByte(message, '\n') >= 0 {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, message); err != nil {
+			return
+		}
+		message = buf.Bytes()
+	}
+
+	select {
+	case h.queue <- message:
+	default:
+		drops.add("handler_queue_full")
+		if n := h.dropped.Add(1); n == 1 || n%1000 == 0 {
+			log.Warn().Uint64("dropped", n).Msg("handler queue full, dropping events")
+		}
+	}
+}
+
+// run keeps the handler process alive until stop is called
+func (h *subprocessHandler) run() {
+	defer close(h.stopped)
+	for {
+		exited := h.runOnce()
+		if !exited {
+			return
+		}
+		log.Warn().Msg("handler exited, restarting in 1 second")
+		time.Sleep(time.Second)
+	}
+}
+
+// runOnce starts the handler and writes queued events to it. It returns
+// true if the process went away on its own, and false once the queue has
+// been closed and drained.
+func (h *subprocessHandler) runOnce() bool {
+	cmd := exec.Command(h.args[0], h.args[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create handler stdin")
+		return true
+	}
+	if err := cmd.Start(); err != nil {
+		log.Error().Err(err).Strs("cmd", h.args).Msg("failed to start handler")
+		return true
+	}
+	log.Info().Strs("cmd", h.args).Int("pid", cmd.Process.Pid).Msg("handler started")
+
+	for message := range h.queue {
+		if _, err := stdin.Write(append(message, '\n')); err != nil {
+			log.Error().Err(err).Msg("handler write error")
+			stdin.Close()
+			cmd.Wait()
+			return true
+		}
+	}
+
+	// queue closed: let the handler finish what it has, then stop it
+	stdin.Close()
+	waited := make(chan error, 1)
+	go func() { waited <- cmd.Wait() }()
+	select {
+	case err := <-waited:
+		if err != nil {
+			log.Error().Err(err).Msg("handler exited with error")
+		}
+	case <-time.After(5 * time.Second):
+		log.Warn().Msg("handler did not exit after stdin closed, killing it")
+		cmd.Process.Kill()
+		<-waited
+	}
+	return false
+}
+
+// stop closes the queue and waits for the handler to shut down
+func (h *subprocessHandler) stop() {
+	close(h.queue)
+	<-h.stopped
+}
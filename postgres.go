@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+// postgresWriteTimeout bounds writing one batch, so a hung server can't
+// stall the sink forever
+const postgresWriteTimeout = time.Minute
+
+// postgres caps the parameters in one statement at 65535
+const postgresMaxParams = 65535
+
+var postgresTypes = map[string]string{"text": "TEXT", "int": "BIGINT", "bool": "BOOLEAN", "json": "JSON"}
+
+// postgresMigrations are applied in order on startup, each recorded in
+// schema_migrations once it succeeds. The first creates the archive
+// tables; changes to them later must be added as new steps rather than by
+// editing earlier ones, which have already run against existing
+// databases.
+var postgresMigrations = []func() []string{
+	createPostgresTables,
+	// databases created before account events carried their status
+	func() []string { return []string{"ALTER TABLE accounts ADD COLUMN IF NOT EXISTS status TEXT"} },
+}
+
+// postgresSink archives events into a Postgres database with the same
+// tables as the SQLite sink. Each batch is written in one transaction:
+// record tables with multi-row upserts, and the append-only event tables
+// with COPY.
+type postgresSink struct {
+	*batchQueue
+	pool *pgxpool.Pool
+}
+
+func newPostgresSink(connString string, queueSize, batchSize int, interval, idle time.Duration) (*postgresSink, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresWriteTimeout)
+	defer cancel()
+
+	pool, err := pgxpool.New(ctx, connString)
+	if err != nil {
+		return nil, err
+	}
+	if err := migratePostgres(ctx, pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	s := &postgresSink{pool: pool}
+	s.batchQueue = newBatchQueue("postgres", queueSize, batchSize, interval, idle, s.write)
+	return s, nil
+}
+
+func createPostgresTables() []string {
+	var stmts []string
+	for _, t := range archiveTables {
+		defs := make([]string, 0, len(t.columns)+1)
+		for _, c := range t.columns {
+			def := c.name + " " + postgresTypes[c.typ]
+			if t.notNull(c) {
+				def += " NOT NULL"
+			}
+			defs = append(defs, def)
+		}
+		if len(t.key) > 0 {
+			defs = append(defs, "PRIMARY KEY ("+strings.Join(t.key, ", ")+")")
+		}
+		stmts = append(stmts, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", t.name, strings.Join(defs, ", ")))
+		for _, columns := range t.indexes {
+			stmts = append(stmts, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)",
+				t.indexName(columns), t.name, strings.Join(columns, ", ")))
+		}
+	}
+	return stmts
+}
+
+// migratePostgres applies the migrations the database hasn't had yet, in
+// one transaction. An advisory lock keeps two loggers starting against the
+// same database from migrating it at once.
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('atproto-logger migrations'))"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())"); err != nil {
+		return err
+	}
+	var current int
+	if err := tx.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+	for i := current; i < len(postgresMigrations); i++ {
+		version := i + 1
+		for _, stmt := range postgresMigrations[i]() {
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("migration %d: %v", version, err)
+			}
+		}
+		if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+			return err
+		}
+		log.Info().Int("version", version).Msg("applied postgres migration")
+	}
+	return tx.Commit(ctx)
+}
+
+// write stores batch in one transaction, so a failed batch leaves nothing
+// behind. Rows are grouped by table first: record tables take one upsert
+// per table, and the event tables one COPY each.
+func (s *postgresSink) write(batch []*jetstream.Message) error {
+	rows := map[*archiveTable][][]any{}
+	for _, msg := range batch {
+		table, row, err := archiveRow(msg)
+		if err != nil {
+			s.fail("insert", err, 1)
+			continue
+		}
+		if table != nil {
+			rows[table] = append(rows[table], stripNULs(row))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), postgresWriteTimeout)
+	defer cancel()
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, t := range archiveTables {
+		if len(rows[t]) == 0 {
+			continue
+		}
+		if len(t.key) == 0 {
+			_, err = tx.CopyFrom(ctx, pgx.Identifier{t.name}, t.columnNames(), pgx.CopyFromRows(rows[t]))
+		} else {
+			err = upsertPostgres(ctx, tx, t, rows[t])
+		}
+		if err != nil {
+			return fmt.Errorf("writing %s: %v", t.name, err)
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// upsertPostgres inserts rows into t, replacing rows with the same key.
+// Postgres refuses to update one row twice in a statement, so only the
+// last version of each record in the batch is written.
+func upsertPostgres(ctx context.Context, tx pgx.Tx, t *archiveTable, rows [][]any) error {
+	keyIndexes := make([]int, len(t.key))
+	for i, name := range t.key {
+		keyIndexes[i] = slices.Index(t.columnNames(), name)
+	}
+	latest := map[string]int{}
+	unique := rows[:0:0]
+	for _, row := range rows {
+		var key strings.Builder
+		for _, i := range keyIndexes {
+			fmt.Fprintf(&key, "%v\x00", row[i])
+		}
+		if i, ok := latest[key.String()]; ok {
+			unique[i] = row
+			continue
+		}
+		latest[key.String()] = len(unique)
+		unique = append(unique, row)
+	}
+
+	updates := make([]string, 0, len(t.columns))
+	for _, c := range t.columns {
+		updates = append(updates, c.name+" = EXCLUDED."+c.name)
+	}
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", t.name, strings.Join(t.columnNames(), ", "))
+	suffix := fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(t.key, ", "), strings.Join(updates, ", "))
+
+	perStatement := postgresMaxParams / len(t.columns)
+	for len(unique) > 0 {
+		chunk := unique[:min(perStatement, len(unique))]
+		unique = unique[len(chunk):]
+
+		var values strings.Builder
+		args := make([]any, 0, len(chunk)*len(t.columns))
+		for i, row := range chunk {
+			if i > 0 {
+				values.WriteString(", ")
+			}
+			values.WriteString("(")
+			for j := range row {
+				if j > 0 {
+					values.WriteString(", ")
+				}
+				fmt.Fprintf(&values, "$%d", len(args)+j+1)
+			}
+			values.WriteString(")")
+			args = append(args, row...)
+		}
+		if _, err := tx.Exec(ctx, prefix+values.String()+suffix, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripNULs removes NUL characters from string values, which Postgres
+// text can't hold but records occasionally contain
+func stripNULs(row []any) []any {
+	for i, v := range row {
+		if s, ok := v.(string); ok && strings.ContainsRune(s, 0) {
+			row[i] = strings.ReplaceAll(s, "\x00", "")
+		}
+	}
+	return row
+}
+
+func (s *postgresSink) close() {
+	s.batchQueue.close()
+	s.pool.Close()
+}
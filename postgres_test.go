@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// recordingTx is a transaction that keeps the statements executed in it
+// and their arguments, and fails the rest of pgx.Tx
+type recordingTx struct {
+	pgx.Tx
+	stmts []string
+	args  [][]any
+}
+
+func (tx *recordingTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	tx.stmts = append(tx.stmts, sql)
+	tx.args = append(tx.args, args)
+	return pgconn.CommandTag{}, nil
+}
+
+// followRow is a follows row for rkey with subject
+func followRow(rkey, subject string) []any {
+	return []any{"did:plc:alice", rkey, int64(1725911162000010), "bafy" + rkey, subject, "2024-09-09T19:46:02Z"}
+}
+
+func TestUpsertPostgres(t *testing.T) {
+	perStatement := postgresMaxParams / len(followsTable.columns)
+	many := make([][]any, perStatement+1)
+	for i := range many {
+		many[i] = followRow(fmt.Sprint(i), "did:plc:bob")
+	}
+	tests := []struct {
+		name string
+		rows [][]any
+		// written is the rows each statement writes, and subjects the
+		// subject of each row, in order
+		written  []int
+		subjects []string
+	}{
+		{"one row", [][]any{followRow("a", "did:plc:bob")}, []int{1}, []string{"did:plc:bob"}},
+		{
+			"last version of a record wins",
+			[][]any{followRow("a", "did:plc:bob"), followRow("b", "did:plc:carol"), followRow("a", "did:plc:dave")},
+			[]int{2}, []string{"did:plc:dave", "did:plc:carol"},
+		},
+		{"split under the parameter limit", many, []int{perStatement, 1}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &recordingTx{}
+			if err := upsertPostgres(context.Background(), tx, followsTable, tt.rows); err != nil {
+				t.Fatal(err)
+			}
+			if len(tx.stmts) != len(tt.written) {
+				t.Fatalf("%d statements, want %d", len(tx.stmts), len(tt.written))
+			}
+			var subjects []string
+			for i, stmt := range tx.stmts {
+				if !strings.HasPrefix(stmt, "INSERT INTO follows (did, rkey, time_us, cid, subject, created_at) VALUES ($1, $2, $3, $4, $5, $6)") ||
+					!strings.HasSuffix(stmt, " ON CONFLICT (did, rkey) DO UPDATE SET did = EXCLUDED.did, rkey = EXCLUDED.rkey, time_us = EXCLUDED.time_us, cid = EXCLUDED.cid, subject = EXCLUDED.subject, created_at = EXCLUDED.created_at") {
+					t.Fatalf("statement %d is %.200s...", i, stmt)
+				}
+				args := tx.args[i]
+				if n := len(args) / len(followsTable.columns); n != tt.written[i] {
+					t.Fatalf("statement %d writes %d rows, want %d", i, n, tt.written[i])
+				}
+				if last := fmt.Sprintf("$%d)", len(args)); !strings.Contains(stmt, last+" ON CONFLICT") {
+					t.Fatalf("statement %d doesn't end its values at %s", i, last)
+				}
+				for j := 4; j < len(args); j += len(followsTable.columns) {
+					subjects = append(subjects, args[j].(string))
+				}
+			}
+			if tt.subjects != nil && !slices.Equal(subjects, tt.subjects) {
+				t.Fatalf("wrote subjects %v, want %v", subjects, tt.subjects)
+			}
+		})
+	}
+}
+
+func TestCreatePostgresTables(t *testing.T) {
+	stmts := createPostgresTables()
+	for _, want := range []string{
+		"CREATE TABLE IF NOT EXISTS posts (did TEXT NOT NULL, rkey TEXT NOT NULL, time_us BIGINT NOT NULL, cid TEXT, text TEXT, langs TEXT, reply_root TEXT, reply_parent TEXT, embed_type TEXT, created_at TEXT, PRIMARY KEY (did, rkey))",
+		"CREATE TABLE IF NOT EXISTS records (did TEXT NOT NULL, collection TEXT NOT NULL, rkey TEXT NOT NULL, time_us BIGINT NOT NULL, cid TEXT, record JSON, PRIMARY KEY (did, collection, rkey))",
+		"CREATE TABLE IF NOT EXISTS accounts (did TEXT NOT NULL, active BOOLEAN NOT NULL, seq BIGINT, time TEXT, time_us BIGINT NOT NULL, status TEXT)",
+		"CREATE INDEX IF NOT EXISTS likes_subject_uri ON likes (subject_uri)",
+	} {
+		if !slices.Contains(stmts, want) {
+			t.Errorf("no statement %s in %v", want, stmts)
+		}
+	}
+}
+
+func TestStripNULs(t *testing.T) {
+	row := stripNULs([]any{"did:plc:alice", "hel\x00lo\x00", int64(7), true})
+	if !slices.Equal(row, []any{"did:plc:alice", "hello", int64(7), true}) {
+		t.Fatalf("stripNULs = %q", row)
+	}
+}
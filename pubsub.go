@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	pubsubScope = "https://www.googleapis.com/auth/pubsub"
+	// a publish request Pub/Sub pushes back on, or that doesn't reach it,
+	// is tried this many times, backing off from pubsubRetryDelay, before
+	// its events are dropped
+	pubsubAttempts   = 6
+	pubsubRetryDelay = time.Second
+	pubsubTimeout    = time.Minute
+	// a publish request holds at most this many messages, and this many
+	// bytes of them, under Pub/Sub's limit of 1000 and 10MB
+	pubsubMaxMessages = 1000
+	pubsubMaxBytes    = 9 << 20
+)
+
+// pubsubMessage is a message of a publish request. Data is sent base64
+// encoded, as encoding/json does with []byte.
+type pubsubMessage struct {
+	Data        []byte            `json:"data"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+// pubsubSink publishes every event as JSON to a Google Cloud Pub/Sub
+// topic, in batches, with the DID as the ordering key so a subscription
+// with message ordering gets each account's events in order. Commits
+// carry kind, collection, and operation attributes, and other events kind,
+// for subscription filters. Events a publish loses are dropped and
+// counted, not republished.
+type pubsubSink struct {
+	*batchQueue
+	url string
+	// creds is nil against the emulator, which doesn't authenticate
+	creds  *googleCredentials
+	client *http.Client
+}
+
+// newPubSubSink publishes to project's topic through endpoint, or through
+// PUBSUB_EMULATOR_HOST when it is set, checking the application default
+// credentials can be used first
+func newPubSubSink(endpoint, project, topic string, queueSize, batchSize int, interval, idle time.Duration) (*pubsubSink, error) {
+	s := &pubsubSink{client: &http.Client{Timeout: pubsubTimeout}}
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		endpoint = "http://" + host
+	} else {
+		creds, err := findGoogleCredentials(pubsubScope)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := creds.accessToken(); err != nil {
+			return nil, err
+		}
+		log.Info().Str("credentials", creds.source).Msg("using google application default credentials for -pubsub-topic")
+		s.creds = creds
+	}
+	s.url = fmt.Sprintf("%s/v1/projects/%s/topics/%s:publish", strings.TrimSuffix(endpoint, "/"), url.PathEscape(project), url.PathEscape(topic))
+	s.batchQueue = newBatchQueue("pubsub", queueSize, batchSize, interval, idle, s.write)
+	return s, nil
+}
+
+// message encodes msg as a Pub/Sub message
+func (s *pubsubSink) message(msg *jetstream.Message) (pubsubMessage, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return pubsubMessage{}, err
+	}
+	attributes := map[string]string{"kind": msg.Kind}
+	if msg.Commit != nil {
+		attributes["collection"] = msg.Commit.Collection
+		attributes["operation"] = msg.Commit.Operation
+	}
+	return pubsubMessage{Data: data, OrderingKey: msg.Did, Attributes: attributes}, nil
+}
+
+// write publishes batch in as few requests as Pub/Sub's limits allow, in
+// order. Once a request fails the rest aren't tried.
+func (s *pubsubSink) write(batch []*jetstream.Message) error {
+	var requests [][]pubsubMessage
+	var request []pubsubMessage
+	size := 0
+	for _, msg := range batch {
+		m, err := s.message(msg)
+		if err != nil {
+			s.fail("invalid_record", err, 1)
+			continue
+		}
+		n := base64.StdEncoding.EncodedLen(len(m.Data)) + len(m.OrderingKey) + 100
+		if n > pubsubMaxBytes {
+			s.fail("too_large", fmt.Errorf("%d byte event", len(m.Data)), 1)
+			continue
+		}
+		if len(request) == pubsubMaxMessages || size+n > pubsubMaxBytes {
+			requests = append(requests, request)
+			request, size = nil, 0
+		}
+		request = append(request, m)
+		size += n
+	}
+	if len(request) > 0 {
+		requests = append(requests, request)
+	}
+
+	for i, request := range requests {
+		if err := s.send(request); err != nil {
+			lost := 0
+			for _, r := range requests[i:] {
+				lost += len(r)
+			}
+			return &partialWriteError{err: err, lost: lost}
+		}
+	}
+	return nil
+}
+
+// send publishes messages in one request, retrying while Pub/Sub pushes back
+func (s *pubsubSink) send(messages []pubsubMessage) error {
+	body, err := json.Marshal(map[string]any{"messages": messages})
+	if err != nil {
+		return err
+	}
+	delay := pubsubRetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil || !retry || attempt == pubsubAttempts {
+			return err
+		}
+		log.Warn().Err(err).Int("events", len(messages)).Int("attempt", attempt).Dur("retry_in", delay).Msg("pubsub publish failed, retrying")
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends a publish request, reporting whether a failure is worth
+// retrying: one that didn't reach Pub/Sub, a refused access token, or a
+// status its client libraries retry
+func (s *pubsubSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.creds != nil {
+		token, err := s.creds.accessToken()
+		if err != nil {
+			return true, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return false, nil
+	case resp.StatusCode == http.StatusUnauthorized && s.creds != nil:
+		s.creds.expire()
+		return true, errors.New("access token refused")
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(data))
+	}
+	return false, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(data))
+}
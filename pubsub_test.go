@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// pubsubServer is a Pub/Sub publish endpoint answering each request with
+// the next status, then 200, and keeping the requests it accepted
+type pubsubServer struct {
+	statuses []int
+
+	mu       sync.Mutex
+	paths    []string
+	requests [][]pubsubMessage
+}
+
+func (p *pubsubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Messages []pubsubMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paths = append(p.paths, r.URL.Path)
+	if len(p.statuses) > 0 {
+		status := p.statuses[0]
+		p.statuses = p.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	p.requests = append(p.requests, body.Messages)
+	w.Write([]byte(`{"messageIds":[]}`))
+}
+
+// useEmulator points newPubSubSink at ts, as the emulator
+func useEmulator(t *testing.T, ts *httptest.Server) {
+	u, _ := url.Parse(ts.URL)
+	t.Setenv("PUBSUB_EMULATOR_HOST", u.Host)
+}
+
+func TestPubSubSinkPublishes(t *testing.T) {
+	isolateBreakers(t)
+	server := &pubsubServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	useEmulator(t, ts)
+
+	s, err := newPubSubSink("https://unused.example", "my-project", "events", 100, 2, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := commitMessage("app.bsky.feed.post", `{"text":"hi"}`)
+	identity := parseFrame(t, identityFrame)
+	like := parseFrame(t, likeFrame)
+	for _, msg := range []*jetstream.Message{first, identity, like} {
+		s.publish(msg)
+	}
+	s.close()
+
+	if len(server.requests) != 2 || len(server.requests[0]) != 2 || len(server.requests[1]) != 1 {
+		t.Fatalf("published %v, want batches of 2 and 1", server.requests)
+	}
+	if server.paths[0] != "/v1/projects/my-project/topics/events:publish" {
+		t.Errorf("published to %s", server.paths[0])
+	}
+	tests := []struct {
+		got        pubsubMessage
+		want       *jetstream.Message
+		attributes map[string]string
+	}{
+		{server.requests[0][0], first, map[string]string{"kind": "commit", "collection": "app.bsky.feed.post", "operation": "create"}},
+		{server.requests[0][1], identity, map[string]string{"kind": "identity"}},
+		{server.requests[1][0], like, map[string]string{"kind": "commit", "collection": "app.bsky.feed.like", "operation": "create"}},
+	}
+	for i, tt := range tests {
+		if tt.got.OrderingKey != tt.want.Did {
+			t.Errorf("message %d has ordering key %q, want %q", i, tt.got.OrderingKey, tt.want.Did)
+		}
+		if len(tt.got.Attributes) != len(tt.attributes) {
+			t.Errorf("message %d has attributes %v, want %v", i, tt.got.Attributes, tt.attributes)
+		}
+		for k, v := range tt.attributes {
+			if tt.got.Attributes[k] != v {
+				t.Errorf("message %d has attributes %v, want %v", i, tt.got.Attributes, tt.attributes)
+			}
+		}
+		var decoded jetstream.Message
+		if err := json.Unmarshal(tt.got.Data, &decoded); err != nil || decoded.Did != tt.want.Did || decoded.Kind != tt.want.Kind {
+			t.Errorf("message %d data %s doesn't decode to the event: %v", i, tt.got.Data, err)
+		}
+	}
+}
+
+func TestPubSubSinkWrite(t *testing.T) {
+	isolateBreakers(t)
+	tests := []struct {
+		name     string
+		statuses []int
+		// lost is how many events the write reports lost, 0 for none
+		lost     int
+		requests int
+	}{
+		{"published", nil, 0, 1},
+		{"retried after pushback", []int{http.StatusServiceUnavailable}, 0, 1},
+		{"rejected", []int{http.StatusNotFound}, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &pubsubServer{statuses: tt.statuses}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+			useEmulator(t, ts)
+			s, err := newPubSubSink("", "p", "t", 10, 10, time.Hour, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.close()
+
+			err = s.write([]*jetstream.Message{parseFrame(t, postFrame), parseFrame(t, likeFrame)})
+			var partial *partialWriteError
+			switch {
+			case tt.lost == 0 && err != nil:
+				t.Fatalf("write failed: %v", err)
+			case tt.lost > 0 && !errors.As(err, &partial):
+				t.Fatalf("write returned %v, want a partialWriteError", err)
+			case tt.lost > 0 && partial.lost != tt.lost:
+				t.Fatalf("write lost %d events, want %d", partial.lost, tt.lost)
+			}
+			if len(server.requests) != tt.requests {
+				t.Fatalf("%d publish requests accepted, want %d", len(server.requests), tt.requests)
+			}
+		})
+	}
+}
+
+// googleAuthServer is a token endpoint and metadata server checking what
+// each kind of credentials asks for a token with
+type googleAuthServer struct {
+	t      *testing.T
+	public *rsa.PublicKey
+	issued atomic.Int32
+}
+
+func (g *googleAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	switch {
+	case r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token":
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.Form.Get("scopes") != pubsubScope {
+			g.t.Errorf("metadata request without its header or scope: %v %v", r.Header, r.Form)
+		}
+	case r.Form.Get("grant_type") == "refresh_token":
+		if r.Form.Get("client_id") != "client" || r.Form.Get("client_secret") != "shh" || r.Form.Get("refresh_token") != "refresh" {
+			g.t.Errorf("refresh request with %v", r.Form)
+		}
+	case r.Form.Get("grant_type") == "urn:ietf:params:oauth:grant-type:jwt-bearer":
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			g.t.Fatalf("assertion %q isn't a JWT", r.Form.Get("assertion"))
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if err := rsa.VerifyPKCS1v15(g.public, crypto.SHA256, digest[:], signature); err != nil {
+			g.t.Errorf("assertion signature: %v", err)
+		}
+		var claims struct {
+			Iss, Scope, Aud string
+		}
+		data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(data, &claims)
+		if claims.Iss != "logger@my-project.iam.gserviceaccount.com" || claims.Scope != pubsubScope || !strings.HasSuffix(claims.Aud, "/token") {
+			g.t.Errorf("assertion claims %+v", claims)
+		}
+	default:
+		g.t.Errorf("unexpected token request %s %v", r.URL, r.Form)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	g.issued.Add(1)
+	json.NewEncoder(w).Encode(googleToken{AccessToken: "token", ExpiresIn: 3600})
+}
+
+func TestGoogleCredentials(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	private := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	server := &googleAuthServer{t: t, public: &key.PublicKey}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		// file is the credentials file GOOGLE_APPLICATION_CREDENTIALS
+		// names, or with gcloud the one gcloud saved, none for the
+		// metadata server
+		file   *googleKeyFile
+		gcloud bool
+	}{
+		{"service account", &googleKeyFile{Type: "service_account", ClientEmail: "logger@my-project.iam.gserviceaccount.com", PrivateKey: private, TokenURI: ts.URL + "/token"}, false},
+		{"gcloud user", &googleKeyFile{Type: "authorized_user", ClientID: "client", ClientSecret: "shh", RefreshToken: "refresh", TokenURI: ts.URL + "/token"}, true},
+		{"metadata server", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("CLOUDSDK_CONFIG", dir)
+			t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+			t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(ts.URL, "http://"))
+			if tt.file != nil {
+				data, _ := json.Marshal(tt.file)
+				path := filepath.Join(dir, "key.json")
+				if tt.gcloud {
+					path = gcloudCredentialsPath()
+				} else {
+					t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path)
+				}
+				if err := os.WriteFile(path, data, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			server.issued.Store(0)
+
+			creds, err := findGoogleCredentials(pubsubScope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 2 {
+				if token, err := creds.accessToken(); err != nil || token != "token" {
+					t.Fatalf("access token %q, %v", token, err)
+				}
+			}
+			if n := server.issued.Load(); n != 1 {
+				t.Fatalf("%d tokens issued for two calls, want 1 cached", n)
+			}
+			creds.expire()
+			creds.accessToken()
+			if n := server.issued.Load(); n != 2 {
+				t.Fatalf("%d tokens issued after expiring, want 2", n)
+			}
+		})
+	}
+}
+
+func TestPubSubSinkSendsAccessToken(t *testing.T) {
+	isolateBreakers(t)
+	var auth atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" {
+			json.NewEncoder(w).Encode(googleToken{AccessToken: "metadata-token", ExpiresIn: 3600})
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		auth.Store(r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+	t.Setenv("PUBSUB_EMULATOR_HOST", "")
+	t.Setenv("CLOUDSDK_CONFIG", t.TempDir())
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(ts.URL, "http://"))
+
+	s, err := newPubSubSink(ts.URL, "p", "t", 10, 10, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.publish(parseFrame(t, postFrame))
+	s.close()
+	if got, _ := auth.Load().(string); got != "Bearer metadata-token" {
+		t.Fatalf("published with Authorization %q", got)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// eventQuery selects stored events for the query, stats, and export
+// commands
+type eventQuery struct {
+	dids, collections, kinds, ops []string
+	// since and until bound time_us, until exclusively, with zero for
+	// no bound
+	since, until int64
+}
+
+// matches reports whether msg is selected. Collections and operations only
+// narrow commits down.
+func (q *eventQuery) matches(msg *jetstream.Message) bool {
+	if len(q.dids) > 0 && !slices.Contains(q.dids, msg.Did) {
+		return false
+	}
+	if len(q.kinds) > 0 && !slices.Contains(q.kinds, msg.Kind) {
+		return false
+	}
+	if (q.since > 0 && msg.TimeUs < q.since) || (q.until > 0 && msg.TimeUs >= q.until) {
+		return false
+	}
+	if msg.Kind != "commit" || msg.Commit == nil {
+		return true
+	}
+	if len(q.ops) > 0 && !slices.Contains(q.ops, msg.Commit.Operation) {
+		return false
+	}
+	return len(q.collections) == 0 || matchesCollection(q.collections, msg.Commit.Collection)
+}
+
+// timeFlag is a time_us bound, given as a time_us or an RFC 3339 time
+type timeFlag int64
+
+func (f *timeFlag) String() string { return strconv.FormatInt(int64(*f), 10) }
+
+func (f *timeFlag) Set(value string) error {
+	if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+		*f = timeFlag(us)
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("expected a time_us or an RFC 3339 time")
+	}
+	*f = timeFlag(t.UnixMicro())
+	return nil
+}
+
+// storeCommand is a command reading the events in a stored file, with the
+// flags selecting them
+type storeCommand struct {
+	flags        *flag.FlagSet
+	query        eventQuery
+	since, until timeFlag
+	dids         stringsFlag
+	collections  stringsFlag
+	kinds        stringsFlag
+	ops          stringsFlag
+}
+
+func newStoreCommand(name, args string) *storeCommand {
+	c := &storeCommand{flags: flag.NewFlagSet(name, flag.ExitOnError)}
+	fs := c.flags
+	fs.Var(&c.dids, "did", "only events from this DID (repeatable)")
+	fs.Var(&c.collections, "collection", "only commits to this collection NSID, or prefix like app.bsky.graph.* (repeatable)")
+	fs.Var(&c.kinds, "kind", "only events of this kind: commit, identity, account, or label (repeatable)")
+	fs.Var(&c.ops, "op", "only commits with this operation: create, update, or delete (repeatable)")
+	fs.Var(&c.since, "since", "only events at or after this time_us or RFC 3339 time")
+	fs.Var(&c.until, "until", "only events before this time_us or RFC 3339 time")
+	fs.BoolVar(firehoseFlag, "firehose", false, "FILE is a raw capture made with -firehose")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: atproto-logger %s %s\n\nFILE is a -raw-capture-file, -ndjson-file output, or -sqlite-file archive.\n\n", name, args)
+		fs.PrintDefaults()
+	}
+	return c
+}
+
+// parse parses args, returning the file to read. Logs go to stderr, so
+// stdout is left to the command's output.
+func (c *storeCommand) parse(args []string) string {
+	files := parseArgs(c.flags, args)
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	if len(files) != 1 {
+		c.flags.Usage()
+		os.Exit(2)
+	}
+	for _, k := range c.kinds {
+		if !validKinds[k] {
+			log.Fatal().Str("kind", k).Msg("invalid -kind, expected commit, identity, account, or label")
+		}
+	}
+	c.query = eventQuery{
+		dids:        c.dids,
+		collections: c.collections,
+		kinds:       c.kinds,
+		ops:         c.ops,
+		since:       int64(c.since),
+		until:       int64(c.until),
+	}
+	return files[0]
+}
+
+// read passes each selected event in path to each, until it returns false
+// or the command is interrupted
+func (c *storeCommand) read(path string, each func(*jetstream.Message) bool) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err := readEvents(ctx, path, &c.query, func(msg *jetstream.Message) bool {
+		return !c.query.matches(msg) || each(msg)
+	})
+	if err != nil {
+		log.Fatal().Err(err).Str("file", path).Msg("failed to read events")
+	}
+}
+
+// queryCommand prints the selected events as Jetstream JSON lines
+func queryCommand(args []string) {
+	c := newStoreCommand("query", "[flags] FILE")
+	limit := c.flags.Int("limit", 0, "print at most this many events (0 prints all)")
+	path := c.parse(args)
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	printed := 0
+	c.read(path, func(msg *jetstream.Message) bool {
+		out.Write(msg.Raw)
+		out.WriteByte('\n')
+		printed++
+		return *limit == 0 || printed < *limit
+	})
+}
+
+// storeStats is the report of the stats command
+type storeStats struct {
+	Events      int               `json:"events"`
+	First       *time.Time        `json:"first,omitempty"`
+	Last        *time.Time        `json:"last,omitempty"`
+	UniqueDids  int               `json:"unique_dids"`
+	Kinds       map[string]int    `json:"kinds"`
+	Operations  map[string]int    `json:"operations"`
+	Collections []collectionTrend `json:"top_collections"`
+}
+
+// statsCommand reports counts of the selected events by kind, operation,
+// and collection, with rates over the time they span
+func statsCommand(args []string) {
+	c := newStoreCommand("stats", "[flags] FILE")
+	top := c.flags.Int("top", 25, "collections ranked in the report (0 ranks all)")
+	path := c.parse(args)
+
+	stats := storeStats{Kinds: map[string]int{}, Operations: map[string]int{}}
+	var firstUs, lastUs int64
+	dids := map[string]struct{}{}
+	collections := map[string]uint64{}
+	c.read(path, func(msg *jetstream.Message) bool {
+		stats.Events++
+		if msg.TimeUs > 0 {
+			if firstUs == 0 || msg.TimeUs < firstUs {
+				firstUs = msg.TimeUs
+			}
+			lastUs = max(lastUs, msg.TimeUs)
+		}
+		if msg.Did != "" {
+			dids[msg.Did] = struct{}{}
+		}
+		stats.Kinds[msg.Kind]++
+		if msg.Commit != nil {
+			stats.Operations[msg.Commit.Operation]++
+			collections[msg.Commit.Collection]++
+		}
+		return true
+	})
+
+	stats.UniqueDids = len(dids)
+	// rates are over the time the events span, at least a second
+	seconds := 1.0
+	if firstUs > 0 {
+		first, last := time.UnixMicro(firstUs).UTC(), time.UnixMicro(lastUs).UTC()
+		stats.First, stats.Last = &first, &last
+		seconds = max(seconds, last.Sub(first).Seconds())
+	}
+	stats.Collections = make([]collectionTrend, 0, len(collections))
+	for c, n := range collections {
+		perSec := math.Round(float64(n)/seconds*100) / 100
+		stats.Collections = append(stats.Collections, collectionTrend{Collection: c, Count: n, PerSec: perSec})
+	}
+	slices.SortFunc(stats.Collections, func(a, b collectionTrend) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Collection, b.Collection))
+	})
+	if *top > 0 && len(stats.Collections) > *top {
+		stats.Collections = stats.Collections[:*top]
+	}
+
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.Encode(stats)
+}
+
+// exportCommand writes the selected events to another file, as NDJSON or
+// a SQLite archive, or to a directory of Parquet files, through the same
+// sinks as -ndjson-file, -sqlite-file, and -parquet-dir
+func exportCommand(args []string) {
+	c := newStoreCommand("export", "[flags] -o OUT FILE")
+	outFlag := c.flags.String("o", "", "file to write, appended to if it exists ('-' for stdout), or directory with -to parquet")
+	toFlag := c.flags.String("to", "", "format to write: ndjson, sqlite, or parquet (default from the -o extension, .db, .sqlite, or .sqlite3 for sqlite)")
+	path := c.parse(args)
+
+	if *outFlag == "" {
+		log.Fatal().Msg("export needs -o")
+	}
+	if *outFlag == path {
+		log.Fatal().Msg("export can't write to the file it reads")
+	}
+	to := *toFlag
+	if to == "" {
+		to = "ndjson"
+		switch filepath.Ext(*outFlag) {
+		case ".db", ".sqlite", ".sqlite3":
+			to = "sqlite"
+		}
+	}
+
+	// every event read is written, however slow the output
+	sinkOverflow = overflowBlock
+	var sink eventSink
+	var err error
+	switch to {
+	case "ndjson":
+		sink, err = newNDJSONSink(*outFlag, 10000, 0, 0, 0, "", 0)
+	case "sqlite":
+		if *outFlag == "-" {
+			log.Fatal().Msg("-to sqlite can't write to stdout")
+		}
+		sink, err = newSQLiteSink(*outFlag, 10000)
+	case "parquet":
+		if *outFlag == "-" {
+			log.Fatal().Msg("-to parquet can't write to stdout")
+		}
+		sink, err = newParquetSink(*outFlag, 10000)
+	default:
+		log.Fatal().Str("to", to).Msg("invalid -to, expected ndjson, sqlite, or parquet")
+	}
+	if err != nil {
+		log.Fatal().Err(err).Str("file", *outFlag).Msg("failed to open export output")
+	}
+
+	exported := 0
+	c.read(path, func(msg *jetstream.Message) bool {
+		sink.publish(msg)
+		exported++
+		return true
+	})
+	sink.close()
+	log.Info().Int("events", exported).Str("file", *outFlag).Str("format", to).Msg("export finished")
+	if drops.total() > 0 {
+		drops.logSummary(zerolog.WarnLevel)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"slices"
+
+	"github.com/rs/zerolog"
+)
+
+// recordCache remembers the latest version of recently seen records by
+// AT URI, so deletes can log what was deleted and updates what changed.
+// It is only used from the handling goroutine. Records created before the
+// logger started, or evicted since, have nothing to compare against.
+type recordCache struct {
+	max     int
+	lru     *list.List // front is most recently written
+	entries map[string]*list.Element
+}
+
+type cachedRecord struct {
+	uri    string
+	record json.RawMessage
+}
+
+// records is the recent record cache, nil unless -record-cache-size is set
+var records *recordCache
+
+func newRecordCache(max int) *recordCache {
+	return &recordCache{max: max, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// swap stores record as the latest version of uri, or forgets uri if
+// record is empty, and returns the version it replaces
+func (c *recordCache) swap(uri string, record json.RawMessage) (json.RawMessage, bool) {
+	var previous json.RawMessage
+	el, found := c.entries[uri]
+	if found {
+		previous = el.Value.(*cachedRecord).record
+	}
+
+	switch {
+	case len(record) == 0:
+		if found {
+			c.lru.Remove(el)
+			delete(c.entries, uri)
+		}
+	case found:
+		// copied, since the message's buffer isn't ours to keep
+		el.Value.(*cachedRecord).record = bytes.Clone(record)
+		c.lru.MoveToFront(el)
+	default:
+		c.entries[uri] = c.lru.PushFront(&cachedRecord{uri: uri, record: bytes.Clone(record)})
+		if c.lru.Len() > c.max {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cachedRecord).uri)
+		}
+	}
+	return previous, found
+}
+
+// diffRecords returns the top-level fields that differ between two
+// versions of a record, sorted, and their previous values as a JSON
+// object, leaving out fields the update added
+func diffRecords(previous, current json.RawMessage) ([]string, json.RawMessage) {
+	var before, after map[string]json.RawMessage
+	if json.Unmarshal(previous, &before) != nil || json.Unmarshal(current, &after) != nil {
+		return nil, nil
+	}
+
+	var changed []string
+	old := map[string]json.RawMessage{}
+	for field, value := range before {
+		if !jsonEqual(value, after[field]) {
+			changed = append(changed, field)
+			old[field] = value
+		}
+	}
+	for field := range after {
+		if _, ok := before[field]; !ok {
+			changed = append(changed, field)
+		}
+	}
+	slices.Sort(changed)
+
+	data, err := json.Marshal(old)
+	if err != nil {
+		return changed, nil
+	}
+	return changed, data
+}
+
+// jsonEqual compares two JSON values ignoring insignificant whitespace
+func jsonEqual(a, b json.RawMessage) bool {
+	if b == nil {
+		return false
+	}
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// withRecordHistory adds what the cache knows about the commit's record:
+// the deleted version for deletes, and the changed fields and their old
+// values for updates. It also records the commit's version.
+func withRecordHistory(ctx zerolog.Context, uri, operation string, record json.RawMessage) zerolog.Context {
+	if operation == "delete" {
+		record = nil
+	}
+	previous, ok := records.swap(uri, record)
+	if !ok {
+		return ctx
+	}
+	switch operation {
+	case "delete":
+		ctx = ctx.RawJSON("original", previous)
+	case "update":
+		changed, old := diffRecords(previous, record)
+		ctx = ctx.Strs("changed_fields", changed)
+		if old != nil {
+			ctx = ctx.RawJSON("previous", old)
+		}
+	}
+	return ctx
+}
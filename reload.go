@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadableFlags are the flags a -config reload changes while the logger
+// runs. They only affect how each event is filtered and logged, so they
+// take effect from the next event; other flags open connections, sinks,
+// and servers at startup, and changes to them wait for a restart.
+var reloadableFlags = map[string]bool{
+	"collection":                    true,
+	"did":                           true,
+	"kind":                          true,
+	"op":                            true,
+	"filter":                        true,
+	"cel":                           true,
+	"match":                         true,
+	"sample":                        true,
+	"sample-by-did":                 true,
+	"log-level":                     true,
+	"min-text-length":               true,
+	"emit-deletes-only":             true,
+	"collection-allow-unknown-only": true,
+	"sink-only":                     true,
+	"strict":                        true,
+	"retry-parse-as-raw":            true,
+}
+
+// watchReload reopens the output files on SIGHUP and reloads the -config
+// file at path, if there is one, on SIGHUP and when its modification time
+// changes if interval is positive, until ctx is cancelled
+func watchReload(ctx context.Context, path string, interval time.Duration, client *jetstream.Client) {
+	var reload chan os.Signal
+	if reloadSignal != nil {
+		reload = make(chan os.Signal, 1)
+		signal.Notify(reload, reloadSignal)
+		defer signal.Stop(reload)
+	}
+	var tick <-chan time.Time
+	var modTime time.Time
+	if path != "" && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		if info, err := os.Stat(path); err == nil {
+			modTime = info.ModTime()
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			reopenFiles()
+			if path != "" {
+				reloadConfig(path, client, "signal")
+			}
+		case <-tick:
+			// editors often replace the file, so it can briefly be missing
+			info, err := os.Stat(path)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = info.ModTime()
+			reloadConfig(path, client, "file_changed")
+		}
+	}
+}
+
+// reopenFiles reopens -log-file, -ndjson-file, and -raw-capture-file at
+// their paths, so once logrotate has moved them aside, writes go to new
+// files rather than the moved ones. Compressed segments are finished
+// instead, and the next write starts another.
+func reopenFiles() {
+	var reopened []string
+	reopen := func(name string, err error) {
+		if err != nil {
+			log.Error().Err(err).Msg("failed to reopen -" + name)
+			return
+		}
+		reopened = append(reopened, name)
+	}
+	switch {
+	case logSegments != nil:
+		reopen("log-file", logSegments.Rotate())
+	case logFile != nil:
+		// lumberjack opens the file again on the next write
+		reopen("log-file", logFile.Close())
+	}
+	for _, s := range sinks {
+		if s, ok := s.(*ndjsonSink); ok && s.closer != nil {
+			reopen("ndjson-file", s.reopen())
+		}
+	}
+	if capture != nil {
+		reopen("raw-capture-file", capture.reopen())
+	}
+	if len(reopened) > 0 {
+		log.Info().Strs("files", reopened).Msg("reopened output files")
+	}
+}
+
+// appendFile is a file opened for appending that can be reopened at its
+// path
+type appendFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openAppendFile(path string) (*appendFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &appendFile{path: path, f: f}, nil
+}
+
+func (a *appendFile) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Write(p)
+}
+
+func (a *appendFile) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// reopen closes the file and opens path again, creating it if it was moved
+// away. On failure the old file is kept.
+func (a *appendFile) reopen() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old := a.f
+	a.f = f
+	return old.Close()
+}
+
+// reloadConfig rereads the -config file and applies what changed in it.
+// Flags set on the command line or in the environment still win, and a
+// file that doesn't parse, or values that aren't valid, leave the running
+// configuration as it was.
+func reloadConfig(path string, client *jetstream.Client, trigger string) {
+	lines, err := readConfigFile(path)
+	if err != nil {
+		log.Error().Err(err).Str("trigger", trigger).Msg("failed to reload config, keeping the current one")
+		return
+	}
+	values := configFileValues(lines, fixedFlags)
+
+	var changed, restart []string
+	for name := range mergeKeys(values, configValues) {
+		if slices.Equal(values[name], configValues[name]) {
+			continue
+		}
+		if reloadableFlags[name] {
+			changed = append(changed, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	slices.Sort(changed)
+	slices.Sort(restart)
+	if len(restart) > 0 {
+		log.Warn().Strs("flags", restart).Msg("config changes that only take effect on restart")
+	}
+	if len(changed) == 0 {
+		log.Info().Str("trigger", trigger).Msg("config reloaded, nothing to apply")
+		return
+	}
+
+	handleMu.Lock()
+	defer handleMu.Unlock()
+	previous := map[string][]string{}
+	for _, name := range changed {
+		previous[name] = flagValues(name)
+	}
+	err = func() error {
+		for _, name := range changed {
+			if err := setConfigFlag(name, values[name]); err != nil {
+				return fmt.Errorf("-%s: %v", name, err)
+			}
+		}
+		return applyReloadedFlags(client, changed)
+	}()
+	if err != nil {
+		for name, v := range previous {
+			setConfigFlag(name, v)
+		}
+		log.Error().Err(err).Str("trigger", trigger).Msg("failed to reload config, keeping the current one")
+		return
+	}
+	configValues = applied(values, configValues, changed)
+	log.Info().Strs("flags", changed).Str("trigger", trigger).Msg("config reloaded")
+}
+
+// applyReloadedFlags rebuilds the state derived from the changed flags,
+// which have been set to their new values, replacing it only once all of
+// it is valid. Server-side filter changes reconnect, resuming from the
+// last handled event as the admin API's do.
+func applyReloadedFlags(client *jetstream.Client, changed []string) error {
+	has := func(names ...string) bool {
+		for _, name := range names {
+			if slices.Contains(changed, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	filters, exprs, terms := eventFilters, exprFilters, matchTerms
+	var err error
+	if has("kind", "op") {
+		filters = nil
+		if len(kindFlags) > 0 || len(opFlags) > 0 {
+			if filters, err = newEventFilter(kindFlags, opFlags); err != nil {
+				return fmt.Errorf("-kind or -op: %v", err)
+			}
+		}
+	}
+	if has("filter", "cel") {
+		exprs = nil
+		if len(filterFlags) > 0 || len(celFlags) > 0 {
+			if exprs, err = newEventExprFilter(filterFlags, celFlags); err != nil {
+				return fmt.Errorf("-filter or -cel: %v", err)
+			}
+		}
+	}
+	if has("match") {
+		terms = nil
+		for _, term := range matchFlags {
+			if term = strings.ToLower(term); term != "" {
+				terms = append(terms, term)
+			}
+		}
+	}
+	rates := sampling.rates
+	if has("sample") {
+		if rates, err = parseSampleRates(*sampleFlag); err != nil {
+			return fmt.Errorf("-sample: %v", err)
+		}
+	}
+	level := zerolog.GlobalLevel()
+	if has("log-level") {
+		if level, err = zerolog.ParseLevel(*logLevelFlag); err != nil {
+			return fmt.Errorf("-log-level: %v", err)
+		}
+	}
+
+	// last, since it takes effect as soon as it succeeds
+	if has("collection", "did") {
+		collections, dids := client.Filters()
+		if has("collection") {
+			collections = slices.Clone(collectionFlags)
+			if *lexiconDirFlag != "" {
+				fromLexicons, err := collectionsFromLexiconDir(*lexiconDirFlag)
+				if err != nil {
+					return fmt.Errorf("-collections-from-lexicon-dir: %v", err)
+				}
+				collections = append(collections, fromLexicons...)
+			}
+		}
+		if has("did") {
+			if follows != nil {
+				return fmt.Errorf("-did can't be combined with -follows-of")
+			}
+			var err error
+			if dids, err = resolveDIDFlags(didFlags, *appviewURLFlag); err != nil {
+				return fmt.Errorf("-did: %v", err)
+			}
+		}
+		if err := client.SetFilters(collections, dids); err != nil {
+			return err
+		}
+		wantedCollections, wantedDids = collections, dids
+	}
+
+	eventFilters, exprFilters, matchTerms = filters, exprs, terms
+	sampling.setRates(rates, *sampleByDIDFlag)
+	zerolog.SetGlobalLevel(level)
+	return nil
+}
+
+// flagValues returns name's current value, as setConfigFlag takes it
+func flagValues(name string) []string {
+	f := flag.Lookup(name)
+	if v, ok := f.Value.(*stringsFlag); ok {
+		return slices.Clone(*v)
+	}
+	return []string{f.Value.String()}
+}
+
+// setConfigFlag replaces name's value with values, the last of them for
+// flags that aren't repeatable, or restores its default when there are
+// none, as when a line is removed from the file
+func setConfigFlag(name string, values []string) error {
+	f := flag.Lookup(name)
+	if v, ok := f.Value.(*stringsFlag); ok {
+		*v = nil
+		for _, value := range values {
+			v.Set(value)
+		}
+		return nil
+	}
+	value := f.DefValue
+	if len(values) > 0 {
+		value = values[len(values)-1]
+	}
+	return f.Value.Set(value)
+}
+
+// applied returns the file values now in effect: the new values of the
+// names that were applied, and the old values of the rest, so flags
+// waiting for a restart are still reported on the next reload
+func applied(values, previous map[string][]string, names []string) map[string][]string {
+	result := map[string][]string{}
+	for name := range mergeKeys(values, previous) {
+		v := previous[name]
+		if slices.Contains(names, name) {
+			v = values[name]
+		}
+		if len(v) > 0 {
+			result[name] = v
+		}
+	}
+	return result
+}
+
+// mergeKeys returns the keys of both maps
+func mergeKeys(a, b map[string][]string) map[string]bool {
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/gorilla/websocket"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+func TestReopenFiles(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	captureLog(t, &buf)
+
+	defer func(saved *lumberjack.Logger) { logFile = saved }(logFile)
+	logFile = &lumberjack.Logger{Filename: filepath.Join(dir, "atproto.log")}
+	defer logFile.Close()
+	ndjson, err := newNDJSONSink(filepath.Join(dir, "events.ndjson"), 10, 0, 0, 0, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useSink(t, ndjson)
+	defer ndjson.close()
+	defer func(saved *rawCapture) { capture = saved }(capture)
+	capture, err = openRawCapture(filepath.Join(dir, "raw.ndjson"), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capture.close()
+
+	write := func(line string) {
+		t.Helper()
+		if _, err := logFile.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ndjson.out.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := capture.write(websocket.TextMessage, []byte(`"`+line+`"`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []string{"atproto.log", "events.ndjson", "raw.ndjson"}
+
+	write("before")
+	// as logrotate does
+	for _, name := range files {
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(dir, name+".1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopenFiles()
+	write("after")
+
+	for _, name := range files {
+		for file, want := range map[string]string{name + ".1": "before", name: "after"} {
+			data, err := os.ReadFile(filepath.Join(dir, file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Trim(strings.TrimSpace(string(data)), `"`); got != want {
+				t.Errorf("%s holds %q, want %q", file, got, want)
+			}
+		}
+	}
+	if !strings.Contains(buf.String(), "reopened output files") {
+		t.Errorf("logged %q, want the reopen logged", buf.String())
+	}
+}
+
+func TestApplyReloadedFlagsNamesLexiconDirFlag(t *testing.T) {
+	defer func(saved string) { *lexiconDirFlag = saved }(*lexiconDirFlag)
+	*lexiconDirFlag = filepath.Join(t.TempDir(), "missing")
+
+	client := jetstream.NewClient(jetstream.DefaultURL)
+	err := applyReloadedFlags(client, []string{"collection"})
+	if err == nil || !strings.HasPrefix(err.Error(), "-collections-from-lexicon-dir: ") {
+		t.Errorf("err = %v, want it to name -collections-from-lexicon-dir", err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+// sqliteMagic starts every SQLite database file
+const sqliteMagic = "SQLite format 3\x00"
+
+// replayFile replays -replay-file, a -sqlite-file archive or otherwise a
+// raw capture, whose JSON lines -ndjson-file output also reads as. Events
+// go through the same handling as the live stream, so stored events can be
+// re-derived with different filters or output settings without
+// reconnecting. With a speed above zero, the gaps between event time_us
+// values are reproduced, divided by speed; otherwise events are handled as
+// fast as they can be read.
+func replayFile(ctx context.Context, path string, speed float64) error {
+	log.Info().Str("file", path).Float64("speed", speed).Msg("replaying")
+
+	var lastTimeUs int64
+	replayed := 0
+	err := readEvents(ctx, path, nil, func(msg *jetstream.Message) bool {
+		if speed > 0 && lastTimeUs > 0 && msg.TimeUs > lastTimeUs {
+			wait := time.Duration(float64(msg.TimeUs-lastTimeUs)/speed) * time.Microsecond
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return false
+			}
+		}
+		lastTimeUs = msg.TimeUs
+
+		if !matchesSubscription(msg) {
+			return true
+		}
+		shapes.check(msg.Raw)
+		if plugin != nil {
+			plugin.send(msg.Raw)
+		}
+		handleMessage(msg)
+		replayed++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		log.Info().Int("events", replayed).Msg("replay interrupted")
+	} else {
+		log.Info().Int("events", replayed).Msg("replay finished")
+	}
+	return nil
+}
+
+// readEvents reads the events stored at path, a -sqlite-file archive or
+// otherwise a raw capture or -ndjson-file output, plain or compressed,
+// passing each to each until it returns false or ctx is done. Archives are
+// read in time_us order, and other files in file order. A non-nil q narrows what is read
+// from an archive, but the caller still has to check its matches.
+func readEvents(ctx context.Context, path string, q *eventQuery, each func(*jetstream.Message) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(sqliteMagic))
+	if _, err := io.ReadFull(f, magic); err == nil && string(magic) == sqliteMagic {
+		return readArchive(ctx, path, q, each)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r, err := decompressed(f)
+	if err != nil {
+		return err
+	}
+	return readCapture(ctx, r, each)
+}
+
+// decompressed reads f through gzip or zstd if it starts with their magic
+// number, as -s3-bucket segments do
+func decompressed(f *os.File) (io.Reader, error) {
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(r)
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return r, nil
+}
+
+// readCapture reads the events in a -raw-capture-file, parsing its frames
+// the same way as the live stream. Captures made with -firehose must be
+// read with it too.
+func readCapture(ctx context.Context, f io.Reader, each func(*jetstream.Message) bool) error {
+	scanner := bufio.NewScanner(f)
+	// records are capped well under this by the PDS, but leave room for
+	// base64 binary frames
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' {
+			// capture header
+			continue
+		}
+
+		messageType := websocket.TextMessage
+		frame := line
+		if line[0] != '{' {
+			decoded, err := base64.StdEncoding.DecodeString(string(line))
+			if err != nil {
+				log.Error().Err(err).Msg("invalid line in raw capture")
+				drops.add("replay_invalid_line")
+				continue
+			}
+			messageType = websocket.BinaryMessage
+			frame = decoded
+		}
+
+		messages, err := parseCapturedFrame(messageType, frame)
+		if errors.Is(err, jetstream.ErrSkipFrame) {
+			log.Trace().Err(err).Int("len", len(frame)).Msg("skipping frame")
+			continue
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("parse error")
+			parseErrors.Inc()
+			drops.add("parse_error")
+			continue
+		}
+
+		for _, msg := range messages {
+			if !each(msg) {
+				return nil
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// parseCapturedFrame parses a captured frame into the events it carries.
+// With -firehose, binary frames are firehose frames rather than compressed
+// jetstream ones.
+func parseCapturedFrame(messageType int, frame []byte) ([]*jetstream.Message, error) {
+	if *firehoseFlag && messageType == websocket.BinaryMessage {
+		messages, _, err := jetstream.ParseFirehoseFrame(frame)
+		return messages, err
+	}
+	msg, err := jetstream.ParseMessage(messageType, frame)
+	if err != nil {
+		return nil, err
+	}
+	return []*jetstream.Message{msg}, nil
+}
+
+// matchesSubscription applies the -collection and -did filters locally,
+// the way jetstream would on a live subscription. Collection filters only
+// apply to commits.
+func matchesSubscription(msg *jetstream.Message) bool {
+	if len(wantedDids) > 0 && !slices.Contains(wantedDids, msg.Did) {
+		return false
+	}
+	if len(wantedCollections) == 0 || msg.Kind != "commit" || msg.Commit == nil {
+		return true
+	}
+	return matchesCollection(wantedCollections, msg.Commit.Collection)
+}
+
+// matchesCollection reports whether collection is one of patterns, which
+// may end in * to match an NSID prefix
+func matchesCollection(patterns []string, collection string) bool {
+	for _, c := range patterns {
+		if prefix, ok := strings.CutSuffix(c, "*"); ok {
+			if strings.HasPrefix(collection, prefix) {
+				return true
+			}
+		} else if collection == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// replyContextBatch is how many posts one getPosts request asks for, the
+// AppView's limit
+const replyContextBatch = 25
+
+// replyContextEntry is a cached post's text. found is false for a post the
+// AppView doesn't have, such as a deleted one, so it isn't asked for again.
+type replyContextEntry struct {
+	uri   string
+	text  string
+	found bool
+}
+
+// replyContextCache maps post URIs to their text, for logging replies with
+// the text of the post they reply to. Posts seen in the stream are
+// remembered as they go by, and others are fetched in the background from
+// the AppView with app.bsky.feed.getPosts, batched. Like handleResolver,
+// lookups never block: a reply whose parent isn't cached yet is logged
+// without its text.
+type replyContextCache struct {
+	mu      sync.Mutex
+	max     int
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+	pending map[string]bool
+
+	appviewURL string
+	client     *http.Client
+	queue      chan string
+}
+
+// replyContext is the parent post cache, nil unless -reply-context is set
+var replyContext *replyContextCache
+
+func newReplyContextCache(appviewURL string, max, workers int) *replyContextCache {
+	c := &replyContextCache{
+		max:        max,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		pending:    make(map[string]bool),
+		appviewURL: strings.TrimSuffix(appviewURL, "/"),
+		client:     enrichClient,
+		// as with handles, a burst beyond this is retried the next time a
+		// reply to the same post is seen
+		queue: make(chan string, 1000),
+	}
+	for range workers {
+		go c.work()
+	}
+	return c
+}
+
+// lookup returns the cached text of the post at uri. On a miss it queues
+// the post to be fetched, unless catching up, and returns false.
+func (c *replyContextCache) lookup(uri string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[uri]; ok {
+		c.lru.MoveToFront(el)
+		e := el.Value.(*replyContextEntry)
+		return e.text, e.found
+	}
+	if !c.pending[uri] && !catchingUp() {
+		select {
+		case c.queue <- uri:
+			c.pending[uri] = true
+		default:
+		}
+	}
+	return "", false
+}
+
+// remember caches a post's text, as seen in the stream or fetched
+func (c *replyContextCache) remember(uri, text string, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[uri]; ok {
+		e := el.Value.(*replyContextEntry)
+		e.text, e.found = text, found
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[uri] = c.lru.PushFront(&replyContextEntry{uri: uri, text: text, found: found})
+	if c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*replyContextEntry).uri)
+	}
+}
+
+// work fetches queued posts, taking whatever else is queued into the same
+// request
+func (c *replyContextCache) work() {
+	for uri := range c.queue {
+		batch := []string{uri}
+	fill:
+		for len(batch) < replyContextBatch {
+			select {
+			case uri := <-c.queue:
+				batch = append(batch, uri)
+			default:
+				break fill
+			}
+		}
+
+		texts, err := c.fetch(batch)
+		if err != nil {
+			// not cached, so the posts are asked for again by the next
+			// reply to them
+			log.Debug().Err(err).Int("posts", len(batch)).Msg("reply context fetch failed")
+		} else {
+			for _, uri := range batch {
+				text, found := texts[uri]
+				c.remember(uri, text, found)
+			}
+		}
+		c.mu.Lock()
+		for _, uri := range batch {
+			delete(c.pending, uri)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// fetch asks the AppView for posts by URI and returns the text of those it
+// has
+func (c *replyContextCache) fetch(uris []string) (map[string]string, error) {
+	resp, err := c.client.Get(c.appviewURL + "/xrpc/app.bsky.feed.getPosts?" + url.Values{"uris": uris}.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getPosts returned %s", resp.Status)
+	}
+
+	var body struct {
+		Posts []struct {
+			URI    string `json:"uri"`
+			Record struct {
+				Text string `json:"text"`
+			} `json:"record"`
+		} `json:"posts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	texts := make(map[string]string, len(body.Posts))
+	for _, post := range body.Posts {
+		texts[post.URI] = post.Record.Text
+	}
+	return texts, nil
+}
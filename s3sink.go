@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// a segment upload is tried this many times, backing off from
+	// s3RetryDelay, before its events are dropped
+	s3UploadAttempts = 5
+	s3RetryDelay     = time.Second
+	s3UploadTimeout  = time.Minute
+)
+
+// s3Segment is a compressed batch of NDJSON lines being built for one hour
+type s3Segment struct {
+	hour    time.Time
+	opened  time.Time
+	buf     bytes.Buffer
+	w       io.WriteCloser
+	events  int
+	firstUs int64
+	lastUs  int64
+}
+
+// s3Sink archives events to an S3 or S3-compatible bucket as compressed
+// NDJSON segments, one Jetstream message per line, under prefixes for the
+// hour of their time_us like 2024/09/09/19/. A segment is uploaded once it
+// reaches segmentSize compressed bytes, once it is interval old, once
+// events from a later hour arrive, and on shutdown. Objects are named by
+// the first and last time_us they hold, so re-archiving the same events,
+// as after a cursor replay, overwrites rather than duplicates them.
+type s3Sink struct {
+	client      *minio.Client
+	bucket      string
+	prefix      string
+	compression string
+	segmentSize int
+	interval    time.Duration
+	queue       chan *jetstream.Message
+	segments    map[time.Time]*s3Segment
+	newest      time.Time
+	failed      atomic.Uint64
+	stopped     chan struct{}
+	breaker     *circuitBreaker
+}
+
+func newS3Sink(endpoint, region, bucket, prefix, compression string, segmentSize int, interval time.Duration, queueSize int) (*s3Sink, error) {
+	switch compression {
+	case "zstd", "gzip":
+	default:
+		return nil, fmt.Errorf("unknown compression %q, expected zstd or gzip", compression)
+	}
+	client, err := newS3Client(endpoint, region)
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Sink{
+		client:      client,
+		bucket:      bucket,
+		prefix:      prefix,
+		compression: compression,
+		segmentSize: segmentSize,
+		interval:    interval,
+		queue:       make(chan *jetstream.Message, queueSize),
+		segments:    map[time.Time]*s3Segment{},
+		stopped:     make(chan struct{}),
+		breaker:     newCircuitBreaker("s3", *sinkBreakerFailuresFlag, *sinkBreakerCooldownFlag),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *s3Sink) publish(msg *jetstream.Message) {
+	if n := enqueue(s.queue, msg); n > 0 {
+		s.fail("queue_full", nil, n)
+	}
+}
+
+// fail counts n lost events, logging the first and then every 1000th
+func (s *s3Sink) fail(reason string, err error, n int) {
+	for range n {
+		drops.add("s3_" + reason)
+	}
+	sinkDrop("s3", reason, n)
+	total := s.failed.Add(uint64(n))
+	if before := total - uint64(n); before == 0 || before/1000 != total/1000 {
+		log.Warn().Err(err).Str("reason", reason).Uint64("failed", total).Msg("s3 archive failed, dropping events")
+	}
+}
+
+func (s *s3Sink) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-s.queue:
+			if !ok {
+				for _, seg := range s.segments {
+					s.upload(seg)
+				}
+				return
+			}
+			s.add(msg)
+		case <-ticker.C:
+			for _, seg := range s.segments {
+				if time.Since(seg.opened) >= s.interval {
+					s.upload(seg)
+				}
+			}
+		}
+	}
+}
+
+// add writes msg to its hour's segment, first uploading the segments of
+// earlier hours if it starts a new one
+func (s *s3Sink) add(msg *jetstream.Message) {
+	hour := time.UnixMicro(msg.TimeUs).UTC().Truncate(time.Hour)
+	if hour.After(s.newest) {
+		s.newest = hour
+		for h, seg := range s.segments {
+			if h.Before(hour) {
+				s.upload(seg)
+			}
+		}
+	}
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		s.fail("marshal", err, 1)
+		return
+	}
+	seg, err := s.segment(hour)
+	if err != nil {
+		s.fail("compress", err, 1)
+		return
+	}
+	if _, err := seg.w.Write(append(line, '\n')); err != nil {
+		s.fail("compress", err, 1)
+		return
+	}
+	if seg.events == 0 {
+		seg.firstUs = msg.TimeUs
+	}
+	seg.events++
+	seg.lastUs = max(seg.lastUs, msg.TimeUs)
+	if seg.buf.Len() >= s.segmentSize {
+		s.upload(seg)
+	}
+}
+
+// segment returns hour's open segment, starting one if there is none
+func (s *s3Sink) segment(hour time.Time) (*s3Segment, error) {
+	if seg := s.segments[hour]; seg != nil {
+		return seg, nil
+	}
+	seg := &s3Segment{hour: hour, opened: time.Now()}
+	var err error
+	switch s.compression {
+	case "zstd":
+		seg.w, err = zstd.NewWriter(&seg.buf)
+	case "gzip":
+		seg.w = gzip.NewWriter(&seg.buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.segments[hour] = seg
+	return seg, nil
+}
+
+// upload finishes seg and puts it in the bucket, retrying with backoff
+func (s *s3Sink) upload(seg *s3Segment) {
+	delete(s.segments, seg.hour)
+	if err := seg.w.Close(); err != nil {
+		s.fail("compress", err, seg.events)
+		return
+	}
+
+	ext := ".ndjson.zst"
+	if s.compression == "gzip" {
+		ext = ".ndjson.gz"
+	}
+	name := fmt.Sprintf("%s%s/%d-%d%s", s.prefix, seg.hour.Format("2006/01/02/15"), seg.firstUs, seg.lastUs, ext)
+	data := seg.buf.Bytes()
+	if !s.breaker.allow(time.Now()) {
+		s.breaker.drop(seg.events)
+		s.fail("circuit_open", nil, seg.events)
+		return
+	}
+	span := tracing.startSink("s3", "upload", seg.events)
+	defer span.End()
+
+	delay := s3RetryDelay
+	var err error
+	for attempt := 1; attempt <= s3UploadAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), s3UploadTimeout)
+		_, err = s.client.PutObject(ctx, s.bucket, name, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+			ContentType: "application/x-ndjson",
+		})
+		cancel()
+		if err == nil {
+			s.breaker.done(nil, time.Now())
+			log.Debug().Str("object", name).Int("events", seg.events).Int("bytes", len(data)).Msg("s3 segment uploaded")
+			return
+		}
+		span.AddEvent("upload failed", trace.WithAttributes(attribute.Int("attempt", attempt), attribute.String("error", err.Error())))
+		if attempt < s3UploadAttempts {
+			log.Warn().Err(err).Str("object", name).Int("attempt", attempt).Dur("retry_in", delay).Msg("s3 segment upload failed, retrying")
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	s.breaker.done(err, time.Now())
+	recordSinkError(span, "upload", err, seg.events)
+	s.fail("upload", err, seg.events)
+}
+
+// close uploads what is queued and the open segments
+func (s *s3Sink) close() {
+	close(s.queue)
+	<-s.stopped
+}
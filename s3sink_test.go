@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/klauspost/compress/zstd"
+)
+
+// s3Server is a bucket that keeps the objects put in it, answering the
+// first failures puts with a 503
+type s3Server struct {
+	failures int
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err == nil && strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		data, err = unchunk(data)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if s.objects == nil {
+		s.objects = map[string][]byte{}
+	}
+	s.objects[r.URL.Path] = data
+	w.Header().Set("ETag", `"etag"`)
+}
+
+// unchunk decodes an aws-chunked body, as minio sends without TLS, into
+// its payload
+func unchunk(body []byte) ([]byte, error) {
+	var data []byte
+	for {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size, _, _ := strings.Cut(string(header), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return data, nil
+		}
+		if int64(len(rest)) < n+2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		data = append(data, rest[:n]...)
+		body = rest[n+2:]
+	}
+}
+
+// names returns the objects' paths, sorted
+func (s *s3Server) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// atTime returns the event of frame at timeUs
+func atTime(t *testing.T, frame string, timeUs int64) *jetstream.Message {
+	msg := parseFrame(t, frame)
+	msg.TimeUs = timeUs
+	return msg
+}
+
+func TestS3Sink(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	const hour = int64(time.Hour / time.Microsecond)
+	// 2024-09-09T19:46:02Z
+	const start = int64(1725911162000010)
+	tests := []struct {
+		name        string
+		compression string
+		segmentSize int
+		failures    int
+		msgs        func(t *testing.T) []*jetstream.Message
+		// objects maps each object put to the DIDs of its events
+		objects map[string][]string
+	}{
+		{
+			name: "one segment", compression: "zstd", segmentSize: 1 << 20,
+			msgs: func(t *testing.T) []*jetstream.Message {
+				return []*jetstream.Message{parseFrame(t, postFrame), parseFrame(t, likeFrame)}
+			},
+			objects: map[string][]string{
+				"/bucket/archive/2024/09/09/19/1725911162000010-1725911162000020.ndjson.zst": {"did:plc:alice", "did:plc:bob"},
+			},
+		},
+		{
+			name: "gzip", compression: "gzip", segmentSize: 1 << 20,
+			msgs: func(t *testing.T) []*jetstream.Message {
+				return []*jetstream.Message{parseFrame(t, postFrame)}
+			},
+			objects: map[string][]string{
+				"/bucket/archive/2024/09/09/19/1725911162000010-1725911162000010.ndjson.gz": {"did:plc:alice"},
+			},
+		},
+		{
+			name: "split by hour", compression: "zstd", segmentSize: 1 << 20,
+			msgs: func(t *testing.T) []*jetstream.Message {
+				return []*jetstream.Message{atTime(t, postFrame, start), atTime(t, likeFrame, start+hour)}
+			},
+			objects: map[string][]string{
+				"/bucket/archive/2024/09/09/19/1725911162000010-1725911162000010.ndjson.zst": {"did:plc:alice"},
+				"/bucket/archive/2024/09/09/20/1725914762000010-1725914762000010.ndjson.zst": {"did:plc:bob"},
+			},
+		},
+		{
+			name: "split by size", compression: "gzip", segmentSize: 1,
+			msgs: func(t *testing.T) []*jetstream.Message {
+				return []*jetstream.Message{parseFrame(t, postFrame), parseFrame(t, likeFrame)}
+			},
+			objects: map[string][]string{
+				"/bucket/archive/2024/09/09/19/1725911162000010-1725911162000010.ndjson.gz": {"did:plc:alice"},
+				"/bucket/archive/2024/09/09/19/1725911162000020-1725911162000020.ndjson.gz": {"did:plc:bob"},
+			},
+		},
+		{
+			name: "upload retried", compression: "zstd", segmentSize: 1 << 20, failures: 1,
+			msgs: func(t *testing.T) []*jetstream.Message {
+				return []*jetstream.Message{parseFrame(t, postFrame)}
+			},
+			objects: map[string][]string{
+				"/bucket/archive/2024/09/09/19/1725911162000010-1725911162000010.ndjson.zst": {"did:plc:alice"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateBreakers(t)
+			captureLog(t, &bytes.Buffer{})
+			server := &s3Server{failures: tt.failures}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+			s, err := newS3Sink(ts.URL, "us-east-1", "bucket", "archive/", tt.compression, tt.segmentSize, time.Hour, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range tt.msgs(t) {
+				s.publish(msg)
+			}
+			s.close()
+
+			var want []string
+			for name := range tt.objects {
+				want = append(want, name)
+			}
+			slices.Sort(want)
+			if got := server.names(); !slices.Equal(got, want) {
+				t.Fatalf("put objects %v, want %v", got, want)
+			}
+			for name, dids := range tt.objects {
+				var r io.Reader
+				if strings.HasSuffix(name, ".gz") {
+					r, err = gzip.NewReader(bytes.NewReader(server.objects[name]))
+				} else {
+					r, err = zstd.NewReader(bytes.NewReader(server.objects[name]))
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := ndjsonDIDs(t, string(data)); !slices.Equal(got, dids) {
+					t.Errorf("%s holds events from %v, want %v", name, got, dids)
+				}
+			}
+			if n := s.failed.Load(); n != 0 {
+				t.Fatalf("%d events failed", n)
+			}
+		})
+	}
+}
+
+func TestNewS3SinkRefusesUnknownCompression(t *testing.T) {
+	if _, err := newS3Sink("http://127.0.0.1:1", "us-east-1", "bucket", "", "lz4", 1, time.Hour, 10); err == nil {
+		t.Fatal("lz4 compression was accepted")
+	}
+}
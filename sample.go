@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sampler keeps 1 in N events for collections with a configured rate and
+// tracks how many were seen versus kept. N needn't be whole, as rates given
+// as percentages often aren't. With byDID set, which events are kept is
+// decided by hashing their DID rather than by counting, so the same
+// accounts are kept every time, and since the hash doesn't depend on the
+// collection, an account kept at one rate is kept for every collection
+// sampled at that rate or a lower N.
+type sampler struct {
+	mu    sync.Mutex
+	byDID bool
+	rates map[string]float64
+	seen  map[string]uint64
+	kept  map[string]uint64
+}
+
+var sampling = &sampler{
+	rates: map[string]float64{},
+	seen:  map[string]uint64{},
+	kept:  map[string]uint64{},
+}
+
+// parseSample parses collection=N pairs, logging 1 in N, or
+// collection=P% pairs, logging P percent
+func parseSample(value string) error {
+	rates, err := parseSampleRates(value)
+	if err != nil {
+		return err
+	}
+	sampling.rates = rates
+	return nil
+}
+
+// parseSampleRates parses -sample into each collection's N
+func parseSampleRates(value string) (map[string]float64, error) {
+	pairs, err := parseKeyValues(value)
+	if err != nil {
+		return nil, err
+	}
+	rates := map[string]float64{}
+	for collection, v := range pairs {
+		var n float64
+		if pct, ok := strings.CutSuffix(v, "%"); ok {
+			p, err := strconv.ParseFloat(pct, 64)
+			if err != nil || p <= 0 || p > 100 {
+				return nil, fmt.Errorf("invalid rate %q for %s, percentages must be above 0 and at most 100", v, collection)
+			}
+			n = 100 / p
+		} else {
+			u, err := strconv.ParseUint(v, 10, 64)
+			if err != nil || u == 0 {
+				return nil, fmt.Errorf("invalid rate %q for %s", v, collection)
+			}
+			n = float64(u)
+		}
+		rates[collection] = n
+	}
+	return rates, nil
+}
+
+// setRates replaces the rates and byDID, as a config reload does, keeping
+// the counts
+func (s *sampler) setRates(rates map[string]float64, byDID bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rates = rates
+	s.byDID = byDID
+}
+
+// keep reports whether an event for collection from did should be logged,
+// along with the collection's rate (0 when it isn't sampled)
+func (s *sampler) keep(collection, did string) (bool, float64) {
+	rate, ok := s.rates[collection]
+	if !ok {
+		return true, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.seen[collection]
+	s.seen[collection]++
+	var keep bool
+	if s.byDID {
+		h := fnv.New64a()
+		h.Write([]byte(did))
+		keep = float64(h.Sum64()>>11)/(1<<53) < 1/rate
+	} else {
+		// the 1st, N+1th, 2N+1th, ...
+		keep = i == 0 || uint64(float64(i)/rate) != uint64(float64(i-1)/rate)
+	}
+	if !keep {
+		return false, rate
+	}
+	s.kept[collection]++
+	return true, rate
+}
+
+// logSummary logs running seen, kept, and dropped counts for every sampled
+// collection
+func (s *sampler) logSummary() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for collection, rate := range s.rates {
+		log.Info().
+			Str("collection", collection).
+			Float64("rate", rate).
+			Uint64("seen", s.seen[collection]).
+			Uint64("kept", s.kept[collection]).
+			Uint64("dropped", s.seen[collection]-s.kept[collection]).
+			Msg("sampling_summary")
+	}
+}
+
+// logSamplingSummaries logs the sampling summary every interval, in
+// addition to the one logged on shutdown
+func logSamplingSummaries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sampling.logSummary()
+	}
+}
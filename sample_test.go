@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"testing"
+)
+
+// randomDIDs returns n did:plc DIDs with random identifiers, as real ones
+// have, the same ones every time
+func randomDIDs(n int) []string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	r := rand.New(rand.NewPCG(1, 2))
+	dids := make([]string, n)
+	for i := range dids {
+		id := make([]byte, 24)
+		for j := range id {
+			id[j] = alphabet[r.IntN(len(alphabet))]
+		}
+		dids[i] = "did:plc:" + string(id)
+	}
+	return dids
+}
+
+func TestParseSampleRates(t *testing.T) {
+	tests := []struct {
+		value string
+		want  map[string]float64
+		err   bool
+	}{
+		{"", map[string]float64{}, false},
+		{"app.bsky.feed.like=1000", map[string]float64{"app.bsky.feed.like": 1000}, false},
+		{"app.bsky.feed.like=1%, app.bsky.graph.follow=25%", map[string]float64{"app.bsky.feed.like": 100, "app.bsky.graph.follow": 4}, false},
+		{"app.bsky.feed.like=100%", map[string]float64{"app.bsky.feed.like": 1}, false},
+		{"app.bsky.feed.like=0", nil, true},
+		{"app.bsky.feed.like=-3", nil, true},
+		{"app.bsky.feed.like=0%", nil, true},
+		{"app.bsky.feed.like=150%", nil, true},
+		{"app.bsky.feed.like=lots", nil, true},
+		{"app.bsky.feed.like", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSampleRates(tt.value)
+			if (err != nil) != tt.err {
+				t.Fatalf("parseSampleRates(%q) error = %v, want error %v", tt.value, err, tt.err)
+			}
+			if !tt.err && !maps.Equal(got, tt.want) {
+				t.Fatalf("parseSampleRates(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSamplerKeep(t *testing.T) {
+	tests := []struct {
+		name  string
+		rates map[string]float64
+		byDID bool
+		// events of collection, from a DID of their own each
+		collection string
+		events     int
+		kept       int
+	}{
+		{"unsampled collection", map[string]float64{"app.bsky.feed.like": 10}, false, "app.bsky.feed.post", 100, 100},
+		{"1 in 10", map[string]float64{"app.bsky.feed.like": 10}, false, "app.bsky.feed.like", 100, 10},
+		{"1 in 10 rounds up", map[string]float64{"app.bsky.feed.like": 10}, false, "app.bsky.feed.like", 101, 11},
+		{"40%", map[string]float64{"app.bsky.feed.like": 2.5}, false, "app.bsky.feed.like", 100, 40},
+		{"everything", map[string]float64{"app.bsky.feed.like": 1}, true, "app.bsky.feed.like", 100, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &sampler{rates: tt.rates, byDID: tt.byDID, seen: map[string]uint64{}, kept: map[string]uint64{}}
+			kept := 0
+			for i := range tt.events {
+				if keep, _ := s.keep(tt.collection, fmt.Sprintf("did:plc:%d", i)); keep {
+					kept++
+				}
+			}
+			if kept != tt.kept {
+				t.Fatalf("kept %d of %d events, want %d", kept, tt.events, tt.kept)
+			}
+			if _, sampled := tt.rates[tt.collection]; sampled && (s.seen[tt.collection] != uint64(tt.events) || s.kept[tt.collection] != uint64(kept)) {
+				t.Fatalf("counted %d seen and %d kept, want %d and %d", s.seen[tt.collection], s.kept[tt.collection], tt.events, kept)
+			}
+		})
+	}
+}
+
+func TestSamplerByDIDKeepsAccounts(t *testing.T) {
+	s := &sampler{
+		rates: map[string]float64{"app.bsky.feed.like": 4, "app.bsky.feed.repost": 4, "app.bsky.graph.follow": 2},
+		byDID: true,
+		seen:  map[string]uint64{},
+		kept:  map[string]uint64{},
+	}
+	kept := 0
+	for _, did := range randomDIDs(1000) {
+		like, _ := s.keep("app.bsky.feed.like", did)
+		repost, _ := s.keep("app.bsky.feed.repost", did)
+		follow, _ := s.keep("app.bsky.graph.follow", did)
+		if again, _ := s.keep("app.bsky.feed.like", did); again != like {
+			t.Fatalf("%s was kept once and dropped once", did)
+		}
+		if like != repost {
+			t.Fatalf("%s is kept for likes but not reposts, at the same rate", did)
+		}
+		if like && !follow {
+			t.Fatalf("%s is kept at 1 in 4 but not 1 in 2", did)
+		}
+		if like {
+			kept++
+		}
+	}
+	// about a quarter
+	if kept < 200 || kept > 300 {
+		t.Fatalf("kept %d of 1000 accounts at 1 in 4", kept)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// searchIndex is the recent-post index, nil unless -search-addr is set
+var searchIndex *postIndex
+
+// indexedPost is a post held in the search index
+type indexedPost struct {
+	id        uint64
+	Did       string    `json:"did"`
+	Rkey      string    `json:"rkey"`
+	Text      string    `json:"text"`
+	IndexedAt time.Time `json:"indexed_at"`
+	terms     []string
+}
+
+// postIndex is a rolling inverted index over recent post text. Posts are
+// evicted oldest-first once they fall outside the window or the index is
+// over its size cap.
+type postIndex struct {
+	mu       sync.Mutex
+	window   time.Duration
+	maxPosts int
+	nextID   uint64
+	posts    []*indexedPost // oldest first
+	byID     map[uint64]*indexedPost
+	postings map[string][]uint64 // term -> post ids, oldest first
+}
+
+func newPostIndex(window time.Duration, maxPosts int) *postIndex {
+	return &postIndex{
+		window:   window,
+		maxPosts: maxPosts,
+		byID:     make(map[uint64]*indexedPost),
+		postings: make(map[string][]uint64),
+	}
+}
+
+// tokenize splits text into unique lowercased terms
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	seen := make(map[string]bool, len(fields))
+	terms := fields[:0]
+	for _, f := range fields {
+		if seen[f] {
+			continue
+		}
+		seen[f] = true
+		terms = append(terms, f)
+	}
+	return terms
+}
+
+func (idx *postIndex) add(did, rkey, text string) {
+	terms := tokenize(text)
+	if len(terms) == 0 {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	now := time.Now()
+	idx.nextID++
+	p := &indexedPost{
+		id:        idx.nextID,
+		Did:       did,
+		Rkey:      rkey,
+		Text:      text,
+		IndexedAt: now,
+		terms:     terms,
+	}
+	idx.posts = append(idx.posts, p)
+	idx.byID[p.id] = p
+	for _, t := range terms {
+		idx.postings[t] = append(idx.postings[t], p.id)
+	}
+
+	idx.evict(now)
+}
+
+// evict drops the oldest posts until the index is within its bounds. It
+// must be called with mu held.
+func (idx *postIndex) evict(now time.Time) {
+	cutoff := now.Add(-idx.window)
+	n := 0
+	for n < len(idx.posts) {
+		p := idx.posts[n]
+		if len(idx.posts)-n <= idx.maxPosts && p.IndexedAt.After(cutoff) {
+			break
+		}
+		delete(idx.byID, p.id)
+		for _, t := range p.terms {
+			// posts are evicted in insertion order, so the oldest id is
+			// always at the front of each posting list
+			ids := idx.postings[t]
+			if len(ids) > 0 && ids[0] == p.id {
+				ids = ids[1:]
+			}
+			if len(ids) == 0 {
+				delete(idx.postings, t)
+			} else {
+				idx.postings[t] = ids
+			}
+		}
+		idx.posts[n] = nil
+		n++
+	}
+	if n > 0 {
+		idx.posts = idx.posts[n:]
+	}
+}
+
+// search returns up to limit posts containing every term in query, newest
+// first
+func (idx *postIndex) search(query string, limit int) []*indexedPost {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.evict(time.Now())
+
+	// start from the rarest term to keep the intersection small
+	shortest := terms[0]
+	for _, t := range terms[1:] {
+		if len(idx.postings[t]) < len(idx.postings[shortest]) {
+			shortest = t
+		}
+	}
+
+	ids := idx.postings[shortest]
+	results := []*indexedPost{}
+	for i := len(ids) - 1; i >= 0 && len(results) < limit; i-- {
+		p := idx.byID[ids[i]]
+		if p != nil && hasAllTerms(p, terms) {
+			results = append(results, p)
+		}
+	}
+	return results
+}
+
+func hasAllTerms(p *indexedPost, terms []string) bool {
+	for _, want := range terms {
+		found := false
+		for _, t := range p.terms {
+			if t == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *postIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		http.Error(w, "missing q parameter", http.StatusBadRequest)
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(idx.search(q, limit))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPostIndexSearch(t *testing.T) {
+	idx := newPostIndex(time.Hour, 3)
+	idx.add("did:plc:a", "1", "Hello golang world")
+	idx.add("did:plc:b", "2", "golang, again!")
+	idx.add("did:plc:c", "3", "nothing to see")
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"golang", []string{"2", "1"}},
+		{"GOLANG hello", []string{"1"}},
+		{"rust", nil},
+		{"!!", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var got []string
+			for _, p := range idx.search(tt.query, 10) {
+				got = append(got, p.Rkey)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("search(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+
+	// over the size cap, the oldest post goes first
+	idx.add("did:plc:d", "4", "golang four")
+	var got []string
+	for _, p := range idx.search("golang", 10) {
+		got = append(got, p.Rkey)
+	}
+	if !slices.Equal(got, []string{"4", "2"}) {
+		t.Errorf("after eviction, search = %v, want [4 2]", got)
+	}
+}
+
+func TestSearchIndexesPostsThatAreNotLogged(t *testing.T) {
+	post := func() { handleMessage(commitMessage("app.bsky.feed.post", `{"text": "hello golang"}`)) }
+	tests := []struct {
+		name  string
+		setup func(t *testing.T)
+	}{
+		{"logged", func(t *testing.T) {}},
+		{"sink-only", func(t *testing.T) {
+			saved := *sinkOnlyFlag
+			t.Cleanup(func() { *sinkOnlyFlag = saved })
+			*sinkOnlyFlag = true
+		}},
+		{"filtered by -match", func(t *testing.T) {
+			saved := matchTerms
+			t.Cleanup(func() { matchTerms = saved })
+			matchTerms = []string{"rust"}
+		}},
+		{"throttled", func(t *testing.T) {
+			saved := throttle
+			t.Cleanup(func() { throttle = saved })
+			throttle = newDIDThrottle(1, 1, 10)
+			throttle.allow("did:plc:abc", time.Now())
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			captureLog(t, &buf)
+			saved := searchIndex
+			t.Cleanup(func() { searchIndex = saved })
+			searchIndex = newPostIndex(time.Hour, 10)
+			tt.setup(t)
+
+			post()
+			if got := searchIndex.search("golang", 10); len(got) != 1 || got[0].Did != "did:plc:abc" {
+				t.Errorf("search found %v, want the post", got)
+			}
+		})
+	}
+}
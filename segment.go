@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+// segmentFlushInterval is how often a segment's compressor is flushed to
+// the file while it is being written, bounding what a crash can lose
+const segmentFlushInterval = time.Second
+
+// logSegments is the -log-file output, nil unless -log-file-compression
+// is set
+var logSegments *segmentWriter
+
+// compressor is the part of the zstd and gzip writers segments use
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// segmentWriter writes a file as compressed segments, rotating by size
+// like lumberjack does for uncompressed files. The segment being written
+// has a .partial suffix and only gets its final name, path with the
+// time it was started and the compression's extension, once its
+// compressed stream has been finished and synced, so every file without
+// the suffix is complete. A .partial file left by a crash, or by a segment
+// that failed to finish, is salvaged on the next start or before the next
+// segment is opened: its complete lines are rewritten as a finished
+// segment.
+type segmentWriter struct {
+	path        string
+	compression string
+	level       int
+	// maxSize is in compressed bytes, 0 for no limit
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+
+	mu      sync.Mutex
+	file    *os.File
+	enc     compressor
+	size    int64
+	started time.Time
+	// dirty is set when there are writes the compressor hasn't flushed
+	dirty bool
+
+	pruning sync.Mutex
+}
+
+// compressionExt is the file extension of each compression
+var compressionExt = map[string]string{"zstd": ".zst", "gzip": ".gz"}
+
+// newSegmentWriter writes compressed segments of path. maxSize is in
+// megabytes; maxBackups and maxAge limit the finished segments kept, 0
+// keeping them all. level is the compression's own level, 0 for its
+// default. The first segment is opened on the first write.
+func newSegmentWriter(path, compression string, level, maxSize, maxBackups int, maxAge time.Duration) (*segmentWriter, error) {
+	if _, ok := compressionExt[compression]; !ok {
+		return nil, fmt.Errorf("unknown compression %q, expected zstd or gzip", compression)
+	}
+	w := &segmentWriter{
+		path:        path,
+		compression: compression,
+		level:       level,
+		maxSize:     int64(maxSize) << 20,
+		maxBackups:  maxBackups,
+		maxAge:      maxAge,
+	}
+	// checks the level before anything is written
+	if _, err := w.newCompressor(io.Discard); err != nil {
+		return nil, err
+	}
+	segment, lines, err := w.salvage()
+	if err != nil {
+		return nil, fmt.Errorf("salvaging %s: %v", w.partialPath(), err)
+	}
+	logSalvaged(segment, lines)
+	go w.flush()
+	return w, nil
+}
+
+// flush flushes the compressor every segmentFlushInterval while there are
+// unflushed writes, so they reach the file even when writes stop
+func (w *segmentWriter) flush() {
+	ticker := time.NewTicker(segmentFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var err error
+		w.mu.Lock()
+		if w.file != nil && w.dirty {
+			w.dirty = false
+			err = w.enc.Flush()
+		}
+		w.mu.Unlock()
+		// logged without the lock, since the log may be this file
+		if err != nil {
+			log.Error().Err(err).Str("file", w.partialPath()).Msg("failed to flush segment")
+		}
+	}
+}
+
+func (w *segmentWriter) newCompressor(out io.Writer) (compressor, error) {
+	if w.compression == "gzip" {
+		level := w.level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(out, level)
+	}
+	level := zstd.SpeedDefault
+	if w.level != 0 {
+		if w.level < 1 || w.level > 22 {
+			return nil, fmt.Errorf("invalid zstd level %d, expected 1 to 22", w.level)
+		}
+		level = zstd.EncoderLevelFromZstd(w.level)
+	}
+	return zstd.NewWriter(out, zstd.WithEncoderLevel(level))
+}
+
+// partialPath is where the segment being written is
+func (w *segmentWriter) partialPath() string {
+	return w.path + compressionExt[w.compression] + ".partial"
+}
+
+// segmentPath is the final name of a segment started at started, with the
+// time before path's extension as lumberjack names its backups
+func (w *segmentWriter) segmentPath(started time.Time) string {
+	ext := filepath.Ext(w.path)
+	return strings.TrimSuffix(w.path, ext) + "-" + started.UTC().Format("2006-01-02T15-04-05.000") + ext + compressionExt[w.compression]
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	segment, lines, n, err := w.write(p)
+	w.mu.Unlock()
+	// after unlocking, since the log may be this file
+	logSalvaged(segment, lines)
+	return n, err
+}
+
+// write is Write with the lock held, returning the segment open salvaged,
+// if any
+func (w *segmentWriter) write(p []byte) (segment string, lines, n int, err error) {
+	if w.file != nil && w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.finish(); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	if w.file == nil {
+		if segment, lines, err = w.open(); err != nil {
+			return segment, lines, 0, err
+		}
+	}
+	w.dirty = true
+	n, err = w.enc.Write(p)
+	return segment, lines, n, err
+}
+
+// Rotate finishes the segment being written, if anything has been written
+// to it; the next write starts another
+func (w *segmentWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.finish()
+}
+
+// Close finishes the segment being written
+func (w *segmentWriter) Close() error {
+	return w.Rotate()
+}
+
+// open starts a segment, returning the segment it salvaged first, if any
+func (w *segmentWriter) open() (string, int, error) {
+	// a segment that failed to finish is still there, and truncating it
+	// would lose it
+	segment, lines, err := w.salvage()
+	if err != nil {
+		return "", 0, fmt.Errorf("salvaging %s: %v", w.partialPath(), err)
+	}
+	f, err := os.OpenFile(w.partialPath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return segment, lines, err
+	}
+	enc, err := w.newCompressor(&segmentCounter{f, &w.size})
+	if err != nil {
+		f.Close()
+		return segment, lines, err
+	}
+	w.file, w.enc, w.size, w.started = f, enc, 0, time.Now()
+	return segment, lines, nil
+}
+
+// finish completes the compressed stream, syncs it, and moves it to its
+// final name
+func (w *segmentWriter) finish() error {
+	if w.file == nil {
+		return nil
+	}
+	f := w.file
+	w.file = nil
+	err := w.enc.Close()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// left as .partial, for the next segment or start to salvage
+		return err
+	}
+	if err := os.Rename(f.Name(), w.segmentPath(w.started)); err != nil {
+		return err
+	}
+	// in the background, since it logs and the log may be this file
+	go w.prune()
+	return nil
+}
+
+// prune removes the oldest finished segments beyond maxBackups, and those
+// older than maxAge
+func (w *segmentWriter) prune() {
+	w.pruning.Lock()
+	defer w.pruning.Unlock()
+	if w.maxBackups <= 0 && w.maxAge <= 0 {
+		return
+	}
+	ext := filepath.Ext(w.path)
+	pattern := strings.TrimSuffix(w.path, ext) + "-*" + ext + compressionExt[w.compression]
+	segments, err := filepath.Glob(pattern)
+	if err != nil {
+		return
+	}
+	// the timestamps in their names sort by time
+	slices.Sort(segments)
+	for i, segment := range segments {
+		remove := w.maxBackups > 0 && i < len(segments)-w.maxBackups
+		if !remove && w.maxAge > 0 {
+			info, err := os.Stat(segment)
+			remove = err == nil && time.Since(info.ModTime()) > w.maxAge
+		}
+		if remove {
+			if err := os.Remove(segment); err != nil {
+				log.Error().Err(err).Str("file", segment).Msg("failed to remove old segment")
+			}
+		}
+	}
+}
+
+// salvage rewrites the complete lines of a .partial segment, left by a
+// crash or a segment that failed to finish, as a finished segment, then
+// removes it, returning the segment and how many lines it holds. A
+// partial segment with no complete line is just removed. It doesn't log,
+// since it runs with the writer locked and the log may be this file.
+func (w *segmentWriter) salvage() (string, int, error) {
+	partial, err := os.Open(w.partialPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	defer partial.Close()
+	info, err := partial.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".salvage-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	enc, err := w.newCompressor(tmp)
+	if err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+	lines := 0
+	if r, err := decompressed(partial); err == nil {
+		// the stream ends in a truncated block, so read up to the error
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+			if _, err := enc.Write(line); err != nil {
+				tmp.Close()
+				return "", 0, err
+			}
+			lines++
+		}
+	}
+	err = enc.Close()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	segment := ""
+	if lines > 0 {
+		segment = w.segmentPath(info.ModTime())
+		if err := os.Rename(tmp.Name(), segment); err != nil {
+			return "", 0, err
+		}
+	}
+	return segment, lines, os.Remove(partial.Name())
+}
+
+// logSalvaged logs a segment salvage rewrote, if it rewrote one
+func logSalvaged(segment string, lines int) {
+	if lines > 0 {
+		log.Warn().Str("file", segment).Int("lines", lines).Msg("salvaged a segment that was left unfinished")
+	}
+}
+
+// segmentCounter counts the compressed bytes written to a segment
+type segmentCounter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *segmentCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
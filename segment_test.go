@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// segmentLines reads the lines of every finished segment of path, oldest
+// first
+func segmentLines(t *testing.T, w *segmentWriter) []string {
+	t.Helper()
+	ext := filepath.Ext(w.path)
+	segments, err := filepath.Glob(w.path[:len(w.path)-len(ext)] + "-*" + ext + compressionExt[w.compression])
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(segments)
+	var lines []string
+	for _, segment := range segments {
+		f, err := os.Open(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := decompressed(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatalf("%s: %v", segment, err)
+		}
+		f.Close()
+	}
+	return lines
+}
+
+func writeLines(t *testing.T, w *segmentWriter, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if _, err := w.Write([]byte(strconv.Itoa(i) + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func wantLines(from, to int) []string {
+	var lines []string
+	for i := from; i < to; i++ {
+		lines = append(lines, strconv.Itoa(i))
+	}
+	return lines
+}
+
+func TestSegmentWriter(t *testing.T) {
+	for _, compression := range []string{"zstd", "gzip"} {
+		t.Run(compression, func(t *testing.T) {
+			w, err := newSegmentWriter(filepath.Join(t.TempDir(), "events.ndjson"), compression, 0, 0, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeLines(t, w, 0, 100)
+			if err := w.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+			// segments are named by the millisecond they started
+			time.Sleep(2 * time.Millisecond)
+			writeLines(t, w, 100, 200)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(w.partialPath()); !os.IsNotExist(err) {
+				t.Errorf("%s is still there after closing: %v", w.partialPath(), err)
+			}
+			if got := segmentLines(t, w); !slices.Equal(got, wantLines(0, 200)) {
+				t.Errorf("segments hold %d lines, want 200", len(got))
+			}
+		})
+	}
+}
+
+func TestSegmentWriterInvalid(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name        string
+		compression string
+		level       int
+	}{
+		{"unknown compression", "brotli", 0},
+		{"zstd level too high", "zstd", 23},
+		{"gzip level too high", "gzip", 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newSegmentWriter(filepath.Join(dir, "events.ndjson"), tt.compression, tt.level, 0, 0, 0); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestSegmentWriterSalvagesOnStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	w, err := newSegmentWriter(path, "zstd", 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, w, 0, 50)
+	// a crash: the stream is flushed but never finished
+	w.mu.Lock()
+	if err := w.enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	w.file.Close()
+	w.file = nil
+	w.mu.Unlock()
+
+	w, err = newSegmentWriter(path, "zstd", 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(w.partialPath()); !os.IsNotExist(err) {
+		t.Errorf("%s wasn't salvaged: %v", w.partialPath(), err)
+	}
+	if got := segmentLines(t, w); !slices.Equal(got, wantLines(0, 50)) {
+		t.Errorf("salvaged %d lines, want 50", len(got))
+	}
+}
+
+func TestSegmentWriterKeepsSegmentThatFailedToFinish(t *testing.T) {
+	w, err := newSegmentWriter(filepath.Join(t.TempDir(), "events.ndjson"), "zstd", 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, w, 0, 50)
+	// a non-empty directory where the segment would be renamed to
+	blocked := w.segmentPath(w.started)
+	if err := os.MkdirAll(filepath.Join(blocked, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Rotate(); err == nil {
+		t.Fatal("finishing into a directory succeeded")
+	}
+	if err := os.RemoveAll(blocked); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// the next segment mustn't truncate the one that failed
+	writeLines(t, w, 50, 100)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := segmentLines(t, w); !slices.Equal(got, wantLines(0, 100)) {
+		t.Errorf("segments hold %v, want lines 0 to 99", got)
+	}
+}
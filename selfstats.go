@@ -0,0 +1,38 @@
+package main
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// logSelfStats logs the process's memory and goroutine usage every interval
+// so leaks show up during long runs
+func logSelfStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastNumGC uint32
+	for range ticker.C {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+
+		// most recent pause, if a GC ran since the last report
+		var lastPause time.Duration
+		if m.NumGC > lastNumGC {
+			lastPause = time.Duration(m.PauseNs[(m.NumGC+255)%256])
+		}
+		lastNumGC = m.NumGC
+
+		log.Info().
+			Uint64("heap_inuse", m.HeapInuse).
+			Uint64("heap_alloc", m.HeapAlloc).
+			Uint64("sys", m.Sys).
+			Int("goroutines", runtime.NumGoroutine()).
+			Uint32("num_gc", m.NumGC).
+			Dur("gc_pause_last", lastPause).
+			Dur("gc_pause_total", time.Duration(m.PauseTotalNs)).
+			Msg("self_stats")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	knownMessageFields = map[string]bool{
+		"did": true, "time_us": true, "kind": true,
+		"commit": true, "identity": true, "account": true,
+	}
+	knownCommitFields = map[string]bool{
+		"rev": true, "operation": true, "collection": true,
+		"rkey": true, "record": true, "cid": true,
+	}
+	knownKinds = map[string]bool{
+		"commit": true, "identity": true, "account": true,
+	}
+)
+
+// shapeChecker inspects the first messages of a run for fields and kinds
+// this logger doesn't know about, so an upstream Jetstream change shows up
+// as a warning instead of silently missing data
+type shapeChecker struct {
+	mu        sync.Mutex
+	remaining int
+	warned    map[string]bool
+}
+
+var shapes = &shapeChecker{warned: map[string]bool{}}
+
+// check compares the raw message against the expected structure. It is a
+// no-op once the sample has been used up.
+func (s *shapeChecker) check(raw []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.remaining <= 0 {
+		return
+	}
+	s.remaining--
+
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &top); err != nil {
+		return
+	}
+	for field := range top {
+		if !knownMessageFields[field] {
+			s.warn("message field "+field, "unexpected top-level field in jetstream message, it will not be logged")
+		}
+	}
+
+	var kind string
+	if err := json.Unmarshal(top["kind"], &kind); err == nil && !knownKinds[kind] {
+		s.warn("kind "+kind, "unexpected message kind, events of this kind will not be logged")
+	}
+
+	if commit, ok := top["commit"]; ok {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(commit, &fields); err != nil {
+			s.warn("commit shape", "commit is not an object, commit events may not be parsed")
+			return
+		}
+		for field := range fields {
+			if !knownCommitFields[field] {
+				s.warn("commit field "+field, "unexpected commit field, it will not be logged")
+			}
+		}
+	}
+}
+
+// unknownKind reports a message kind the handler has no case for. Unlike
+// check it applies for the whole run, since dropping a kind loses data.
+func (s *shapeChecker) unknownKind(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.warn("kind "+kind, "unexpected message kind, events of this kind will not be logged")
+}
+
+// warn logs msg once per key. It must be called with mu held.
+func (s *shapeChecker) warn(key, msg string) {
+	if s.warned[key] {
+		return
+	}
+	s.warned[key] = true
+	log.Warn().
+		Str("shape", key).
+		Str("hint", "jetstream may have changed its message format, check for a newer version of this logger").
+		Msg(msg)
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// exportSignal asks the logger to export tracked state without stopping
+var exportSignal os.Signal = syscall.SIGUSR1
+
+// reloadSignal asks the logger to reload its -config file
+var reloadSignal os.Signal = syscall.SIGHUP
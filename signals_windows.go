@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// exportSignal is nil on Windows, which has no SIGUSR1; tracked state is only
+// exported on shutdown
+var exportSignal os.Signal
+
+// reloadSignal is nil on Windows, which has no SIGHUP; -config-watch is the
+// only way to reload the -config file
+var reloadSignal os.Signal
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// signingKeyTTL is how long a resolved key is trusted. A commit that
+// doesn't verify against a cached key resolves it again anyway, so this
+// only bounds how long a revoked key would still be accepted.
+const signingKeyTTL = time.Hour
+
+type signingKeyEntry struct {
+	did       string
+	key       *jetstream.SigningKey
+	err       error
+	expiresAt time.Time
+}
+
+// signingKeyResolver resolves repos' signing keys from their DID documents
+// for -verify-commits, caching them. Unlike handleResolver it resolves
+// synchronously, since a commit can't be verified without its key, from
+// the read goroutine or the -workers. Failed resolutions are cached too,
+// so a missing document isn't fetched for every commit.
+type signingKeyResolver struct {
+	mu      sync.Mutex
+	max     int
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+
+	plcURL string
+	client *http.Client
+}
+
+func newSigningKeyResolver(plcURL string, max int) *signingKeyResolver {
+	return &signingKeyResolver{
+		max:     max,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		plcURL:  strings.TrimSuffix(plcURL, "/"),
+		client:  enrichClient,
+	}
+}
+
+// key is a jetstream.KeyResolver
+func (r *signingKeyResolver) key(did string, fresh bool) (*jetstream.SigningKey, error) {
+	r.mu.Lock()
+	if el, ok := r.entries[did]; ok && !fresh {
+		e := el.Value.(*signingKeyEntry)
+		if time.Now().Before(e.expiresAt) {
+			r.lru.MoveToFront(el)
+			r.mu.Unlock()
+			return e.key, e.err
+		}
+	}
+	r.mu.Unlock()
+
+	// not holding the lock, so workers resolve different repos at once
+	key, err := r.resolve(did)
+	expiresAt := time.Now().Add(signingKeyTTL)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if el, ok := r.entries[did]; ok {
+		e := el.Value.(*signingKeyEntry)
+		e.key, e.err, e.expiresAt = key, err, expiresAt
+		r.lru.MoveToFront(el)
+		return key, err
+	}
+	r.entries[did] = r.lru.PushFront(&signingKeyEntry{did: did, key: key, err: err, expiresAt: expiresAt})
+	if r.lru.Len() > r.max {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*signingKeyEntry).did)
+	}
+	return key, err
+}
+
+// resolve fetches the DID document for did and parses its #atproto
+// verification method
+func (r *signingKeyResolver) resolve(did string) (*jetstream.SigningKey, error) {
+	doc, err := fetchDIDDocument(r.client, r.plcURL, did)
+	if err != nil {
+		return nil, err
+	}
+	for _, method := range doc.VerificationMethod {
+		if method.ID == "#atproto" || method.ID == did+"#atproto" {
+			return jetstream.ParseSigningKey(method.PublicKeyMultibase)
+		}
+	}
+	return nil, errors.New("did document has no #atproto verification method")
+}
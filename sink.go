@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+// eventSink receives every decoded event that reaches handleMessage, for
+// re-publishing outside the log output. publish must not block.
+type eventSink interface {
+	publish(msg *jetstream.Message)
+	// close flushes anything queued and releases the sink
+	close()
+}
+
+// sinks are the configured event sinks, empty unless a sink flag is set
+var sinks []eventSink
+
+// committingSink is a sink that delivers at least once. Events it has
+// accepted but not had acknowledged hold the saved cursor back, so a
+// restart replays them instead of losing them.
+type committingSink interface {
+	eventSink
+	// oldestPending returns the time_us of the oldest event not yet
+	// acknowledged, or 0 if there is none
+	oldestPending() int64
+}
+
+const (
+	// events published before waiting for their acks, in JetStream mode
+	natsAckBatch = 256
+	// how long to wait for an ack, and for unacknowledged events on close
+	natsAckTimeout   = 5 * time.Second
+	natsCloseTimeout = 10 * time.Second
+)
+
+// natsConfig configures a natsSink
+type natsConfig struct {
+	url    string
+	prefix string
+	// subjects maps collections and event kinds to subject names under
+	// prefix, replacing the collection or kind
+	subjects map[string]string
+	// partitions, when above zero, adds a partition number to each
+	// subject, hashed from the DID or, with partitionBy "collection",
+	// from the collection
+	partitions  int
+	partitionBy string
+	// stream enables JetStream: events are published to this stream,
+	// created over <prefix>.> if missing, and each is acknowledged
+	stream    string
+	queueSize int
+}
+
+// natsSink publishes events to NATS, one subject per collection under a
+// prefix, e.g. jetstream.app.bsky.feed.post, with identity and account
+// events on jetstream.identity and jetstream.account. Events are queued so
+// a slow or disconnected server doesn't stall the read loop; when the queue
+// is full, -sink-overflow decides whether the newest or oldest event is
+// dropped and counted, or the read loop waits.
+//
+// With a JetStream stream, delivery is at least once instead: publish
+// waits for room in the queue, failed publishes are retried until
+// acknowledged, and events awaiting an ack hold back the saved cursor.
+// Each message carries a Nats-Msg-Id, so the stream discards replayed
+// duplicates within its duplicate window.
+type natsSink struct {
+	natsConfig
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	queue   chan *jetstream.Message
+	failed  atomic.Uint64
+	stopped chan struct{}
+	// giveUp is closed once close has waited natsCloseTimeout for acks
+	giveUp chan struct{}
+
+	mu sync.Mutex
+	// pending holds the time_us of accepted events not yet acknowledged,
+	// in the order they were accepted
+	pending []int64
+	// abandoned is set once an event has been given up on, after which
+	// pending is no longer trimmed. Only runJetStream uses it.
+	abandoned bool
+}
+
+func newNATSSink(config natsConfig) (*natsSink, error) {
+	conn, err := nats.Connect(config.url,
+		nats.Name("atproto-logger"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Warn().Err(err).Msg("disconnected from nats")
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Info().Str("url", c.ConnectedUrl()).Msg("reconnected to nats")
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s := &natsSink{
+		natsConfig: config,
+		conn:       conn,
+		queue:      make(chan *jetstream.Message, config.queueSize),
+		stopped:    make(chan struct{}),
+		giveUp:     make(chan struct{}),
+	}
+	if config.stream != "" {
+		if err := s.setupStream(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+// setupStream connects to JetStream and creates the stream if it doesn't
+// exist. An existing stream is used as configured.
+func (s *natsSink) setupStream() error {
+	js, err := s.conn.JetStream()
+	if err != nil {
+		return err
+	}
+	s.js = js
+	_, err = js.StreamInfo(s.stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{Name: s.stream, Subjects: []string{s.prefix + ".>"}})
+		if err == nil {
+			log.Info().Str("stream", s.stream).Str("subjects", s.prefix+".>").Msg("created nats stream")
+		}
+	}
+	return err
+}
+
+func (s *natsSink) subject(msg *jetstream.Message) string {
+	name := msg.Kind
+	if msg.Commit != nil {
+		name = msg.Commit.Collection
+	}
+	if mapped, ok := s.subjects[name]; ok {
+		name = mapped
+	}
+	subject := s.prefix + "." + name
+	if s.partitions > 0 {
+		key := msg.Did
+		if s.partitionBy == "collection" {
+			key = msg.Kind
+			if msg.Commit != nil {
+				key = msg.Commit.Collection
+			}
+		}
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		subject += "." + strconv.Itoa(int(h.Sum32()%uint32(s.partitions)))
+	}
+	return subject
+}
+
+func (s *natsSink) publish(msg *jetstream.Message) {
+	if s.js != nil {
+		s.mu.Lock()
+		s.pending = append(s.pending, msg.TimeUs)
+		s.mu.Unlock()
+		s.queue <- msg
+		return
+	}
+	for range enqueue(s.queue, msg) {
+		s.fail("queue_full", nil)
+	}
+}
+
+func (s *natsSink) oldestPending() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return 0
+	}
+	return s.pending[0]
+}
+
+// fail counts a lost event, logging the first and then every 1000th so a
+// dead server doesn't flood the output
+func (s *natsSink) fail(reason string, err error) {
+	drops.add("nats_" + reason)
+	sinkDrop("nats", reason, 1)
+	if n := s.failed.Add(1); n == 1 || n%1000 == 0 {
+		log.Warn().Err(err).Str("reason", reason).Uint64("failed", n).Msg("nats publish failed, dropping events")
+	}
+}
+
+func (s *natsSink) run() {
+	defer close(s.stopped)
+	if s.js != nil {
+		s.runJetStream()
+		return
+	}
+	for msg := range s.queue {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			s.fail("marshal", err)
+			continue
+		}
+		if err := s.conn.Publish(s.subject(msg), data); err != nil {
+			s.fail("publish", err)
+		}
+	}
+}
+
+// runJetStream publishes queued events in batches, waits for each batch to
+// be acknowledged, and retries what wasn't before moving on
+func (s *natsSink) runJetStream() {
+	batch := make([]*nats.Msg, 0, natsAckBatch)
+	futures := make([]nats.PubAckFuture, 0, natsAckBatch)
+	for msg := range s.queue {
+		batch, futures = batch[:0], futures[:0]
+		taken := 0
+		for {
+			taken++
+			if m := s.natsMsg(msg); m != nil {
+				f, err := s.js.PublishMsgAsync(m)
+				if err != nil {
+					f = nil
+				}
+				batch, futures = append(batch, m), append(futures, f)
+			}
+			if taken == natsAckBatch {
+				break
+			}
+			var ok bool
+			select {
+			case msg, ok = <-s.queue:
+			default:
+			}
+			if !ok {
+				break
+			}
+		}
+
+		delivered := true
+		ctx, cancel := context.WithTimeout(context.Background(), natsAckTimeout)
+		for i, m := range batch {
+			if !s.acknowledged(ctx, futures[i]) && !s.republish(m) {
+				delivered = false
+			}
+		}
+		cancel()
+		if delivered && !s.abandoned {
+			s.mu.Lock()
+			s.pending = s.pending[taken:]
+			s.mu.Unlock()
+		} else {
+			// keep the cursor behind the first event given up on
+			s.abandoned = true
+		}
+	}
+}
+
+// natsMsg builds the message for msg, or returns nil if it can't be
+// encoded, which retrying wouldn't fix
+func (s *natsSink) natsMsg(msg *jetstream.Message) *nats.Msg {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		s.fail("marshal", err)
+		return nil
+	}
+	m := nats.NewMsg(s.subject(msg))
+	m.Data = data
+	m.Header.Set(nats.MsgIdHdr, eventKey(msg))
+	return m
+}
+
+// acknowledged waits for f's ack until ctx is done, or close gives up
+func (s *natsSink) acknowledged(ctx context.Context, f nats.PubAckFuture) bool {
+	if f == nil {
+		return false
+	}
+	select {
+	case <-f.Ok():
+		return true
+	case <-f.Err():
+	case <-ctx.Done():
+	case <-s.giveUp:
+	}
+	return false
+}
+
+// republish retries m until it is acknowledged, backing off while the
+// server is unavailable. Once close has given up waiting, the event is
+// dropped and republish returns false; the saved cursor stays behind it,
+// so the next run replays it.
+func (s *natsSink) republish(m *nats.Msg) bool {
+	wait := time.Second
+	for {
+		select {
+		case <-s.giveUp:
+			s.fail("unacknowledged", nil)
+			return false
+		default:
+		}
+		_, err := s.js.PublishMsg(m, nats.AckWait(natsAckTimeout))
+		if err == nil {
+			return true
+		}
+		log.Warn().Err(err).Str("subject", m.Subject).Dur("retry_in", wait).Msg("nats publish not acknowledged, retrying")
+		select {
+		case <-time.After(wait):
+		case <-s.giveUp:
+			s.fail("unacknowledged", err)
+			return false
+		}
+		wait = min(wait*2, 30*time.Second)
+	}
+}
+
+func (s *natsSink) close() {
+	close(s.queue)
+	if s.js != nil {
+		timer := time.AfterFunc(natsCloseTimeout, func() { close(s.giveUp) })
+		defer timer.Stop()
+	}
+	<-s.stopped
+	if err := s.conn.FlushTimeout(5 * time.Second); err != nil {
+		log.Error().Err(err).Msg("error flushing nats")
+	}
+	s.conn.Close()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// recordingSink is an eventSink that keeps what it's given
+type recordingSink struct {
+	mu        sync.Mutex
+	published []*jetstream.Message
+	closed    bool
+}
+
+func (s *recordingSink) publish(msg *jetstream.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = append(s.published, msg)
+}
+
+func (s *recordingSink) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+// useSink makes s the only sink for the rest of the test
+func useSink(t *testing.T, s eventSink) {
+	saved := sinks
+	t.Cleanup(func() { sinks = saved })
+	sinks = []eventSink{s}
+}
+
+func TestThrottleAppliesToSinks(t *testing.T) {
+	var buf bytes.Buffer
+	captureLog(t, &buf)
+	sink := &recordingSink{}
+	useSink(t, sink)
+	defer func(saved *didThrottle) { throttle = saved }(throttle)
+	throttle = newDIDThrottle(1, 2, 10)
+
+	for range 5 {
+		handleMessage(commitMessage("app.bsky.feed.like", `{"subject": {"uri": "at://did:plc:x/app.bsky.feed.post/1", "cid": "bafypost"}}`))
+	}
+	if len(sink.published) != 2 {
+		t.Errorf("sink got %d events, want the burst of 2", len(sink.published))
+	}
+	if lines := logLines(t, &buf); len(lines) != 2 {
+		t.Errorf("logged %d lines, want 2: %v", len(lines), lines)
+	}
+	if throttle.dropped != 3 {
+		t.Errorf("dropped = %d, want 3", throttle.dropped)
+	}
+}
+
+// natsPub is a message published to fakeNATS
+type natsPub struct {
+	subject string
+	data    []byte
+}
+
+// fakeNATS is a NATS server that speaks enough of the core protocol for a
+// client to connect and publish, sending what it receives on pubs
+func fakeNATS(t *testing.T) (url string, pubs chan natsPub) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	pubs = make(chan natsPub, 100)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, `INFO {"server_id":"fake","version":"2.10.0","proto":1,"max_payload":1048576,"headers":true}`+"\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			switch fields[0] {
+			case "PING":
+				io.WriteString(conn, "PONG\r\n")
+			case "PUB":
+				n, _ := strconv.Atoi(fields[len(fields)-1])
+				data := make([]byte, n+2)
+				if _, err := io.ReadFull(r, data); err != nil {
+					return
+				}
+				pubs <- natsPub{fields[1], data[:n]}
+			}
+		}
+	}()
+	return "nats://" + ln.Addr().String(), pubs
+}
+
+func TestNATSSinkSubject(t *testing.T) {
+	like := commitMessage("app.bsky.feed.like", `{}`)
+	identity := parseFrame(t, identityFrame)
+	tests := []struct {
+		name   string
+		config natsConfig
+		msg    *jetstream.Message
+		want   string
+	}{
+		{"collection", natsConfig{prefix: "jetstream"}, like, "jetstream.app.bsky.feed.like"},
+		{"event kind", natsConfig{prefix: "jetstream"}, identity, "jetstream.identity"},
+		{"mapped collection", natsConfig{prefix: "jetstream", subjects: map[string]string{"app.bsky.feed.like": "likes"}}, like, "jetstream.likes"},
+		{"mapped kind", natsConfig{prefix: "bsky", subjects: map[string]string{"identity": "ids"}}, identity, "bsky.ids"},
+		{"one partition", natsConfig{prefix: "jetstream", partitions: 1}, like, "jetstream.app.bsky.feed.like.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &natsSink{natsConfig: tt.config}
+			if got := s.subject(tt.msg); got != tt.want {
+				t.Fatalf("subject = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNATSSinkPartitions(t *testing.T) {
+	tests := []struct {
+		partitionBy string
+		// same is whether two DIDs' likes share a partition
+		same bool
+	}{
+		{"did", false},
+		{"collection", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.partitionBy, func(t *testing.T) {
+			s := &natsSink{natsConfig: natsConfig{prefix: "jetstream", partitions: 1 << 16, partitionBy: tt.partitionBy}}
+			first := commitMessage("app.bsky.feed.like", `{}`)
+			second := commitMessage("app.bsky.feed.like", `{}`)
+			second.Did = "did:plc:bob"
+			a, b := s.subject(first), s.subject(second)
+			if again := s.subject(first); again != a {
+				t.Fatalf("the same like went to %s, then %s", a, again)
+			}
+			if (a == b) != tt.same {
+				t.Fatalf("partitions %s and %s, want same = %v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestNATSSinkPublishes(t *testing.T) {
+	url, pubs := fakeNATS(t)
+	s, err := newNATSSink(natsConfig{url: url, prefix: "jetstream", queueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range []string{postFrame, likeFrame, identityFrame} {
+		s.publish(parseFrame(t, frame))
+	}
+	s.close()
+
+	want := []string{"jetstream.app.bsky.feed.post", "jetstream.app.bsky.feed.like", "jetstream.identity"}
+	for i, subject := range want {
+		pub := <-pubs
+		if pub.subject != subject {
+			t.Fatalf("message %d published to %s, want %s", i, pub.subject, subject)
+		}
+		var msg jetstream.Message
+		if err := json.Unmarshal(pub.data, &msg); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if msg.Kind == "" || msg.Did == "" {
+			t.Fatalf("message %d is %s", i, pub.data)
+		}
+	}
+	if n := s.failed.Load(); n != 0 {
+		t.Fatalf("%d events failed", n)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// spamRule is a -spam-threshold: more than limit events in window from one
+// DID, counting commits to the collections pattern matches, or every event
+// for "*"
+type spamRule struct {
+	spec    string
+	pattern string
+	limit   float64
+	window  time.Duration
+}
+
+// parseSpamRule parses collection=limit/window, e.g. app.bsky.feed.post=30/1m
+func parseSpamRule(s string) (spamRule, error) {
+	pattern, rate, ok := strings.Cut(s, "=")
+	if !ok || pattern == "" {
+		return spamRule{}, fmt.Errorf("%q: expected collection=limit/window, e.g. app.bsky.feed.post=30/1m", s)
+	}
+	limit, window, ok := strings.Cut(rate, "/")
+	if !ok {
+		return spamRule{}, fmt.Errorf("%q: expected a limit and window like 30/1m", s)
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		return spamRule{}, fmt.Errorf("%q: limit must be a positive number", s)
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return spamRule{}, fmt.Errorf("%q: window must be a positive duration like 1m", s)
+	}
+	return spamRule{spec: s, pattern: pattern, limit: float64(n), window: d}, nil
+}
+
+func (r spamRule) counts(msg *jetstream.Message) bool {
+	if r.pattern == "*" {
+		return true
+	}
+	return msg.Commit != nil && matchesCollection([]string{r.pattern}, msg.Commit.Collection)
+}
+
+// spamWindow counts one DID's events under one rule, as a sliding window
+// estimated from the current and previous fixed windows
+type spamWindow struct {
+	key         string
+	start       time.Time
+	current     float64
+	previous    float64
+	flaggedTill time.Time
+}
+
+// rate estimates the events in the window ending at now
+func (w *spamWindow) rate(now time.Time, window time.Duration) float64 {
+	elapsed := max(now.Sub(w.start), 0)
+	return w.previous*(1-float64(elapsed)/float64(window)) + w.current
+}
+
+// spamAction is what -spam-action does with events from a flagged DID
+type spamAction string
+
+const (
+	spamFlag     spamAction = "flag"
+	spamTag      spamAction = "tag"
+	spamSuppress spamAction = "suppress"
+)
+
+// spamDetector tracks per-DID event rates against the -spam-threshold
+// rules. A DID that exceeds one is flagged, with a spam_detected warning,
+// until a full window passes without it exceeding it again; while it is,
+// its events are tagged with spam=true in the log output, or suppressed
+// from the output and sinks alike, as -spam-action says. Windows follow
+// the events' time_us rather than the clock, so replays are judged as the
+// live stream was. They are kept in an LRU of at most max, like the
+// throttle's buckets. It is only called from the handling goroutine.
+type spamDetector struct {
+	rules   []spamRule
+	action  spamAction
+	max     int
+	lru     *list.List // front is most recently used
+	windows map[string]*list.Element
+
+	flagged    uint64
+	suppressed uint64
+}
+
+// spam is nil unless -spam-threshold is set
+var spam *spamDetector
+
+func newSpamDetector(specs []string, action string, max int) (*spamDetector, error) {
+	d := &spamDetector{action: spamAction(action), max: max, lru: list.New(), windows: map[string]*list.Element{}}
+	switch d.action {
+	case spamFlag, spamTag, spamSuppress:
+	default:
+		return nil, fmt.Errorf("unknown action %q, expected flag, tag, or suppress", action)
+	}
+	for _, s := range specs {
+		rule, err := parseSpamRule(s)
+		if err != nil {
+			return nil, err
+		}
+		d.rules = append(d.rules, rule)
+	}
+	return d, nil
+}
+
+// check counts msg and reports whether its DID is flagged
+func (d *spamDetector) check(msg *jetstream.Message, now time.Time) bool {
+	flagged := false
+	for i, rule := range d.rules {
+		if !rule.counts(msg) {
+			continue
+		}
+		w := d.window(strconv.Itoa(i)+" "+msg.Did, now)
+		if elapsed := now.Sub(w.start); elapsed >= rule.window {
+			w.previous = w.current
+			if elapsed >= 2*rule.window {
+				w.previous = 0
+			}
+			w.start, w.current = now, 0
+		}
+		w.current++
+		if rate := w.rate(now, rule.window); rate > rule.limit {
+			if !now.Before(w.flaggedTill) {
+				d.flagged++
+				log.Warn().
+					Str("did", msg.Did).
+					Str("rule", rule.spec).
+					Float64("rate", rate).
+					Str("action", string(d.action)).
+					Msg("spam_detected")
+			}
+			w.flaggedTill = now.Add(rule.window)
+		}
+		if now.Before(w.flaggedTill) {
+			flagged = true
+		}
+	}
+	if flagged && d.action == spamSuppress {
+		d.suppressed++
+	}
+	return flagged
+}
+
+// window returns key's window, starting one if it has none
+func (d *spamDetector) window(key string, now time.Time) *spamWindow {
+	if el, ok := d.windows[key]; ok {
+		d.lru.MoveToFront(el)
+		return el.Value.(*spamWindow)
+	}
+	w := &spamWindow{key: key, start: now}
+	d.windows[key] = d.lru.PushFront(w)
+	if d.lru.Len() > d.max {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.windows, oldest.Value.(*spamWindow).key)
+	}
+	return w
+}
+
+// logSummary logs how many times DIDs were flagged and how many events
+// were suppressed
+func (d *spamDetector) logSummary() {
+	log.Info().
+		Uint64("flagged", d.flagged).
+		Uint64("suppressed", d.suppressed).
+		Int("tracked", d.lru.Len()).
+		Msg("spam_summary")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// events written per transaction, and the longest an event waits
+	// for its transaction to commit
+	sqliteBatchSize     = 1000
+	sqliteBatchInterval = time.Second
+)
+
+var sqliteTypes = map[string]string{"text": "TEXT", "int": "INTEGER", "bool": "INTEGER", "json": "TEXT"}
+
+// sqliteSink archives events into a SQLite database with the archive
+// tables, writing each batch in one transaction
+type sqliteSink struct {
+	*batchQueue
+	db *sql.DB
+	// insert statements by table
+	inserts map[*archiveTable]string
+}
+
+func newSQLiteSink(path string, queueSize int) (*sqliteSink, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// one writer, and WAL so the archive can be queried while it's written
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{"PRAGMA journal_mode = WAL", "PRAGMA synchronous = NORMAL", "PRAGMA busy_timeout = 5000"} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	s := &sqliteSink{db: db, inserts: map[*archiveTable]string{}}
+	for _, t := range archiveTables {
+		if err := s.createTable(t); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating %s: %v", t.name, err)
+		}
+		verb := "INSERT"
+		if len(t.key) > 0 {
+			verb = "INSERT OR REPLACE"
+		}
+		s.inserts[t] = fmt.Sprintf("%s INTO %s (%s) VALUES (%s)", verb, t.name,
+			strings.Join(t.columnNames(), ", "), strings.TrimSuffix(strings.Repeat("?, ", len(t.columns)), ", "))
+	}
+	s.batchQueue = newBatchQueue("sqlite", queueSize, sqliteBatchSize, sqliteBatchInterval, 0, s.write)
+	return s, nil
+}
+
+func (s *sqliteSink) createTable(t *archiveTable) error {
+	defs := make([]string, 0, len(t.columns)+1)
+	for _, c := range t.columns {
+		def := c.name + " " + sqliteTypes[c.typ]
+		if t.notNull(c) {
+			def += " NOT NULL"
+		}
+		defs = append(defs, def)
+	}
+	if len(t.key) > 0 {
+		defs = append(defs, "PRIMARY KEY ("+strings.Join(t.key, ", ")+")")
+	}
+	if _, err := s.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", t.name, strings.Join(defs, ", "))); err != nil {
+		return err
+	}
+	if err := s.addMissingColumns(t); err != nil {
+		return err
+	}
+	for _, columns := range t.indexes {
+		stmt := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", t.indexName(columns), t.name, strings.Join(columns, ", "))
+		if _, err := s.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMissingColumns adds the columns t has gained since the database was
+// created. They are added as nullable, which SQLite requires, so older
+// rows read them as NULL.
+func (s *sqliteSink) addMissingColumns(t *archiveTable) error {
+	rows, err := s.db.Query("SELECT name FROM pragma_table_info(?)", t.name)
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range t.columns {
+		if existing[c.name] {
+			continue
+		}
+		if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", t.name, c.name, sqliteTypes[c.typ])); err != nil {
+			return err
+		}
+		log.Info().Str("table", t.name).Str("column", c.name).Msg("added sqlite column")
+	}
+	return nil
+}
+
+// write stores batch in one transaction. A record that can't be parsed
+// or inserted is counted as dropped without costing the rest of the
+// batch.
+func (s *sqliteSink) write(batch []*jetstream.Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, msg := range batch {
+		table, row, err := archiveRow(msg)
+		if err == nil && table != nil {
+			_, err = tx.Exec(s.inserts[table], row...)
+		}
+		if err != nil {
+			s.fail("insert", err, 1)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteSink) close() {
+	s.batchQueue.close()
+	if err := s.db.Close(); err != nil {
+		log.Error().Err(err).Msg("error closing sqlite database")
+	}
+}
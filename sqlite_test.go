@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// tableCount counts the rows of table
+func tableCount(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSQLiteSinkWrite(t *testing.T) {
+	isolateBreakers(t)
+	s, err := newSQLiteSink(filepath.Join(t.TempDir(), "archive.db"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	var batch []*jetstream.Message
+	// the second post replaces the first, as a replayed event would
+	for _, frame := range []string{postFrame, postFrame, likeFrame, badLikeFrame, deleteFrame, identityFrame} {
+		batch = append(batch, parseFrame(t, frame))
+	}
+	if err := s.write(batch); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		table string
+		rows  int
+	}{
+		{"posts", 1},
+		{"likes", 1},
+		{"reposts", 0},
+		{"deletes", 1},
+		{"identities", 1},
+	}
+	for _, tt := range tests {
+		if n := tableCount(t, s.db, tt.table); n != tt.rows {
+			t.Errorf("%s holds %d rows, want %d", tt.table, n, tt.rows)
+		}
+	}
+	if n := s.failed.Load(); n != 1 {
+		t.Errorf("%d events counted as failed, want the like that doesn't parse", n)
+	}
+
+	var text, langs string
+	if err := s.db.QueryRow("SELECT text, langs FROM posts WHERE did = ? AND rkey = ?", "did:plc:alice", "3kpost").Scan(&text, &langs); err != nil {
+		t.Fatal(err)
+	}
+	if text != "hello world" || langs != "en" {
+		t.Errorf("post archived with text %q and langs %q", text, langs)
+	}
+}
+
+func TestSQLiteSinkAddsMissingColumns(t *testing.T) {
+	isolateBreakers(t)
+	path := filepath.Join(t.TempDir(), "archive.db")
+	// a posts table from before embed_type and created_at
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("CREATE TABLE posts (did TEXT NOT NULL, rkey TEXT NOT NULL, time_us INTEGER NOT NULL, cid TEXT, text TEXT, langs TEXT, reply_root TEXT, reply_parent TEXT, PRIMARY KEY (did, rkey))")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newSQLiteSink(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.write([]*jetstream.Message{parseFrame(t, postFrame)}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := s.db.Query("SELECT name FROM pragma_table_info('posts')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		columns = append(columns, name)
+	}
+	if got := strings.Join(columns, ","); got != strings.Join(postsTable.columnNames(), ",") {
+		t.Fatalf("posts has columns %s, want %s", got, strings.Join(postsTable.columnNames(), ","))
+	}
+	if n := tableCount(t, s.db, "posts"); n != 1 {
+		t.Fatalf("posts holds %d rows, want 1", n)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// collectionCounter counts commits per collection between reports. It sees
+// every commit before any filtering, so the counts reflect the stream
+// itself rather than what was logged.
+type collectionCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+var collectionCounts = &collectionCounter{counts: map[string]uint64{}}
+
+func (c *collectionCounter) add(collection string) {
+	c.mu.Lock()
+	c.counts[collection]++
+	c.mu.Unlock()
+}
+
+// swap returns the counts since the last call and starts a new window
+func (c *collectionCounter) swap() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.counts
+	c.counts = make(map[string]uint64, len(counts))
+	return counts
+}
+
+// logCollectionStats logs per-collection commit counts every interval
+func logCollectionStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		counts := collectionCounts.swap()
+		collections := zerolog.Dict()
+		var total uint64
+		for collection, n := range counts {
+			collections.Uint64(collection, n)
+			total += n
+		}
+		log.Info().
+			Dur("interval", interval).
+			Uint64("total", total).
+			Dict("collections", collections).
+			Msg("collection_stats")
+	}
+}
+
+// eventCounter counts every event by kind, and commits by collection, for
+// the -summary-interval throughput line. Like collectionCounter it counts
+// before any filtering.
+type eventCounter struct {
+	mu          sync.Mutex
+	kinds       map[string]uint64
+	collections map[string]uint64
+}
+
+var eventCounts = &eventCounter{kinds: map[string]uint64{}, collections: map[string]uint64{}}
+
+func (c *eventCounter) add(msg *jetstream.Message) {
+	c.mu.Lock()
+	c.kinds[msg.Kind]++
+	if msg.Commit != nil {
+		c.collections[msg.Commit.Collection]++
+	}
+	c.mu.Unlock()
+}
+
+// swap returns the counts since the last call and starts a new window
+func (c *eventCounter) swap() (kinds, collections map[string]uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kinds, collections = c.kinds, c.collections
+	c.kinds = make(map[string]uint64, len(kinds))
+	c.collections = make(map[string]uint64, len(collections))
+	return kinds, collections
+}
+
+// logEventSummaries logs the number of events and events per second in
+// each interval, broken down by kind and collection
+func logEventSummaries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for now := range ticker.C {
+		kinds, collections := eventCounts.swap()
+		// the actual window, which can run long if the ticker was delayed
+		window := now.Sub(last)
+		last = now
+
+		byKind := zerolog.Dict()
+		var total uint64
+		for kind, n := range kinds {
+			byKind.Uint64(kind, n)
+			total += n
+		}
+		byCollection := zerolog.Dict()
+		for collection, n := range collections {
+			byCollection.Uint64(collection, n)
+		}
+		log.Info().
+			Dur("interval", window).
+			Uint64("total", total).
+			Float64("events_per_sec", float64(total)/window.Seconds()).
+			Dict("kinds", byKind).
+			Dict("collections", byCollection).
+			Msg("event_summary")
+	}
+}
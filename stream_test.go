@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+// canned Jetstream frames, one of each kind the logger handles, and ones
+// it has to survive
+var (
+	postFrame = `{"did":"did:plc:alice","time_us":1725911162000010,"kind":"commit","commit":{"rev":"3l3qo2vutsw2b","operation":"create","collection":"app.bsky.feed.post","rkey":"3kpost","record":{"$type":"app.bsky.feed.post","text":"hello world","langs":["en"],"createdAt":"2024-09-09T19:46:02Z"},"cid":"bafypost"}}`
+	likeFrame = `{"did":"did:plc:bob","time_us":1725911162000020,"kind":"commit","commit":{"rev":"3l3qo2vutsw2c","operation":"create","collection":"app.bsky.feed.like","rkey":"3klike","record":{"$type":"app.bsky.feed.like","subject":{"uri":"at://did:plc:alice/app.bsky.feed.post/3kpost","cid":"bafypost"},"createdAt":"2024-09-09T19:46:02Z"},"cid":"bafylike"}}`
+	// a like whose subject is a string, which doesn't unmarshal
+	badLikeFrame   = `{"did":"did:plc:bob","time_us":1725911162000030,"kind":"commit","commit":{"rev":"3l3qo2vutsw2d","operation":"create","collection":"app.bsky.feed.like","rkey":"3kbad","record":{"$type":"app.bsky.feed.like","subject":"at://did:plc:alice/app.bsky.feed.post/3kpost"},"cid":"bafybad"}}`
+	malformedFrame = `{"did":"did:plc:bob","time_us":`
+	deleteFrame    = `{"did":"did:plc:alice","time_us":1725911162000040,"kind":"commit","commit":{"rev":"3l3qo2vutsw2e","operation":"delete","collection":"app.bsky.feed.post","rkey":"3kpost"}}`
+	identityFrame  = `{"did":"did:plc:alice","time_us":1725911162000050,"kind":"identity","identity":{"did":"did:plc:alice","handle":"alice.test","seq":7,"time":"2024-09-09T19:46:02Z"}}`
+)
+
+// mockJetstream is a Jetstream subscribe endpoint sending each connection
+// the next batch of frames. It drops every connection but the last
+// without a close frame once its batch is sent, as a server going away
+// mid-stream does.
+type mockJetstream struct {
+	batches [][]string
+
+	mu      sync.Mutex
+	cursors []string
+}
+
+func (m *mockJetstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	m.mu.Lock()
+	n := len(m.cursors)
+	m.cursors = append(m.cursors, r.URL.Query().Get("cursor"))
+	m.mu.Unlock()
+	if n >= len(m.batches) {
+		n = len(m.batches) - 1
+	}
+	for _, frame := range m.batches[n] {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			return
+		}
+	}
+	if n < len(m.batches)-1 {
+		return
+	}
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func TestParseMessageFrames(t *testing.T) {
+	msg, err := jetstream.ParseMessage(websocket.TextMessage, []byte(postFrame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Did != "did:plc:alice" || msg.TimeUs != 1725911162000010 || msg.Kind != "commit" || msg.Commit == nil {
+		t.Fatalf("post parsed as %+v", msg)
+	}
+	if c := msg.Commit; c.Operation != "create" || c.Collection != "app.bsky.feed.post" || c.Rkey != "3kpost" || c.Cid != "bafypost" {
+		t.Errorf("post commit parsed as %+v", c)
+	}
+	if string(msg.Raw) != postFrame {
+		t.Errorf("Raw = %s, want the frame", msg.Raw)
+	}
+
+	msg, err = jetstream.ParseMessage(websocket.TextMessage, []byte(deleteFrame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Commit == nil || msg.Commit.Operation != "delete" || len(msg.Commit.Record) != 0 {
+		t.Errorf("delete parsed as %+v", msg.Commit)
+	}
+
+	msg, err = jetstream.ParseMessage(websocket.TextMessage, []byte(identityFrame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Kind != "identity" || msg.Identity == nil || msg.Identity.Handle != "alice.test" || msg.Identity.Seq != 7 {
+		t.Errorf("identity parsed as %+v", msg.Identity)
+	}
+
+	// the frame of a record that doesn't match its lexicon still parses,
+	// it's the record that is rejected when it's logged
+	if _, err := jetstream.ParseMessage(websocket.TextMessage, []byte(badLikeFrame)); err != nil {
+		t.Errorf("bad like frame: %v", err)
+	}
+	if _, err := jetstream.ParseMessage(websocket.TextMessage, []byte(malformedFrame)); err == nil || errors.Is(err, jetstream.ErrSkipFrame) {
+		t.Errorf("malformed frame: got %v, want a parse error", err)
+	}
+	if _, err := jetstream.ParseMessage(websocket.TextMessage, []byte("ping")); !errors.Is(err, jetstream.ErrSkipFrame) {
+		t.Errorf("non-JSON frame: got %v, want ErrSkipFrame", err)
+	}
+}
+
+func TestHandleMessageSkipsMalformedRecord(t *testing.T) {
+	defer func(strict bool) { *strictFlag = strict }(*strictFlag)
+	msg, err := jetstream.ParseMessage(websocket.TextMessage, []byte(badLikeFrame))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	captureLog(t, &buf)
+	*strictFlag = false
+	handleMessage(msg)
+	if buf.Len() > 0 {
+		t.Errorf("logged %s, want the record skipped quietly", buf.Bytes())
+	}
+
+	*strictFlag = true
+	handleMessage(msg)
+	lines := logLines(t, &buf)
+	if len(lines) != 1 || lines[0]["level"] != "warn" || lines[0]["message"] != "record does not match the expected schema" || lines[0]["rkey"] != "3kbad" {
+		t.Errorf("got %v, want one schema warning with -strict", lines)
+	}
+}
+
+func TestStreamFromMockJetstream(t *testing.T) {
+	server := &mockJetstream{batches: [][]string{
+		{postFrame, likeFrame, malformedFrame, "ping", badLikeFrame},
+		{deleteFrame, identityFrame},
+	}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	captureLog(t, &buf)
+
+	client := jetstream.NewClient("ws" + strings.TrimPrefix(ts.URL, "http") + "/subscribe")
+	client.Logger = zerolog.Nop()
+	client.MaxBackoff = 10 * time.Millisecond
+	var parseErrs, reconnects int
+	client.OnParseError = func(error) { parseErrs++ }
+	client.OnConnect = func(cursor int64, reconnect bool) {
+		if reconnect {
+			reconnects++
+		}
+	}
+	identity := make(chan struct{})
+	client.Handle(func(msg *jetstream.Message) {
+		handleMessage(msg)
+		if msg.Kind == "identity" {
+			close(identity)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- client.Run(ctx) }()
+	select {
+	case <-identity:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the events after the reconnect never arrived")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	cursors := server.cursors
+	server.mu.Unlock()
+	// the second connection resumes from the last event handled on the
+	// first, the malformed like
+	if len(cursors) != 2 || cursors[0] != "" || cursors[1] != strconv.FormatInt(1725911162000030, 10) {
+		t.Errorf("connections resumed from %q", cursors)
+	}
+	if reconnects != 1 || parseErrs != 1 {
+		t.Errorf("got %d reconnects and %d parse errors, want 1 of each", reconnects, parseErrs)
+	}
+
+	want := []map[string]any{
+		{"message": "post", "did": "did:plc:alice", "rkey": "3kpost", "text": "hello world"},
+		{"message": "like", "did": "did:plc:bob", "post_uri": "at://did:plc:alice/app.bsky.feed.post/3kpost"},
+		{"message": "delete", "did": "did:plc:alice", "uri": "at://did:plc:alice/app.bsky.feed.post/3kpost"},
+		{"message": "handle_update", "did": "did:plc:alice", "handle": "alice.test"},
+	}
+	lines := logLines(t, &buf)
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d: %v", len(lines), len(want), lines)
+	}
+	for i, fields := range want {
+		for k, v := range fields {
+			if lines[i][k] != v {
+				t.Errorf("line %d: %s = %v, want %v", i, k, lines[i][k], v)
+			}
+		}
+	}
+}
+
+// parseFrame parses a canned frame
+func parseFrame(t *testing.T, frame string) *jetstream.Message {
+	t.Helper()
+	msg, err := jetstream.ParseMessage(websocket.TextMessage, []byte(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog"
+)
+
+// TangledRecord covers the fields used by the sh.tangled.* record types
+type TangledRecord struct {
+	Type         string `json:"$type"`
+	Name         string `json:"name,omitempty"`
+	Knot         string `json:"knot,omitempty"`
+	Description  string `json:"description,omitempty"`
+	Repo         string `json:"repo,omitempty"`
+	Issue        string `json:"issue,omitempty"`
+	Pull         string `json:"pull,omitempty"`
+	Title        string `json:"title,omitempty"`
+	Body         string `json:"body,omitempty"`
+	TargetRepo   string `json:"targetRepo,omitempty"`
+	TargetBranch string `json:"targetBranch,omitempty"`
+	Subject      string `json:"subject,omitempty"`
+	Key          string `json:"key,omitempty"`
+	CreatedAt    string `json:"createdAt,omitempty"`
+}
+
+// logTangled logs records from the tangled.sh code-forge lexicons
+func logTangled(logger zerolog.Logger, msg *jetstream.Message) {
+	commit := msg.Commit
+	var record TangledRecord
+	if err := json.Unmarshal(commit.Record, &record); err != nil {
+		logUnparsed(logger, commit, err)
+		return
+	}
+
+	switch commit.Collection {
+	case "sh.tangled.repo":
+		logger.Info().
+			Str("type", "tangled_repo").
+			Str("rkey", commit.Rkey).
+			Str("name", record.Name).
+			Str("knot", record.Knot).
+			Str("description", record.Description).
+			Msg(eventName("tangled_repo", commit.Operation))
+
+	case "sh.tangled.repo.issue":
+		logger.Info().
+			Str("type", "tangled_issue").
+			Str("rkey", commit.Rkey).
+			Str("repo", record.Repo).
+			Str("title", record.Title).
+			Str("body", record.Body).
+			Msg(eventName("tangled_issue", commit.Operation))
+
+	case "sh.tangled.repo.issue.comment":
+		logger.Info().
+			Str("type", "tangled_issue_comment").
+			Str("rkey", commit.Rkey).
+			Str("issue", record.Issue).
+			Str("body", record.Body).
+			Msg(eventName("tangled_issue_comment", commit.Operation))
+
+	case "sh.tangled.repo.pull":
+		logger.Info().
+			Str("type", "tangled_pull").
+			Str("rkey", commit.Rkey).
+			Str("target_repo", record.TargetRepo).
+			Str("target_branch", record.TargetBranch).
+			Str("title", record.Title).
+			Str("body", record.Body).
+			Msg(eventName("tangled_pull", commit.Operation))
+
+	case "sh.tangled.repo.pull.comment":
+		logger.Info().
+			Str("type", "tangled_pull_comment").
+			Str("rkey", commit.Rkey).
+			Str("pull", record.Pull).
+			Str("body", record.Body).
+			Msg(eventName("tangled_pull_comment", commit.Operation))
+
+	case "sh.tangled.feed.star":
+		logger.Info().
+			Str("type", "tangled_star").
+			Str("subject", record.Subject).
+			Msg(eventName("tangled_star", commit.Operation))
+
+	case "sh.tangled.graph.follow":
+		logger.Info().
+			Str("type", "tangled_follow").
+			Str("subject", record.Subject).
+			Msg(eventName("tangled_follow", commit.Operation))
+
+	case "sh.tangled.publicKey":
+		logger.Info().
+			Str("type", "tangled_public_key").
+			Str("rkey", commit.Rkey).
+			Str("name", record.Name).
+			Msg(eventName("tangled_public_key", commit.Operation))
+
+	default:
+		logPresetOther(logger, "tangled_other", commit)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog"
+)
+
+// WhitewindEntry is a com.whtwnd.blog.entry, a WhiteWind blog post
+type WhitewindEntry struct {
+	Type       string `json:"$type"`
+	Title      string `json:"title,omitempty"`
+	Subtitle   string `json:"subtitle,omitempty"`
+	Content    string `json:"content"`
+	Visibility string `json:"visibility,omitempty"`
+	CreatedAt  string `json:"createdAt,omitempty"`
+}
+
+// logWhitewind logs records from the whtwnd.com blogging lexicons
+func logWhitewind(logger zerolog.Logger, msg *jetstream.Message) {
+	commit := msg.Commit
+	if commit.Collection != "com.whtwnd.blog.entry" {
+		logPresetOther(logger, "whitewind_other", commit)
+		return
+	}
+	var record WhitewindEntry
+	if err := json.Unmarshal(commit.Record, &record); err != nil {
+		logUnparsed(logger, commit, err)
+		return
+	}
+	event := logger.Info().
+		Str("type", "whitewind_entry").
+		Str("rkey", commit.Rkey).
+		Str("title", record.Title)
+	if record.Subtitle != "" {
+		event = event.Str("subtitle", record.Subtitle)
+	}
+	if record.Visibility != "" {
+		event = event.Str("visibility", record.Visibility)
+	}
+	event.
+		Str("content", record.Content).
+		Msg(eventName("whitewind_entry", commit.Operation))
+}
+
+// FrontpageRecord covers the fields used by the fyi.unravel.frontpage.*
+// record types
+type FrontpageRecord struct {
+	Type      string             `json:"$type"`
+	Title     string             `json:"title,omitempty"`
+	URL       string             `json:"url,omitempty"`
+	Content   string             `json:"content,omitempty"`
+	Post      *jetstream.Subject `json:"post,omitempty"`
+	Parent    *jetstream.Subject `json:"parent,omitempty"`
+	Subject   *jetstream.Subject `json:"subject,omitempty"`
+	CreatedAt string             `json:"createdAt,omitempty"`
+}
+
+// logFrontpage logs records from the frontpage.fyi link aggregator
+func logFrontpage(logger zerolog.Logger, msg *jetstream.Message) {
+	commit := msg.Commit
+	var record FrontpageRecord
+	if err := json.Unmarshal(commit.Record, &record); err != nil {
+		logUnparsed(logger, commit, err)
+		return
+	}
+
+	switch commit.Collection {
+	case "fyi.unravel.frontpage.post":
+		logger.Info().
+			Str("type", "frontpage_post").
+			Str("rkey", commit.Rkey).
+			Str("title", record.Title).
+			Str("url", record.URL).
+			Msg(eventName("frontpage_post", commit.Operation))
+
+	case "fyi.unravel.frontpage.comment":
+		event := logger.Info().
+			Str("type", "frontpage_comment").
+			Str("rkey", commit.Rkey)
+		if record.Post != nil {
+			event = event.Str("post", record.Post.URI)
+		}
+		if record.Parent != nil {
+			event = event.Str("parent", record.Parent.URI)
+		}
+		event.
+			Str("content", record.Content).
+			Msg(eventName("frontpage_comment", commit.Operation))
+
+	case "fyi.unravel.frontpage.vote":
+		event := logger.Info().
+			Str("type", "frontpage_vote").
+			Str("rkey", commit.Rkey)
+		if record.Subject != nil {
+			event = event.Str("subject", record.Subject.URI)
+		}
+		event.Msg(eventName("frontpage_vote", commit.Operation))
+
+	default:
+		logPresetOther(logger, "frontpage_other", commit)
+	}
+}
+
+// CalendarRecord covers the fields used by the community calendar
+// lexicons Smoke Signal publishes events and RSVPs with, under both
+// community.lexicon.calendar and Smoke Signal's older
+// events.smokesignal.calendar
+type CalendarRecord struct {
+	Type        string             `json:"$type"`
+	Name        string             `json:"name,omitempty"`
+	Description string             `json:"description,omitempty"`
+	StartsAt    string             `json:"startsAt,omitempty"`
+	EndsAt      string             `json:"endsAt,omitempty"`
+	Mode        string             `json:"mode,omitempty"`
+	Status      string             `json:"status,omitempty"`
+	Subject     *jetstream.Subject `json:"subject,omitempty"`
+	CreatedAt   string             `json:"createdAt,omitempty"`
+}
+
+// logCalendar logs calendar events and RSVPs, as Smoke Signal creates
+func logCalendar(logger zerolog.Logger, msg *jetstream.Message) {
+	commit := msg.Commit
+	var record CalendarRecord
+	if err := json.Unmarshal(commit.Record, &record); err != nil {
+		logUnparsed(logger, commit, err)
+		return
+	}
+
+	switch strings.TrimPrefix(strings.TrimPrefix(commit.Collection, "community.lexicon."), "events.smokesignal.") {
+	case "calendar.event":
+		event := logger.Info().
+			Str("type", "calendar_event").
+			Str("rkey", commit.Rkey).
+			Str("name", record.Name)
+		if record.StartsAt != "" {
+			event = event.Str("starts_at", record.StartsAt)
+		}
+		if record.EndsAt != "" {
+			event = event.Str("ends_at", record.EndsAt)
+		}
+		if record.Mode != "" {
+			event = event.Str("mode", lexiconToken(record.Mode))
+		}
+		if record.Status != "" {
+			event = event.Str("status", lexiconToken(record.Status))
+		}
+		event.
+			Str("description", record.Description).
+			Msg(eventName("calendar_event", commit.Operation))
+
+	case "calendar.rsvp":
+		event := logger.Info().
+			Str("type", "calendar_rsvp").
+			Str("rkey", commit.Rkey)
+		if record.Subject != nil {
+			event = event.Str("subject", record.Subject.URI)
+		}
+		event.
+			Str("status", lexiconToken(record.Status)).
+			Msg(eventName("calendar_rsvp", commit.Operation))
+
+	default:
+		logPresetOther(logger, "calendar_other", commit)
+	}
+}
+
+// lexiconToken shortens a token like community.lexicon.calendar.rsvp#going
+// to its name, going
+func lexiconToken(token string) string {
+	if _, name, ok := strings.Cut(token, "#"); ok {
+		return name
+	}
+	return token
+}
+
+// logPresetOther logs a record of a preset's lexicon family that it has no
+// dedicated handling for, as logOtherCommit would but with the preset's
+// type
+func logPresetOther(logger zerolog.Logger, typ string, commit *jetstream.CommitEvent) {
+	event := withCollection(logger.Info().Str("type", typ), commit.Collection).
+		Str("rkey", commit.Rkey)
+	withRawJSON(event, commit.Collection, commit.Record).
+		Msg(eventName(typ, commit.Operation))
+}
+
+// parseCollectionFields registers the handling -collection-fields
+// describes, NSID=TYPE:FIELD,FIELD, where NSID may end in * to match a
+// prefix. Matching commits are logged as TYPE with each FIELD of the
+// record, a path like subject.uri logged as subject_uri, that it has.
+func parseCollectionFields(specs []string) error {
+	for _, spec := range specs {
+		nsid, rest, ok := strings.Cut(spec, "=")
+		typ, fields, _ := strings.Cut(rest, ":")
+		if !ok || nsid == "" || typ == "" {
+			return fmt.Errorf("%q: expected NSID=TYPE:FIELD,FIELD, e.g. com.example.blog.entry=blog_entry:title,tags", spec)
+		}
+		var paths [][]string
+		for _, field := range strings.Split(fields, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				paths = append(paths, strings.Split(field, "."))
+			}
+		}
+		commitLoggers[nsid] = fieldsLogger(typ, paths)
+	}
+	return nil
+}
+
+// fieldsLogger returns a commitLogger for -collection-fields
+func fieldsLogger(typ string, paths [][]string) commitLogger {
+	return func(logger zerolog.Logger, msg *jetstream.Message) {
+		commit := msg.Commit
+		var record map[string]any
+		if err := json.Unmarshal(commit.Record, &record); err != nil {
+			logUnparsed(logger, commit, err)
+			return
+		}
+		event := withCollection(logger.Info().Str("type", typ), commit.Collection).
+			Str("rkey", commit.Rkey)
+		for _, path := range paths {
+			if v, ok := recordField(record, path); ok {
+				event = event.Interface(strings.Join(path, "_"), v)
+			}
+		}
+		event.Msg(eventName(typ, commit.Operation))
+	}
+}
+
+// recordField looks up path in a decoded record
+func recordField(record map[string]any, path []string) (any, bool) {
+	var v any = record
+	for _, key := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
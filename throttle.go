@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// didBucket is a token bucket for one DID
+type didBucket struct {
+	did    string
+	tokens float64
+	last   time.Time
+}
+
+// didThrottle rate limits commits per DID so one hyperactive account can't
+// dominate the output. Buckets are kept in an LRU so the number of tracked
+// DIDs stays bounded; an evicted DID simply starts again with a full bucket.
+type didThrottle struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	max     int
+	lru     *list.List // front is most recently used
+	buckets map[string]*list.Element
+	dropped uint64
+}
+
+// throttle is the per-DID rate limiter, nil unless -did-rate is set
+var throttle *didThrottle
+
+func newDIDThrottle(rate float64, burst, max int) *didThrottle {
+	return &didThrottle{
+		rate:    rate,
+		burst:   float64(burst),
+		max:     max,
+		lru:     list.New(),
+		buckets: make(map[string]*list.Element),
+	}
+}
+
+// allow takes a token from did's bucket, reporting false if it's empty
+func (t *didThrottle) allow(did string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var b *didBucket
+	if el, ok := t.buckets[did]; ok {
+		t.lru.MoveToFront(el)
+		b = el.Value.(*didBucket)
+		b.tokens += now.Sub(b.last).Seconds() * t.rate
+		if b.tokens > t.burst {
+			b.tokens = t.burst
+		}
+		b.last = now
+	} else {
+		b = &didBucket{did: did, tokens: t.burst, last: now}
+		t.buckets[did] = t.lru.PushFront(b)
+		if t.lru.Len() > t.max {
+			oldest := t.lru.Back()
+			t.lru.Remove(oldest)
+			delete(t.buckets, oldest.Value.(*didBucket).did)
+		}
+	}
+
+	if b.tokens < 1 {
+		t.dropped++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// logSummary logs how many events were dropped by the throttle
+func (t *didThrottle) logSummary() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	log.Info().
+		Float64("rate", t.rate).
+		Uint64("dropped", t.dropped).
+		Int("tracked_dids", t.lru.Len()).
+		Msg("did_throttle_summary")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDIDThrottle(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	type call struct {
+		did  string
+		at   time.Duration
+		want bool
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		max   int
+		calls []call
+	}{
+		{
+			name: "burst then empty", rate: 1, burst: 2, max: 10,
+			calls: []call{{"a", 0, true}, {"a", 0, true}, {"a", 0, false}},
+		},
+		{
+			name: "refills at the rate", rate: 2, burst: 1, max: 10,
+			calls: []call{{"a", 0, true}, {"a", 0, false}, {"a", 500 * time.Millisecond, true}, {"a", 500 * time.Millisecond, false}},
+		},
+		{
+			name: "refill capped at the burst", rate: 1, burst: 1, max: 10,
+			calls: []call{{"a", 0, true}, {"a", time.Hour, true}, {"a", time.Hour, false}},
+		},
+		{
+			name: "dids have their own buckets", rate: 1, burst: 1, max: 10,
+			calls: []call{{"a", 0, true}, {"b", 0, true}, {"a", 0, false}, {"b", 0, false}},
+		},
+		{
+			name: "evicted did starts full", rate: 1, burst: 1, max: 1,
+			calls: []call{{"a", 0, true}, {"b", 0, true}, {"a", 0, true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := newDIDThrottle(tt.rate, tt.burst, tt.max)
+			var dropped uint64
+			for i, c := range tt.calls {
+				if got := th.allow(c.did, start.Add(c.at)); got != c.want {
+					t.Errorf("call %d (%s at %v) = %v, want %v", i, c.did, c.at, got, c.want)
+				}
+				if !c.want {
+					dropped++
+				}
+			}
+			if th.dropped != dropped {
+				t.Errorf("dropped = %d, want %d", th.dropped, dropped)
+			}
+			if th.lru.Len() > tt.max {
+				t.Errorf("tracking %d dids, want at most %d", th.lru.Len(), tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// sinkAttr marks sink spans, which tracingSampler always samples
+const sinkAttr = attribute.Key("atproto_logger.sink")
+
+// eventTracer exports traces of events through the pipeline to an OTLP
+// collector. Each sampled event is a trace whose root span runs from when
+// its frame was read until it was handled, with a child span for each
+// stage: parse, queue (waiting to be handled, with -workers or
+// -labeler), filter, script, sinks, and log. Sink writes happen in
+// batches apart from events, so each is its own trace, always sampled so
+// the errors recorded on them aren't missed.
+type eventTracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// tracing is nil unless -otlp-endpoint is set
+var tracing *eventTracer
+
+func newEventTracer(endpoint string, sampleRate float64) (*eventTracer, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("atproto-logger"),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(tracingSampler{sdktrace.TraceIDRatioBased(sampleRate)})),
+	)
+	return &eventTracer{provider: provider, tracer: provider.Tracer("github.com/dickeyy/atproto-logger")}, nil
+}
+
+// tracingSampler samples events at the -trace-sample-rate and sink
+// writes always
+type tracingSampler struct {
+	events sdktrace.Sampler
+}
+
+func (s tracingSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, attr := range p.Attributes {
+		if attr.Key == sinkAttr {
+			return sdktrace.AlwaysSample().ShouldSample(p)
+		}
+	}
+	return s.events.ShouldSample(p)
+}
+
+func (s tracingSampler) Description() string {
+	return "events: " + s.events.Description() + ", sinks: AlwaysOnSampler"
+}
+
+// shutdown exports the spans still buffered
+func (t *eventTracer) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("failed to export remaining traces")
+	}
+}
+
+// eventSpan is the trace of one event through handleMessage. Its methods
+// do nothing on a nil eventSpan, as start returns when tracing is off or
+// the event isn't sampled.
+type eventSpan struct {
+	tracer trace.Tracer
+	ctx    context.Context
+	root   trace.Span
+	// the span of the current stage
+	stage trace.Span
+}
+
+// start begins msg's trace, with the parse and queue stages the client's
+// timestamps already cover
+func (t *eventTracer) start(msg *jetstream.Message) *eventSpan {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	begin := msg.ReceivedAt
+	if begin.IsZero() {
+		begin = now
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("atproto.did", msg.Did),
+		attribute.String("atproto.kind", msg.Kind),
+		attribute.Int64("atproto.time_us", msg.TimeUs),
+		attribute.Float64("atproto.lag_seconds", begin.Sub(time.UnixMicro(msg.TimeUs)).Seconds()),
+	}
+	if msg.Commit != nil {
+		attrs = append(attrs,
+			attribute.String("atproto.collection", msg.Commit.Collection),
+			attribute.String("atproto.operation", msg.Commit.Operation),
+		)
+	}
+	ctx, root := t.tracer.Start(context.Background(), "event", trace.WithTimestamp(begin), trace.WithAttributes(attrs...))
+	if !root.IsRecording() {
+		return nil
+	}
+	if !msg.ReceivedAt.IsZero() {
+		_, parse := t.tracer.Start(ctx, "parse", trace.WithTimestamp(msg.ReceivedAt))
+		parse.End(trace.WithTimestamp(msg.ParsedAt))
+		_, queue := t.tracer.Start(ctx, "queue", trace.WithTimestamp(msg.ParsedAt))
+		queue.End(trace.WithTimestamp(now))
+	}
+	return &eventSpan{tracer: t.tracer, ctx: ctx, root: root}
+}
+
+// next ends the current stage and starts the one called name
+func (s *eventSpan) next(name string) {
+	if s == nil {
+		return
+	}
+	if s.stage != nil {
+		s.stage.End()
+	}
+	_, s.stage = s.tracer.Start(s.ctx, name)
+}
+
+// end ends the current stage and the event's trace
+func (s *eventSpan) end() {
+	if s == nil {
+		return
+	}
+	if s.stage != nil {
+		s.stage.End()
+	}
+	s.root.End()
+}
+
+// startSink begins the span of a sink writing events, a span that does
+// nothing when tracing is off
+func (t *eventTracer) startSink(sink, operation string, events int) trace.Span {
+	if t == nil {
+		return noop.Span{}
+	}
+	_, span := t.tracer.Start(context.Background(), sink+" "+operation, trace.WithAttributes(
+		sinkAttr.String(sink),
+		attribute.Int("atproto_logger.events", events),
+	))
+	return span
+}
+
+// recordSinkError marks span failed, for n events lost for reason
+func recordSinkError(span trace.Span, reason string, err error, n int) {
+	if err == nil {
+		err = errors.New(reason)
+	}
+	span.RecordError(err, trace.WithAttributes(
+		attribute.String("atproto_logger.reason", reason),
+		attribute.Int("atproto_logger.events", n),
+	))
+	span.SetStatus(codes.Error, reason)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// trends is the rolling-window aggregator, nil unless -trends-interval is
+// set
+var trends *trendCounter
+
+// trendRates are the collections whose creates get their own rate in trend
+// reports, and the rate's name
+var trendRates = []struct{ collection, name string }{
+	{"app.bsky.feed.post", "posts_per_sec"},
+	{"app.bsky.feed.like", "likes_per_sec"},
+	{"app.bsky.feed.repost", "reposts_per_sec"},
+	{"app.bsky.graph.follow", "follows_per_sec"},
+}
+
+// trendBucket holds one second of counts
+type trendBucket struct {
+	second      int64
+	events      uint64
+	collections map[string]uint64
+	// creates counts create operations by collection
+	creates map[string]uint64
+}
+
+// trendCounter counts events over a rolling window, in a ring of
+// one-second buckets, along with when each DID was last seen and the top
+// hashtags, quoted posts, and linked domains of new posts. Like the other
+// stats it counts events as received, before any filtering, and by when
+// they arrive rather than their time_us.
+type trendCounter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	started time.Time
+	buckets []trendBucket
+	// dids maps each DID seen to the unix second it was last seen
+	dids map[string]int64
+
+	// nil when terms aren't ranked
+	hashtags, quotes, domains *topTerms
+}
+
+// newTrendCounter ranks the top terms when top is positive
+func newTrendCounter(window time.Duration, top int) *trendCounter {
+	t := &trendCounter{
+		window:  window,
+		started: time.Now(),
+		buckets: make([]trendBucket, int(window/time.Second)),
+		dids:    map[string]int64{},
+	}
+	if top > 0 {
+		t.hashtags, t.quotes, t.domains = newTopTerms(window, top), newTopTerms(window, top), newTopTerms(window, top)
+	}
+	return t
+}
+
+func (t *trendCounter) add(msg *jetstream.Message) {
+	now := time.Now()
+	second := now.Unix()
+	var terms postTerms
+	isPost := false
+	if t.hashtags != nil {
+		terms, isPost = trendingTerms(msg)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if isPost {
+		for _, tag := range terms.hashtags {
+			t.hashtags.add(tag, now)
+		}
+		for _, uri := range terms.quotes {
+			t.quotes.add(uri, now)
+		}
+		for _, domain := range terms.domains {
+			t.domains.add(domain, now)
+		}
+	}
+	b := &t.buckets[second%int64(len(t.buckets))]
+	if b.second != second {
+		*b = trendBucket{second: second, collections: map[string]uint64{}, creates: map[string]uint64{}}
+	}
+	b.events++
+	if msg.Commit != nil {
+		b.collections[msg.Commit.Collection]++
+		if msg.Commit.Operation == "create" {
+			b.creates[msg.Commit.Collection]++
+		}
+	}
+	if msg.Did != "" {
+		t.dids[msg.Did] = second
+	}
+}
+
+// collectionTrend is a collection's commits over the window
+type collectionTrend struct {
+	Collection string  `json:"collection"`
+	Count      uint64  `json:"count"`
+	PerSec     float64 `json:"per_sec"`
+}
+
+// trendReport summarizes the window, as logged and written to -trends-file
+type trendReport struct {
+	Time   time.Time `json:"time"`
+	Window string    `json:"window"`
+	Events uint64    `json:"events"`
+	// Rates holds events_per_sec, and the creates per second of each of
+	// trendRates' collections
+	Rates          map[string]float64 `json:"rates"`
+	UniqueDids     int                `json:"unique_dids"`
+	TopCollections []collectionTrend  `json:"top_collections"`
+	// the counts of these are estimates, which can run a little high
+	TopHashtags    []termTrend `json:"top_hashtags"`
+	TopQuotedPosts []termTrend `json:"top_quoted_posts"`
+	TopDomains     []termTrend `json:"top_domains"`
+}
+
+// report summarizes the last window, ranking the top collections and
+// terms, and forgets DIDs not seen within it
+func (t *trendCounter) report(top int) trendReport {
+	now := time.Now()
+	oldest := now.Unix() - int64(len(t.buckets)) + 1
+
+	t.mu.Lock()
+	var events uint64
+	collections := map[string]uint64{}
+	creates := map[string]uint64{}
+	for _, b := range t.buckets {
+		if b.second < oldest {
+			continue
+		}
+		events += b.events
+		for c, n := range b.collections {
+			collections[c] += n
+		}
+		for c, n := range b.creates {
+			creates[c] += n
+		}
+	}
+	for did, seen := range t.dids {
+		if seen < oldest {
+			delete(t.dids, did)
+		}
+	}
+	uniqueDids := len(t.dids)
+	var hashtags, quotes, domains []termTrend
+	if t.hashtags != nil {
+		hashtags, quotes, domains = t.hashtags.top(top, now), t.quotes.top(top, now), t.domains.top(top, now)
+	}
+	t.mu.Unlock()
+
+	// until a full window has passed, rates are over the time so far
+	seconds := min(t.window, now.Sub(t.started)).Seconds()
+	rate := func(n uint64) float64 {
+		return math.Round(float64(n)/seconds*100) / 100
+	}
+
+	rates := map[string]float64{"events_per_sec": rate(events)}
+	for _, r := range trendRates {
+		rates[r.name] = rate(creates[r.collection])
+	}
+	ranked := make([]collectionTrend, 0, len(collections))
+	for c, n := range collections {
+		ranked = append(ranked, collectionTrend{Collection: c, Count: n, PerSec: rate(n)})
+	}
+	slices.SortFunc(ranked, func(a, b collectionTrend) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Collection, b.Collection))
+	})
+	if len(ranked) > top {
+		ranked = ranked[:top]
+	}
+	return trendReport{
+		Time:           now.UTC(),
+		Window:         t.window.String(),
+		Events:         events,
+		Rates:          rates,
+		UniqueDids:     uniqueDids,
+		TopCollections: ranked,
+		TopHashtags:    hashtags,
+		TopQuotedPosts: quotes,
+		TopDomains:     domains,
+	}
+}
+
+// logTrends logs a trend_summary every interval, and with out set also
+// writes each report to it as a line of JSON
+func logTrends(interval time.Duration, top int, out io.Writer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r := trends.report(top)
+
+		rates := zerolog.Dict().Float64("events_per_sec", r.Rates["events_per_sec"])
+		for _, rate := range trendRates {
+			rates.Float64(rate.name, r.Rates[rate.name])
+		}
+		collections := zerolog.Arr()
+		for _, c := range r.TopCollections {
+			collections.Dict(zerolog.Dict().Str("collection", c.Collection).Uint64("count", c.Count).Float64("per_sec", c.PerSec))
+		}
+		log.Info().
+			Str("window", r.Window).
+			Uint64("events", r.Events).
+			Dict("rates", rates).
+			Int("unique_dids", r.UniqueDids).
+			Array("top_collections", collections).
+			Array("top_hashtags", termTrends(r.TopHashtags)).
+			Array("top_quoted_posts", termTrends(r.TopQuotedPosts)).
+			Array("top_domains", termTrends(r.TopDomains)).
+			Msg("trend_summary")
+
+		if out == nil {
+			continue
+		}
+		data, err := json.Marshal(r)
+		if err == nil {
+			_, err = out.Write(append(data, '\n'))
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to write -trends-file")
+		}
+	}
+}
+
+// termTrends logs ranked terms
+func termTrends(terms []termTrend) *zerolog.Array {
+	arr := zerolog.Arr()
+	for _, t := range terms {
+		arr.Dict(zerolog.Dict().Str("term", t.Term).Uint64("count", t.Count))
+	}
+	return arr
+}
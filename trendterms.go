@@ -0,0 +1,242 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"encoding/json"
+	"hash/fnv"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+const (
+	// sketchDepth and sketchWidth size each count-min sketch: 4 rows of
+	// 4096 counters overcount a term by more than 1/1500th of the events
+	// counted less than 2% of the time
+	sketchDepth = 4
+	sketchWidth = 4096
+
+	// trendSlots is how many sketches a window is split into, so counts
+	// expire a slot at a time as the window rolls on
+	trendSlots = 10
+)
+
+// countMinSketch estimates how often each term was seen in fixed memory.
+// Estimates are never low, only high when other terms collide with it in
+// every row.
+type countMinSketch [sketchDepth][sketchWidth]uint32
+
+// sketchIndexes returns term's counter in each row, from two halves of one
+// hash
+func sketchIndexes(term string) [sketchDepth]uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(term))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	var indexes [sketchDepth]uint32
+	for row := range indexes {
+		indexes[row] = (h1 + uint32(row)*h2) % sketchWidth
+	}
+	return indexes
+}
+
+// trendSlot is one part of a rolling window, numbered by when it started
+type trendSlot struct {
+	number int64
+	sketch *countMinSketch
+}
+
+// termCount is a term ranked in a topTerms heap
+type termCount struct {
+	term  string
+	count uint64
+	index int
+}
+
+// termHeap is a min-heap of the candidates, so the least counted is the
+// first replaced
+type termHeap []*termCount
+
+func (h termHeap) Len() int { return len(h) }
+func (h termHeap) Less(i, j int) bool {
+	return cmp.Or(cmp.Compare(h[i].count, h[j].count), cmp.Compare(h[j].term, h[i].term)) < 0
+}
+func (h termHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *termHeap) Push(x any) {
+	t := x.(*termCount)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+func (h *termHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// topTerms tracks the most frequent terms over a rolling window: counts in
+// a ring of count-min sketches, one per slot of the window, and the terms
+// with the highest estimates in a bounded heap of candidates. Memory is
+// fixed however many distinct terms there are. Callers serialize access.
+type topTerms struct {
+	slotLength time.Duration
+	slots      [trendSlots]trendSlot
+	candidates termHeap
+	byTerm     map[string]*termCount
+	capacity   int
+}
+
+// newTopTerms tracks enough candidates to rank top terms reliably
+func newTopTerms(window time.Duration, top int) *topTerms {
+	return &topTerms{
+		slotLength: max(window/trendSlots, time.Second),
+		byTerm:     map[string]*termCount{},
+		capacity:   max(top*10, 100),
+	}
+}
+
+// add counts term once, at now
+func (t *topTerms) add(term string, now time.Time) {
+	number := now.UnixNano() / int64(t.slotLength)
+	slot := &t.slots[number%trendSlots]
+	if slot.number != number || slot.sketch == nil {
+		if slot.sketch == nil {
+			slot.sketch = new(countMinSketch)
+		} else {
+			*slot.sketch = countMinSketch{}
+		}
+		slot.number = number
+	}
+	indexes := sketchIndexes(term)
+	for row, i := range indexes {
+		slot.sketch[row][i]++
+	}
+
+	count := t.estimate(indexes, number)
+	if c, ok := t.byTerm[term]; ok {
+		c.count = count
+		heap.Fix(&t.candidates, c.index)
+		return
+	}
+	if len(t.candidates) < t.capacity {
+		c := &termCount{term: term, count: count}
+		heap.Push(&t.candidates, c)
+		t.byTerm[term] = c
+		return
+	}
+	if least := t.candidates[0]; count > least.count {
+		delete(t.byTerm, least.term)
+		least.term, least.count = term, count
+		t.byTerm[term] = least
+		heap.Fix(&t.candidates, 0)
+	}
+}
+
+// estimate sums the counters at indexes over the slots still in the window
+// ending with slot number, taking the lowest row
+func (t *topTerms) estimate(indexes [sketchDepth]uint32, number int64) uint64 {
+	var lowest uint64
+	for row, i := range indexes {
+		var sum uint64
+		for _, slot := range t.slots {
+			if slot.sketch != nil && slot.number > number-trendSlots && slot.number <= number {
+				sum += uint64(slot.sketch[row][i])
+			}
+		}
+		if row == 0 || sum < lowest {
+			lowest = sum
+		}
+	}
+	return lowest
+}
+
+// termTrend is a term's estimated count over the window
+type termTrend struct {
+	Term  string `json:"term"`
+	Count uint64 `json:"count"`
+}
+
+// top re-estimates every candidate as of now, dropping those that expired
+// from the window, and returns the n most counted
+func (t *topTerms) top(n int, now time.Time) []termTrend {
+	number := now.UnixNano() / int64(t.slotLength)
+	kept := t.candidates[:0]
+	for _, c := range t.candidates {
+		if c.count = t.estimate(sketchIndexes(c.term), number); c.count > 0 {
+			kept = append(kept, c)
+		} else {
+			delete(t.byTerm, c.term)
+		}
+	}
+	t.candidates = kept
+	for i, c := range t.candidates {
+		c.index = i
+	}
+	heap.Init(&t.candidates)
+
+	ranked := make([]termTrend, 0, len(t.candidates))
+	for _, c := range t.candidates {
+		ranked = append(ranked, termTrend{Term: c.term, Count: c.count})
+	}
+	slices.SortFunc(ranked, func(a, b termTrend) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Term, b.Term))
+	})
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// postTerms are what a post adds to the term trends, each once per post
+type postTerms struct {
+	hashtags []string
+	quotes   []string
+	domains  []string
+}
+
+// trendingTerms pulls the hashtags, quoted post, and linked domains out of
+// a created post, lowercasing hashtags and domains so variants count
+// together
+func trendingTerms(msg *jetstream.Message) (postTerms, bool) {
+	var terms postTerms
+	if msg.Commit == nil || msg.Commit.Operation != "create" || msg.Commit.Collection != "app.bsky.feed.post" {
+		return terms, false
+	}
+	var record jetstream.Post
+	if err := json.Unmarshal(msg.Commit.Record, &record); err != nil {
+		return terms, false
+	}
+
+	facets := summarizeFacets(record.Text, record.Facets)
+	for _, tag := range append(facets.hashtags, record.Tags...) {
+		if tag = strings.ToLower(strings.TrimPrefix(tag, "#")); tag != "" && !slices.Contains(terms.hashtags, tag) {
+			terms.hashtags = append(terms.hashtags, tag)
+		}
+	}
+	embed := summarizeEmbed(record.Embed)
+	if embed.quoteURI != "" {
+		terms.quotes = append(terms.quotes, embed.quoteURI)
+	}
+	links := facets.links
+	if embed.externalURL != "" {
+		links = append(links, embed.externalURL)
+	}
+	for _, link := range links {
+		u, err := url.Parse(link)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		domain := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+		if !slices.Contains(terms.domains, domain) {
+			terms.domains = append(terms.domains, domain)
+		}
+	}
+	return terms, true
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// the window -tui rates are averaged over
+	tuiRateWindow = 10 * time.Second
+	// how often the dashboard redraws
+	tuiRefresh = 500 * time.Millisecond
+	// recent posts and log lines kept for the dashboard
+	tuiMaxPosts = 200
+	tuiMaxLogs  = 50
+	// log lines shown below the panes
+	tuiShownLogs = 5
+	// collections ranked in the rates pane
+	tuiTopCollections = 50
+)
+
+// dashboard is the -tui display, nil unless -tui is set
+var dashboard *tuiDashboard
+
+// tuiDashboard is what -tui shows instead of log lines: event rates by
+// collection, a feed of recent posts, and the connection's health
+type tuiDashboard struct {
+	rates *trendCounter
+	// logs is the log output, whose last lines are shown
+	logs *tuiLog
+
+	connected   atomic.Bool
+	reconnects  atomic.Uint64
+	lastEventUs atomic.Int64
+
+	mu    sync.Mutex
+	posts []tuiPost // oldest first
+
+	app                                *tview.Application
+	header, collections, feed, logPane *tview.TextView
+	stopped                            chan struct{}
+}
+
+// tuiPost is a post in the dashboard's feed
+type tuiPost struct {
+	at     time.Time
+	author string
+	text   string
+}
+
+func newTUIDashboard(logs *tuiLog) *tuiDashboard {
+	d := &tuiDashboard{
+		rates:       newTrendCounter(tuiRateWindow, 0),
+		logs:        logs,
+		app:         tview.NewApplication(),
+		header:      tview.NewTextView().SetDynamicColors(true).SetWrap(false),
+		collections: tview.NewTextView().SetDynamicColors(true).SetWrap(false),
+		feed:        tview.NewTextView().SetDynamicColors(true).SetWrap(false),
+		logPane:     tview.NewTextView().SetWrap(false),
+		stopped:     make(chan struct{}),
+	}
+	d.collections.SetBorder(true).SetTitle(" events/s by collection ")
+	d.feed.SetBorder(true).SetTitle(" recent posts ")
+	d.logPane.SetBorder(true).SetTitle(" log ")
+	footer := tview.NewTextView().SetText(" q to quit").SetTextColor(tcell.ColorGray)
+
+	panes := tview.NewFlex().
+		AddItem(d.collections, 52, 0, false).
+		AddItem(d.feed, 0, 1, false)
+	root := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(d.header, 1, 0, false).
+		AddItem(panes, 0, 1, false).
+		AddItem(d.logPane, tuiShownLogs+2, 0, false).
+		AddItem(footer, 1, 0, false)
+	d.app.SetRoot(root, true).SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape || event.Rune() == 'q' {
+			d.app.Stop()
+			return nil
+		}
+		return event
+	})
+	return d
+}
+
+// count records an event for the rates, before any filtering
+func (d *tuiDashboard) count(msg *jetstream.Message) {
+	d.rates.add(msg)
+	d.lastEventUs.Store(msg.TimeUs)
+}
+
+// show adds msg to the feed if it is a new post
+func (d *tuiDashboard) show(msg *jetstream.Message) {
+	c := msg.Commit
+	if c == nil || c.Collection != "app.bsky.feed.post" || c.Operation != "create" {
+		return
+	}
+	var post jetstream.Post
+	if err := json.Unmarshal(c.Record, &post); err != nil {
+		return
+	}
+	author := msg.Did
+	if handles != nil {
+		if handle, ok := handles.lookup(msg.Did); ok {
+			author = "@" + handle
+		}
+	}
+	text := strings.Join(strings.Fields(post.Text), " ")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.posts) >= tuiMaxPosts {
+		d.posts = d.posts[1:]
+	}
+	d.posts = append(d.posts, tuiPost{at: time.Now(), author: author, text: text})
+}
+
+// recentPosts returns up to n of the newest posts, newest first
+func (d *tuiDashboard) recentPosts(n int) []tuiPost {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n = min(n, len(d.posts))
+	recent := make([]tuiPost, n)
+	for i := range recent {
+		recent[i] = d.posts[len(d.posts)-1-i]
+	}
+	return recent
+}
+
+// run shows the dashboard until the user quits, which calls quit, or stop
+// is called
+func (d *tuiDashboard) run(quit context.CancelFunc) {
+	defer close(d.stopped)
+	d.logs.attach(d.stop)
+	go d.refresh()
+	err := d.app.Run()
+	d.logs.detach()
+	if err != nil {
+		log.Error().Err(err).Msg("tui error")
+	}
+	quit()
+}
+
+// stop closes the dashboard, if it is still up, and waits for the terminal
+// to be restored, so what is logged afterwards is readable
+func (d *tuiDashboard) stop() {
+	select {
+	case <-d.stopped:
+		return
+	default:
+	}
+	// queued rather than called directly, in case the dashboard hasn't
+	// started yet
+	go d.app.QueueUpdate(d.app.Stop)
+	<-d.stopped
+}
+
+// refresh redraws the dashboard every tuiRefresh until it stops
+func (d *tuiDashboard) refresh() {
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopped:
+			return
+		case <-ticker.C:
+			d.app.QueueUpdateDraw(d.update)
+		}
+	}
+}
+
+// update fills in the dashboard's views, from the draw goroutine
+func (d *tuiDashboard) update() {
+	r := d.rates.report(tuiTopCollections)
+
+	status := "[red]● disconnected[-]"
+	if d.connected.Load() {
+		status = "[green]● connected[-]"
+	}
+	lag := "-"
+	if last := d.lastEventUs.Load(); last > 0 {
+		lag = time.Since(time.UnixMicro(last)).Round(100 * time.Millisecond).String()
+	}
+	d.header.SetText(fmt.Sprintf(" [::b]atproto-logger[::-]  %s  reconnects %d  lag %s  %.0f events/s  %d DIDs  drops %d",
+		status, d.reconnects.Load(), lag, r.Rates["events_per_sec"], r.UniqueDids, drops.total()))
+
+	var b strings.Builder
+	for _, c := range r.TopCollections {
+		fmt.Fprintf(&b, "%-40s %8.1f\n", tview.Escape(c.Collection), c.PerSec)
+	}
+	d.collections.SetText(b.String())
+
+	_, _, _, height := d.feed.GetInnerRect()
+	b.Reset()
+	for _, p := range d.recentPosts(max(height, 1)) {
+		fmt.Fprintf(&b, "[gray]%s[-] [blue]%s[-] %s\n", p.at.Format("15:04:05"), tview.Escape(p.author), tview.Escape(p.text))
+	}
+	if b.Len() == 0 {
+		b.WriteString("[gray]waiting for posts...[-]")
+	}
+	d.feed.SetText(b.String())
+
+	d.logPane.SetText(strings.Join(d.logs.recent(tuiShownLogs), "\n"))
+}
+
+// tuiLog receives log output with -tui. While the dashboard is up it keeps
+// the last lines for it to show, and only passes them on to out if out is
+// a -log-file rather than the terminal the dashboard is drawn on.
+type tuiLog struct {
+	mu     sync.Mutex
+	out    io.Writer
+	toFile bool
+	lines  []string
+	// stop closes the dashboard, set while it is up
+	stop func()
+}
+
+func newTUILog(out io.Writer, toFile bool) *tuiLog {
+	return &tuiLog{out: out, toFile: toFile}
+}
+
+func (l *tuiLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop == nil || l.toFile {
+		if _, err := l.out.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	if l.stop == nil {
+		return len(p), nil
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if len(l.lines) >= tuiMaxLogs {
+			l.lines = l.lines[1:]
+		}
+		l.lines = append(l.lines, line)
+	}
+	return len(p), nil
+}
+
+// Run is a zerolog hook closing the dashboard before a fatal error is
+// logged, since the process exits right after and would otherwise leave the
+// terminal in the dashboard's state with the error unseen
+func (l *tuiLog) Run(_ *zerolog.Event, level zerolog.Level, _ string) {
+	if level != zerolog.FatalLevel && level != zerolog.PanicLevel {
+		return
+	}
+	l.mu.Lock()
+	stop := l.stop
+	l.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// recent returns the last n lines, oldest first
+func (l *tuiLog) recent(n int) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines[max(len(l.lines)-n, 0):]...)
+}
+
+// attach holds output for the dashboard until detach, with stop closing it
+func (l *tuiLog) attach(stop func()) {
+	l.mu.Lock()
+	l.stop = stop
+	l.mu.Unlock()
+}
+
+func (l *tuiLog) detach() {
+	l.mu.Lock()
+	l.stop = nil
+	l.mu.Unlock()
+}
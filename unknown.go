@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// isKnownCollection reports whether collection has dedicated handling,
+// including collections covered by an enabled preset
+func isKnownCollection(collection string) bool {
+	_, ok := commitLoggerFor(collection)
+	return ok
+}
+
+// collectionAliases maps NSID prefixes to shorter display names for the
+// generic output branches, set by -collection-alias
+var collectionAliases = map[string]string{}
+
+func parseCollectionAliases(value string) error {
+	pairs, err := parseKeyValues(value)
+	if err != nil {
+		return err
+	}
+	for prefix, alias := range pairs {
+		collectionAliases[prefix] = alias
+	}
+	return nil
+}
+
+// displayCollection shortens nsid using the longest matching alias prefix
+func displayCollection(nsid string) string {
+	best := ""
+	for prefix := range collectionAliases {
+		if strings.HasPrefix(nsid, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return nsid
+	}
+	return collectionAliases[best] + nsid[len(best):]
+}
+
+// withCollection adds the collection to a generic event, displayed through
+// any configured alias. When aliases are in use the full NSID is kept in
+// "nsid" for machine use.
+func withCollection(event *zerolog.Event, nsid string) *zerolog.Event {
+	if len(collectionAliases) == 0 {
+		return event.Str("collection", nsid)
+	}
+	return event.Str("collection", displayCollection(nsid)).Str("nsid", nsid)
+}
+
+// unknownCollectionTracker counts commits per collection that fell through
+// to the "other" case, to find lexicons worth handling
+type unknownCollectionTracker struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+var unknownCollections = &unknownCollectionTracker{counts: map[string]uint64{}}
+
+func (t *unknownCollectionTracker) add(collection string) {
+	t.mu.Lock()
+	t.counts[collection]++
+	t.mu.Unlock()
+}
+
+// logRanking logs the most frequently seen unknown collections, most
+// common first
+func (t *unknownCollectionTracker) logRanking(limit int) {
+	t.mu.Lock()
+	type entry struct {
+		collection string
+		count      uint64
+	}
+	entries := make([]entry, 0, len(t.counts))
+	for c, n := range t.counts {
+		entries = append(entries, entry{c, n})
+	}
+	distinct := len(t.counts)
+	t.mu.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].count != entries[j].count {
+			return entries[i].count > entries[j].count
+		}
+		return entries[i].collection < entries[j].collection
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	top := zerolog.Arr()
+	for _, e := range entries {
+		top.Dict(zerolog.Dict().Str("collection", e.collection).Uint64("count", e.count))
+	}
+	log.Info().
+		Int("distinct", distinct).
+		Array("top", top).
+		Msg("unknown_collections")
+}
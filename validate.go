@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+	"github.com/rivo/uniseg"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// bundledLexicons are the schemas of the core Bluesky records and the
+// definitions they refer to, which -validate-records checks without any
+// other lexicons given
+//
+//go:embed lexicons/*.json
+var bundledLexicons embed.FS
+
+// validator is nil unless -validate-records is set
+var validator *recordValidator
+
+// lexSchema is a lexicon definition, or a type within one. Only the fields
+// of its type are set.
+type lexSchema struct {
+	Type string `json:"type"`
+
+	// record
+	Key    string     `json:"key"`
+	Record *lexSchema `json:"record"`
+
+	// object
+	Required   []string              `json:"required"`
+	Nullable   []string              `json:"nullable"`
+	Properties map[string]*lexSchema `json:"properties"`
+
+	// array
+	Items *lexSchema `json:"items"`
+
+	// ref and union, made absolute as nsid#name when loaded
+	Ref    string   `json:"ref"`
+	Refs   []string `json:"refs"`
+	Closed bool     `json:"closed"`
+
+	// string, integer, boolean, bytes, and blob
+	Format       string   `json:"format"`
+	MinLength    *int     `json:"minLength"`
+	MaxLength    *int     `json:"maxLength"`
+	MinGraphemes *int     `json:"minGraphemes"`
+	MaxGraphemes *int     `json:"maxGraphemes"`
+	Minimum      *int64   `json:"minimum"`
+	Maximum      *int64   `json:"maximum"`
+	Enum         []any    `json:"enum"`
+	Const        any      `json:"const"`
+	Accept       []string `json:"accept"`
+	MaxSize      *int64   `json:"maxSize"`
+}
+
+// lexiconSchemas is a lexicon file with its definitions
+type lexiconSchemas struct {
+	Lexicon int                   `json:"lexicon"`
+	ID      string                `json:"id"`
+	Defs    map[string]*lexSchema `json:"defs"`
+}
+
+// recordValidator checks commit records against the lexicon of their
+// collection. It is only used from the handling goroutine.
+type recordValidator struct {
+	defs map[string]*lexSchema
+
+	// last is the message last checked and violation what was wrong with
+	// it, so the tagging and -filter valid: share one check
+	last      *jetstream.Message
+	violation string
+
+	checked, unchecked uint64
+	invalid            map[string]uint64
+}
+
+// newRecordValidator loads the bundled lexicons, then those in dir, then
+// the NSIDs in fetch from where their authorities publish them, each
+// replacing any earlier lexicon with the same id
+func newRecordValidator(dir string, fetch []string, plcURL string) (*recordValidator, error) {
+	v := &recordValidator{defs: map[string]*lexSchema{}, invalid: map[string]uint64{}}
+	err := fs.WalkDir(bundledLexicons, "lexicons", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := bundledLexicons.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return v.load(path, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		err := walkLexiconDir(dir, func(path string, data []byte, _ lexiconDoc) error {
+			return v.load(path, data)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, nsid := range fetch {
+		data, err := fetchLexicon(client, plcURL, nsid)
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %v", nsid, err)
+		}
+		if err := v.load(nsid, data); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// load adds a lexicon file's definitions, named where errors point to
+func (v *recordValidator) load(name string, data []byte) error {
+	var doc lexiconSchemas
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if doc.Lexicon == 0 || doc.ID == "" {
+		return fmt.Errorf("%s: not a lexicon", name)
+	}
+	for key := range v.defs {
+		if strings.HasPrefix(key, doc.ID+"#") {
+			delete(v.defs, key)
+		}
+	}
+	for defName, def := range doc.Defs {
+		absoluteRefs(doc.ID, def)
+		v.defs[doc.ID+"#"+defName] = def
+	}
+	return nil
+}
+
+// absoluteRefs rewrites the refs in s, which may be #name within the
+// lexicon id or an NSID for its main definition, as nsid#name
+func absoluteRefs(id string, s *lexSchema) {
+	if s == nil {
+		return
+	}
+	s.Ref = absoluteRef(id, s.Ref)
+	for i, ref := range s.Refs {
+		s.Refs[i] = absoluteRef(id, ref)
+	}
+	absoluteRefs(id, s.Record)
+	absoluteRefs(id, s.Items)
+	for _, p := range s.Properties {
+		absoluteRefs(id, p)
+	}
+}
+
+func absoluteRef(id, ref string) string {
+	switch {
+	case ref == "":
+		return ""
+	case strings.HasPrefix(ref, "#"):
+		return id + ref
+	case !strings.Contains(ref, "#"):
+		return ref + "#main"
+	}
+	return ref
+}
+
+// collections returns how many record types there are lexicons for
+func (v *recordValidator) collections() int {
+	n := 0
+	for key, def := range v.defs {
+		if strings.HasSuffix(key, "#main") && def.Type == "record" {
+			n++
+		}
+	}
+	return n
+}
+
+// check returns what is wrong with a created or updated record, or "" when
+// it is valid, isn't a record, or its collection has no lexicon
+func (v *recordValidator) check(msg *jetstream.Message) string {
+	if msg == v.last {
+		return v.violation
+	}
+	v.last, v.violation = msg, ""
+	c := msg.Commit
+	if c == nil || (c.Operation != "create" && c.Operation != "update") {
+		return ""
+	}
+	if !v.checks(msg) {
+		v.unchecked++
+		return ""
+	}
+	v.checked++
+	v.violation = v.validateRecord(v.defs[c.Collection+"#main"], c)
+	if v.violation != "" {
+		v.invalid[c.Collection]++
+		invalidRecords.WithLabelValues(c.Collection).Inc()
+	}
+	return v.violation
+}
+
+// checks reports whether msg is a created or updated record of a
+// collection there is a lexicon for
+func (v *recordValidator) checks(msg *jetstream.Message) bool {
+	c := msg.Commit
+	if c == nil || (c.Operation != "create" && c.Operation != "update") {
+		return false
+	}
+	def, ok := v.defs[c.Collection+"#main"]
+	return ok && def.Type == "record" && def.Record != nil
+}
+
+func (v *recordValidator) validateRecord(def *lexSchema, c *jetstream.CommitEvent) string {
+	if err := validRecordKey(def.Key, c.Rkey); err != nil {
+		return "rkey: " + err.Error()
+	}
+	dec := json.NewDecoder(bytes.NewReader(c.Record))
+	dec.UseNumber()
+	var record any
+	if err := dec.Decode(&record); err != nil {
+		return "invalid json: " + err.Error()
+	}
+	obj, ok := record.(map[string]any)
+	if !ok {
+		return "expected an object"
+	}
+	if typ, _ := obj["$type"].(string); typ != c.Collection {
+		return fmt.Sprintf("$type: expected %s", c.Collection)
+	}
+	if err := v.validate(def.Record, record, ""); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// validRecordKey checks rkey against a record's key type: tid, nsid,
+// literal:VALUE, or any
+func validRecordKey(key, rkey string) error {
+	if !recordKeyPattern.MatchString(rkey) || rkey == "." || rkey == ".." {
+		return errors.New("not a valid record key")
+	}
+	switch {
+	case key == "tid" && !tidPattern.MatchString(rkey):
+		return errors.New("expected a tid")
+	case key == "nsid" && !nsidPattern.MatchString(rkey):
+		return errors.New("expected an nsid")
+	case strings.HasPrefix(key, "literal:") && rkey != strings.TrimPrefix(key, "literal:"):
+		return fmt.Errorf("expected %s", strings.TrimPrefix(key, "literal:"))
+	}
+	return nil
+}
+
+// violation is a value that doesn't match its schema, at path
+type violation struct {
+	path, problem string
+}
+
+func (e *violation) Error() string {
+	if e.path == "" {
+		return e.problem
+	}
+	return e.path + ": " + e.problem
+}
+
+func violationf(path, format string, args ...any) error {
+	return &violation{path, fmt.Sprintf(format, args...)}
+}
+
+// validate checks value, decoded with UseNumber, against s. Refs to
+// definitions there is no lexicon for aren't checked.
+func (v *recordValidator) validate(s *lexSchema, value any, path string) error {
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return violationf(path, "expected an object")
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return violationf(joinPath(path, name), "required")
+			}
+		}
+		for name, prop := range s.Properties {
+			field, ok := obj[name]
+			if !ok {
+				continue
+			}
+			if field == nil {
+				if slices.Contains(s.Nullable, name) {
+					continue
+				}
+				return violationf(joinPath(path, name), "can't be null")
+			}
+			if err := v.validate(prop, field, joinPath(path, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			return violationf(path, "expected an array")
+		}
+		if s.MinLength != nil && len(items) < *s.MinLength {
+			return violationf(path, "fewer than %d items", *s.MinLength)
+		}
+		if s.MaxLength != nil && len(items) > *s.MaxLength {
+			return violationf(path, "more than %d items", *s.MaxLength)
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				if err := v.validate(s.Items, item, path+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+
+	case "ref":
+		def, ok := v.defs[s.Ref]
+		if !ok {
+			return nil
+		}
+		return v.validate(def, value, path)
+
+	case "union":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return violationf(path, "expected an object")
+		}
+		typ, _ := obj["$type"].(string)
+		if typ == "" {
+			return violationf(path, "union member needs a $type")
+		}
+		ref := absoluteRef(typ, typ)
+		if !slices.Contains(s.Refs, ref) {
+			if s.Closed {
+				return violationf(path, "$type %s isn't one of %s", typ, strings.Join(s.Refs, ", "))
+			}
+			return nil
+		}
+		if def, ok := v.defs[ref]; ok {
+			return v.validate(def, value, path)
+		}
+		return nil
+
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return violationf(path, "expected a string")
+		}
+		return validateString(s, str, path)
+
+	case "integer":
+		num, ok := value.(json.Number)
+		if !ok {
+			return violationf(path, "expected an integer")
+		}
+		n, err := strconv.ParseInt(string(num), 10, 64)
+		if err != nil {
+			return violationf(path, "expected an integer")
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			return violationf(path, "less than %d", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return violationf(path, "more than %d", *s.Maximum)
+		}
+		if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return lexEqual(e, num) }) {
+			return violationf(path, "%d isn't an allowed value", n)
+		}
+		if s.Const != nil && !lexEqual(s.Const, num) {
+			return violationf(path, "expected %v", s.Const)
+		}
+		return nil
+
+	case "boolean":
+		b, ok := value.(bool)
+		if !ok {
+			return violationf(path, "expected a boolean")
+		}
+		if s.Const != nil && s.Const != b {
+			return violationf(path, "expected %v", s.Const)
+		}
+		return nil
+
+	case "bytes":
+		obj, ok := value.(map[string]any)
+		encoded, _ := obj["$bytes"].(string)
+		if !ok || encoded == "" {
+			return violationf(path, "expected bytes, as {\"$bytes\": base64}")
+		}
+		data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		if err != nil {
+			return violationf(path, "invalid base64")
+		}
+		if s.MinLength != nil && len(data) < *s.MinLength {
+			return violationf(path, "shorter than %d bytes", *s.MinLength)
+		}
+		if s.MaxLength != nil && len(data) > *s.MaxLength {
+			return violationf(path, "longer than %d bytes", *s.MaxLength)
+		}
+		return nil
+
+	case "cid-link":
+		obj, ok := value.(map[string]any)
+		link, _ := obj["$link"].(string)
+		if !ok || !cidPattern.MatchString(link) {
+			return violationf(path, "expected a cid link, as {\"$link\": cid}")
+		}
+		return nil
+
+	case "blob":
+		return validateBlob(s, value, path)
+
+	case "unknown":
+		if _, ok := value.(map[string]any); !ok {
+			return violationf(path, "expected an object")
+		}
+		return nil
+	}
+	// tokens, and types of later lexicon versions, aren't values to check
+	return nil
+}
+
+func validateString(s *lexSchema, str, path string) error {
+	if s.MinLength != nil && len(str) < *s.MinLength {
+		return violationf(path, "shorter than %d bytes", *s.MinLength)
+	}
+	if s.MaxLength != nil && len(str) > *s.MaxLength {
+		return violationf(path, "longer than %d bytes", *s.MaxLength)
+	}
+	if s.MinGraphemes != nil || s.MaxGraphemes != nil {
+		n := uniseg.GraphemeClusterCount(str)
+		if s.MinGraphemes != nil && n < *s.MinGraphemes {
+			return violationf(path, "shorter than %d graphemes", *s.MinGraphemes)
+		}
+		if s.MaxGraphemes != nil && n > *s.MaxGraphemes {
+			return violationf(path, "longer than %d graphemes", *s.MaxGraphemes)
+		}
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return e == str }) {
+		return violationf(path, "%q isn't an allowed value", str)
+	}
+	if s.Const != nil && s.Const != str {
+		return violationf(path, "expected %q", s.Const)
+	}
+	if s.Format != "" && !validFormat(s.Format, str) {
+		return violationf(path, "not a valid %s", s.Format)
+	}
+	return nil
+}
+
+// validateBlob checks a blob reference, or the legacy {cid, mimeType}
+// form older records have, against the schema's accepted types and size
+func validateBlob(s *lexSchema, value any, path string) error {
+	obj, ok := value.(map[string]any)
+	if !ok {
+		return violationf(path, "expected a blob")
+	}
+	mimeType, _ := obj["mimeType"].(string)
+	if typ, _ := obj["$type"].(string); typ == "blob" {
+		ref, _ := obj["ref"].(map[string]any)
+		link, _ := ref["$link"].(string)
+		size, _ := obj["size"].(json.Number)
+		n, err := strconv.ParseInt(string(size), 10, 64)
+		if !cidPattern.MatchString(link) || mimeType == "" || err != nil {
+			return violationf(path, "expected a blob with ref, mimeType, and size")
+		}
+		if s.MaxSize != nil && n > *s.MaxSize {
+			return violationf(path, "blob of %d bytes is over the %d allowed", n, *s.MaxSize)
+		}
+	} else if cid, _ := obj["cid"].(string); cid == "" || mimeType == "" {
+		return violationf(path, "expected a blob")
+	}
+	if len(s.Accept) > 0 && !slices.ContainsFunc(s.Accept, func(accept string) bool {
+		if prefix, ok := strings.CutSuffix(accept, "*"); ok {
+			return strings.HasPrefix(mimeType, prefix)
+		}
+		return accept == mimeType
+	}) {
+		return violationf(path, "blob type %s isn't one of %s", mimeType, strings.Join(s.Accept, ", "))
+	}
+	return nil
+}
+
+// lexEqual compares a schema's enum or const value, as decoded from the
+// lexicon, to a record's number
+func lexEqual(want any, num json.Number) bool {
+	f, ok := want.(float64)
+	return ok && strconv.FormatFloat(f, 'f', -1, 64) == string(num)
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// the string formats lexicons use, loosely following the atproto specs
+var (
+	datetimePattern  = regexp.MustCompile(`^[0-9]{4}-[01][0-9]-[0-3][0-9]T[0-2][0-9]:[0-6][0-9]:[0-6][0-9](\.[0-9]+)?(Z|[+-][0-2][0-9]:[0-5][0-9])$`)
+	didPattern       = regexp.MustCompile(`^did:[a-z]+:[a-zA-Z0-9._:%-]*[a-zA-Z0-9._-]$`)
+	handlePattern    = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+	nsidPattern      = regexp.MustCompile(`^[a-zA-Z]([a-zA-Z0-9-]{0,62}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,62}[a-zA-Z0-9])?)+\.[a-zA-Z][a-zA-Z0-9]{0,62}$`)
+	cidPattern       = regexp.MustCompile(`^[a-zA-Z0-9+=]{8,256}$`)
+	tidPattern       = regexp.MustCompile(`^[234567abcdefghij][234567abcdefghijklmnopqrstuvwxyz]{12}$`)
+	recordKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9_~.:-]{1,512}$`)
+	languagePattern  = regexp.MustCompile(`^(i|[a-zA-Z]{2,3})(-[a-zA-Z0-9]{1,8})*$`)
+	uriPattern       = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:\S+$`)
+)
+
+func validFormat(format, s string) bool {
+	switch format {
+	case "datetime":
+		if !datetimePattern.MatchString(s) || strings.HasSuffix(s, "-00:00") {
+			return false
+		}
+		_, err := time.Parse(time.RFC3339Nano, s)
+		return err == nil
+	case "did":
+		return len(s) <= 2048 && didPattern.MatchString(s)
+	case "handle":
+		return len(s) <= 253 && handlePattern.MatchString(s)
+	case "at-identifier":
+		return validFormat("did", s) || validFormat("handle", s)
+	case "nsid":
+		return len(s) <= 317 && nsidPattern.MatchString(s)
+	case "cid":
+		return cidPattern.MatchString(s)
+	case "tid":
+		return tidPattern.MatchString(s)
+	case "record-key":
+		return recordKeyPattern.MatchString(s) && s != "." && s != ".."
+	case "language":
+		return languagePattern.MatchString(s)
+	case "uri":
+		return len(s) <= 8192 && uriPattern.MatchString(s)
+	case "at-uri":
+		rest, ok := strings.CutPrefix(s, "at://")
+		if !ok || len(s) > 8192 {
+			return false
+		}
+		authority, _, _ := strings.Cut(rest, "/")
+		return validFormat("at-identifier", authority)
+	}
+	// formats of later lexicon versions aren't checked
+	return true
+}
+
+// fetchLexicon fetches the lexicon for nsid from where its authority
+// publishes it: the DID in the _lexicon TXT record of the NSID's domain,
+// reversed and without its name, hosts it as a com.atproto.lexicon.schema
+// record keyed by the NSID
+func fetchLexicon(client *http.Client, plcURL, nsid string) ([]byte, error) {
+	if !nsidPattern.MatchString(nsid) {
+		return nil, errors.New("not a valid nsid")
+	}
+	segments := strings.Split(nsid, ".")
+	segments = segments[:len(segments)-1]
+	slices.Reverse(segments)
+	records, err := net.LookupTXT("_lexicon." + strings.Join(segments, "."))
+	if err != nil {
+		return nil, err
+	}
+	var did string
+	for _, r := range records {
+		if d, ok := strings.CutPrefix(r, "did="); ok {
+			did = d
+			break
+		}
+	}
+	if did == "" {
+		return nil, errors.New("no did= in the _lexicon TXT record")
+	}
+	doc, err := fetchDIDDocument(client, plcURL, did)
+	if err != nil {
+		return nil, err
+	}
+	pds, err := doc.pds(did)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"repo": {did}, "collection": {"com.atproto.lexicon.schema"}, "rkey": {nsid}}
+	resp, err := client.Get(pds + "/xrpc/com.atproto.repo.getRecord?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getRecord returned %s", resp.Status)
+	}
+	var record struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+func (v *recordValidator) logSummary() {
+	if v.checked+v.unchecked == 0 {
+		return
+	}
+	var total uint64
+	byCollection := zerolog.Dict()
+	for collection, n := range v.invalid {
+		byCollection.Uint64(collection, n)
+		total += n
+	}
+	log.Info().
+		Uint64("checked", v.checked).
+		Uint64("unchecked", v.unchecked).
+		Uint64("invalid", total).
+		Dict("invalid_by_collection", byCollection).
+		Msg("validation_summary")
+}
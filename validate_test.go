@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dickeyy/atproto-logger/jetstream"
+)
+
+// validateCommit is a create of record in collection at rkey
+func validateCommit(collection, rkey, record string) *jetstream.Message {
+	return &jetstream.Message{Did: "did:plc:abc", Kind: "commit", Commit: &jetstream.CommitEvent{
+		Rev: "3l3qo2vutsw2b", Operation: "create", Collection: collection, Rkey: rkey, Record: []byte(record),
+	}}
+}
+
+func TestRecordValidator(t *testing.T) {
+	v, err := newRecordValidator("", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const rkey = "3l3qo2vuowo2b"
+	const post = "app.bsky.feed.post"
+	tests := []struct {
+		name string
+		msg  *jetstream.Message
+		// want is the start of the violation, "" for a valid record
+		want string
+	}{
+		{"valid post", validateCommit(post, rkey, `{"$type":"app.bsky.feed.post","text":"hello","langs":["en"],"createdAt":"2024-09-09T19:46:02.102Z"}`), ""},
+		{"post in reply", validateCommit(post, rkey, `{"$type":"app.bsky.feed.post","text":"hi","createdAt":"2024-09-09T19:46:02Z","reply":{"root":{"uri":"at://did:plc:r/app.bsky.feed.post/1","cid":"bafyreidc6sydkkbchcyg62v77wbhzvb2mvytlmsychqgwf2xojjtirmzj4"},"parent":{"uri":"at://did:plc:p/app.bsky.feed.post/2","cid":"bafyreidc6sydkkbchcyg62v77wbhzvb2mvytlmsychqgwf2xojjtirmzj4"}}}`), ""},
+		{"missing field", validateCommit(post, rkey, `{"$type":"app.bsky.feed.post","text":"hello"}`), "createdAt: required"},
+		{"text too long", validateCommit(post, rkey, `{"$type":"app.bsky.feed.post","text":"`+strings.Repeat("ab ", 101)+`","createdAt":"2024-09-09T19:46:02Z"}`), "text: longer than 300 graphemes"},
+		{"bad datetime", validateCommit(post, rkey, `{"$type":"app.bsky.feed.post","text":"hello","createdAt":"yesterday"}`), "createdAt: not a valid datetime"},
+		{"bad language", validateCommit(post, rkey, `{"$type":"app.bsky.feed.post","text":"hello","langs":["english!"],"createdAt":"2024-09-09T19:46:02Z"}`), "langs[0]: not a valid language"},
+		{"wrong type", validateCommit(post, rkey, `{"$type":"app.bsky.feed.like","text":"hello","createdAt":"2024-09-09T19:46:02Z"}`), "$type: expected app.bsky.feed.post"},
+		{"not a tid", validateCommit(post, "self", `{"$type":"app.bsky.feed.post","text":"hello","createdAt":"2024-09-09T19:46:02Z"}`), "rkey: expected a tid"},
+		{"not json", validateCommit(post, rkey, `{"$type":`), "invalid json"},
+		{"like without a uri", validateCommit("app.bsky.feed.like", rkey, `{"$type":"app.bsky.feed.like","subject":{"cid":"bafyreidc6sydkkbchcyg62v77wbhzvb2mvytlmsychqgwf2xojjtirmzj4"},"createdAt":"2024-09-09T19:46:02Z"}`), "subject.uri: required"},
+		{"profile", validateCommit("app.bsky.actor.profile", "self", `{"$type":"app.bsky.actor.profile","displayName":"Alice"}`), ""},
+		{"profile at another key", validateCommit("app.bsky.actor.profile", rkey, `{"$type":"app.bsky.actor.profile","displayName":"Alice"}`), "rkey: expected self"},
+		{"collection without a lexicon", validateCommit("com.example.thing", rkey, `{"what":1}`), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := v.check(tt.msg)
+			if tt.want == "" && got != "" {
+				t.Fatalf("check = %q, want the record valid", got)
+			}
+			if !strings.HasPrefix(got, tt.want) {
+				t.Fatalf("check = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if v.unchecked != 1 || v.checked != uint64(len(tests)-1) {
+		t.Fatalf("counted %d checked and %d unchecked, want %d and 1", v.checked, v.unchecked, len(tests)-1)
+	}
+}
+
+func TestValidFormat(t *testing.T) {
+	tests := []struct {
+		format, value string
+		want          bool
+	}{
+		{"datetime", "2024-09-09T19:46:02.102Z", true},
+		{"datetime", "2024-09-09T19:46:02+02:00", true},
+		{"datetime", "2024-09-09T19:46:02-00:00", false},
+		{"datetime", "2024-09-09 19:46:02Z", false},
+		{"datetime", "2024-02-30T19:46:02Z", false},
+		{"did", "did:plc:z72i7hdynmk6r22z27h6tvur", true},
+		{"did", "did:web:example.com", true},
+		{"did", "did:plc:", false},
+		{"handle", "alice.bsky.social", true},
+		{"handle", "alice", false},
+		{"at-identifier", "alice.bsky.social", true},
+		{"at-identifier", "did:plc:z72i7hdynmk6r22z27h6tvur", true},
+		{"nsid", "app.bsky.feed.post", true},
+		{"nsid", "post", false},
+		{"tid", "3l3qo2vuowo2b", true},
+		{"tid", "3l3qo2vuowo2", false},
+		{"record-key", "self", true},
+		{"record-key", "..", false},
+		{"language", "en", true},
+		{"language", "zh-Hant", true},
+		{"language", "e", false},
+		{"uri", "https://example.com/a", true},
+		{"uri", "example.com", false},
+		{"at-uri", "at://did:plc:abc/app.bsky.feed.post/3l3qo2vuowo2b", true},
+		{"at-uri", "at://alice.bsky.social", true},
+		{"at-uri", "https://bsky.app", false},
+		{"some-future-format", "anything", true},
+	}
+	for _, tt := range tests {
+		if got := validFormat(tt.format, tt.value); got != tt.want {
+			t.Errorf("validFormat(%q, %q) = %v, want %v", tt.format, tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// version and commit are set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD)"
+//
+// When built without them, commit falls back to the VCS revision recorded by
+// the Go toolchain, if any.
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// startTime is when this run of the logger started
+var startTime = time.Now()
+
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// secretFlagWords mark flags whose values are redacted from run metadata.
+// Webhook URLs carry their token in the path.
+var secretFlagWords = []string{"password", "secret", "token", "key", "credential", "webhook"}
+
+// effectiveConfig returns flags and their values, with secrets redacted.
+// With all unset, only flags given on the command line are included.
+func effectiveConfig(all bool) map[string]string {
+	visit := flag.Visit
+	if all {
+		visit = flag.VisitAll
+	}
+
+	config := map[string]string{}
+	visit(func(f *flag.Flag) {
+		value := redactURLPassword(f.Value.String())
+		for _, word := range secretFlagWords {
+			if strings.Contains(strings.ToLower(f.Name), word) && value != "" {
+				value = "[redacted]"
+				break
+			}
+		}
+		if f.Name == "header" {
+			value = redactHeaders(headerFlags)
+		}
+		config[f.Name] = value
+	})
+	return config
+}
+
+// redactURLPassword hides the password in a URL-valued flag such as
+// -postgres-url, or in a key=value connection string
+func redactURLPassword(value string) string {
+	if strings.Contains(value, "password=") {
+		return "[redacted]"
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+	}
+	return value
+}
+
+// runMetadata describes this run, for the startup log and capture headers
+type runMetadata struct {
+	Version   string            `json:"version"`
+	Commit    string            `json:"commit"`
+	StartedAt time.Time         `json:"started_at"`
+	Host      string            `json:"host,omitempty"`
+	Config    map[string]string `json:"config"`
+}
+
+func currentRunMetadata(allFlags bool) runMetadata {
+	host, _ := os.Hostname()
+	return runMetadata{
+		Version:   version,
+		Commit:    buildCommit(),
+		StartedAt: startTime,
+		Host:      host,
+		Config:    effectiveConfig(allFlags),
+	}
+}
+
+// header renders the metadata as a capture file header line. It starts
+// with '#' so it can't be mistaken for a JSON or base64 frame.
+func (m runMetadata) header() []byte {
+	data, _ := json.Marshal(m)
+	return append(append([]byte("# atproto-logger "), data...), '\n')
+}